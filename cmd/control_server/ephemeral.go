@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/edup2p/common/types/control"
+	"github.com/edup2p/common/types/key"
+	"golang.org/x/exp/maps"
+)
+
+// collectInterval is how often disconnected ephemeral nodes are checked on.
+const collectInterval = 30 * time.Second
+
+// forgetNodeLater has node forgotten after the grace period, if it is ephemeral, unless it reconnects before then.
+func (cs *ControlServer) forgetNodeLater(node key.NodePublic) {
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+
+	if mapping, ok := cs.cfg.IPMapping[node]; ok && mapping.Ephemeral {
+		cs.collectAt[node] = time.Now().Add(*ephemeralGrace)
+	}
+}
+
+// keepNode keeps node from being forgotten, as it is connected again.
+func (cs *ControlServer) keepNode(node key.NodePublic) {
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+
+	delete(cs.collectAt, node)
+}
+
+// runCollector forgets the ephemeral nodes whose grace period passed, until the server is done.
+func (cs *ControlServer) runCollector() {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case <-ticker.C:
+			cs.collect()
+		}
+	}
+}
+
+// collect forgets the ephemeral nodes whose grace period passed; their IPs, routes, and visibility pairs.
+//
+// Their IPs are assigned again once the rest of the address space is used, see findNewIP.
+func (cs *ControlServer) collect() {
+	connected, err := cs.server.GetConnectedClients()
+	if err != nil {
+		slog.Error("could not get connected clients", "err", err)
+		return
+	}
+
+	isConnected := make(map[key.NodePublic]bool, len(connected))
+	for _, cid := range connected {
+		isConnected[key.NodePublic(cid)] = true
+	}
+
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+
+	forgotten := cs.forgetCollectable(time.Now(), isConnected)
+
+	for i, node := range forgotten {
+		if err := cs.server.ApproveRoutes(control.ClientID(node), nil); err != nil {
+			slog.Error("could not revoke routes", "node", node.Debug(), "err", err)
+		}
+
+		cs.server.ApproveExitNode(control.ClientID(node), false)
+
+		// The pairs between forgotten nodes are removed once.
+		others := slices.Concat(maps.Keys(cs.cfg.IPMapping), forgotten[i+1:])
+
+		for _, node2 := range others {
+			if err := cs.server.RemoveVisibilityPair(control.ClientID(node), control.ClientID(node2)); err != nil {
+				slog.Error("could not remove visibility pair", "node", node.Debug(), "node2", node2.Debug(), "err", err)
+			}
+		}
+
+		slog.Info("forgot ephemeral node", "node", node.Debug())
+	}
+
+	if len(forgotten) > 0 {
+		writeConfig(cs.cfg, *configPath)
+	}
+}
+
+// forgetCollectable removes the nodes whose grace period passed at now from the config, unless they are connected,
+// and returns them.
+//
+// Assumes cfgMu is held.
+func (cs *ControlServer) forgetCollectable(now time.Time, isConnected map[key.NodePublic]bool) []key.NodePublic {
+	var forgotten []key.NodePublic
+
+	for node, at := range cs.collectAt {
+		if now.Before(at) {
+			continue
+		}
+
+		delete(cs.collectAt, node)
+
+		if isConnected[node] {
+			continue
+		}
+
+		delete(cs.cfg.IPMapping, node)
+		delete(cs.cfg.Routes, node)
+		cs.cfg.ExitNodes = slices.DeleteFunc(cs.cfg.ExitNodes, func(n key.NodePublic) bool {
+			return n == node
+		})
+
+		forgotten = append(forgotten, node)
+	}
+
+	return forgotten
+}
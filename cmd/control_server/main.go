@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -23,7 +24,10 @@ import (
 	"github.com/edup2p/common/types/control"
 	"github.com/edup2p/common/types/control/controlhttp"
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
 	"github.com/edup2p/common/types/relay"
+	"github.com/edup2p/common/types/servertls"
+	"go4.org/netipx"
 )
 
 var (
@@ -34,9 +38,14 @@ var (
 	publicFacingBase       *url.URL
 	password               = flag.String("p", "", "password")
 
+	ephemeralPassword = flag.String("ep", "", "password for ephemeral nodes, which are forgotten after they disconnect (disabled if empty)")
+	ephemeralGrace    = flag.Duration("eg", 10*time.Minute, "time after which a disconnected ephemeral node is forgotten")
+
 	publicIPString = flag.String("ip", "", "public IP")
 	publicIP       *netip.Addr
 
+	certCfg = servertls.RegisterFlags(flag.CommandLine, "/var/lib/toversok/control-certs")
+
 	programLevel = new(slog.LevelVar) // Info by default
 )
 
@@ -56,6 +65,9 @@ func main() {
 	} else if *password == "" {
 		slog.Error("password is required (-p)")
 		os.Exit(1)
+	} else if *ephemeralPassword == *password {
+		slog.Error("ephemeral password (-ep) must differ from the password (-p)")
+		os.Exit(1)
 	}
 
 	if publicIPString != nil {
@@ -75,6 +87,8 @@ func main() {
 
 	cserver := LoadServer(ctx)
 
+	go cserver.runCollector()
+
 	if publicIP != nil {
 		if err := cserver.server.RunAdditionalSTUN([]netip.Addr{*publicIP}, "0.0.0.0", 1667, 1776); err != nil {
 			slog.Error("could not run additional STUN server", "err", err)
@@ -131,10 +145,8 @@ func main() {
 		}
 	}()
 
-	// TODO setup TLS with autocert?
-
-	slog.Info("control: serving", "addr", *addr)
-	err = httpsrv.ListenAndServe()
+	slog.Info("control: serving", "addr", *addr, "tls", certCfg.ShouldServeTLS(*addr))
+	err = certCfg.ListenAndServe(ctx, httpsrv)
 
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("control: error %s", err) //nolint:gocritic
@@ -147,6 +159,9 @@ type ControlServer struct {
 	cfgMu sync.Mutex
 	cfg   Config
 
+	// collectAt holds when disconnected ephemeral nodes are forgotten, guarded by cfgMu.
+	collectAt map[key.NodePublic]time.Time
+
 	server *control.Server
 }
 
@@ -160,9 +175,26 @@ func (cs *ControlServer) HandleAuthRequest(w http.ResponseWriter, r *http.Reques
 	s := r.FormValue("session")
 	slog.Info("auth request", "url", r.URL.String(), "pass", p, "session", s)
 
-	if p == *password {
+	if p == *password || (*ephemeralPassword != "" && p == *ephemeralPassword) {
 		// Success
 
+		cid, err := cs.server.GetClientID(control.SessID(s))
+		if err != nil {
+			http.Error(w, "Authentication error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := cs.registerNode(key.NodePublic(cid), p != *password); err != nil {
+			slog.Error("could not register node", "cid", cid, "err", err)
+
+			if err := cs.server.RejectAuthentication(control.SessID(s), err.Error()); err != nil {
+				slog.Error("error rejecting authentication", "sess", s, "err", err)
+			}
+
+			http.Error(w, "Authentication error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
 		if err := cs.server.AcceptAuthentication(control.SessID(s)); err != nil {
 			http.Error(w, "Authentication error: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -196,42 +228,89 @@ func (cs *ControlServer) OnSessionCreate(id control.SessID, cid control.ClientID
 
 func (cs *ControlServer) OnSessionResume(sess control.SessID, cid control.ClientID) {
 	slog.Info("OnSessionResume", "sess", sess, "cid", cid)
+
+	cs.keepNode(key.NodePublic(cid))
 }
 
 func (cs *ControlServer) OnDeviceKey(sess control.SessID, deviceKey string) {
 	slog.Info("OnDeviceKey", "sess", sess, "deviceKey", deviceKey)
 }
 
-func (cs *ControlServer) OnSessionFinalize(sess control.SessID, cid control.ClientID) (netip.Prefix, netip.Prefix, time.Time) {
+func (cs *ControlServer) OnSessionFinalize(sess control.SessID, cid control.ClientID) (netip.Prefix, netip.Prefix, time.Time, error) {
 	slog.Info("OnSessionFinalize", "sess", sess, "cid", cid)
 
-	ip4, ip6 := cs.getIPs(key.NodePublic(cid))
+	ip4, ip6, err := cs.getIPs(key.NodePublic(cid))
+	if err != nil {
+		return netip.Prefix{}, netip.Prefix{}, time.Time{}, fmt.Errorf("could not assign IPs: %w", err)
+	}
 
-	return ip4, ip6, time.Now().Add(time.Hour * 24 * 7)
+	return ip4, ip6, time.Now().Add(time.Hour * 24 * 7), nil
 }
 
 func (cs *ControlServer) OnSessionDestroy(sess control.SessID, cid control.ClientID) {
 	slog.Info("OnSessionDestroy", "sess", sess, "cid", cid)
+
+	cs.forgetNodeLater(key.NodePublic(cid))
+}
+
+func (cs *ControlServer) OnRoutesAdvertised(sess control.SessID, cid control.ClientID, routes []netip.Prefix) {
+	cs.cfgMu.Lock()
+	approved, exit := cs.cfg.Routes[key.NodePublic(cid)], slices.Contains(cs.cfg.ExitNodes, key.NodePublic(cid))
+	cs.cfgMu.Unlock()
+
+	slog.Info("OnRoutesAdvertised", "sess", sess, "cid", cid, "routes", routes, "approved", approved, "exit", exit)
 }
 
 func LoadServer(ctx context.Context) *ControlServer {
 	cfg := loadConfig()
 
 	s := &ControlServer{
-		ctx: ctx,
-		cfg: cfg,
+		ctx:       ctx,
+		cfg:       cfg,
+		collectAt: make(map[key.NodePublic]time.Time),
 	}
 
 	println("creating new server")
 	s.server = control.NewServer(cfg.ControlKey, cfg.Relays)
 	println("created new server")
 
+	if err := s.server.SetMTU(cfg.MTU); err != nil {
+		log.Fatalf("control: %s", err)
+	}
+
+	if err := s.server.SetDomain(cfg.Domain); err != nil {
+		log.Fatalf("control: %s", err)
+	}
+
+	for node, name := range cfg.Hostnames {
+		if err := s.server.SetHostname(control.ClientID(node), name); err != nil {
+			log.Fatalf("control: could not set hostname %q for %s: %s", name, node.Debug(), err)
+		}
+	}
+
+	for node, routes := range cfg.Routes {
+		if err := s.server.ApproveRoutes(control.ClientID(node), routes); err != nil {
+			log.Fatalf("control: could not approve routes for %s: %s", node.Debug(), err)
+		}
+	}
+
+	for _, node := range cfg.ExitNodes {
+		s.server.ApproveExitNode(control.ClientID(node), true)
+	}
+
 	s.server.RegisterCallbacks(s)
 	println("loaded callbacks")
 
 	s.loadExistingNodes()
 	println("loaded nodes")
 
+	// Ephemeral nodes left over from before a restart are forgotten, unless they reconnect.
+	for node, mapping := range cfg.IPMapping {
+		if mapping.Ephemeral {
+			s.collectAt[node] = time.Now().Add(*ephemeralGrace)
+		}
+	}
+
 	return s
 }
 
@@ -250,7 +329,8 @@ func (cs *ControlServer) loadExistingNodes() {
 			}
 
 			if err := cs.server.UpsertVisibilityPair(client, client2, control.VisibilityPair{
-				MDNS: true,
+				MDNS:         true,
+				MDNSServices: cs.cfg.MDNSServices,
 			}); err != nil {
 				panic(err)
 			}
@@ -265,109 +345,135 @@ func (cs *ControlServer) addNewNode(node key.NodePublic) {
 		}
 
 		if err := cs.server.UpsertVisibilityPair(control.ClientID(node), control.ClientID(node2), control.VisibilityPair{
-			MDNS: true,
+			MDNS:         true,
+			MDNSServices: cs.cfg.MDNSServices,
 		}); err != nil {
 			panic(err)
 		}
 	}
 }
 
+// isKnown returns whether node has IPs assigned, in which case it is kept from being forgotten, as it is reconnecting.
 func (cs *ControlServer) isKnown(node key.NodePublic) bool {
 	cs.cfgMu.Lock()
 	defer cs.cfgMu.Unlock()
 
 	_, ok := cs.cfg.IPMapping[node]
+	if ok {
+		delete(cs.collectAt, node)
+	}
 
 	return ok
 }
 
-func (cs *ControlServer) getIPs(node key.NodePublic) (netip.Prefix, netip.Prefix) {
+// registerNode assigns IPs to node if it has none, marking it as ephemeral if it is.
+func (cs *ControlServer) registerNode(node key.NodePublic, ephemeral bool) error {
 	cs.cfgMu.Lock()
 	defer cs.cfgMu.Unlock()
 
-	mapping, ok := cs.cfg.IPMapping[node]
+	if _, ok := cs.cfg.IPMapping[node]; ok {
+		delete(cs.collectAt, node)
+		return nil
+	}
 
-	if !ok {
-		ip4 := cs.findNewIP4()
-		ip6 := cs.findNewIP6()
+	return cs.addIPs(node, ephemeral)
+}
 
-		mapping = IPMapping{
-			IP4: ip4,
-			IP6: ip6,
-		}
+// addIPs assigns new IPs to node, assumes cfgMu is held.
+func (cs *ControlServer) addIPs(node key.NodePublic, ephemeral bool) error {
+	ip4, err := cs.findNewIP4()
+	if err != nil {
+		return err
+	}
 
-		cs.cfg.IPMapping[node] = mapping
+	ip6, err := cs.findNewIP6()
+	if err != nil {
+		return err
+	}
 
-		writeConfig(cs.cfg, *configPath)
+	cs.cfg.IPMapping[node] = IPMapping{
+		IP4:       ip4,
+		IP6:       ip6,
+		Ephemeral: ephemeral,
+	}
 
-		cs.addNewNode(node)
+	writeConfig(cs.cfg, *configPath)
+
+	cs.addNewNode(node)
+
+	return nil
+}
+
+func (cs *ControlServer) getIPs(node key.NodePublic) (netip.Prefix, netip.Prefix, error) {
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+
+	if _, ok := cs.cfg.IPMapping[node]; !ok {
+		if err := cs.addIPs(node, false); err != nil {
+			return netip.Prefix{}, netip.Prefix{}, err
+		}
 	}
 
-	return netip.PrefixFrom(mapping.IP4, cs.cfg.IP4.Bits()), netip.PrefixFrom(mapping.IP6, cs.cfg.IP6.Bits())
+	mapping := cs.cfg.IPMapping[node]
+
+	return netip.PrefixFrom(mapping.IP4, cs.cfg.IP4.Bits()), netip.PrefixFrom(mapping.IP6, cs.cfg.IP6.Bits()), nil
 }
 
-func findNewIP(ipp netip.Prefix, used func(netip.Addr) bool) (netip.Prefix, netip.Addr) {
-	backwards := false
+var errAddressSpaceExhausted = errors.New("address space exhausted")
+
+// findNewIP finds the first unused address after the one ipp points at, and returns ipp pointing at it.
+//
+// It wraps around within ipp, so that the addresses of forgotten nodes are used again once the rest is used.
+// The first address of ipp (the network address) is never returned, nor is the last one for IPv4 (the broadcast address).
+func findNewIP(ipp netip.Prefix, used map[netip.Addr]bool) (netip.Prefix, netip.Addr, error) {
+	first := ipp.Masked().Addr()
+	start := ipp.Addr()
+	addr := start
+
+	var broadcast netip.Addr
+	if first.Is4() && ipp.Bits() < 31 {
+		broadcast = netipx.PrefixLastIP(ipp)
+	}
 
 	for {
-		var addr netip.Addr
+		addr = addr.Next()
 
-		if backwards {
-			addr = ipp.Addr().Prev()
-		} else {
-			addr = ipp.Addr().Next()
+		if !addr.IsValid() || !ipp.Contains(addr) {
+			// we exceeded the boundary, wrap around
+			addr = first
 		}
 
-		if !ipp.Contains(addr) {
-			if !backwards {
-				// we exceeded the boundary, try a back-sweep
-				backwards = true
-			} else {
-				// TODO find better way to deal with this
-				panic("address space exhausted")
-			}
+		if addr != first && addr != broadcast && !used[addr] {
+			return netip.PrefixFrom(addr, ipp.Bits()), addr, nil
 		}
 
-		ipp = netip.PrefixFrom(addr, ipp.Bits())
-
-		if used(addr) {
-			continue
+		if addr == start {
+			return ipp, netip.Addr{}, fmt.Errorf("%w in %s", errAddressSpaceExhausted, ipp.Masked())
 		}
-
-		return ipp, addr
 	}
 }
 
 // Find an unused ip4 address, and advance the counter
-func (cs *ControlServer) findNewIP4() (addr netip.Addr) {
-	cs.cfg.IP4, addr = findNewIP(cs.cfg.IP4, cs.ip4Used)
+func (cs *ControlServer) findNewIP4() (addr netip.Addr, err error) {
+	cs.cfg.IP4, addr, err = findNewIP(cs.cfg.IP4, cs.usedIPs(func(m IPMapping) netip.Addr { return m.IP4 }))
 	return
 }
 
 // Find an unused ip6 address, and advance the counter
-func (cs *ControlServer) findNewIP6() (addr netip.Addr) {
-	cs.cfg.IP6, addr = findNewIP(cs.cfg.IP6, cs.ip6Used)
+func (cs *ControlServer) findNewIP6() (addr netip.Addr, err error) {
+	cs.cfg.IP6, addr, err = findNewIP(cs.cfg.IP6, cs.usedIPs(func(m IPMapping) netip.Addr { return m.IP6 }))
 	return
 }
 
-func (cs *ControlServer) ip4Used(a netip.Addr) bool {
-	for _, mapping := range cs.cfg.IPMapping {
-		if mapping.IP4 == a {
-			return true
-		}
-	}
-
-	return false
-}
+// usedIPs returns the set of addresses ip returns for all mappings, assumes cfgMu is held.
+func (cs *ControlServer) usedIPs(ip func(IPMapping) netip.Addr) map[netip.Addr]bool {
+	used := make(map[netip.Addr]bool, len(cs.cfg.IPMapping))
 
-func (cs *ControlServer) ip6Used(a netip.Addr) bool {
 	for _, mapping := range cs.cfg.IPMapping {
-		if mapping.IP6 == a {
-			return true
-		}
+		used[ip(mapping)] = true
 	}
 
-	return false
+	return used
 }
 
 func handleStaticHTML(doc string) http.HandlerFunc {
@@ -473,11 +579,28 @@ type Config struct {
 	IPMapping map[key.NodePublic]IPMapping
 
 	Relays []relay.Information
+
+	// MTU is the network-wide MTU for the WireGuard interfaces of clients, or 0 to leave it up to them.
+	MTU int `json:",omitempty"`
+
+	// Domain is the domain under which clients resolve each other, or empty for the client default ("edup2p").
+	Domain string `json:",omitempty"`
+	// Hostnames are names assigned by the admin, overriding the ones the devices request.
+	Hostnames map[key.NodePublic]string `json:",omitempty"`
+	// Routes are the prefixes nodes may route into the network, of the ones they advertise.
+	Routes map[key.NodePublic][]netip.Prefix `json:",omitempty"`
+	// ExitNodes are the nodes which may offer to route all traffic of their peers.
+	ExitNodes []key.NodePublic `json:",omitempty"`
+	// MDNSServices are the DNS-SD service types (e.g. "_ipp._tcp") nodes share with each other, or empty for all.
+	MDNSServices []string `json:",omitempty"`
 }
 
 type IPMapping struct {
 	IP4 netip.Addr
 	IP6 netip.Addr
+
+	// Ephemeral nodes are forgotten once they have been disconnected for a while, see -eg.
+	Ephemeral bool `json:",omitempty"`
 }
 
 func loadConfig() Config {
@@ -502,6 +625,9 @@ func loadConfig() Config {
 		if err := json.Unmarshal(b, &cfg); err != nil {
 			log.Fatalf("control: config: %v", err)
 		}
+		if err := msgcontrol.ValidateServiceTypes(cfg.MDNSServices); err != nil {
+			log.Fatalf("control: config: %v", err)
+		}
 		return cfg
 	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func usedSet(ss ...string) map[netip.Addr]bool {
+	used := make(map[netip.Addr]bool)
+	for _, s := range ss {
+		used[netip.MustParseAddr(s)] = true
+	}
+
+	return used
+}
+
+func TestFindNewIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ipp  string
+		used map[netip.Addr]bool
+		want string
+	}{
+		{name: "first", ipp: "10.0.0.0/24", want: "10.0.0.1"},
+		{name: "next", ipp: "10.0.0.5/24", want: "10.0.0.6"},
+		{name: "skips used", ipp: "10.0.0.1/24", used: usedSet("10.0.0.2", "10.0.0.3"), want: "10.0.0.4"},
+		{name: "skips broadcast", ipp: "10.0.0.253/24", used: usedSet("10.0.0.1"), want: "10.0.0.254"},
+		{name: "wraps around", ipp: "10.0.0.254/24", used: usedSet("10.0.0.1"), want: "10.0.0.2"},
+		{name: "wraps around to forgotten", ipp: "10.0.0.2/30", used: usedSet("10.0.0.2"), want: "10.0.0.1"},
+		{name: "ipv6 has no broadcast", ipp: "fd00::fffe/112", want: "fd00::ffff"},
+		{name: "ipv6 wraps around", ipp: "fd00::ffff/112", want: "fd00::1"},
+		{name: "point to point", ipp: "10.0.0.0/31", want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipp, addr, err := findNewIP(netip.MustParsePrefix(tt.ipp), tt.used)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, addr.String())
+			assert.Equal(t, netip.PrefixFrom(addr, ipp.Bits()), ipp, "should point at the new address")
+		})
+	}
+}
+
+func TestFindNewIPExhausted(t *testing.T) {
+	for _, tt := range []struct {
+		ipp  string
+		used map[netip.Addr]bool
+	}{
+		{"10.0.0.1/30", usedSet("10.0.0.1", "10.0.0.2")},
+		{"10.0.0.0/30", usedSet("10.0.0.1", "10.0.0.2")},
+		{"fd00::1/126", usedSet("fd00::1", "fd00::2", "fd00::3")},
+		{"10.0.0.0/32", nil},
+	} {
+		ipp := netip.MustParsePrefix(tt.ipp)
+
+		got, _, err := findNewIP(ipp, tt.used)
+		assert.ErrorIs(t, err, errAddressSpaceExhausted, tt.ipp)
+		assert.Equal(t, ipp, got, "should be left as-is")
+	}
+}
+
+func TestForgetCollectable(t *testing.T) {
+	now := time.Now()
+	expired, pending, reconnected := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+
+	cs := &ControlServer{
+		cfg: Config{
+			IPMapping: map[key.NodePublic]IPMapping{
+				expired:     {Ephemeral: true},
+				pending:     {Ephemeral: true},
+				reconnected: {Ephemeral: true},
+			},
+			Routes: map[key.NodePublic][]netip.Prefix{
+				expired: {netip.MustParsePrefix("10.1.0.0/16")},
+				pending: {netip.MustParsePrefix("10.2.0.0/16")},
+			},
+			ExitNodes: []key.NodePublic{expired, pending},
+		},
+		collectAt: map[key.NodePublic]time.Time{
+			expired:     now.Add(-time.Second),
+			pending:     now.Add(time.Minute),
+			reconnected: now.Add(-time.Second),
+		},
+	}
+
+	forgotten := cs.forgetCollectable(now, map[key.NodePublic]bool{reconnected: true})
+	assert.Equal(t, []key.NodePublic{expired}, forgotten)
+
+	assert.NotContains(t, cs.cfg.IPMapping, expired)
+	assert.NotContains(t, cs.cfg.Routes, expired)
+	assert.Equal(t, []key.NodePublic{pending}, cs.cfg.ExitNodes)
+
+	// Connected nodes are kept, and no longer collected.
+	assert.Contains(t, cs.cfg.IPMapping, reconnected)
+	assert.NotContains(t, cs.collectAt, reconnected)
+
+	assert.Contains(t, cs.cfg.IPMapping, pending)
+	assert.Contains(t, cs.collectAt, pending)
+}
@@ -10,10 +10,12 @@ import (
 	"log"
 	"log/slog"
 	"math"
+	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,12 +25,18 @@ import (
 	"github.com/edup2p/common/extwg"
 	"github.com/edup2p/common/toversok"
 	"github.com/edup2p/common/toversok/actors"
+	"github.com/edup2p/common/toversok/filetransfer"
+	"github.com/edup2p/common/toversok/overlaydns"
+	"github.com/edup2p/common/toversok/portforward"
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsname"
 	"github.com/edup2p/common/types/ifaces"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgcontrol"
 	"github.com/edup2p/common/types/relay"
+	"github.com/edup2p/common/unifw"
 	"github.com/edup2p/common/usrwg"
+	"github.com/edup2p/common/usrwg/overlayproxy"
 	"golang.org/x/exp/maps"
 	"golang.zx2c4.com/wireguard/wgctrl"
 )
@@ -38,6 +46,7 @@ var (
 
 	wgCtrl *extwg.WGCtrl
 	usrWg  *usrwg.UserSpaceWireGuardHost
+	nsWg   *usrwg.NetstackWireGuardHost
 
 	wg toversok.WireGuardHost
 
@@ -53,6 +62,18 @@ var (
 
 	eccc   context.CancelCauseFunc
 	engine *toversok.Engine
+
+	proxyCancel context.CancelFunc
+	dnsCancel   context.CancelFunc
+
+	// ftMu guards ftCancel, which stops receiving files, and ftOffers, the file offers awaiting ft accept or ft decline,
+	// by their ID.
+	ftMu     sync.Mutex
+	ftCancel context.CancelFunc
+	ftOffers = make(map[int]*pendingOffer)
+	ftNextID int
+
+	fwHost toversok.FirewallHost
 )
 
 func init() {
@@ -126,6 +147,11 @@ func main() {
 	shell.AddCmd(enCmd())
 	shell.AddCmd(pcCmd())
 	shell.AddCmd(fcCmd())
+	shell.AddCmd(proxyCmd())
+	shell.AddCmd(dnsCmd())
+	shell.AddCmd(ftCmd())
+	shell.AddCmd(pfCmd())
+	shell.AddCmd(fwCmd())
 
 	shell.Run()
 
@@ -374,6 +400,16 @@ func pcCmd() *ishell.Cmd {
 		},
 	})
 
+	c.AddCmd(&ishell.Cmd{
+		Name: "websocket",
+		Help: "toggle connecting to control over websockets",
+		Func: func(c *ishell.Context) {
+			properControl.Opts.WebSocket = !properControl.Opts.WebSocket
+
+			c.Println("websocket:", properControl.Opts.WebSocket)
+		},
+	})
+
 	return c
 }
 
@@ -492,6 +528,33 @@ func fcCmd() *ishell.Cmd {
 		},
 	})
 
+	peerCmd.AddCmd(&ishell.Cmd{
+		Name: "routes",
+		Help: "set the routes of a peer: <pubkey:hex> [prefixes...]",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("did not define peer key"))
+				return
+			}
+
+			peerKey, err := key.UnmarshalPublic(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			routes, err := parsePrefixes(c.Args[1:])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			if err = fakeControl.setPeerRoutes(*peerKey, routes); err != nil {
+				c.Err(err)
+			}
+		},
+	})
+
 	c.AddCmd(peerCmd)
 
 	c.AddCmd(&ishell.Cmd{
@@ -692,9 +755,15 @@ func wgCmd() *ishell.Cmd {
 
 	c.AddCmd(&ishell.Cmd{
 		Name: "usr",
-		Help: "Use User Wireguard",
+		Help: "Use User Wireguard. wg usr [mtu]",
 		Func: func(c *ishell.Context) {
-			usrWg = usrwg.NewUsrWGHost()
+			mtu, err := mtuArg(c.Args)
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			usrWg = usrwg.NewUsrWGHostWithMTU(mtu)
 
 			wg = usrWg
 
@@ -702,6 +771,45 @@ func wgCmd() *ishell.Cmd {
 		},
 	})
 
+	c.AddCmd(&ishell.Cmd{
+		Name: "ns",
+		Help: "Use User Wireguard on a netstack, without a TUN device. wg ns [mtu]",
+		Func: func(c *ishell.Context) {
+			mtu, err := mtuArg(c.Args)
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			nsWg = usrwg.NewNetstackWGHostWithMTU(mtu)
+
+			wg = nsWg
+
+			c.Println("now using netstack userspace wireguard")
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "dns",
+		Help: "Have the wg host point the OS resolver at the overlay for the network domain. wg dns <on|off>",
+		Func: func(c *ishell.Context) {
+			dc, ok := wg.(interface{ SetConfigureDNS(bool) })
+
+			switch {
+			case len(c.Args) != 1 || (c.Args[0] != "on" && c.Args[0] != "off"):
+				c.Err(errors.New("usage: wg dns <on|off>"))
+				return
+			case !ok:
+				c.Err(errors.New("wg not setup, or does not configure dns; use wg usr or wg use"))
+				return
+			}
+
+			dc.SetConfigureDNS(c.Args[0] == "on")
+
+			c.Println("dns configuration", c.Args[0], "for the next engine")
+		},
+	})
+
 	c.AddCmd(&ishell.Cmd{
 		Name: "init",
 		Help: "Perform Init() on the wg configurator. wg init <privkey addr4/cidr addr6/cidr>",
@@ -741,7 +849,7 @@ func wgCmd() *ishell.Cmd {
 					c.Err(errors.New("second argument is not ipv6 address/cidr"))
 					return
 				}
-				wgC, err = wg.Controller(privkey, addr4, addr6)
+				wgC, err = wg.Controller(privkey, addr4, addr6, 0)
 				if err != nil {
 					c.Err(err)
 					return
@@ -754,6 +862,617 @@ func wgCmd() *ishell.Cmd {
 	return c
 }
 
+// parsePrefixes parses prefixes from arguments, where "exit" stands for msgcontrol.ExitRoutes.
+func parsePrefixes(args []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, a := range args {
+		if a == "exit" {
+			prefixes = append(prefixes, msgcontrol.ExitRoutes...)
+			continue
+		}
+
+		p, err := netip.ParsePrefix(a)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, nil
+}
+
+// mtuArg parses the optional mtu argument, or returns 0 to use the one given by control.
+func mtuArg(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	mtu, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid mtu: %w", err)
+	}
+
+	return mtu, nil
+}
+
+func fwCmd() *ishell.Cmd {
+	c := &ishell.Cmd{
+		Name: "fw",
+		Help: "firewall host state and subcommands, used on next engine create",
+		Func: func(c *ishell.Context) {
+			if fwHost == nil {
+				c.Println("fw: stok (no-op)")
+			} else {
+				c.Println("fw: using", fwHost)
+			}
+		},
+	}
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "uni",
+		Help: "use the platform firewall (nftables on linux) for an interface. fw uni [iface]",
+		Func: func(c *ishell.Context) {
+			var iface string
+			if len(c.Args) > 0 {
+				iface = c.Args[0]
+			}
+
+			h, err := unifw.NewFirewallHost(iface)
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			fwHost = h
+
+			c.Println("now using platform firewall")
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "usr",
+		Help: "use the userspace packet filter of the current wg (requires wg usr or wg ns)",
+		Func: func(c *ishell.Context) {
+			f := usrwg.NewPacketFilter()
+
+			switch {
+			case usrWg != nil && wg == usrWg:
+				usrWg.SetPacketFilter(f)
+			case nsWg != nil && wg == nsWg:
+				nsWg.SetPacketFilter(f)
+			default:
+				c.Err(errors.New("not using userspace wireguard"))
+				return
+			}
+
+			fwHost = f
+
+			c.Println("now using userspace packet filter")
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "stok",
+		Help: "use the no-op firewall",
+		Func: func(c *ishell.Context) {
+			fwHost = nil
+
+			if usrWg != nil {
+				usrWg.SetPacketFilter(nil)
+			}
+			if nsWg != nil {
+				nsWg.SetPacketFilter(nil)
+			}
+
+			c.Println("now using no-op firewall")
+		},
+	})
+
+	return c
+}
+
+func proxyCmd() *ishell.Cmd {
+	c := &ishell.Cmd{
+		Name: "proxy",
+		Help: "serve a socks5/http connect proxy into the overlay (requires wg ns). proxy <listen addr>",
+		Func: func(c *ishell.Context) {
+			switch {
+			case len(c.Args) != 1:
+				c.Err(errors.New("usage: proxy <listen addr>"))
+				return
+			case nsWg == nil || wg != nsWg:
+				c.Err(errors.New("netstack wg not setup, use wg ns"))
+				return
+			case proxyCancel != nil:
+				c.Err(errors.New("proxy already running, use proxy stop"))
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			proxyCancel = cancel
+
+			srv := &overlayproxy.Server{Dial: nsWg.DialContext, Resolve: resolveOverlayName}
+			addr := c.Args[0]
+
+			go func() {
+				if err := srv.ListenAndServe(ctx, addr); err != nil {
+					slog.Error("proxy exited", "err", err)
+				}
+			}()
+
+			c.Println("serving proxy on", addr)
+		},
+	}
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "stop",
+		Help: "stop the proxy",
+		Func: func(c *ishell.Context) {
+			if proxyCancel == nil {
+				c.Err(errors.New("proxy not running"))
+				return
+			}
+
+			proxyCancel()
+			proxyCancel = nil
+
+			c.Println("stopped proxy")
+		},
+	})
+
+	return c
+}
+
+// resolveOverlayName resolves peer hostnames with the current engine.
+func resolveOverlayName(ctx context.Context, host string) (netip.Addr, error) {
+	if engine == nil {
+		return netip.Addr{}, errors.New("engine not setup")
+	}
+
+	return overlaydns.Resolve(engine)(ctx, host)
+}
+
+func dnsCmd() *ishell.Cmd {
+	c := &ishell.Cmd{
+		Name: "dns",
+		Help: "serve dns for the names of peers, from the current engine. dns <listen addr>",
+		Func: func(c *ishell.Context) {
+			switch {
+			case len(c.Args) != 1:
+				c.Err(errors.New("usage: dns <listen addr>"))
+				return
+			case engine == nil:
+				c.Err(errors.New("engine not setup, use en create"))
+				return
+			case dnsCancel != nil:
+				c.Err(errors.New("dns already running, use dns stop"))
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			dnsCancel = cancel
+
+			srv := &overlaydns.Server{Source: engine}
+			addr := c.Args[0]
+
+			go func() {
+				if err := srv.ListenAndServe(ctx, addr); err != nil {
+					slog.Error("dns exited", "err", err)
+				}
+			}()
+
+			c.Println("serving dns on", addr)
+		},
+	}
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "stop",
+		Help: "stop the dns server",
+		Func: func(c *ishell.Context) {
+			if dnsCancel == nil {
+				c.Err(errors.New("dns not running"))
+				return
+			}
+
+			dnsCancel()
+			dnsCancel = nil
+
+			c.Println("stopped dns")
+		},
+	})
+
+	return c
+}
+
+func pfCmd() *ishell.Cmd {
+	c := &ishell.Cmd{
+		Name: "pf",
+		Help: "port forwarding between local ports and peers, and subcommands",
+		Func: func(c *ishell.Context) {
+			if engine == nil {
+				c.Err(errors.New("engine does not exist"))
+				return
+			}
+
+			forwards, published := engine.PortForwards()
+
+			for _, f := range forwards {
+				c.Println("forward:", f)
+			}
+
+			for _, p := range published {
+				c.Println("publish:", p)
+			}
+
+			if len(forwards) == 0 && len(published) == 0 {
+				c.Println("no ports forwarded")
+			}
+		},
+	}
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "fwd",
+		Help: "forward a local port to a port of a peer. pf fwd <tcp|udp> <local port> <hostname>:<port>",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 3 {
+				c.Err(errors.New("usage: pf fwd <tcp|udp> <local port> <hostname>:<port>"))
+				return
+			}
+
+			port, err := parsePort(c.Args[1])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			host, peerPortStr, err := net.SplitHostPort(c.Args[2])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			peerPort, err := parsePort(peerPortStr)
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			f := portforward.Forward{Proto: portforward.Proto(c.Args[0]), Port: port, Peer: host, PeerPort: peerPort}
+
+			updatePortForwards(c, func(forwards []portforward.Forward, published []portforward.Publish) ([]portforward.Forward, []portforward.Publish) {
+				forwards = slices.DeleteFunc(forwards, func(o portforward.Forward) bool { return o.Proto == f.Proto && o.Port == f.Port })
+				return append(forwards, f), published
+			})
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "pub",
+		Help: "publish a local port to peers, on a port of the overlay addresses. pf pub <tcp|udp> <port> <local port> [pubkey:hex...]",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) < 3 {
+				c.Err(errors.New("usage: pf pub <tcp|udp> <port> <local port> [pubkey:hex...]"))
+				return
+			}
+
+			port, err := parsePort(c.Args[1])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			target, err := parsePort(c.Args[2])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			p := portforward.Publish{Proto: portforward.Proto(c.Args[0]), Port: port, Target: target}
+
+			for _, arg := range c.Args[3:] {
+				peer, err := key.UnmarshalPublic(arg)
+				if err != nil {
+					c.Err(err)
+					return
+				}
+
+				p.Peers = append(p.Peers, *peer)
+			}
+
+			updatePortForwards(c, func(forwards []portforward.Forward, published []portforward.Publish) ([]portforward.Forward, []portforward.Publish) {
+				published = slices.DeleteFunc(published, func(o portforward.Publish) bool { return o.Proto == p.Proto && o.Port == p.Port })
+				return forwards, append(published, p)
+			})
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "rm",
+		Help: "stop forwarding or publishing a port. pf rm <fwd|pub> <tcp|udp> <port>",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 3 || (c.Args[0] != "fwd" && c.Args[0] != "pub") {
+				c.Err(errors.New("usage: pf rm <fwd|pub> <tcp|udp> <port>"))
+				return
+			}
+
+			proto := portforward.Proto(c.Args[1])
+
+			port, err := parsePort(c.Args[2])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+
+			updatePortForwards(c, func(forwards []portforward.Forward, published []portforward.Publish) ([]portforward.Forward, []portforward.Publish) {
+				if c.Args[0] == "fwd" {
+					forwards = slices.DeleteFunc(forwards, func(o portforward.Forward) bool { return o.Proto == proto && o.Port == port })
+				} else {
+					published = slices.DeleteFunc(published, func(o portforward.Publish) bool { return o.Proto == proto && o.Port == port })
+				}
+
+				return forwards, published
+			})
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "clear",
+		Help: "stop forwarding and publishing all ports",
+		Func: func(c *ishell.Context) {
+			updatePortForwards(c, func([]portforward.Forward, []portforward.Publish) ([]portforward.Forward, []portforward.Publish) {
+				return nil, nil
+			})
+		},
+	})
+
+	return c
+}
+
+// updatePortForwards changes the port forwards of the engine with update.
+func updatePortForwards(c *ishell.Context, update func([]portforward.Forward, []portforward.Publish) ([]portforward.Forward, []portforward.Publish)) {
+	if engine == nil {
+		c.Err(errors.New("engine does not exist"))
+		return
+	}
+
+	if err := engine.SetPortForwards(update(engine.PortForwards())); err != nil {
+		c.Err(err)
+		return
+	}
+
+	c.Println("updated port forwards")
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %w", s, err)
+	}
+
+	return uint16(port), nil
+}
+
+type pendingOffer struct {
+	offer filetransfer.Offer
+	dir   string
+
+	// decide receives the path to save the file at, or an empty string to decline.
+	decide chan string
+}
+
+func ftCmd() *ishell.Cmd {
+	c := &ishell.Cmd{
+		Name: "ft",
+		Help: "peer-to-peer file transfer and subcommands",
+		Func: func(c *ishell.Context) {
+			ftMu.Lock()
+			defer ftMu.Unlock()
+
+			if ftCancel == nil {
+				c.Println("not receiving files")
+			} else {
+				c.Println("receiving files")
+			}
+
+			ids := maps.Keys(ftOffers)
+			slices.Sort(ids)
+
+			for _, id := range ids {
+				o := ftOffers[id].offer
+				c.Printf("offer %d: %s (%d bytes) from %s (%s)\n", id, o.Name, o.Size, o.Hostname, o.Peer.Debug())
+			}
+		},
+	}
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "serve",
+		Help: "receive files offered by peers into a directory, after ft accept. ft serve [dir]",
+		Func: func(c *ishell.Context) {
+			ftMu.Lock()
+			defer ftMu.Unlock()
+
+			switch {
+			case len(c.Args) > 1:
+				c.Err(errors.New("usage: ft serve [dir]"))
+				return
+			case engine == nil:
+				c.Err(errors.New("engine not setup, use en create"))
+				return
+			case ftCancel != nil:
+				c.Err(errors.New("already receiving files, use ft stop"))
+				return
+			}
+
+			dir := "."
+			if len(c.Args) == 1 {
+				dir = c.Args[0]
+			}
+
+			// Listens through the overlay only, so that files cannot be offered from the other networks of this host.
+			overlay, err := engine.OverlayNet()
+			if err != nil {
+				c.Err(fmt.Errorf("could not reach overlay: %w", err))
+				return
+			}
+
+			ln, err := overlay.Listen("tcp", ":"+strconv.Itoa(filetransfer.Port))
+			if err != nil {
+				c.Err(fmt.Errorf("could not listen: %w", err))
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			ftCancel = cancel
+
+			r := &filetransfer.Receiver{
+				Peers: engine,
+				Accept: func(ctx context.Context, offer filetransfer.Offer) string {
+					return awaitDecision(ctx, offer, dir)
+				},
+			}
+
+			go func() {
+				if err := r.Serve(ctx, ln); err != nil {
+					slog.Error("file transfer exited", "err", err)
+				}
+			}()
+
+			c.Println("receiving files into", dir, "on port", filetransfer.Port)
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "stop",
+		Help: "stop receiving files",
+		Func: func(c *ishell.Context) {
+			ftMu.Lock()
+			defer ftMu.Unlock()
+
+			if ftCancel == nil {
+				c.Err(errors.New("not receiving files"))
+				return
+			}
+
+			ftCancel()
+			ftCancel = nil
+
+			c.Println("stopped receiving files")
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "accept",
+		Help: "accept a file offer, saving it under its name. ft accept <id>",
+		Func: func(c *ishell.Context) {
+			decideOffer(c, true)
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "decline",
+		Help: "decline a file offer. ft decline <id>",
+		Func: func(c *ishell.Context) {
+			decideOffer(c, false)
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "send",
+		Help: "offer a file to a peer, and send it in the background once accepted. ft send <hostname> <file>",
+		Func: func(c *ishell.Context) {
+			switch {
+			case len(c.Args) != 2:
+				c.Err(errors.New("usage: ft send <hostname> <file>"))
+				return
+			case engine == nil:
+				c.Err(errors.New("engine not setup, use en create"))
+				return
+			}
+
+			s := &filetransfer.Sender{Peers: engine}
+			if nsWg != nil && wg == nsWg {
+				s.Dial = nsWg.DialContext
+			}
+
+			hostname, path := c.Args[0], c.Args[1]
+
+			go func() {
+				if err := s.Send(context.Background(), hostname, path); err != nil {
+					slog.Error("could not send file", "peer", hostname, "file", path, "err", err)
+					return
+				}
+
+				slog.Info("sent file", "peer", hostname, "file", path)
+			}()
+
+			c.Println("offered", path, "to", hostname)
+		},
+	})
+
+	return c
+}
+
+// awaitDecision holds an offer until ft accept or ft decline, and returns the path to save it at, if accepted.
+func awaitDecision(ctx context.Context, offer filetransfer.Offer, dir string) string {
+	p := &pendingOffer{offer: offer, dir: dir, decide: make(chan string, 1)}
+
+	ftMu.Lock()
+	ftNextID++
+	id := ftNextID
+	ftOffers[id] = p
+	ftMu.Unlock()
+
+	defer func() {
+		ftMu.Lock()
+		delete(ftOffers, id)
+		ftMu.Unlock()
+	}()
+
+	slog.Info(fmt.Sprintf("file offered, use ft accept %d or ft decline %d", id, id),
+		"name", offer.Name, "size", offer.Size, "peer", offer.Hostname, "key", offer.Peer.Debug())
+
+	select {
+	case path := <-p.decide:
+		return path
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+func decideOffer(c *ishell.Context, accept bool) {
+	if len(c.Args) != 1 {
+		c.Err(errors.New("usage: ft accept/decline <id>"))
+		return
+	}
+
+	id, err := strconv.Atoi(c.Args[0])
+	if err != nil {
+		c.Err(fmt.Errorf("invalid id: %w", err))
+		return
+	}
+
+	ftMu.Lock()
+	p, ok := ftOffers[id]
+	delete(ftOffers, id)
+	ftMu.Unlock()
+
+	if !ok {
+		c.Err(fmt.Errorf("no offer %d", id))
+		return
+	}
+
+	if accept {
+		path := filepath.Join(p.dir, p.offer.Name)
+		p.decide <- path
+		c.Println("receiving", path)
+	} else {
+		p.decide <- ""
+		c.Println("declined offer", id)
+	}
+}
+
 func enCmd() *ishell.Cmd {
 	c := &ishell.Cmd{
 		Name: "en",
@@ -803,7 +1522,10 @@ func enCmd() *ishell.Cmd {
 
 			ctx, ccc := context.WithCancelCause(context.Background())
 
-			fw := &StokFirewall{}
+			fw := fwHost
+			if fw == nil {
+				fw = &StokFirewall{}
+			}
 
 			e, err := toversok.NewEngine(ctx, wg, fw, usedControl, engineExtPort, *privKey)
 			if err != nil {
@@ -828,6 +1550,78 @@ func enCmd() *ishell.Cmd {
 		}
 	}})
 
+	c.AddCmd(&ishell.Cmd{
+		Name: "routes",
+		Help: "get or set the prefixes this node routes into the network, \"exit\" offers it as exit node. en routes [prefixes...|exit|none]",
+		Func: func(c *ishell.Context) {
+			if engine == nil {
+				c.Err(errors.New("engine does not exist"))
+				return
+			}
+
+			if len(c.Args) == 0 {
+				c.Println("routes:", engine.AdvertisedRoutes())
+				return
+			}
+
+			var routes []netip.Prefix
+
+			if len(c.Args) != 1 || c.Args[0] != "none" {
+				var err error
+				if routes, err = parsePrefixes(c.Args); err != nil {
+					c.Err(err)
+					return
+				}
+			}
+
+			if err := engine.SetAdvertisedRoutes(routes); err != nil {
+				c.Err(err)
+				return
+			}
+
+			c.Println("advertising routes:", routes)
+		},
+	})
+
+	c.AddCmd(&ishell.Cmd{
+		Name: "exit",
+		Help: "get or set the peer to route all traffic through. en exit [pubkey:hex|none]",
+		Func: func(c *ishell.Context) {
+			if engine == nil {
+				c.Err(errors.New("engine does not exist"))
+				return
+			}
+
+			if len(c.Args) == 0 {
+				if exit := engine.ExitNode(); exit.IsZero() {
+					c.Println("exit node: none")
+				} else {
+					c.Println("exit node:", exit.Marshal())
+				}
+				return
+			}
+
+			var peer key.NodePublic
+
+			if c.Args[0] != "none" {
+				peerKey, err := key.UnmarshalPublic(c.Args[0])
+				if err != nil {
+					c.Err(err)
+					return
+				}
+
+				peer = *peerKey
+			}
+
+			if err := engine.SetExitNode(peer); err != nil {
+				c.Err(err)
+				return
+			}
+
+			c.Println("set exit node")
+		},
+	})
+
 	c.AddCmd(&ishell.Cmd{
 		Name: "port",
 		Help: "set the external port",
@@ -855,7 +1649,9 @@ type PeerDef struct {
 	SessionKey  key.SessionPublic
 	Endpoints   []netip.AddrPort
 
-	VIPs toversok.VirtualIPs
+	VIPs     toversok.VirtualIPs
+	Hostname string
+	Routes   []netip.Prefix
 
 	Properties msgcontrol.Properties
 }
@@ -889,6 +1685,22 @@ func (s *StokControl) Expiry() time.Time {
 	return time.Time{}
 }
 
+func (s *StokControl) MTU() int {
+	return 0
+}
+
+func (s *StokControl) Hostname() string {
+	return ""
+}
+
+func (s *StokControl) Domain() string {
+	return dnsname.DefaultDomain
+}
+
+func (s *StokControl) ControlAddr() netip.Addr {
+	return netip.Addr{}
+}
+
 func (s *StokControl) UpdateEndpoints(endpoints []netip.AddrPort) error {
 	slog.Info("called UpdateEndpoints", "endpoints", endpoints)
 
@@ -901,6 +1713,12 @@ func (s *StokControl) UpdateHomeRelay(i int64) error {
 	return nil
 }
 
+func (s *StokControl) UpdateRoutes(routes []netip.Prefix) error {
+	slog.Info("called UpdateRoutes", "routes", routes)
+
+	return nil
+}
+
 func (s *StokControl) Context() context.Context {
 	return context.Background()
 }
@@ -917,7 +1735,7 @@ func (s *StokControl) InstallCallbacks(callbacks ifaces.ControlCallbacks) {
 
 	for _, peer := range s.peers {
 		if err := callbacks.AddPeer(
-			peer.Key, peer.HomeRelayID, peer.Endpoints, peer.SessionKey, peer.VIPs.IPv4, peer.VIPs.IPv6, peer.Properties,
+			peer.Key, peer.HomeRelayID, peer.Endpoints, peer.SessionKey, peer.VIPs.IPv4, peer.VIPs.IPv6, peer.Hostname, peer.Routes, peer.Properties,
 		); err != nil {
 			slog.Error("AddPeer errored", "err", err, "peer", peer.Key.Debug())
 			return
@@ -943,13 +1761,32 @@ func (s *StokControl) addPeer(
 
 	if s.callback != nil {
 		err = s.callback.AddPeer(
-			peer.Key, peer.HomeRelayID, peer.Endpoints, peer.SessionKey, peer.VIPs.IPv4, peer.VIPs.IPv6, peer.Properties,
+			peer.Key, peer.HomeRelayID, peer.Endpoints, peer.SessionKey, peer.VIPs.IPv4, peer.VIPs.IPv6, peer.Hostname, peer.Routes, peer.Properties,
 		)
 	}
 
 	return
 }
 
+func (s *StokControl) setPeerRoutes(peer key.NodePublic, routes []netip.Prefix) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	def, ok := s.peers[peer]
+	if !ok {
+		return errors.New("peer not defined")
+	}
+
+	def.Routes = routes
+	s.peers[peer] = def
+
+	if s.callback != nil {
+		err = s.callback.UpdatePeer(peer, nil, nil, nil, nil, &routes, nil)
+	}
+
+	return
+}
+
 func (s *StokControl) delPeer(peer key.NodePublic) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -997,6 +1834,12 @@ func (s *StokFirewall) QuarantineNodes(ips []netip.Addr) error {
 	return nil
 }
 
+func (s *StokFirewall) SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error {
+	slog.Info("StokFirewall SetPeerRules called", "rules", rules)
+
+	return nil
+}
+
 func (s *StokFirewall) LocalAddresses() ([]netip.Addr, error) {
 	slog.Info("StokFirewall LocalAddresses called")
 
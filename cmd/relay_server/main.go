@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -20,16 +21,23 @@ import (
 	"time"
 
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/metrics"
 	"github.com/edup2p/common/types/relay"
 	"github.com/edup2p/common/types/relay/relayhttp"
+	"github.com/edup2p/common/types/relay/relayquic"
+	"github.com/edup2p/common/types/servertls"
 	stunserver "github.com/edup2p/common/types/stun"
 )
 
 var (
-	dev        = flag.Bool("dev", false, "run in localhost development mode (overrides -a)")
-	addr       = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
-	configPath = flag.String("c", "", "config file path")
-	stunPort   = flag.Int("stun-port", stunserver.DefaultPort, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	dev         = flag.Bool("dev", false, "run in localhost development mode (overrides -a)")
+	addr        = flag.String("a", ":443", "server HTTP/HTTPS listen address, in form \":port\", \"ip:port\", or for IPv6 \"[ip]:port\". If the IP is omitted, it defaults to all interfaces. Serves HTTPS if the port is 443 and/or -certmode is manual, otherwise HTTP.")
+	configPath  = flag.String("c", "", "config file path")
+	stunPort    = flag.Int("stun-port", stunserver.DefaultPort, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	quicPort    = flag.Int("quic-port", 0, "The UDP port on which to serve the relay protocol over QUIC, 0 to disable. The listener is bound to the same IP (if any) as specified in the -a flag.")
+	metricsAddr = flag.String("metrics-addr", "", "if set, serve prometheus /metrics on this listen address, such as 127.0.0.1:9100; disabled if empty.")
+
+	certCfg = servertls.RegisterFlags(flag.CommandLine, "/var/lib/toversok/relay-certs")
 )
 
 const ToverSokRelayDefaultHTML = `
@@ -85,6 +93,19 @@ func main() {
 
 	server := relay.NewServer(cfg.PrivateKey)
 
+	if *quicPort != 0 {
+		go serveQUIC(ctx, server, net.JoinHostPort(listenHost, fmt.Sprint(*quicPort)))
+	}
+
+	// Metrics are only served on their own listener, so that they are not public along with the relay.
+	if *metricsAddr != "" {
+		reg := metrics.NewRegistry()
+		server.RegisterMetrics(reg)
+		stunServer.RegisterMetrics(reg)
+
+		go serveMetrics(ctx, *metricsAddr, reg)
+	}
+
 	mux := http.NewServeMux()
 
 	mux.Handle("/relay", relayhttp.ServerHandler(server))
@@ -124,16 +145,62 @@ func main() {
 		}
 	}()
 
-	// TODO setup TLS with autocert: https://github.com/eduP2P/relay-server/issues/2
-
-	slog.Info("relay: serving", "addr", *addr)
-	err = httpsrv.ListenAndServe()
+	slog.Info("relay: serving", "addr", *addr, "tls", certCfg.ShouldServeTLS(*addr))
+	err = certCfg.ListenAndServe(ctx, httpsrv)
 
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("relay: error %s", err) //nolint:gocritic
 	}
 }
 
+func serveQUIC(ctx context.Context, server *relay.Server, quicAddr string) {
+	var (
+		tlsCfg *tls.Config
+		err    error
+	)
+
+	if certCfg.ShouldServeTLS(*addr) {
+		tlsCfg, err = certCfg.TLSConfig()
+	} else {
+		// QUIC always requires TLS, insecure clients will not verify this certificate.
+		tlsCfg, err = relayquic.SelfSignedTLSConfig(certCfg.Hostname)
+	}
+
+	if err != nil {
+		slog.Error("could not get TLS config for quic", "err", err)
+		return
+	}
+
+	if err := relayquic.ListenAndServe(ctx, server, quicAddr, tlsCfg); err != nil {
+		slog.Error("quic listen error", "err", err)
+	}
+}
+
+func serveMetrics(ctx context.Context, addr string, reg *metrics.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("failed to shutdown metrics server", "err", err)
+		}
+	}()
+
+	slog.Info("relay: serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("metrics server listen error", "err", err)
+	}
+}
+
 func browserHeaders(w http.ResponseWriter) {
 	w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; form-action 'self'; base-uri 'self'; block-all-mixed-content; object-src 'none'")
@@ -0,0 +1,156 @@
+package extwg
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"github.com/edup2p/common/usrwg/router"
+	"github.com/vishvananda/netlink"
+)
+
+// linkState is the state of the kernel WireGuard link configured by WGCtrl.
+type linkState struct {
+	router router.Router
+	// cfg is the configuration last set on router.
+	cfg router.Config
+
+	// created is set when the link did not exist yet, and was created by WGCtrl.
+	created bool
+}
+
+// configureInterface creates the kernel WireGuard link if it does not exist yet,
+// and assigns the addresses, sets the MTU, and brings it up.
+func (w *WGCtrl) configureInterface(addr4, addr6 netip.Prefix, mtu int) error {
+	if w.link.router == nil {
+		created, err := ensureWireGuardLink(w.name)
+		if err != nil {
+			return err
+		}
+
+		r, err := router.NewLinkRouter(w.name)
+		if err != nil {
+			return errors.Join(err, w.deleteLinkIf(created))
+		}
+
+		w.link = linkState{router: r, created: created}
+	}
+
+	cfg := router.Config{
+		LocalAddrs:      []netip.Addr{addr4.Addr(), addr6.Addr()},
+		RoutingPrefixes: []netip.Prefix{addr4, addr6},
+		MTU:             mtu,
+	}
+
+	if err := w.link.router.Set(&cfg); err != nil {
+		return fmt.Errorf("failed to set routing config: %w", err)
+	}
+
+	w.link.cfg = cfg
+
+	if err := w.link.router.Up(); err != nil {
+		return fmt.Errorf("failed to bring up device through router: %w", err)
+	}
+
+	return nil
+}
+
+// routeInterface routes routes into the link, on top of the overlay prefixes.
+func (w *WGCtrl) routeInterface(routes []netip.Prefix) error {
+	if w.link.router == nil {
+		return nil
+	}
+
+	cfg := w.link.cfg
+	cfg.Routes = routes
+
+	if err := w.link.router.Set(&cfg); err != nil {
+		return fmt.Errorf("failed to set routes: %w", err)
+	}
+
+	w.link.cfg = cfg
+
+	return nil
+}
+
+// bypassInterface keeps traffic to addrs out of the link, see router.Config.Bypass.
+func (w *WGCtrl) bypassInterface(addrs []netip.Addr) error {
+	if w.link.router == nil {
+		return nil
+	}
+
+	cfg := w.link.cfg
+	cfg.Bypass = addrs
+
+	if err := w.link.router.Set(&cfg); err != nil {
+		return fmt.Errorf("failed to set bypass: %w", err)
+	}
+
+	w.link.cfg = cfg
+
+	return nil
+}
+
+// teardownInterface restores the link to the state it had before configureInterface,
+// or deletes it if it was created by it.
+func (w *WGCtrl) teardownInterface() error {
+	if w.link.router == nil {
+		return nil
+	}
+
+	var errs []error
+
+	if err := w.link.router.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close router: %w", err))
+	}
+
+	if err := w.deleteLinkIf(w.link.created); err != nil {
+		errs = append(errs, err)
+	}
+
+	w.link = linkState{}
+
+	return errors.Join(errs...)
+}
+
+func (w *WGCtrl) deleteLinkIf(created bool) error {
+	if !created {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(w.name)
+	if err != nil {
+		return fmt.Errorf("could not find link %q: %w", w.name, err)
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("could not delete link %q: %w", w.name, err)
+	}
+
+	slog.Info("extwg: deleted wireguard link", "name", w.name)
+
+	return nil
+}
+
+// ensureWireGuardLink creates a kernel WireGuard link by name if it does not exist yet,
+// and returns whether it did so.
+func ensureWireGuardLink(name string) (bool, error) {
+	_, err := netlink.LinkByName(name)
+	if err == nil {
+		return false, nil
+	}
+
+	var notFound netlink.LinkNotFoundError
+	if !errors.As(err, &notFound) {
+		return false, fmt.Errorf("could not look up link %q: %w", name, err)
+	}
+
+	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+		return false, fmt.Errorf("could not create wireguard link %q: %w", name, err)
+	}
+
+	slog.Info("extwg: created wireguard link", "name", name)
+
+	return true, nil
+}
@@ -0,0 +1,80 @@
+//go:build !linux
+
+package extwg
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"strings"
+
+	"github.com/edup2p/common/usrwg/router"
+)
+
+type linkState struct{}
+
+// configureInterface asks the user to configure the interface, as this is only done automatically on linux.
+func (w *WGCtrl) configureInterface(addr4, addr6 netip.Prefix, mtu int) error {
+	const sep = "; "
+
+	if runtime.GOOS == "darwin" {
+		const (
+			ifconfig4   = "sudo ifconfig %s inet %s/32 %s"
+			ifconfig6   = "sudo ifconfig %s inet6 %s %s prefixlen 128"
+			ifconfigMTU = "sudo ifconfig %s mtu %d"
+
+			route4 = "sudo route add -inet %s -iface %s"
+			route6 = "sudo route add -inet6 %s -iface %s"
+		)
+
+		slog.Warn("Please run these lines in a separate terminal:")
+		slog.Warn(
+			strings.Join([]string{
+				fmt.Sprintf(ifconfig4, w.name, addr4.Addr().String(), addr4.Addr().String()),
+				fmt.Sprintf(ifconfig6, w.name, addr6.Addr().String(), addr6.Addr().String()),
+				fmt.Sprintf(ifconfigMTU, w.name, mtu),
+				fmt.Sprintf(route4, addr4.String(), w.name),
+				fmt.Sprintf(route6, addr6.String(), w.name),
+			}, sep),
+		)
+	}
+
+	return nil
+}
+
+// routeInterface asks the user to route routes into the interface, as this is only done automatically on linux.
+func (w *WGCtrl) routeInterface(routes []netip.Prefix) error {
+	if runtime.GOOS == "darwin" && len(routes) > 0 {
+		const route = "sudo route add -%s %s -iface %s"
+
+		var lines []string
+
+		for _, r := range routes {
+			family := "inet"
+			if r.Addr().Is6() {
+				family = "inet6"
+			}
+
+			lines = append(lines, fmt.Sprintf(route, family, r.String(), w.name))
+		}
+
+		slog.Warn("Please run these lines in a separate terminal, for the routes of peers:")
+		slog.Warn(strings.Join(lines, "; "))
+	}
+
+	return nil
+}
+
+// bypassInterface is only supported on linux, where the interface is configured automatically.
+func (w *WGCtrl) bypassInterface(addrs []netip.Addr) error {
+	if len(addrs) > 0 {
+		return router.ErrBypassUnsupported
+	}
+
+	return nil
+}
+
+func (w *WGCtrl) teardownInterface() error {
+	return nil
+}
@@ -7,12 +7,12 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
-	"runtime"
-	"strings"
+	"os"
 	"sync"
 
 	"github.com/edup2p/common/toversok"
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsconfig"
 	"github.com/edup2p/common/types/key"
 	"go4.org/netipx"
 	"golang.org/x/exp/maps"
@@ -22,11 +22,14 @@ import (
 
 // A wireguard configurator by the help of wgtools shell commands.
 //
-// Should only be used for development, not in actual application.
+// Outside of linux, should only be used for development, not in actual application.
 
 // WGCtrl is a toversok.WireGuardController implementation that takes a preconfigured `client`-tool compatible
 // interface and interacts with it.
 //
+// On linux, the kernel WireGuard link is created if it does not exist yet, and its addresses, routes, and MTU are
+// configured automatically; all of which is undone on Reset.
+//
 // On macos, run:
 // - sudo wireguard-go utun
 // - sudo chown $USER /var/run/wireguard/utun*
@@ -45,19 +48,61 @@ type WGCtrl struct {
 	wgPort uint16
 
 	localMapping map[key.NodePublic]*mapping
+
+	// routes of peers, which are routed into the interface.
+	routes toversok.PeerRoutes
+
+	link linkState
+
+	// hostMTU is the MTU configured on the host, or 0 to use the one given by control.
+	hostMTU int
+	// mtu is the MTU of the current controller.
+	mtu int
+
+	// configureDNS makes the controller configure the resolver of the OS for the interface.
+	configureDNS bool
+	// dns is nil when not configuring the resolver of the OS.
+	dns dnsconfig.Configurator
 }
 
 func NewWGCtrl(client *wgctrl.Client, device string) *WGCtrl {
+	return NewWGCtrlWithMTU(client, device, 0)
+}
+
+// NewWGCtrlWithMTU creates a WGCtrl which sets mtu on the interface, instead of the one given by control.
+func NewWGCtrlWithMTU(client *wgctrl.Client, device string, mtu int) *WGCtrl {
 	return &WGCtrl{
 		client:       client,
 		name:         device,
 		localMapping: make(map[key.NodePublic]*mapping),
+		routes:       make(toversok.PeerRoutes),
+		hostMTU:      mtu,
 	}
 }
 
+// SetConfigureDNS makes the next controllers configure the resolver of the OS for the interface,
+// see toversok.DNSConfigurer.
+func (w *WGCtrl) SetConfigureDNS(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.configureDNS = enabled
+}
+
 func (w *WGCtrl) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	var errs []error
 
+	if w.dns != nil {
+		if err := w.dns.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error reverting dns: %w", err))
+		}
+
+		w.dns = nil
+	}
+
 	for _, m := range w.localMapping {
 		if err := m.conn.Close(); err != nil {
 			errs = append(errs, err)
@@ -65,6 +110,7 @@ func (w *WGCtrl) Reset() error {
 	}
 
 	maps.Clear(w.localMapping)
+	maps.Clear(w.routes)
 
 	zeroKey := wgtypes.Key{}
 
@@ -72,10 +118,14 @@ func (w *WGCtrl) Reset() error {
 		PrivateKey:   &zeroKey,
 		ReplacePeers: true,
 		Peers:        []wgtypes.PeerConfig{},
-	}); err != nil {
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
 		errs = append(errs, fmt.Errorf("error resetting wg device: %w", err))
 	}
 
+	if err := w.teardownInterface(); err != nil {
+		errs = append(errs, fmt.Errorf("error tearing down interface: %w", err))
+	}
+
 	if len(errs) > 0 {
 		return fmt.Errorf("errors while wg device: %w", errors.Join(errs...))
 	}
@@ -89,48 +139,30 @@ type mapping struct {
 	port uint16
 }
 
-func (w *WGCtrl) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix) (toversok.WireGuardController, error) {
+func (w *WGCtrl) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix, controlMTU int) (toversok.WireGuardController, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	const sep = "; "
-
-	switch runtime.GOOS {
-	case "darwin":
-		const (
-			ifconfig4 = "sudo ifconfig %s inet %s/32 %s"
-			ifconfig6 = "sudo ifconfig %s inet6 %s %s prefixlen 128"
+	mtu, err := toversok.ChooseMTU(w.hostMTU, controlMTU)
+	if err != nil {
+		return nil, err
+	}
 
-			route4 = "sudo route add -inet %s -iface %s"
-			route6 = "sudo route add -inet6 %s -iface %s"
-		)
+	if err := w.configureInterface(addr4, addr6, mtu); err != nil {
+		return nil, fmt.Errorf("failed to configure interface: %w", err)
+	}
 
-		slog.Warn("Please run these lines in a separate terminal:")
-		slog.Warn(
-			strings.Join([]string{
-				fmt.Sprintf(ifconfig4, w.name, addr4.Addr().String(), addr4.Addr().String()),
-				fmt.Sprintf(ifconfig6, w.name, addr6.Addr().String(), addr6.Addr().String()),
-				fmt.Sprintf(route4, addr4.String(), w.name),
-				fmt.Sprintf(route6, addr6.String(), w.name),
-			}, sep),
-		)
-	case "linux":
-		const (
-			ip = "sudo ip address add %s dev %s"
-		)
+	w.mtu = mtu
 
-		slog.Warn("Please run these lines in a separate terminal:")
-		slog.Warn(
-			strings.Join([]string{
-				fmt.Sprintf(ip, addr4.String(), w.name),
-				fmt.Sprintf(ip, addr6.String(), w.name),
-			}, sep),
-		)
+	if w.configureDNS && w.dns == nil {
+		if w.dns, err = dnsconfig.NewConfigurator(w.name); err != nil {
+			slog.Warn("extwg: cannot configure dns", "err", err)
+		}
 	}
 
 	unveiledKey := key.UnveilPrivate(privateKey)
 
-	err := w.client.ConfigureDevice(w.name, wgtypes.Config{
+	err = w.client.ConfigureDevice(w.name, wgtypes.Config{
 		PrivateKey:   (*wgtypes.Key)(&unveiledKey),
 		ReplacePeers: true,
 		Peers:        []wgtypes.PeerConfig{},
@@ -150,6 +182,17 @@ func (w *WGCtrl) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefi
 	return w, nil
 }
 
+func (w *WGCtrl) SetDNS(cfg dnsconfig.Config) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.dns == nil {
+		return dnsconfig.ErrUnavailable
+	}
+
+	return w.dns.Set(cfg)
+}
+
 func (w *WGCtrl) ConnFor(node key.NodePublic) types.UDPConn {
 	return &w.ensureLocalConn(node).conn
 }
@@ -170,24 +213,46 @@ func (w *WGCtrl) UpdatePeer(publicKey key.NodePublic, cfg toversok.PeerCfg) erro
 	}
 
 	peercfg.ReplaceAllowedIPs = true
-	peercfg.AllowedIPs = []net.IPNet{
-		*netipx.AddrIPNet(cfg.VIPs.IPv4),
-		*netipx.AddrIPNet(cfg.VIPs.IPv6),
+	for _, p := range cfg.AllowedIPs() {
+		peercfg.AllowedIPs = append(peercfg.AllowedIPs, *netipx.PrefixIPNet(p))
 	}
 
-	return w.client.ConfigureDevice(w.name, wgtypes.Config{
+	if err := w.client.ConfigureDevice(w.name, wgtypes.Config{
 		ReplacePeers: false,
 		Peers: []wgtypes.PeerConfig{
 			peercfg,
 		},
-	})
+	}); err != nil {
+		return err
+	}
+
+	return w.setRoutes(publicKey, cfg.Routes)
+}
+
+// setRoutes replaces the routes of a peer, and routes the routes of all peers into the interface if they changed.
+//
+// Assumes mu is held.
+func (w *WGCtrl) setRoutes(peer key.NodePublic, routes []netip.Prefix) error {
+	if !w.routes.Set(peer, routes) {
+		return nil
+	}
+
+	return w.routeInterface(w.routes.All())
+}
+
+// SetBypass implements toversok.Bypasser.
+func (w *WGCtrl) SetBypass(addrs []netip.Addr) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.bypassInterface(addrs)
 }
 
 func (w *WGCtrl) RemovePeer(publicKey key.NodePublic) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	return w.client.ConfigureDevice(w.name, wgtypes.Config{
+	if err := w.client.ConfigureDevice(w.name, wgtypes.Config{
 		ReplacePeers: false,
 		Peers: []wgtypes.PeerConfig{
 			{
@@ -195,7 +260,11 @@ func (w *WGCtrl) RemovePeer(publicKey key.NodePublic) error {
 				Remove:    true,
 			},
 		},
-	})
+	}); err != nil {
+		return err
+	}
+
+	return w.setRoutes(publicKey, nil)
 }
 
 func (w *WGCtrl) GetStats(publicKey key.NodePublic) (*toversok.WGStats, error) {
@@ -236,6 +305,10 @@ func (w *WGCtrl) GetInterface() *net.Interface {
 	return i
 }
 
+func (w *WGCtrl) MTU() int {
+	return w.mtu
+}
+
 func (w *WGCtrl) ensureLocalConn(peer key.NodePublic) *mapping {
 	m, ok := w.localMapping[peer]
 
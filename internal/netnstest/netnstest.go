@@ -0,0 +1,44 @@
+// Package netnstest runs tests in network namespaces of their own, so that they can configure networking freely.
+package netnstest
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Run runs f in a fresh network namespace, with only the loopback interface up.
+//
+// The test is skipped outside of linux, or when the namespace cannot be created, such as without privileges.
+func Run(t *testing.T, f func()) {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("network namespaces are only available on linux")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer func() {
+		require.NoError(t, netns.Set(orig))
+	}()
+
+	lo, err := netlink.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(lo))
+
+	f()
+}
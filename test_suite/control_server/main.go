@@ -111,18 +111,29 @@ func (cs *ControlServer) OnDeviceKey(sess control.SessID, deviceKey string) {
 	slog.Info("OnDeviceKey", "sess", sess, "deviceKey", deviceKey)
 }
 
-func (cs *ControlServer) OnSessionFinalize(sess control.SessID, cid control.ClientID) (netip.Prefix, netip.Prefix, time.Time) {
+func (cs *ControlServer) OnSessionFinalize(sess control.SessID, cid control.ClientID) (netip.Prefix, netip.Prefix, time.Time, error) {
 	slog.Info("OnSessionFinalize", "sess", sess, "cid", cid)
 
 	ip4, ip6 := cs.getIPs(key.NodePublic(cid))
 
-	return ip4, ip6, time.Time{}
+	return ip4, ip6, time.Time{}, nil
 }
 
 func (cs *ControlServer) OnSessionDestroy(sess control.SessID, cid control.ClientID) {
 	slog.Info("OnSessionDestroy", "sess", sess, "cid", cid)
 }
 
+func (cs *ControlServer) OnRoutesAdvertised(sess control.SessID, cid control.ClientID, routes []netip.Prefix) {
+	slog.Info("OnRoutesAdvertised", "sess", sess, "cid", cid, "routes", routes)
+
+	// Approve everything, like with authentication.
+	if err := cs.server.ApproveRoutes(cid, routes); err != nil {
+		slog.Error("error approving routes", "cid", cid, "err", err)
+	}
+
+	cs.server.ApproveExitNode(cid, true)
+}
+
 func LoadServer(ctx context.Context) *ControlServer {
 	cfg := loadConfig()
 
@@ -18,6 +18,7 @@ import (
 	"github.com/edup2p/common/toversok"
 	"github.com/edup2p/common/types/dial"
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
 	"github.com/edup2p/common/usrwg"
 	"golang.zx2c4.com/wireguard/wgctrl"
 )
@@ -349,6 +350,12 @@ func (s *StokFirewall) QuarantineNodes(ips []netip.Addr) error {
 	return nil
 }
 
+func (s *StokFirewall) SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error {
+	slog.Info("StokFirewall SetPeerRules called", "rules", rules)
+
+	return nil
+}
+
 func (s *StokFirewall) LocalAddresses() ([]netip.Addr, error) {
 	slog.Info("StokFirewall LocalAddresses called")
 
@@ -44,6 +44,22 @@ func (m *MockControl) Expiry() time.Time {
 	return m.expiry()
 }
 
+func (m *MockControl) MTU() int {
+	return 0
+}
+
+func (m *MockControl) Hostname() string {
+	return ""
+}
+
+func (m *MockControl) Domain() string {
+	return ""
+}
+
+func (m *MockControl) ControlAddr() netip.Addr {
+	return netip.Addr{}
+}
+
 func (m *MockControl) UpdateEndpoints(endpoints []netip.AddrPort) error {
 	m.endpoints = endpoints
 	return m.updateEndpoints(endpoints)
@@ -53,6 +69,10 @@ func (m *MockControl) UpdateHomeRelay(relayID int64) error {
 	return m.updateHomeRelay(relayID)
 }
 
+func (m *MockControl) UpdateRoutes([]netip.Prefix) error {
+	return nil
+}
+
 func TestEndpointManager(t *testing.T) {
 	// EndpointManager uses a DirectRouter and RelayManager in this test
 	s := &Stage{
@@ -6,16 +6,20 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/netip"
 	"runtime"
 	"runtime/debug"
 	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgactor"
+	"github.com/edup2p/common/types/stage"
 	"github.com/sethvargo/go-limiter"
 	"github.com/sethvargo/go-limiter/memorystore"
 	"golang.org/x/net/dns/dnsmessage"
@@ -29,13 +33,33 @@ type MDNSManager struct {
 
 	rlStore limiter.Store
 
+	// cache keeps the services of peers, to answer local queries from.
+	cache *serviceCache
+	// asked records when questions were last asked to peers, to not repeat them.
+	asked map[key.NodePublic]map[questionKey]time.Time
+
+	// The sockets are (re)created by setupSockets, and are nil while they are not available.
 	b4Sock *SockRecv
 	b6Sock *SockRecv
 
 	u4Sock *SockRecv
 	u6Sock *SockRecv
 
-	working bool
+	// pc4 and pc6 join the mDNS groups on b4Sock and b6Sock, for the interfaces in joined4 and joined6.
+	pc4     *ipv4.PacketConn
+	pc6     *ipv6.PacketConn
+	joined4 map[int]bool
+	joined6 map[int]bool
+
+	// overlay6 is the interface IPv6 mDNS is injected over on linux, see setupOverlay6; nil until it is set up.
+	overlay6 *net.Interface
+
+	// localAddrs are the addresses of all local interfaces,
+	// including the link-local ones which local endpoints leave out, but IPv6 mDNS is sent from.
+	localAddrs []netip.Addr
+
+	// setupErrs holds the last error of setting up each socket, to only log changes.
+	setupErrs map[string]string
 }
 
 func (s *Stage) makeMM() *MDNSManager {
@@ -56,56 +80,28 @@ func (s *Stage) makeMM() *MDNSManager {
 		panic(err)
 	}
 
-	m := assureClose(&MDNSManager{
+	return assureClose(&MDNSManager{
 		ActorCommon: c,
 		s:           s,
 		rlStore:     store,
+		cache:       newServiceCache(),
+		asked:       make(map[key.NodePublic]map[questionKey]time.Time),
+		setupErrs:   make(map[string]string),
 	})
+}
 
-	b4bind, err := m.makeMDNSv4Listener()
-	if err != nil {
-		L(m).Warn("MDNS ipv4 listener creation failed", "err", err)
-	} else {
-		m.b4Sock = MakeSockRecv(c.ctx, b4bind)
-	}
-
-	b6bind, err := m.makeMDNSv6Listener()
-	if err != nil {
-		L(m).Warn("MDNS ipv6 listener creation failed", "err", err)
-	} else {
-		m.b6Sock = MakeSockRecv(c.ctx, b6bind)
-	}
-
-	if m.b4Sock == nil && m.b6Sock == nil {
-		L(m).Error("could not start MDNS Manager; creating both MDNS broadcast sockets failed")
-
-		return m
-	}
-
-	u4bind, err := m.makeIPv4UnicastListener()
-	if err != nil {
-		L(m).Warn("MDNS ipv4 sender creation failed", "err", err)
-	} else {
-		m.u4Sock = MakeSockRecv(c.ctx, u4bind)
-	}
-
-	u6bind, err := m.makeIPv6UnicastListener()
-	if err != nil {
-		L(m).Warn("MDNS ipv4 sender creation failed", "err", err)
-	} else {
-		m.u6Sock = MakeSockRecv(c.ctx, u6bind)
-	}
-
-	if m.u4Sock == nil && m.u6Sock == nil {
-		L(m).Error("could not start MDNS Manager; creating both MDNS unicast sockets failed")
-
-		return m
-	}
+const (
+	// mdnsSetupInterval is the interval at which missing sockets are set up again,
+	// and the mDNS groups are joined on interfaces that came up.
+	mdnsSetupInterval = 10 * time.Second
 
-	m.working = true
+	// mdnsCacheExpiry is the interval at which expired records are removed from the service cache.
+	mdnsCacheExpiry = time.Minute
 
-	return m
-}
+	// mdnsRequeryInterval is how long a question is not asked to a peer again,
+	// unless its answers in the cache are not fresh anymore.
+	mdnsRequeryInterval = 30 * time.Second
+)
 
 var (
 	MDNSPort             uint16 = 5353
@@ -134,95 +130,118 @@ func getLoopBackInterface() (*net.Interface, error) {
 	return nil, fmt.Errorf("no loopback interface found")
 }
 
-func (mm *MDNSManager) makeMDNSv4Listener() (types.UDPConn, error) {
+// interfaceWithAddr returns the interface that has addr assigned.
+func interfaceWithAddr(addr netip.Addr) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list network interfaces: %w", err)
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+					return &iface, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no interface with address %s found", addr)
+}
+
+func (mm *MDNSManager) makeMDNSv4Listener() (types.UDPConn, *ipv4.PacketConn, error) {
 	ua := net.UDPAddrFromAddrPort(ip4MDNSBroadcastAP)
 
 	conn, err := net.ListenUDP("udp4", ua)
 	if err != nil {
-		return nil, fmt.Errorf("ListenUDP error: %w", err)
+		return nil, nil, fmt.Errorf("ListenUDP error: %w", err)
 	}
 
 	pc4 := ipv4.NewPacketConn(conn)
 
-	ift, err := net.Interfaces()
-	if err != nil {
-		return nil, fmt.Errorf("cannot get interfaces: %w", err)
-	}
-	for _, ifi := range ift {
-		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagPointToPoint == 0 {
-			if err := pc4.JoinGroup(&ifi, &net.UDPAddr{IP: ip4MDNSBroadcastBare.AsSlice()}); err != nil {
-				L(mm).Warn("pc4 Multicast JoinGroup failed", "err", err, "iface", ifi.Name)
-			}
-		}
+	if err := mm.setupMDNSv4Listener(pc4); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
+	return conn, pc4, nil
+}
+
+func (mm *MDNSManager) setupMDNSv4Listener(pc4 *ipv4.PacketConn) error {
 	if loop, err := pc4.MulticastLoopback(); err == nil {
 		if !loop {
 			if err := pc4.SetMulticastLoopback(true); err != nil {
-				return nil, fmt.Errorf("cannot set multicast loopback: %w", err)
+				return fmt.Errorf("cannot set multicast loopback: %w", err)
 			}
 		}
 	}
 
 	lo, err := getLoopBackInterface()
 	if err != nil {
-		return nil, fmt.Errorf("cannot get loopback interface: %w", err)
+		return fmt.Errorf("cannot get loopback interface: %w", err)
 	}
 
 	if err := pc4.SetMulticastInterface(lo); err != nil {
-		return nil, fmt.Errorf("cannot set multicast interface: %w", err)
+		return fmt.Errorf("cannot set multicast interface: %w", err)
 	}
 
 	if err := pc4.SetTTL(255); err != nil {
-		return nil, fmt.Errorf("cannot set TTL: %w", err)
+		return fmt.Errorf("cannot set TTL: %w", err)
 	}
 	if err := pc4.SetMulticastTTL(255); err != nil {
-		return nil, fmt.Errorf("cannot set Multicast TTL: %w", err)
+		return fmt.Errorf("cannot set Multicast TTL: %w", err)
 	}
 
-	return conn, nil
+	return nil
 }
 
-func (mm *MDNSManager) makeMDNSv6Listener() (types.UDPConn, error) {
+func (mm *MDNSManager) makeMDNSv6Listener() (types.UDPConn, *ipv6.PacketConn, error) {
 	ua := net.UDPAddrFromAddrPort(ip6MDNSBroadcastAP)
 
 	conn, err := net.ListenUDP("udp6", ua)
 	if err != nil {
-		return nil, fmt.Errorf("ListenUDP error: %w", err)
+		return nil, nil, fmt.Errorf("ListenUDP error: %w", err)
 	}
 
 	pc6 := ipv6.NewPacketConn(conn)
 
-	ift, err := net.Interfaces()
-	if err != nil {
-		return nil, fmt.Errorf("cannot get interfaces: %w", err)
-	}
-	for _, ifi := range ift {
-		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagPointToPoint == 0 {
-			if err := pc6.JoinGroup(&ifi, &net.UDPAddr{IP: ip6MDNSBroadcastBare.AsSlice()}); err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-				L(mm).Warn("pc6 Multicast JoinGroup failed", "err", err, "iface", ifi.Name)
-			}
-		}
+	if err := mm.setupMDNSv6Listener(pc6); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
+	return conn, pc6, nil
+}
+
+func (mm *MDNSManager) setupMDNSv6Listener(pc6 *ipv6.PacketConn) error {
 	if loop, err := pc6.MulticastLoopback(); err == nil {
 		if !loop {
 			if err := pc6.SetMulticastLoopback(true); err != nil {
-				return nil, fmt.Errorf("cannot set multicast loopback: %w", err)
+				return fmt.Errorf("cannot set multicast loopback: %w", err)
 			}
 		}
 	}
 
 	lo, err := getLoopBackInterface()
 	if err != nil {
-		return nil, fmt.Errorf("cannot get loopback interface: %w", err)
+		return fmt.Errorf("cannot get loopback interface: %w", err)
 	}
 
 	if err := pc6.SetMulticastInterface(lo); err != nil {
-		return nil, fmt.Errorf("cannot set multicast interface: %w", err)
+		return fmt.Errorf("cannot set multicast interface: %w", err)
 	}
 
-	return conn, nil
+	if err := pc6.SetMulticastHopLimit(255); err != nil {
+		return fmt.Errorf("cannot set multicast hop limit: %w", err)
+	}
+
+	return nil
 }
 
 func (mm *MDNSManager) makeIPv4UnicastListener() (types.UDPConn, error) {
@@ -244,15 +263,174 @@ func (mm *MDNSManager) makeIPv6UnicastListener() (types.UDPConn, error) {
 	addr := ip6MDNSLoopBackAP
 
 	if runtime.GOOS == "windows" {
-		laddr = net.UDPAddrFromAddrPort(
-			netip.AddrPortFrom(mm.s.control.IPv6().Addr(), 0),
-		)
-		addr = ip6MDNSBroadcastAP
+		ip6 := mm.s.control.IPv6().Addr()
+
+		// FF02::FB is link-local, so it needs the zone of the overlay interface to be sent over it.
+		iface, err := interfaceWithAddr(ip6)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find overlay interface: %w", err)
+		}
+
+		laddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip6, 0))
+		addr = netip.AddrPortFrom(ip6MDNSBroadcastBare.WithZone(iface.Name), MDNSPort)
 	}
 
 	return net.DialUDP("udp6", laddr, net.UDPAddrFromAddrPort(addr))
 }
 
+// setupSockets creates the sockets which are missing, and joins the mDNS groups on the interfaces that came up.
+//
+// It is called periodically, as sockets may stop, and interfaces (such as the overlay one) may come up later.
+func (mm *MDNSManager) setupSockets() {
+	if mm.b4Sock == nil {
+		conn, pc, err := mm.makeMDNSv4Listener()
+		if mm.setupResult("ipv4 listener", err) {
+			mm.b4Sock, mm.pc4, mm.joined4 = mm.startSock(conn), pc, make(map[int]bool)
+		}
+	}
+
+	if mm.b6Sock == nil {
+		conn, pc, err := mm.makeMDNSv6Listener()
+		if mm.setupResult("ipv6 listener", err) {
+			mm.b6Sock, mm.pc6, mm.joined6 = mm.startSock(conn), pc, make(map[int]bool)
+		}
+	}
+
+	if mm.u4Sock == nil {
+		conn, err := mm.makeIPv4UnicastListener()
+		if mm.setupResult("ipv4 sender", err) {
+			mm.u4Sock = mm.startSock(conn)
+		}
+	}
+
+	if mm.u6Sock == nil {
+		conn, err := mm.makeIPv6UnicastListener()
+		if mm.setupResult("ipv6 sender", err) {
+			mm.u6Sock = mm.startSock(conn)
+		}
+	}
+
+	if runtime.GOOS == "linux" {
+		mm.setupOverlay6()
+	}
+
+	mm.joinGroups()
+	mm.updateLocalAddrs()
+}
+
+// setupOverlay6 has b6Sock inject IPv6 mDNS over the overlay interface.
+//
+// On linux, the loopback interface has no route for IPv6 multicast, so it cannot be injected over it.
+// FF02::FB is link-local, so the overlay interface is also the zone the packets are sent to, see injectVia.
+func (mm *MDNSManager) setupOverlay6() {
+	if mm.pc6 == nil || mm.overlay6 != nil {
+		return
+	}
+
+	iface := mm.s.wgIf
+	if iface == nil {
+		var err error
+
+		// The interface may not be up yet, in which case this is tried again on the next setup.
+		if iface, err = interfaceWithAddr(mm.s.control.IPv6().Addr()); err != nil {
+			return
+		}
+	}
+
+	if mm.setupResult("ipv6 overlay interface", mm.pc6.SetMulticastInterface(iface)) {
+		mm.overlay6 = iface
+	}
+}
+
+// setupResult logs the result of setting up a socket if it changed, and returns whether it succeeded.
+func (mm *MDNSManager) setupResult(name string, err error) bool {
+	last, failed := mm.setupErrs[name]
+
+	if err == nil {
+		if failed {
+			L(mm).Info("MDNS socket creation succeeded after failing", "socket", name)
+			delete(mm.setupErrs, name)
+		}
+
+		return true
+	}
+
+	if !failed || last != err.Error() {
+		L(mm).Warn("MDNS socket creation failed, retrying periodically", "socket", name, "err", err)
+		mm.setupErrs[name] = err.Error()
+	}
+
+	return false
+}
+
+func (mm *MDNSManager) startSock(conn types.UDPConn) *SockRecv {
+	sock := MakeSockRecv(mm.ctx, conn)
+
+	go sock.Run()
+
+	return sock
+}
+
+// joinGroups joins the mDNS groups on all multicast-capable interfaces that have not joined them yet.
+func (mm *MDNSManager) joinGroups() {
+	ift, err := net.Interfaces()
+	if err != nil {
+		L(mm).Warn("cannot get interfaces", "err", err)
+		return
+	}
+
+	up := make(map[int]bool)
+
+	for _, ifi := range ift {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagPointToPoint != 0 {
+			continue
+		}
+
+		up[ifi.Index] = true
+
+		if mm.pc4 != nil && !mm.joined4[ifi.Index] {
+			if err := mm.pc4.JoinGroup(&ifi, &net.UDPAddr{IP: ip4MDNSBroadcastBare.AsSlice()}); err != nil {
+				L(mm).Debug("pc4 Multicast JoinGroup failed", "err", err, "iface", ifi.Name)
+			} else {
+				mm.joined4[ifi.Index] = true
+			}
+		}
+
+		if mm.pc6 != nil && !mm.joined6[ifi.Index] {
+			if err := mm.pc6.JoinGroup(&ifi, &net.UDPAddr{IP: ip6MDNSBroadcastBare.AsSlice()}); err != nil {
+				if !errors.Is(err, syscall.EAFNOSUPPORT) {
+					L(mm).Debug("pc6 Multicast JoinGroup failed", "err", err, "iface", ifi.Name)
+				}
+			} else {
+				mm.joined6[ifi.Index] = true
+			}
+		}
+	}
+
+	// Interfaces that went down left the groups, and have to join them again when they come back up.
+	isDown := func(index int, _ bool) bool { return !up[index] }
+	maps.DeleteFunc(mm.joined4, isDown)
+	maps.DeleteFunc(mm.joined6, isDown)
+}
+
+func (mm *MDNSManager) updateLocalAddrs() {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		L(mm).Warn("cannot get interface addresses", "err", err)
+		return
+	}
+
+	mm.localAddrs = mm.localAddrs[:0]
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				mm.localAddrs = append(mm.localAddrs, ip.Unmap())
+			}
+		}
+	}
+}
+
 func dataToB64Hash(b []byte) string {
 	h := sha256.Sum256(b)
 
@@ -273,13 +451,13 @@ func (mm *MDNSManager) Run() {
 		}
 	}()
 
-	if !mm.working {
-		mm.deadRun()
-		return
-	}
+	mm.setupSockets()
 
-	go mm.b4Sock.Run()
-	go mm.u4Sock.Run()
+	setup := time.NewTicker(mdnsSetupInterval)
+	defer setup.Stop()
+
+	expiry := time.NewTicker(mdnsCacheExpiry)
+	defer expiry.Stop()
 
 	for {
 		select {
@@ -291,20 +469,57 @@ func (mm *MDNSManager) Run() {
 			default:
 				mm.logUnknownMessage(msg)
 			}
-		case frame := <-mm.b4Sock.outCh:
-			mm.handleSystemFrame(frame)
-		case frame := <-mm.b6Sock.outCh:
-			mm.handleSystemFrame(frame)
-		case frame := <-mm.u4Sock.outCh:
-			mm.handleSystemFrame(frame)
-		case frame := <-mm.u6Sock.outCh:
-			mm.handleSystemFrame(frame)
+		case frame, ok := <-outCh(mm.b4Sock):
+			mm.handleSockFrame(&mm.b4Sock, frame, ok)
+		case frame, ok := <-outCh(mm.b6Sock):
+			mm.handleSockFrame(&mm.b6Sock, frame, ok)
+		case frame, ok := <-outCh(mm.u4Sock):
+			mm.handleSockFrame(&mm.u4Sock, frame, ok)
+		case frame, ok := <-outCh(mm.u6Sock):
+			mm.handleSockFrame(&mm.u6Sock, frame, ok)
+		case <-setup.C:
+			mm.setupSockets()
+		case <-expiry.C:
+			mm.expireCache()
 		case <-mm.ctx.Done():
 			return
 		}
 	}
 }
 
+// outCh returns the frames of sock, or nil (which blocks forever) if there is no socket.
+func outCh(sock *SockRecv) <-chan RecvFrame {
+	if sock == nil {
+		return nil
+	}
+
+	return sock.outCh
+}
+
+// handleSockFrame handles a frame received from *sock, or drops the socket when it has stopped,
+// for setupSockets to create it again.
+func (mm *MDNSManager) handleSockFrame(sock **SockRecv, frame RecvFrame, ok bool) {
+	if ok {
+		mm.handleSystemFrame(frame)
+		return
+	}
+
+	if mm.ctx.Err() != nil {
+		return
+	}
+
+	L(mm).Warn("MDNS socket stopped, recreating it")
+
+	switch *sock {
+	case mm.b4Sock:
+		mm.pc4, mm.joined4 = nil, nil
+	case mm.b6Sock:
+		mm.pc6, mm.joined6, mm.overlay6 = nil, nil, nil
+	}
+
+	*sock = nil
+}
+
 func (mm *MDNSManager) handleReceivedPacket(msg *msgactor.MManReceivedPacket) {
 	pi := mm.s.GetPeerInfo(msg.From)
 	if pi == nil {
@@ -312,55 +527,153 @@ func (mm *MDNSManager) handleReceivedPacket(msg *msgactor.MManReceivedPacket) {
 		return
 	}
 
-	extra := "ip4"
-	if msg.IP6 {
-		extra = "ip6"
-	}
-
-	if _, _, _, ok, _ := mm.rlStore.Take(context.Background(), dataToB64Hash(msg.Data)+extra); !ok {
+	if _, _, _, ok, _ := mm.rlStore.Take(context.Background(), dataToB64Hash(msg.Data)+ipExtra(msg.IP6)); !ok {
 		// some rudimentary filtering to prevent true loop storms
 		return
 	}
 
 	L(mm).Debug("processing external MDNS packet", "len", len(msg.Data), "from", msg.From.Debug())
 
-	pkt := mm.processMDNS(msg.Data, false)
+	dm := dnsmessage.Message{}
+	if err := dm.Unpack(msg.Data); err != nil {
+		L(mm).Warn("dropping external MDNS packet which failed to unpack", "err", err, "from", msg.From.Debug())
+		return
+	}
+
+	mm.debugMDNS(&dm)
+
+	// The peer should only send the services it shares with us, but we hold it to that.
+	if !filterServices(&dm, pi.MDNSServices) {
+		L(mm).Log(context.Background(), types.LevelTrace, "dropping external MDNS packet without shared services", "from", msg.From.Debug())
+		return
+	}
+
+	if dm.Response {
+		// RFC 6762:
+		//   Multicast DNS responses MUST NOT contain any questions in the
+		//   Question Section.  Any questions in the Question Section of a
+		//   received Multicast DNS response MUST be silently ignored.  Multicast
+		//   DNS queriers receiving Multicast DNS responses do not care what
+		//   question elicited the response; they care only that the information
+		//   in the response is true and accurate.
+		//
+		// f.e. avahi doesn't properly work if the questions section is filled out, so we need to process that.
+		//
+		// The likes of Apple's mDNSResponder haven't gotten this above message, so we need to check for this.
+		dm.Questions = nil
+
+		mm.cache.add(msg.From, slices.Concat(dm.Answers, dm.Additionals), time.Now())
+	}
+
+	pkt, err := dm.Pack()
+	if err != nil {
+		L(mm).Warn("failed to pack external MDNS packet", "err", err)
+		return
+	}
+
+	if err := mm.inject(pkt, msg.IP6); err != nil {
+		if err2 := mm.injectFrom(msg.From, pkt, msg.IP6); err2 != nil {
+			L(mm).Warn("failed to process external MDNS packet", "err", errors.Join(err, err2))
+		}
+	}
+}
+
+// inject writes an mDNS packet to the local system.
+//
+// If that fails over the IP version it was sent with, it is written over the other one, as the records it carries
+// are the same over either, and not every system can inject both; linux cannot send IPv6 multicast over loopback.
+func (mm *MDNSManager) inject(pkt []byte, ip6 bool) error {
+	err := mm.injectVia(pkt, ip6)
+	if err == nil {
+		return nil
+	}
+
+	if err2 := mm.injectVia(pkt, !ip6); err2 != nil {
+		return errors.Join(err, err2)
+	}
 
-	var err error
+	L(mm).Debug("injected MDNS packet over other IP version", "ip6", ip6, "err", err)
 
-	// TODO process external mDNS packet
+	return nil
+}
+
+func (mm *MDNSManager) injectVia(pkt []byte, ip6 bool) (err error) {
+	// We will receive our own packet back, taking its token makes handleSystemFrame drop it.
+	_, _, _, _, _ = mm.rlStore.Take(context.Background(), dataToB64Hash(pkt)+ipExtra(ip6))
 
 	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
 		// On macOS, we can't use the broadsock's WriteTo, since it just doesn't generate a packet.
 		// However, we can use our specialised query sock to poke responses in unicast, even if they're QM.
-		if msg.IP6 {
-			_, err = mm.u6Sock.Conn.Write(pkt)
-		} else {
-			_, err = mm.u4Sock.Conn.Write(pkt)
+		sock := mm.u4Sock
+		if ip6 {
+			sock = mm.u6Sock
+		}
+
+		if sock == nil {
+			return errNoMDNSSocket
 		}
+
+		_, err = sock.Conn.Write(pkt)
 	} else {
-		if msg.IP6 {
-			_, err = mm.b6Sock.Conn.WriteToUDPAddrPort(pkt, ip6MDNSBroadcastAP)
-		} else {
-			_, err = mm.b4Sock.Conn.WriteToUDPAddrPort(pkt, ip4MDNSBroadcastAP)
+		sock, dst := mm.b4Sock, ip4MDNSBroadcastAP
+		if ip6 {
+			sock, dst = mm.b6Sock, ip6MDNSBroadcastAP
+
+			if mm.overlay6 != nil {
+				dst = netip.AddrPortFrom(ip6MDNSBroadcastBare.WithZone(mm.overlay6.Name), MDNSPort)
+			}
+		}
+
+		if sock == nil {
+			return errNoMDNSSocket
 		}
+
+		_, err = sock.Conn.WriteToUDPAddrPort(pkt, dst)
 	}
-	if err != nil {
-		L(mm).Warn("failed to process external MDNS packet", "err", err)
+
+	return err
+}
+
+// injectFrom injects an mDNS packet of peer into the local network stack through the wireguard controller,
+// as if peer multicast it over the overlay.
+func (mm *MDNSManager) injectFrom(peer key.NodePublic, pkt []byte, ip6 bool) error {
+	if mm.s.injector == nil || !mm.s.injector.Available() {
+		return errNoInjector
+	}
+
+	pi := mm.s.GetPeerInfo(peer)
+	if pi == nil {
+		return fmt.Errorf("unknown peer %s", peer.Debug())
 	}
+
+	from, to := netip.AddrPortFrom(pi.IPv4, MDNSPort), ip4MDNSBroadcastAP
+	if ip6 {
+		from, to = netip.AddrPortFrom(pi.IPv6, MDNSPort), ip6MDNSBroadcastAP
+	}
+
+	return mm.s.injector.InjectPacket(from, to, pkt)
+}
+
+var (
+	errNoMDNSSocket = errors.New("no MDNS socket available")
+	errNoInjector   = errors.New("cannot inject into local network stack")
+)
+
+func ipExtra(ip6 bool) string {
+	if ip6 {
+		return "ip6"
+	}
+
+	return "ip4"
 }
 
 func (mm *MDNSManager) handleSystemFrame(frame RecvFrame) {
 	// got MDNS message from system; forward
 
 	nap := types.NormaliseAddr(frame.src.Addr())
+	ip6 := nap.Is6()
 
-	extra := "ip4"
-	if nap.Is6() {
-		extra = "ip6"
-	}
-
-	if _, _, _, ok, _ := mm.rlStore.Take(context.Background(), dataToB64Hash(frame.pkt)+extra); !ok {
+	if _, _, _, ok, _ := mm.rlStore.Take(context.Background(), dataToB64Hash(frame.pkt)+ipExtra(ip6)); !ok {
 		// some rudimentary filtering to prevent true loop storms
 		return
 	}
@@ -370,13 +683,205 @@ func (mm *MDNSManager) handleSystemFrame(frame RecvFrame) {
 		return
 	}
 
-	// TODO proper in-depth filtering
+	dm := dnsmessage.Message{}
+	if err := dm.Unpack(frame.pkt); err != nil {
+		L(mm).Warn("dropping local MDNS packet which failed to unpack", "err", err)
+		return
+	}
+
+	mm.debugMDNS(&dm)
+
+	if dm.Response {
+		if rewriteLocal(&dm, mm.isLocal, mm.s.control.IPv4().Addr(), mm.s.control.IPv6().Addr(), mm.localHostname()) {
+			L(mm).Debug("rewritten local MDNS response")
+
+			mm.debugMDNS(&dm)
+		}
+	} else if frame.src.Port() == MDNSPort {
+		// One-shot queriers (RFC 6762, section 5.1) expect a unicast response, which we cannot give.
+		mm.answerFromCache(&dm, ip6)
+	}
 
 	L(mm).Debug("spreading local MDNS packet to peers", "len", len(frame.pkt), "from", frame.src.String())
 
-	pkt := mm.processMDNS(frame.pkt, true)
+	mm.spread(&dm, ip6)
+}
+
+// spread sends a local mDNS packet to all peers which have mDNS enabled,
+// with only the services shared with them, and only the questions they were not asked recently.
+func (mm *MDNSManager) spread(dm *dnsmessage.Message, ip6 bool) {
+	peers := mm.s.GetPeersWhere(func(_ key.NodePublic, info *stage.PeerInfo) bool {
+		return info.MDNS
+	})
+
+	now := time.Now()
+
+	for _, peer := range peers {
+		pi := mm.s.GetPeerInfo(peer)
+		if pi == nil {
+			continue
+		}
+
+		pm := cloneMessage(dm)
+
+		if !filterServices(pm, pi.MDNSServices) {
+			continue
+		}
+
+		if !pm.Response {
+			pm.Questions = mm.toAsk(peer, pm.Questions, now)
+
+			if len(pm.Questions) == 0 {
+				continue
+			}
+		}
+
+		pkt, err := pm.Pack()
+		if err != nil {
+			L(mm).Warn("failed to pack MDNS packet for peer", "err", err, "peer", peer.Debug())
+			continue
+		}
+
+		SendMessage(mm.s.TMan.Inbox(), &msgactor.TManSendMDNSPacket{To: peer, Pkt: pkt, IP6: ip6})
+	}
+}
+
+type questionKey struct {
+	name string
+	t    dnsmessage.Type
+}
+
+func keyOf(q dnsmessage.Question) questionKey {
+	return questionKey{strings.ToLower(q.Name.String()), q.Type}
+}
+
+// toAsk returns the questions to ask to peer; the ones it was not asked recently,
+// and of which it has no fresh answers in the cache. It records them as asked.
+func (mm *MDNSManager) toAsk(peer key.NodePublic, questions []dnsmessage.Question, now time.Time) []dnsmessage.Question {
+	asked := mm.asked[peer]
+	if asked == nil {
+		asked = make(map[questionKey]time.Time)
+		mm.asked[peer] = asked
+	}
+
+	fromPeer := func(p key.NodePublic, _ *dnsmessage.Resource) bool {
+		return p == peer
+	}
+
+	return slices.DeleteFunc(questions, func(q dnsmessage.Question) bool {
+		if records, fresh := mm.cache.lookup(q.Name, q.Type, now, fromPeer); len(records) > 0 && fresh {
+			return true
+		}
+
+		k := keyOf(q)
+
+		if at, ok := asked[k]; ok && now.Sub(at) < mdnsRequeryInterval {
+			return true
+		}
+
+		asked[k] = now
+
+		return false
+	})
+}
+
+// answerFromCache answers a local query with the records of peers in the cache,
+// leaving out the answers the querier already knows.
+func (mm *MDNSManager) answerFromCache(dm *dnsmessage.Message, ip6 bool) {
+	now := time.Now()
+
+	var answers, additionals []dnsmessage.Resource
+
+	for _, q := range dm.Questions {
+		ans, add, _ := mm.cache.answer(q, now, mm.sharedWithUs)
+
+		// Known-answer suppression, see RFC 6762, section 7.1.
+		ans = slices.DeleteFunc(ans, func(res dnsmessage.Resource) bool {
+			return slices.ContainsFunc(dm.Answers, func(known dnsmessage.Resource) bool {
+				return sameRecord(&known, &res) && known.Header.TTL*2 > res.Header.TTL
+			})
+		})
+
+		answers = append(answers, ans...)
+		additionals = append(additionals, add...)
+	}
+
+	if len(answers) == 0 {
+		return
+	}
 
-	SendMessage(mm.s.TMan.Inbox(), &msgactor.TManSpreadMDNSPacket{Pkt: pkt, IP6: nap.Is6()})
+	resp := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+
+	L(mm).Debug("answering local MDNS query from cache", "answers", len(answers), "additionals", len(additionals))
+
+	mm.debugMDNS(&resp)
+
+	pkt, err := resp.Pack()
+	if err != nil {
+		L(mm).Warn("failed to pack MDNS response from cache", "err", err)
+		return
+	}
+
+	if err := mm.inject(pkt, ip6); err != nil {
+		L(mm).Warn("failed to answer MDNS query from cache", "err", err)
+	}
+}
+
+// sharedWithUs returns whether peer currently shares the service of a cached record with us.
+//
+// Records of no service type were limited to the hosts of shared services when they were received, see filterServices.
+func (mm *MDNSManager) sharedWithUs(peer key.NodePublic, res *dnsmessage.Resource) bool {
+	pi := mm.s.GetPeerInfo(peer)
+	if pi == nil || !pi.MDNS {
+		return false
+	}
+
+	st := resourceServiceType(res)
+
+	return st == "" || serviceAllowed(pi.MDNSServices, st)
+}
+
+// expireCache removes expired records and questions, and forgets peers that do not have mDNS enabled anymore.
+func (mm *MDNSManager) expireCache() {
+	now := time.Now()
+
+	mm.cache.expire(now)
+
+	for peer, asked := range mm.asked {
+		maps.DeleteFunc(asked, func(_ questionKey, at time.Time) bool {
+			return now.Sub(at) >= mdnsRequeryInterval
+		})
+
+		if len(asked) == 0 {
+			delete(mm.asked, peer)
+		}
+	}
+
+	for peer := range mm.cache.records {
+		if pi := mm.s.GetPeerInfo(peer); pi == nil || !pi.MDNS {
+			mm.cache.forget(peer)
+		}
+	}
+}
+
+// localHostname returns the name local hosts are renamed to for peers, or an empty name if control gave no hostname.
+func (mm *MDNSManager) localHostname() dnsmessage.Name {
+	hostname := mm.s.control.Hostname()
+	if hostname == "" {
+		return dnsmessage.Name{}
+	}
+
+	name, err := dnsmessage.NewName(hostname + ".local.")
+	if err != nil {
+		L(mm).Warn("cannot use hostname in MDNS records", "hostname", hostname, "err", err)
+		return dnsmessage.Name{}
+	}
+
+	return name
 }
 
 func (mm *MDNSManager) debugMDNS(msg *dnsmessage.Message) {
@@ -401,30 +906,10 @@ func (mm *MDNSManager) debugMDNS(msg *dnsmessage.Message) {
 	}
 }
 
-func (mm *MDNSManager) fixResource(res *dnsmessage.Resource) (dirty bool) {
-	switch res.Header.Type {
-	case dnsmessage.TypeA:
-		ar := res.Body.(*dnsmessage.AResource)
-		if mm.isLocal(netip.AddrFrom4(ar.A)) {
-			ar.A = mm.s.control.IPv4().Addr().As4()
-			res.Header.Class |= 32768
-			dirty = true
-		}
-	case dnsmessage.TypeAAAA:
-		a4r := res.Body.(*dnsmessage.AAAAResource)
-
-		if mm.isLocal(netip.AddrFrom16(a4r.AAAA)) {
-			a4r.AAAA = mm.s.control.IPv6().Addr().As16()
-			res.Header.Class |= 32768
-			dirty = true
-		}
-	}
-
-	return
-}
-
 func (mm *MDNSManager) isLocal(addr netip.Addr) bool {
-	return addr.IsLoopback() || slices.IndexFunc(mm.s.getLocalEndpoints(), func(cAddr netip.Addr) bool {
+	addr = addr.WithZone("")
+
+	return addr.IsLoopback() || slices.Contains(mm.localAddrs, addr) || slices.IndexFunc(mm.s.getLocalEndpoints(), func(cAddr netip.Addr) bool {
 		return cAddr == addr
 	}) != -1
 }
@@ -433,89 +918,6 @@ func (mm *MDNSManager) isSelf(addr netip.Addr) bool {
 	return mm.isLocal(addr) || addr == mm.s.control.IPv4().Addr() || addr == mm.s.control.IPv6().Addr()
 }
 
-func (mm *MDNSManager) processMDNS(pkt []byte, local bool) []byte {
-	msg := dnsmessage.Message{}
-	if err := msg.Unpack(pkt); err != nil {
-		L(mm).Warn("failed to unpack MDNS packet", "err", err)
-		return pkt
-	}
-
-	mm.debugMDNS(&msg)
-
-	var dirty bool
-
-	if local {
-		for _, ans := range msg.Answers {
-			if mm.fixResource(&ans) {
-				dirty = true
-			}
-		}
-
-		for _, add := range msg.Additionals {
-			if mm.fixResource(&add) {
-				dirty = true
-			}
-		}
-	} else if msg.Response {
-		// RFC 6762:
-		//   Multicast DNS responses MUST NOT contain any questions in the
-		//   Question Section.  Any questions in the Question Section of a
-		//   received Multicast DNS response MUST be silently ignored.  Multicast
-		//   DNS queriers receiving Multicast DNS responses do not care what
-		//   question elicited the response; they care only that the information
-		//   in the response is true and accurate.
-		//
-		// f.e. avahi doesn't properly work if the questions section is filled out, so we need to process that.
-		//
-		// The likes of Apple's mDNSResponder haven't gotten this above message, so we need to check for this.
-		//
-		// TODO this may be because we're regarding it via unicast DNS, and then this is the fallback described in
-		//  section 6.7?
-		//   If the source UDP port in a received Multicast DNS query is not port
-		//   5353, this indicates that the querier originating the query is a
-		//   simple resolver such as described in Section 5.1, "One-Shot Multicast
-		//   DNS Queries", which does not fully implement all of Multicast DNS.
-		//   In this case, the Multicast DNS responder MUST send a UDP response
-		//   directly back to the querier, via unicast, to the query packet's
-		//   source IP address and port.  This unicast response MUST be a
-		//   conventional unicast response as would be generated by a conventional
-		//   Unicast DNS server; for example, it MUST repeat the query ID and the
-		//   question given in the query message.  In addition, the cache-flush
-		//   bit described in Section 10.2, "Announcements to Flush Outdated Cache
-		//   Entries", MUST NOT be set in legacy unicast responses.
-		if len(msg.Questions) != 0 {
-			msg.Questions = []dnsmessage.Question{}
-			dirty = true
-		}
-	}
-
-	if dirty {
-		L(mm).Debug("processMDNS: rewritten request")
-
-		mm.debugMDNS(&msg)
-
-		ret, err := msg.Pack()
-		if err != nil {
-			L(mm).Warn("failed to pack MDNS packet", "err", err)
-			return pkt
-		}
-
-		return ret
-	}
-
-	return pkt
-}
-
-func (mm *MDNSManager) deadRun() {
-	for {
-		select {
-		case <-mm.inbox:
-		case <-mm.ctx.Done():
-			return
-		}
-	}
-}
-
 func (mm *MDNSManager) Close() {
 	mm.rlStore.Close(context.Background())
 }
@@ -0,0 +1,70 @@
+package actors
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/internal/netnstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestMDNSManagerInjectIPv6(t *testing.T) {
+	netnstest.Run(t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// A veth stands in for the overlay interface, as a TUN device has no carrier without wireguard.
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ov0"}, PeerName: "ov0p"}))
+
+		ov0, err := netlink.LinkByName("ov0")
+		require.NoError(t, err)
+		ov0p, err := netlink.LinkByName("ov0p")
+		require.NoError(t, err)
+
+		addr, err := netlink.ParseAddr("fd00::1/64")
+		require.NoError(t, err)
+		addr.Flags = unix.IFA_F_NODAD
+		require.NoError(t, netlink.AddrAdd(ov0, addr))
+		require.NoError(t, netlink.LinkSetUp(ov0))
+		require.NoError(t, netlink.LinkSetUp(ov0p))
+
+		wgIf, err := net.InterfaceByName("ov0")
+		require.NoError(t, err)
+
+		s := &Stage{Ctx: ctx, wgIf: wgIf}
+		s.control = &MockControl{
+			ipv4: func() netip.Prefix { return netip.MustParsePrefix("100.64.0.1/10") },
+			ipv6: func() netip.Prefix { return netip.MustParsePrefix("fd00::1/64") },
+		}
+
+		mm := s.makeMM()
+		mm.setupSockets()
+
+		require.NotNil(t, mm.b6Sock)
+		require.Equal(t, wgIf, mm.overlay6)
+
+		local, err := net.ListenMulticastUDP("udp6", wgIf, net.UDPAddrFromAddrPort(ip6MDNSBroadcastAP))
+		require.NoError(t, err)
+		defer local.Close()
+
+		pkt := []byte("not really mdns")
+
+		// The multicast route of the interface comes up shortly after it.
+		require.Eventually(t, func() bool {
+			return mm.injectVia(pkt, true) == nil
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, local.SetReadDeadline(time.Now().Add(time.Second)))
+
+		buf := make([]byte, 64)
+		n, _, err := local.ReadFromUDPAddrPort(buf)
+		require.NoError(t, err)
+		assert.Equal(t, pkt, buf[:n])
+	})
+}
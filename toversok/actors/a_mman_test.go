@@ -0,0 +1,119 @@
+package actors
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/internal/netnstest"
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/stage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSManagerSockets(t *testing.T) {
+	netnstest.Run(t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := &Stage{Ctx: ctx}
+		s.control = &MockControl{
+			ipv4: func() netip.Prefix { return netip.MustParsePrefix("100.64.0.1/10") },
+			ipv6: func() netip.Prefix { return netip.MustParsePrefix("fd00::1/64") },
+		}
+
+		mm := s.makeMM()
+		mm.setupSockets()
+
+		require.NotNil(t, mm.b4Sock)
+		require.NotNil(t, mm.b6Sock)
+		require.NotNil(t, mm.u4Sock)
+		require.NotNil(t, mm.u6Sock)
+		assert.Contains(t, mm.localAddrs, netip.MustParseAddr("::1"))
+
+		// Packets are injected over the other IP version if needed; linux cannot send IPv6 multicast over loopback.
+		pkt := []byte("not really mdns")
+		require.NoError(t, mm.inject(pkt, true))
+
+		select {
+		case frame := <-mm.b4Sock.outCh:
+			assert.Equal(t, pkt, frame.pkt)
+		case frame := <-mm.b6Sock.outCh:
+			assert.Equal(t, pkt, frame.pkt)
+		case <-time.After(time.Second):
+			t.Fatal("injected packet was not received")
+		}
+
+		// Stopped sockets are created again.
+		old := mm.b4Sock
+		old.Cancel()
+
+		select {
+		case _, ok := <-old.outCh:
+			require.False(t, ok)
+			mm.handleSockFrame(&mm.b4Sock, RecvFrame{}, ok)
+		case <-time.After(time.Second):
+			t.Fatal("stopped socket was not closed")
+		}
+
+		assert.Nil(t, mm.b4Sock)
+		assert.Nil(t, mm.pc4)
+
+		mm.setupSockets()
+
+		require.NotNil(t, mm.b4Sock)
+		assert.NotSame(t, old, mm.b4Sock)
+		assert.NotNil(t, mm.pc4)
+	})
+}
+
+// recordingInjector records the packets injected into it.
+type recordingInjector struct {
+	from, to netip.AddrPort
+	pkt      []byte
+}
+
+func (r *recordingInjector) Available() bool {
+	return true
+}
+
+func (r *recordingInjector) InjectPacket(from, to netip.AddrPort, pkt []byte) error {
+	r.from, r.to, r.pkt = from, to, pkt
+	return nil
+}
+
+func (r *recordingInjector) InjectICMPv6(netip.Addr, netip.Addr, uint8, uint8, []byte) error {
+	return nil
+}
+
+func TestMDNSManagerInjectFrom(t *testing.T) {
+	peer := key.NewNode().Public()
+	inj := &recordingInjector{}
+
+	s := &Stage{
+		Ctx: context.Background(),
+		peerInfo: map[key.NodePublic]*stage.PeerInfo{
+			peer: {IPv4: netip.MustParseAddr("100.64.0.2"), IPv6: netip.MustParseAddr("fd00::2")},
+		},
+	}
+	mm := &MDNSManager{s: s}
+
+	assert.ErrorIs(t, mm.injectFrom(peer, nil, false), errNoInjector)
+
+	s.injector = inj
+
+	pkt := []byte("not really mdns")
+
+	require.NoError(t, mm.injectFrom(peer, pkt, false))
+	assert.Equal(t, netip.MustParseAddrPort("100.64.0.2:5353"), inj.from)
+	assert.Equal(t, ip4MDNSBroadcastAP, inj.to)
+	assert.Equal(t, pkt, inj.pkt)
+
+	require.NoError(t, mm.injectFrom(peer, pkt, true))
+	assert.Equal(t, netip.MustParseAddrPort("[fd00::2]:5353"), inj.from)
+	assert.Equal(t, ip6MDNSBroadcastAP, inj.to)
+
+	assert.Error(t, mm.injectFrom(key.NewNode().Public(), pkt, false))
+}
@@ -119,16 +119,37 @@ func (c *RestartableRelayConn) establish() (success bool) {
 		port = types.PtrOr(c.config.HTTPSPort, 0)
 	}
 
-	var err error
-	c.client, err = c.man.s.dialRelayFunc(c.ctx, dial.Opts{
+	opts := dial.Opts{
 		Domain:       c.config.Domain,
 		Addrs:        types.SliceOrNil(c.config.IPs),
 		Port:         port,
 		TLS:          !c.config.IsInsecure,
 		ExpectCertCN: types.PtrOr(c.config.CertCN, c.config.Domain),
+		WebSocket:    c.config.UseWebSocket,
 		// Connect and establishment timeouts are default
 		// TODO maybe allow Control to tweak this setting?
-	}, c.man.s.getNodePriv, c.config.Key)
+	}
+
+	var (
+		client relay.Client
+		err    error
+	)
+
+	if c.config.QUICPort != nil && c.man.s.dialRelayQUICFunc != nil {
+		quicOpts := opts
+		quicOpts.Port = *c.config.QUICPort
+
+		if client, err = c.man.s.dialRelayQUICFunc(c.ctx, quicOpts, c.man.s.getNodePriv, c.config.Key); err != nil {
+			c.L().Info("failed to establish quic connection to relay, falling back", "error", err)
+			client = nil
+		}
+	}
+
+	if client == nil {
+		client, err = c.man.s.dialRelayFunc(c.ctx, opts, c.man.s.getNodePriv, c.config.Key)
+	}
+
+	c.client = client
 
 	if err != nil {
 		c.L().Warn("failed to establish connection to relay", "error", err)
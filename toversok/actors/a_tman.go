@@ -32,6 +32,14 @@ type TrafficManager struct {
 
 	// an opportunistic map that caches session-to-node mapping
 	sessMap map[key.SessionPublic]key.NodePublic
+
+	// sideBand queues side-band data for the handler of the stage, see runSideBand.
+	sideBand chan receivedSideBand
+}
+
+type receivedSideBand struct {
+	peer key.NodePublic
+	data *msgsess.SideBandData
 }
 
 func (s *Stage) makeTM() *TrafficManager {
@@ -47,6 +55,8 @@ func (s *Stage) makeTM() *TrafficManager {
 		activeOut: make(map[key.NodePublic]bool),
 		activeIn:  make(map[key.NodePublic]bool),
 		sessMap:   make(map[key.SessionPublic]key.NodePublic),
+
+		sideBand: make(chan receivedSideBand, TrafficManSideBandChLen),
 	})
 }
 
@@ -64,6 +74,8 @@ func (tm *TrafficManager) Run() {
 		}
 	}()
 
+	go tm.runSideBand()
+
 	for {
 		select {
 
@@ -126,6 +138,11 @@ func (tm *TrafficManager) Handle(m msgactor.ActorMessage) {
 			return
 		}
 
+		if sbd, ok := m.Msg.Message.(*msgsess.SideBandData); ok {
+			tm.receiveSideBand(node, sbd)
+			return
+		}
+
 		tm.forState(node, func(s peerstate.PeerState) peerstate.PeerState {
 			return s.OnDirect(types.NormaliseAddrPort(m.AddrPort), m.Msg)
 		})
@@ -145,6 +162,11 @@ func (tm *TrafficManager) Handle(m msgactor.ActorMessage) {
 			return
 		}
 
+		if sbd, ok := m.Msg.Message.(*msgsess.SideBandData); ok {
+			tm.receiveSideBand(m.Peer, sbd)
+			return
+		}
+
 		tm.forState(m.Peer, func(s peerstate.PeerState) peerstate.PeerState {
 			return s.OnRelay(m.Relay, m.Peer, m.Msg)
 		})
@@ -166,8 +188,10 @@ func (tm *TrafficManager) Handle(m msgactor.ActorMessage) {
 				return key == m.Peer
 			})
 		}
-	case *msgactor.TManSpreadMDNSPacket:
-		tm.spreadMDNS(m.Pkt, m.IP6)
+	case *msgactor.TManSendMDNSPacket:
+		tm.sendMDNSTo(m.To, m.Pkt, m.IP6)
+	case *msgactor.TManSendSideBandData:
+		tm.opportunisticSendTo(m.To, m.Data)
 	default:
 		tm.logUnknownMessage(m)
 	}
@@ -203,15 +227,13 @@ func (tm *TrafficManager) sendMDNS(peer key.NodePublic, msg *msgsess.ClearMessag
 	})
 }
 
-func (tm *TrafficManager) spreadMDNS(pkt []byte, ip6 bool) {
-	peers := tm.s.GetPeersWhere(func(_ key.NodePublic, info *stage.PeerInfo) bool {
-		return info.MDNS
-	})
+func (tm *TrafficManager) sendMDNSTo(peer key.NodePublic, pkt []byte, ip6 bool) {
+	if !tm.mdnsAllowed(peer) {
+		L(tm).Log(context.Background(), types.LevelTrace, "not sending mdns packet to peer where it is not allowed", "peer", peer.Debug())
+		return
+	}
 
-	peersDebug := types.Map(peers, func(t key.NodePublic) string {
-		return t.Debug()
-	})
-	L(tm).Log(context.Background(), types.LevelTrace, "sending mdns packet to peers", "peers", peersDebug)
+	L(tm).Log(context.Background(), types.LevelTrace, "sending mdns packet to peer", "peer", peer.Debug())
 
 	var t msgsess.SideBandDataType
 	if ip6 {
@@ -220,11 +242,45 @@ func (tm *TrafficManager) spreadMDNS(pkt []byte, ip6 bool) {
 		t = msgsess.MDNSv4Type
 	}
 
-	for _, peer := range peers {
-		tm.opportunisticSendTo(peer, &msgsess.SideBandData{
-			Type: t,
-			Data: pkt,
-		})
+	tm.opportunisticSendTo(peer, &msgsess.SideBandData{
+		Type: t,
+		Data: pkt,
+	})
+}
+
+// receiveSideBand queues side-band data of application-defined types for the handler of the stage.
+//
+// Data is dropped while the queue is full, as peers could otherwise hold up the TrafficManager.
+func (tm *TrafficManager) receiveSideBand(peer key.NodePublic, sbd *msgsess.SideBandData) {
+	if !sbd.Type.IsApplication() {
+		L(tm).Debug("got side-band data of unknown type from peer", "peer", peer.Debug(), "type", sbd.Type)
+		return
+	}
+
+	if tm.s.sideBandHandler == nil {
+		L(tm).Log(context.Background(), types.LevelTrace, "dropping side-band data without handler", "peer", peer.Debug(), "type", sbd.Type)
+		return
+	}
+
+	select {
+	case tm.sideBand <- receivedSideBand{peer, sbd}:
+	default:
+		L(tm).Debug("dropping side-band data, handler is behind", "peer", peer.Debug(), "type", sbd.Type)
+	}
+}
+
+// runSideBand hands the queued side-band data to the handler of the stage, one at a time, until the TrafficManager
+// is done.
+func (tm *TrafficManager) runSideBand() {
+	for {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case r := <-tm.sideBand:
+			if h := tm.s.sideBandHandler; h != nil {
+				h(r.peer, r.data)
+			}
+		}
 	}
 }
 
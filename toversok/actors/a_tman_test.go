@@ -3,9 +3,11 @@ package actors
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgactor"
+	"github.com/edup2p/common/types/msgsess"
 	"github.com/edup2p/common/types/stage"
 	"github.com/stretchr/testify/assert"
 )
@@ -61,3 +63,60 @@ func TestTrafficManager(t *testing.T) {
 	assert.Equal(t, syncMsg, receivedSyncMsg, "TrafficManager did not correctly forward SyncPeerInfo message to OutConn")
 	assert.Eventually(t, func() bool { return tm.sessMap[testPub] == syncMsg.Peer }, assertEventuallyTimeout, assertEventuallyTick, "TrafficManager's cachedMap is incorrect")
 }
+
+func TestTrafficManagerSideBand(t *testing.T) {
+	s := &Stage{
+		Ctx: context.TODO(),
+	}
+
+	s.peerInfo = map[key.NodePublic]*stage.PeerInfo{dummyKey: {Session: testPub}}
+
+	type received struct {
+		peer key.NodePublic
+		data *msgsess.SideBandData
+	}
+
+	got := make(chan received, 2)
+	s.SetSideBandHandler(func(peer key.NodePublic, data *msgsess.SideBandData) {
+		got <- received{peer, data}
+	})
+
+	tm := s.makeTM()
+	go tm.Run()
+
+	for _, typ := range []msgsess.SideBandDataType{msgsess.FirstApplicationType - 1, msgsess.FirstApplicationType} {
+		tm.Handle(&msgactor.TManSessionMessageFromRelay{
+			Peer: dummyKey,
+			Msg: &msgsess.ClearMessage{
+				Session: testPub,
+				Message: &msgsess.SideBandData{Type: typ, Data: []byte("hello")},
+			},
+		})
+	}
+
+	select {
+	case r := <-got:
+		assert.Equal(t, dummyKey, r.peer)
+		assert.Equal(t, msgsess.FirstApplicationType, r.data.Type, "only side-band data of application types should be handled")
+		assert.Equal(t, []byte("hello"), r.data.Data)
+	case <-time.After(assertEventuallyTimeout):
+		t.Fatal("side-band data was not handled")
+	}
+
+	// Data beyond the queue is dropped while the handler is behind, instead of piling up.
+	block := make(chan struct{})
+	defer close(block)
+
+	s.SetSideBandHandler(func(key.NodePublic, *msgsess.SideBandData) {
+		<-block
+	})
+
+	for range TrafficManSideBandChLen + 2 {
+		tm.receiveSideBand(dummyKey, &msgsess.SideBandData{Type: msgsess.FirstApplicationType})
+	}
+
+	assert.Len(t, tm.sideBand, TrafficManSideBandChLen)
+
+	assert.ErrorIs(t, s.SendSideBand(dummyKey, &msgsess.SideBandData{Type: msgsess.MDNSv4Type}), errNotApplicationSideBand)
+	assert.ErrorIs(t, s.SendSideBand(key.NewNode().Public(), &msgsess.SideBandData{Type: msgsess.FirstApplicationType}), errUnknownPeer)
+}
@@ -17,6 +17,9 @@ const (
 	DirectRouterInboxChLen = 4
 	MdnsManInboxChLen      = 32
 
+	// TrafficManSideBandChLen bounds the side-band data waiting for the handler of the stage; more is dropped.
+	TrafficManSideBandChLen = 64
+
 	// Frame
 	SockRecvFrameChanBuffer = 256
 	InConnFrameChanBuffer   = 512
@@ -0,0 +1,380 @@
+package actors
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsCacheFlush is the cache-flush bit in the class of mDNS records, see RFC 6762, section 10.2.
+const mdnsCacheFlush dnsmessage.Class = 1 << 15
+
+// mdnsServicesName is the name under which DNS-SD enumerates all service types, see RFC 6763, section 9.
+const mdnsServicesName = "_services._dns-sd._udp.local."
+
+// mdnsDomain is the domain of all mDNS names.
+const mdnsDomain = ".local."
+
+// maxCachedRecords bounds the records kept of each peer; the oldest ones are dropped beyond it.
+const maxCachedRecords = 256
+
+// serviceTypeOf returns the DNS-SD service type (e.g. "_ipp._tcp") that name belongs to,
+// such as services, subtypes, and service instances, or an empty string if it belongs to none.
+func serviceTypeOf(name dnsmessage.Name) string {
+	s := strings.ToLower(name.String())
+
+	if s == mdnsServicesName || !strings.HasSuffix(s, mdnsDomain) {
+		return ""
+	}
+
+	labels := strings.Split(strings.TrimSuffix(s, mdnsDomain), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+
+	st := labels[len(labels)-2] + "." + labels[len(labels)-1]
+	if !msgcontrol.IsServiceType(st) {
+		return ""
+	}
+
+	return st
+}
+
+// resourceServiceType returns the service type a record describes,
+// or an empty string for records of no service, such as those of addresses.
+func resourceServiceType(res *dnsmessage.Resource) string {
+	if ptr, ok := res.Body.(*dnsmessage.PTRResource); ok && strings.EqualFold(res.Header.Name.String(), mdnsServicesName) {
+		return serviceTypeOf(ptr.PTR)
+	}
+
+	return serviceTypeOf(res.Header.Name)
+}
+
+// serviceAllowed returns whether records of service type st may be shared, given the allowed service types.
+//
+// All are allowed if allowed is empty, otherwise records of no service type are not.
+func serviceAllowed(allowed []string, st string) bool {
+	return len(allowed) == 0 || slices.ContainsFunc(allowed, func(a string) bool {
+		return strings.EqualFold(a, st)
+	})
+}
+
+// cloneMessage copies msg, so that its sections can be filtered without affecting msg.
+func cloneMessage(msg *dnsmessage.Message) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:      msg.Header,
+		Questions:   slices.Clone(msg.Questions),
+		Answers:     slices.Clone(msg.Answers),
+		Authorities: slices.Clone(msg.Authorities),
+		Additionals: slices.Clone(msg.Additionals),
+	}
+}
+
+// filterServices removes the questions and records of service types which are not allowed from msg,
+// and returns whether anything is left.
+//
+// Of the records of no service type, only the addresses of the hosts of allowed services are kept.
+func filterServices(msg *dnsmessage.Message, allowed []string) bool {
+	if len(allowed) > 0 {
+		msg.Questions = slices.DeleteFunc(msg.Questions, func(q dnsmessage.Question) bool {
+			return !serviceAllowed(allowed, serviceTypeOf(q.Name))
+		})
+
+		sections := []*[]dnsmessage.Resource{&msg.Answers, &msg.Authorities, &msg.Additionals}
+		hosts := make(map[string]bool)
+
+		for _, section := range sections {
+			*section = slices.DeleteFunc(*section, func(res dnsmessage.Resource) bool {
+				st := resourceServiceType(&res)
+				if st == "" {
+					return false
+				}
+
+				if !serviceAllowed(allowed, st) {
+					return true
+				}
+
+				if srv, ok := res.Body.(*dnsmessage.SRVResource); ok {
+					hosts[strings.ToLower(srv.Target.String())] = true
+				}
+
+				return false
+			})
+		}
+
+		for _, section := range sections {
+			*section = slices.DeleteFunc(*section, func(res dnsmessage.Resource) bool {
+				if resourceServiceType(&res) != "" {
+					return false
+				}
+
+				_, isAddr := resourceAddr(&res)
+
+				return !isAddr || !hosts[strings.ToLower(res.Header.Name.String())]
+			})
+		}
+	}
+
+	return len(msg.Questions)+len(msg.Answers)+len(msg.Authorities)+len(msg.Additionals) > 0
+}
+
+// rewriteLocal makes the records of local hosts in msg point at this node in the overlay;
+// their addresses become addr4 and addr6, and if host is set, their name becomes host, also as target of SRV records.
+//
+// Other addresses of local hosts (such as link-local ones) are removed, as peers cannot reach them.
+func rewriteLocal(msg *dnsmessage.Message, isLocal func(netip.Addr) bool, addr4, addr6 netip.Addr, host dnsmessage.Name) (dirty bool) {
+	localHosts := make(map[string]bool)
+
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, res := range section {
+			if addr, ok := resourceAddr(&res); ok && isLocal(addr) {
+				localHosts[strings.ToLower(res.Header.Name.String())] = true
+			}
+		}
+	}
+
+	if len(localHosts) == 0 {
+		return false
+	}
+
+	isLocalHost := func(name dnsmessage.Name) bool {
+		return localHosts[strings.ToLower(name.String())]
+	}
+
+	for _, section := range []*[]dnsmessage.Resource{&msg.Answers, &msg.Authorities, &msg.Additionals} {
+		rewritten := make([]dnsmessage.Resource, 0, len(*section))
+
+		for _, res := range *section {
+			if srv, ok := res.Body.(*dnsmessage.SRVResource); ok && host.Length > 0 && isLocalHost(srv.Target) {
+				res.Body = &dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: host}
+			}
+
+			addr, ok := resourceAddr(&res)
+			if !ok || !isLocalHost(res.Header.Name) {
+				rewritten = append(rewritten, res)
+				continue
+			}
+
+			if !isLocal(addr) {
+				continue
+			}
+
+			if host.Length > 0 {
+				res.Header.Name = host
+			}
+
+			res.Header.Class |= mdnsCacheFlush
+
+			if addr.Is4() {
+				res.Body = &dnsmessage.AResource{A: addr4.As4()}
+			} else {
+				res.Body = &dnsmessage.AAAAResource{AAAA: addr6.As16()}
+			}
+
+			// Multiple local addresses all become the same overlay address.
+			if !slices.ContainsFunc(rewritten, func(r dnsmessage.Resource) bool { return sameRecord(&r, &res) }) {
+				rewritten = append(rewritten, res)
+			}
+		}
+
+		*section = rewritten
+	}
+
+	return true
+}
+
+// resourceAddr returns the address of an A or AAAA record.
+func resourceAddr(res *dnsmessage.Resource) (netip.Addr, bool) {
+	switch body := res.Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A), true
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA).Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// sameRecord returns whether a and b are the same record, apart from their TTLs and cache-flush bits.
+func sameRecord(a, b *dnsmessage.Resource) bool {
+	return a.Header.Type == b.Header.Type &&
+		a.Header.Class&^mdnsCacheFlush == b.Header.Class&^mdnsCacheFlush &&
+		strings.EqualFold(a.Header.Name.String(), b.Header.Name.String()) &&
+		a.Body.GoString() == b.Body.GoString()
+}
+
+// serviceCache keeps the mDNS records received from peers, to answer local queries without asking all peers again.
+//
+// Only records describing services and their hosts are kept, up to maxCachedRecords of each peer.
+type serviceCache struct {
+	records map[key.NodePublic][]cachedRecord
+}
+
+type cachedRecord struct {
+	res      dnsmessage.Resource
+	received time.Time
+	expires  time.Time
+}
+
+func newServiceCache() *serviceCache {
+	return &serviceCache{records: make(map[key.NodePublic][]cachedRecord)}
+}
+
+// remaining returns the TTL a record has left at now.
+func (r *cachedRecord) remaining(now time.Time) uint32 {
+	return uint32((r.expires.Sub(now) + time.Second - 1) / time.Second)
+}
+
+func cacheable(t dnsmessage.Type) bool {
+	switch t {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypePTR, dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+		return true
+	default:
+		return false
+	}
+}
+
+// add caches the records of a response from peer, replacing the ones it sent before.
+//
+// Records with a TTL of 0 are goodbyes, and are removed instead,
+// and records with the cache-flush bit set replace all others of their name and type, see RFC 6762, section 10.2.
+//
+// Beyond maxCachedRecords, the records of peer received longest ago are dropped.
+func (c *serviceCache) add(peer key.NodePublic, records []dnsmessage.Resource, now time.Time) {
+	cached := c.records[peer]
+
+	for _, res := range records {
+		if res.Header.Class&mdnsCacheFlush == 0 {
+			continue
+		}
+
+		// Records received within the last second are part of the same set, and are kept.
+		cached = slices.DeleteFunc(cached, func(r cachedRecord) bool {
+			return r.res.Header.Type == res.Header.Type &&
+				strings.EqualFold(r.res.Header.Name.String(), res.Header.Name.String()) &&
+				now.Sub(r.received) > time.Second
+		})
+	}
+
+	for _, res := range records {
+		if !cacheable(res.Header.Type) {
+			continue
+		}
+
+		cached = slices.DeleteFunc(cached, func(r cachedRecord) bool { return sameRecord(&r.res, &res) })
+
+		if res.Header.TTL == 0 {
+			continue
+		}
+
+		cached = append(cached, cachedRecord{
+			res:      res,
+			received: now,
+			expires:  now.Add(time.Duration(res.Header.TTL) * time.Second),
+		})
+	}
+
+	// Records are appended as they are received, so the oldest ones are in front.
+	if len(cached) > maxCachedRecords {
+		cached = slices.Delete(cached, 0, len(cached)-maxCachedRecords)
+	}
+
+	if len(cached) == 0 {
+		delete(c.records, peer)
+	} else {
+		c.records[peer] = cached
+	}
+}
+
+// forget removes all records of peer.
+func (c *serviceCache) forget(peer key.NodePublic) {
+	delete(c.records, peer)
+}
+
+// expire removes all records which expired at now.
+func (c *serviceCache) expire(now time.Time) {
+	for peer, cached := range c.records {
+		cached = slices.DeleteFunc(cached, func(r cachedRecord) bool { return !now.Before(r.expires) })
+
+		if len(cached) == 0 {
+			delete(c.records, peer)
+		} else {
+			c.records[peer] = cached
+		}
+	}
+}
+
+// lookup returns the unexpired records of name and type (or of all types with dnsmessage.TypeALL),
+// of which include returns true, with their remaining TTLs.
+//
+// fresh is set when all of them have more than half of their TTL left, after which RFC 6762 has queriers ask again.
+func (c *serviceCache) lookup(name dnsmessage.Name, t dnsmessage.Type, now time.Time, include func(key.NodePublic, *dnsmessage.Resource) bool) (records []dnsmessage.Resource, fresh bool) {
+	fresh = true
+
+	for peer, cached := range c.records {
+		for _, r := range cached {
+			if !now.Before(r.expires) || (t != dnsmessage.TypeALL && r.res.Header.Type != t) ||
+				!strings.EqualFold(r.res.Header.Name.String(), name.String()) || !include(peer, &r.res) {
+				continue
+			}
+
+			res := r.res
+			res.Header.TTL = r.remaining(now)
+
+			if res.Header.TTL*2 <= r.res.Header.TTL {
+				fresh = false
+			}
+
+			records = append(records, res)
+		}
+	}
+
+	return records, fresh
+}
+
+// answer returns the cached records answering q, with additional records describing them (RFC 6763, section 12),
+// and whether the answers are fresh, see lookup.
+func (c *serviceCache) answer(q dnsmessage.Question, now time.Time, include func(key.NodePublic, *dnsmessage.Resource) bool) (answers, additionals []dnsmessage.Resource, fresh bool) {
+	answers, fresh = c.lookup(q.Name, q.Type, now, include)
+
+	addUnique := func(records []dnsmessage.Resource) {
+		for _, res := range records {
+			known := func(r dnsmessage.Resource) bool { return sameRecord(&r, &res) }
+
+			if !slices.ContainsFunc(answers, known) && !slices.ContainsFunc(additionals, known) {
+				additionals = append(additionals, res)
+			}
+		}
+	}
+
+	// Additionals are appended to while iterating, to describe the targets of the SRV records added for PTR records.
+	describe := func(res dnsmessage.Resource) {
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			for _, t := range []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT} {
+				records, _ := c.lookup(body.PTR, t, now, include)
+				addUnique(records)
+			}
+		case *dnsmessage.SRVResource:
+			for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+				records, _ := c.lookup(body.Target, t, now, include)
+				addUnique(records)
+			}
+		}
+	}
+
+	for _, res := range answers {
+		describe(res)
+	}
+
+	for i := 0; i < len(additionals); i++ {
+		describe(additionals[i])
+	}
+
+	return answers, additionals, fresh
+}
@@ -0,0 +1,217 @@
+package actors
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func ptrRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 4500},
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(target)},
+	}
+}
+
+func srvRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: 120},
+		Body:   &dnsmessage.SRVResource{Port: 631, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func aRecord(name, addr string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: 120},
+		Body:   &dnsmessage.AResource{A: netip.MustParseAddr(addr).As4()},
+	}
+}
+
+func aaaaRecord(name, addr string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: 120},
+		Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr(addr).As16()},
+	}
+}
+
+func recordNames(records []dnsmessage.Resource) []string {
+	var ret []string
+	for _, r := range records {
+		ret = append(ret, r.Header.Type.String()+" "+r.Header.Name.String())
+	}
+	return ret
+}
+
+func TestServiceTypeOf(t *testing.T) {
+	for name, want := range map[string]string{
+		"_ipp._tcp.local.":                    "_ipp._tcp",
+		"Office Printer._IPP._tcp.local.":     "_ipp._tcp",
+		"_universal._sub._ipp._tcp.local.":    "_ipp._tcp",
+		"_services._dns-sd._udp.local.":       "",
+		"printer.local.":                      "",
+		"_ipp._tcp.example.com.":              "",
+		"Speaker._raop._tcp.local.":           "_raop._tcp",
+		"1.0.168.192.in-addr.arpa.":           "",
+		"_spotify-connect._tcp.local.":        "_spotify-connect._tcp",
+		"Living Room._googlecast._tcp.local.": "_googlecast._tcp",
+	} {
+		assert.Equal(t, want, serviceTypeOf(dnsmessage.MustNewName(name)), name)
+	}
+
+	meta := ptrRecord(mdnsServicesName, "_ipp._tcp.local.")
+	assert.Equal(t, "_ipp._tcp", resourceServiceType(&meta))
+}
+
+func TestFilterServices(t *testing.T) {
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			ptrRecord(mdnsServicesName, "_ipp._tcp.local."),
+			ptrRecord(mdnsServicesName, "_ssh._tcp.local."),
+			ptrRecord("_ipp._tcp.local.", "Printer._ipp._tcp.local."),
+			ptrRecord("_ssh._tcp.local.", "Host._ssh._tcp.local."),
+		},
+		Additionals: []dnsmessage.Resource{
+			srvRecord("Printer._ipp._tcp.local.", "host.local."),
+			srvRecord("Host._ssh._tcp.local.", "host.local."),
+			aRecord("host.local.", "192.168.1.2"),
+			aRecord("other.local.", "192.168.1.3"),
+		},
+	}
+
+	all := cloneMessage(msg)
+	require.True(t, filterServices(all, nil))
+	assert.Equal(t, msg, all, "no allowed services should allow all")
+
+	require.True(t, filterServices(msg, []string{"_IPP._tcp"}))
+	assert.Equal(t, []string{
+		"TypePTR _services._dns-sd._udp.local.",
+		"TypePTR _ipp._tcp.local.",
+	}, recordNames(msg.Answers))
+	assert.Equal(t, []string{
+		"TypeSRV Printer._ipp._tcp.local.",
+		"TypeA host.local.",
+	}, recordNames(msg.Additionals), "only the hosts of allowed services should be kept")
+
+	query := &dnsmessage.Message{Questions: []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName("_ssh._tcp.local."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("other.local."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+	}}
+	assert.False(t, filterServices(query, []string{"_ipp._tcp"}))
+
+	hosts := &dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("other.local.", "192.168.1.3")}}
+	assert.False(t, filterServices(hosts, []string{"_ipp._tcp"}), "hosts of no allowed service should not be shared")
+}
+
+func TestRewriteLocal(t *testing.T) {
+	local := netip.MustParseAddr("192.168.1.2")
+	isLocal := func(addr netip.Addr) bool { return addr == local || addr.IsLoopback() }
+
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			ptrRecord("_ipp._tcp.local.", "Printer._ipp._tcp.local."),
+		},
+		Additionals: []dnsmessage.Resource{
+			srvRecord("Printer._ipp._tcp.local.", "host.local."),
+			srvRecord("Other._ipp._tcp.local.", "other.local."),
+			aRecord("host.local.", "192.168.1.2"),
+			aRecord("host.local.", "127.0.0.1"),
+			aaaaRecord("host.local.", "fe80::2"),
+			aRecord("other.local.", "192.168.1.3"),
+		},
+	}
+
+	addr4 := netip.MustParseAddr("100.64.0.2")
+	addr6 := netip.MustParseAddr("fd00::2")
+
+	require.True(t, rewriteLocal(msg, isLocal, addr4, addr6, dnsmessage.MustNewName("laptop.local.")))
+
+	assert.Equal(t, "laptop.local.", msg.Additionals[0].Body.(*dnsmessage.SRVResource).Target.String())
+	assert.Equal(t, "other.local.", msg.Additionals[1].Body.(*dnsmessage.SRVResource).Target.String())
+
+	addrs := msg.Additionals[2:]
+	require.Len(t, addrs, 2, "local addresses should be merged, and link-local addresses dropped")
+	assert.Equal(t, "laptop.local.", addrs[0].Header.Name.String())
+	assert.Equal(t, addr4.As4(), addrs[0].Body.(*dnsmessage.AResource).A)
+	assert.NotZero(t, addrs[0].Header.Class&mdnsCacheFlush)
+	assert.Equal(t, "other.local.", addrs[1].Header.Name.String(), "records of other hosts are left alone")
+
+	none := &dnsmessage.Message{Additionals: []dnsmessage.Resource{aRecord("other.local.", "192.168.1.3")}}
+	assert.False(t, rewriteLocal(none, isLocal, addr4, addr6, dnsmessage.Name{}))
+}
+
+func TestServiceCache(t *testing.T) {
+	peer1 := key.NewNode().Public()
+	peer2 := key.NewNode().Public()
+	all := func(key.NodePublic, *dnsmessage.Resource) bool { return true }
+
+	now := time.Now()
+	c := newServiceCache()
+
+	c.add(peer1, []dnsmessage.Resource{
+		ptrRecord("_ipp._tcp.local.", "Printer._ipp._tcp.local."),
+		srvRecord("Printer._ipp._tcp.local.", "laptop.local."),
+		aRecord("laptop.local.", "100.64.0.2"),
+	}, now)
+	c.add(peer2, []dnsmessage.Resource{
+		ptrRecord("_ipp._tcp.local.", "Scanner._ipp._tcp.local."),
+	}, now)
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("_ipp._tcp.local."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+
+	answers, additionals, fresh := c.answer(q, now.Add(time.Minute), all)
+	assert.Len(t, answers, 2)
+	assert.ElementsMatch(t, []string{"TypeSRV Printer._ipp._tcp.local.", "TypeA laptop.local."}, recordNames(additionals))
+	assert.True(t, fresh)
+
+	for _, add := range additionals {
+		assert.Equal(t, uint32(60), add.Header.TTL, "TTLs should count down")
+	}
+
+	answers, _, _ = c.answer(q, now, func(p key.NodePublic, _ *dnsmessage.Resource) bool { return p == peer2 })
+	assert.Equal(t, []string{"TypePTR _ipp._tcp.local."}, recordNames(answers))
+	assert.Equal(t, "Scanner._ipp._tcp.local.", answers[0].Body.(*dnsmessage.PTRResource).PTR.String())
+
+	_, _, fresh = c.answer(q, now.Add(3000*time.Second), all)
+	assert.False(t, fresh, "answers past half their TTL are not fresh")
+
+	// Cache-flush records replace older ones of the same name.
+	c.add(peer1, []dnsmessage.Resource{aRecord("laptop.local.", "100.64.0.3")}, now.Add(2*time.Second))
+	addrs, _ := c.lookup(dnsmessage.MustNewName("laptop.local."), dnsmessage.TypeA, now.Add(2*time.Second), all)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, netip.MustParseAddr("100.64.0.3").As4(), addrs[0].Body.(*dnsmessage.AResource).A)
+
+	// Goodbyes remove records.
+	bye := ptrRecord("_ipp._tcp.local.", "Scanner._ipp._tcp.local.")
+	bye.Header.TTL = 0
+	c.add(peer2, []dnsmessage.Resource{bye}, now)
+	assert.NotContains(t, c.records, peer2)
+
+	c.expire(now.Add(200 * time.Second))
+	answers, _, _ = c.answer(q, now.Add(200*time.Second), all)
+	assert.Len(t, answers, 1, "PTR records outlive the SRV and A records")
+	assert.Len(t, c.records[peer1], 1)
+}
+
+func TestServiceCacheLimit(t *testing.T) {
+	peer := key.NewNode().Public()
+	now := time.Now()
+	c := newServiceCache()
+
+	for i := range maxCachedRecords + 10 {
+		c.add(peer, []dnsmessage.Resource{
+			ptrRecord("_ipp._tcp.local.", fmt.Sprintf("Printer %d._ipp._tcp.local.", i)),
+		}, now)
+	}
+
+	require.Len(t, c.records[peer], maxCachedRecords)
+	assert.Equal(t, "Printer 10._ipp._tcp.local.", c.records[peer][0].res.Body.(*dnsmessage.PTRResource).PTR.String(),
+		"the oldest records should be dropped")
+}
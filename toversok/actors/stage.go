@@ -16,8 +16,10 @@ import (
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgactor"
 	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/edup2p/common/types/msgsess"
 	"github.com/edup2p/common/types/relay"
 	"github.com/edup2p/common/types/relay/relayhttp"
+	"github.com/edup2p/common/types/relay/relayquic"
 	"github.com/edup2p/common/types/stage"
 	"golang.org/x/exp/maps"
 )
@@ -45,9 +47,13 @@ func MakeStage(
 	dialRelayFunc relayhttp.RelayDialFunc,
 
 	wgIf *net.Interface,
+	injector ifaces.Injectable,
 ) ifaces.Stage {
+	var dialRelayQUICFunc relayhttp.RelayDialFunc
+
 	if dialRelayFunc == nil {
 		dialRelayFunc = relayhttp.Dial
+		dialRelayQUICFunc = relayquic.Dial
 	}
 
 	ctx, cancel := context.WithCancel(pCtx)
@@ -72,9 +78,11 @@ func MakeStage(
 		bindLocal: bindLocal,
 		control:   controlSession,
 
-		wgIf: wgIf,
+		wgIf:     wgIf,
+		injector: injector,
 
-		dialRelayFunc: dialRelayFunc,
+		dialRelayFunc:     dialRelayFunc,
+		dialRelayQUICFunc: dialRelayQUICFunc,
 	}
 
 	s.DMan = s.makeDM(s.ext)
@@ -156,6 +164,8 @@ type Stage struct {
 	control ifaces.ControlInterface
 
 	wgIf *net.Interface
+	// injector is nil if packets cannot be injected into the local network stack.
+	injector ifaces.Injectable
 
 	//// A repeatable function to an outside context to acquire a new UDPconn,
 	//// once a peer conn has died for whatever reason.
@@ -169,6 +179,11 @@ type Stage struct {
 	bindLocal func(peer key.NodePublic) types.UDPConn
 
 	dialRelayFunc relayhttp.RelayDialFunc
+	// Optional, nil if QUIC should not be attempted.
+	dialRelayQUICFunc relayhttp.RelayDialFunc
+
+	// Optional, handles side-band data of application-defined types, see SetSideBandHandler.
+	sideBandHandler func(peer key.NodePublic, data *msgsess.SideBandData)
 }
 
 // Start kicks off goroutines for the stage and returns
@@ -509,7 +524,7 @@ func (s *Stage) notifyEndpointChanged() {
 	}
 }
 
-func (s *Stage) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.AddrPort, session key.SessionPublic, ip4, ip6 netip.Addr, prop msgcontrol.Properties) error {
+func (s *Stage) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.AddrPort, session key.SessionPublic, ip4, ip6 netip.Addr, hostname string, routes []netip.Prefix, prop msgcontrol.Properties) error {
 	s.peerInfoMutex.Lock()
 
 	defer func() {
@@ -530,7 +545,10 @@ func (s *Stage) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.
 		Session:             session,
 		IPv4:                ip4,
 		IPv6:                ip6,
+		Hostname:            hostname,
+		Routes:              routes,
 		MDNS:                prop.MDNS,
+		MDNSServices:        prop.MDNSServices,
 	}
 
 	return nil
@@ -538,7 +556,7 @@ func (s *Stage) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.
 
 var errNoPeerInfo = errors.New("could not find peer info to update")
 
-func (s *Stage) UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, prop *msgcontrol.Properties) error {
+func (s *Stage) UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, hostname *string, routes *[]netip.Prefix, prop *msgcontrol.Properties) error {
 	return s.updatePeerInfo(peer, func(info *stage.PeerInfo) {
 		if homeRelay != nil {
 			info.HomeRelay = *homeRelay
@@ -549,8 +567,15 @@ func (s *Stage) UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []ne
 		if session != nil {
 			info.Session = *session
 		}
+		if hostname != nil {
+			info.Hostname = *hostname
+		}
+		if routes != nil {
+			info.Routes = *routes
+		}
 		if prop != nil {
 			info.MDNS = prop.MDNS
+			info.MDNSServices = prop.MDNSServices
 		}
 	})
 }
@@ -641,3 +666,26 @@ func (s *Stage) ControlSTUN() []netip.AddrPort {
 func (s *Stage) Context() context.Context {
 	return s.Ctx
 }
+
+var (
+	errNotApplicationSideBand = errors.New("side-band data type is reserved")
+	errUnknownPeer            = errors.New("unknown peer")
+)
+
+func (s *Stage) SendSideBand(peer key.NodePublic, data *msgsess.SideBandData) error {
+	if !data.Type.IsApplication() {
+		return errNotApplicationSideBand
+	}
+
+	if s.GetPeerInfo(peer) == nil {
+		return errUnknownPeer
+	}
+
+	go SendMessage(s.TMan.Inbox(), &msgactor.TManSendSideBandData{To: peer, Data: data})
+
+	return nil
+}
+
+func (s *Stage) SetSideBandHandler(h func(peer key.NodePublic, data *msgsess.SideBandData)) {
+	s.sideBandHandler = h
+}
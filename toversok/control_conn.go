@@ -51,17 +51,28 @@ type ResumableControlSession struct {
 	ipv4       netip.Prefix
 	ipv6       netip.Prefix
 	expiry     time.Time
+	mtu        int
+	hostname   string
+	domain     string
 	controlKey key.ControlPublic
 
 	session string
 	client  *control.Client
 
+	// controlAddr is the remote address of the last connection to control.
+	controlAddrMu sync.Mutex
+	controlAddr   netip.Addr
+
 	clientOpts dial.Opts
 	getPriv    func() *key.NodePrivate
 	getSess    func() *key.SessionPrivate
 
 	knownPeers map[key.NodePublic]bool
 
+	// routes are the routes advertised to control, which are sent again on every new connection.
+	routesMu sync.Mutex
+	routes   []netip.Prefix
+
 	queueMutex sync.Mutex
 	// Out to control
 	msgOutQueue []msgcontrol.ControlMessage
@@ -93,11 +104,16 @@ func CreateControlSession(ctx context.Context, opts dial.Opts, controlKey key.Co
 		ipv4:       c.IPv4,
 		ipv6:       c.IPv6,
 		expiry:     c.Expiry,
+		mtu:        c.MTU,
+		hostname:   c.Hostname,
+		domain:     c.Domain,
 		controlKey: c.ControlKey,
 
 		session: *c.SessionID,
 		client:  c,
 
+		controlAddr: c.RemoteAddr,
+
 		knownPeers: make(map[key.NodePublic]bool),
 
 		clientOpts: opts,
@@ -241,12 +257,27 @@ func (rcs *ResumableControlSession) Run() {
 				return
 			}
 
+			if rcs.mtu != client.MTU {
+				// The interface is already up, and keeps its MTU until the next session.
+				slog.Warn("control-given MTU is different than cached MTU, ignoring until next session", "cached", rcs.mtu, "given", client.MTU)
+			}
+
+			if rcs.hostname != client.Hostname || rcs.domain != client.Domain {
+				// Peers have already been told our name, we pick up the new one with the next session.
+				slog.Warn("control-given name is different than cached name, ignoring until next session", "cached", rcs.hostname+"."+rcs.domain, "given", client.Hostname+"."+client.Domain)
+			}
+
 			slog.Debug("resumed control connection")
 
 			break
 		}
 
 		rcs.ClearPeers()
+		rcs.resendRoutes()
+
+		rcs.controlAddrMu.Lock()
+		rcs.controlAddr = client.RemoteAddr
+		rcs.controlAddrMu.Unlock()
 
 		rcs.client = client
 
@@ -269,6 +300,8 @@ func (rcs *ResumableControlSession) Handle(msg msgcontrol.ControlMessage) error
 			m.SessKey,
 			m.IPv4,
 			m.IPv6,
+			m.Hostname,
+			m.Routes,
 			m.Properties,
 		)
 	case *msgcontrol.PeerUpdate:
@@ -282,6 +315,8 @@ func (rcs *ResumableControlSession) Handle(msg msgcontrol.ControlMessage) error
 			m.HomeRelay,
 			endpoints,
 			m.SessKey,
+			m.Hostname,
+			m.Routes,
 			m.Properties,
 		)
 	case *msgcontrol.PeerRemove:
@@ -366,6 +401,25 @@ func (rcs *ResumableControlSession) Expiry() time.Time {
 	return rcs.expiry
 }
 
+func (rcs *ResumableControlSession) MTU() int {
+	return rcs.mtu
+}
+
+func (rcs *ResumableControlSession) Hostname() string {
+	return rcs.hostname
+}
+
+func (rcs *ResumableControlSession) Domain() string {
+	return rcs.domain
+}
+
+func (rcs *ResumableControlSession) ControlAddr() netip.Addr {
+	rcs.controlAddrMu.Lock()
+	defer rcs.controlAddrMu.Unlock()
+
+	return rcs.controlAddr
+}
+
 func (rcs *ResumableControlSession) ExpectCallbacks() ifaces.ControlCallbacks {
 	rcs.callbackLock.RLock()
 	defer rcs.callbackLock.RUnlock()
@@ -416,6 +470,24 @@ func (rcs *ResumableControlSession) UpdateHomeRelay(rid int64) error {
 	return rcs.send(&msgcontrol.HomeRelayUpdate{HomeRelay: rid})
 }
 
+func (rcs *ResumableControlSession) UpdateRoutes(routes []netip.Prefix) error {
+	rcs.routesMu.Lock()
+	rcs.routes = routes
+	rcs.routesMu.Unlock()
+
+	return rcs.send(&msgcontrol.RoutesUpdate{Routes: routes})
+}
+
+// resendRoutes queues the advertised routes for a new control connection, which starts out without any.
+func (rcs *ResumableControlSession) resendRoutes() {
+	rcs.routesMu.Lock()
+	defer rcs.routesMu.Unlock()
+
+	if len(rcs.routes) > 0 {
+		rcs.QueueOut(&msgcontrol.RoutesUpdate{Routes: rcs.routes})
+	}
+}
+
 func (rcs *ResumableControlSession) QueueIn(msg msgcontrol.ControlMessage) {
 	rcs.queueMutex.Lock()
 	defer rcs.queueMutex.Unlock()
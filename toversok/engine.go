@@ -10,9 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/edup2p/common/toversok/portforward"
 	"github.com/edup2p/common/types"
 	"github.com/edup2p/common/types/control"
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgsess"
 )
 
 // Engine is the main and most high-level object for any client implementation.
@@ -26,7 +28,24 @@ type Engine struct {
 	runningCtx    context.Context
 	runningCancel context.CancelFunc
 
-	sess *Session
+	// sessMu guards sess, which is only read through session.
+	sessMu sync.RWMutex
+	sess   *Session
+
+	// routesMu guards routes, the routes this node advertises, see SetAdvertisedRoutes,
+	// and exitNode, the peer this node routes all traffic through, see SetExitNode.
+	routesMu sync.Mutex
+	routes   []netip.Prefix
+	exitNode key.NodePublic
+
+	// forwardsMu guards forwards and published, the ports this node forwards, see SetPortForwards.
+	forwardsMu sync.Mutex
+	forwards   []portforward.Forward
+	published  []portforward.Publish
+
+	// sideBandMu guards sideBandHandlers, see HandleSideBand.
+	sideBandMu       sync.RWMutex
+	sideBandHandlers map[msgsess.SideBandDataType]SideBandHandler
 
 	extBind *types.UDPConnCloseCatcher
 	extPort uint16
@@ -74,9 +93,9 @@ func (e *Engine) start(allowLogon bool) error {
 		e.runningCancel()
 	}
 
-	if e.sess != nil && e.sess.ctx.Err() == nil {
+	if sess := e.session(); sess != nil {
 		// Session is still running, even though that shouldn't be the case, as we checked for NoSession above
-		e.sess.ccc(errors.New("engine state desynced, shutting down"))
+		sess.ccc(errors.New("engine state desynced, shutting down"))
 	}
 
 	e.runningCtx, e.runningCancel = context.WithCancel(e.ctx)
@@ -195,14 +214,19 @@ func (e *Engine) installSession(allowLogon bool) error {
 		}
 	}
 
-	var err error
-	e.sess, err = SetupSession(e.runningCtx, e.wg, e.fw, e.co, e.getExtConn, e.getNodePriv, logon)
+	sess, err := SetupSession(e.runningCtx, e.wg, e.fw, e.co, e.getExtConn, e.getNodePriv, logon)
 	if err != nil {
 		return fmt.Errorf("failed to setup session: %w", err)
 	}
 
+	sess.onSideBand = e.handleSideBand
+
+	e.sessMu.Lock()
+	e.sess = sess
+	e.sessMu.Unlock()
+
 	e.state.alter(func(o *stateObserver) {
-		o.expiry = e.sess.cs.Expiry()
+		o.expiry = sess.cs.Expiry()
 	})
 
 	if !(e.state.change(CreatingSession, Established) || e.state.change(NeedsLogin, Established)) {
@@ -211,16 +235,42 @@ func (e *Engine) installSession(allowLogon bool) error {
 		return err
 	}
 
-	context.AfterFunc(e.sess.ctx, func() {
+	context.AfterFunc(sess.ctx, func() {
 		e.state.set(NoSession)
 		e.autoRestart()
 	})
 
-	e.sess.Start()
+	sess.Start()
+
+	if routes := e.AdvertisedRoutes(); len(routes) > 0 {
+		if err := sess.advertiseRoutes(routes); err != nil {
+			e.slog().Warn("could not advertise routes", "err", err, "routes", routes)
+		}
+	}
+
+	if exit := e.ExitNode(); !exit.IsZero() {
+		if err := sess.useExitNode(exit); err != nil {
+			e.slog().Warn("could not use exit node", "err", err, "peer", exit.Debug())
+		}
+	}
+
+	e.applyPortForwards(sess)
 
 	return err
 }
 
+// session returns the current session, if it is running.
+func (e *Engine) session() *Session {
+	e.sessMu.RLock()
+	defer e.sessMu.RUnlock()
+
+	if e.sess == nil || e.sess.ctx.Err() != nil {
+		return nil
+	}
+
+	return e.sess
+}
+
 // WillRestart says whether the engine strives to be in a running state.
 func (e *Engine) WillRestart() bool {
 	return e.runningCtx != nil && e.runningCtx.Err() != nil
@@ -366,6 +416,8 @@ func NewEngine(
 
 		nodePriv: privateKey,
 		state:    newStateObserver(),
+
+		sideBandHandlers: make(map[msgsess.SideBandDataType]SideBandHandler),
 	}
 
 	e.Observer().RegisterStateChangeListener(func(state EngineState) {
@@ -0,0 +1,187 @@
+package toversok
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/edup2p/common/types/relay"
+)
+
+// relayLookupTimeout bounds the lookup of the addresses of a relay without IPs, for the bypass of an exit node.
+const relayLookupTimeout = 5 * time.Second
+
+// wgRoutes returns the routes of peer to route into wireguard;
+// its exit routes are left out, unless it is the exit node.
+//
+// A quarantined peer gets none, so that wireguard drops the traffic it sends from them,
+// as the firewall only knows its overlay IPs.
+//
+// (assumes locked quarantineMu)
+func (s *Session) wgRoutes(peer key.NodePublic) []netip.Prefix {
+	if s.quarantinedPeers[peer] {
+		return nil
+	}
+
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	routes := s.peerRoutes[peer]
+
+	if peer == s.exitNode {
+		return slices.Clone(routes)
+	}
+
+	return slices.DeleteFunc(slices.Clone(routes), msgcontrol.IsExitRoute)
+}
+
+// useExitNode routes all traffic through peer, for as long as it has exit routes (see msgcontrol.ExitRoutes).
+//
+// The zero key stops routing through an exit node.
+func (s *Session) useExitNode(peer key.NodePublic) error {
+	if _, ok := s.wg.(Bypasser); !ok && !peer.IsZero() {
+		return errors.New("wireguard controller cannot route traffic through an exit node")
+	}
+
+	s.routesMu.Lock()
+	prev := s.exitNode
+	s.exitNode = peer
+	s.routesMu.Unlock()
+
+	if prev == peer {
+		return nil
+	}
+
+	// The bypass is set up before the exit routes are routed into wireguard, and torn down after.
+	if !peer.IsZero() {
+		if err := s.updateBypass(); err != nil {
+			s.routesMu.Lock()
+			s.exitNode = prev
+			s.routesMu.Unlock()
+
+			return err
+		}
+	}
+
+	var errs []error
+
+	for _, p := range []key.NodePublic{prev, peer} {
+		if p.IsZero() || !s.knowsPeer(p) {
+			continue
+		}
+
+		if err := s.configurePeer(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if peer.IsZero() {
+		if err := s.updateBypass(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// updateBypass keeps the traffic to control, the relays, and the exit node itself out of wireguard,
+// while routing through an exit node.
+func (s *Session) updateBypass() error {
+	b, ok := s.wg.(Bypasser)
+	if !ok {
+		return nil
+	}
+
+	s.routesMu.Lock()
+	exit := s.exitNode
+	relays := slices.Clone(s.relays)
+	s.routesMu.Unlock()
+
+	var addrs []netip.Addr
+
+	if !exit.IsZero() {
+		addrs = s.bypassAddrs(exit, relays)
+	}
+
+	return b.SetBypass(addrs)
+}
+
+func (s *Session) bypassAddrs(exit key.NodePublic, relays []relay.Information) []netip.Addr {
+	var addrs []netip.Addr
+
+	if addr := s.cs.ControlAddr(); addr.IsValid() {
+		addrs = append(addrs, addr)
+	}
+
+	for _, ri := range relays {
+		addrs = append(addrs, s.relayAddrs(ri)...)
+	}
+
+	if info := s.stage.GetPeerInfo(exit); info != nil {
+		for _, ap := range slices.Concat(info.Endpoints, info.RendezvousEndpoints) {
+			addrs = append(addrs, ap.Addr())
+		}
+	}
+
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+
+	// Link-local addresses are routed over their link, regardless of the routes into wireguard.
+	addrs = slices.DeleteFunc(addrs, func(addr netip.Addr) bool {
+		return !addr.IsValid() || addr.IsLinkLocalUnicast() || addr.IsLoopback()
+	})
+
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return slices.Compact(addrs)
+}
+
+// relayAddrs returns the IPs of a relay, or looks them up from its domain if it has none.
+func (s *Session) relayAddrs(ri relay.Information) []netip.Addr {
+	if len(ri.IPs) > 0 || ri.Domain == "" {
+		return ri.IPs
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, relayLookupTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", ri.Domain)
+	if err != nil {
+		slog.Warn("could not look up relay to keep it out of the exit node", "relay", ri.ID, "domain", ri.Domain, "err", err)
+		return nil
+	}
+
+	return addrs
+}
+
+// SetExitNode routes all traffic of this node through peer, once control distributes its exit routes,
+// see msgcontrol.ExitRoutes. The traffic to control, relays, and the exit node itself is kept out of it.
+//
+// The zero key stops routing through an exit node.
+// Applies to the current session right away if it is running.
+func (e *Engine) SetExitNode(peer key.NodePublic) error {
+	e.routesMu.Lock()
+	e.exitNode = peer
+	e.routesMu.Unlock()
+
+	if sess := e.session(); sess != nil {
+		return sess.useExitNode(peer)
+	}
+
+	return nil
+}
+
+// ExitNode returns the peer this node routes all traffic through, or the zero key if none, see SetExitNode.
+func (e *Engine) ExitNode() key.NodePublic {
+	e.routesMu.Lock()
+	defer e.routesMu.Unlock()
+
+	return e.exitNode
+}
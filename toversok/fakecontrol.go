@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"time"
 
+	"github.com/edup2p/common/types/dnsname"
 	"github.com/edup2p/common/types/ifaces"
 	"github.com/edup2p/common/types/key"
 )
@@ -31,6 +32,22 @@ func (f *FakeControl) Expiry() time.Time {
 	return time.Time{}
 }
 
+func (f *FakeControl) MTU() int {
+	return 0
+}
+
+func (f *FakeControl) Hostname() string {
+	return ""
+}
+
+func (f *FakeControl) Domain() string {
+	return dnsname.DefaultDomain
+}
+
+func (f *FakeControl) ControlAddr() netip.Addr {
+	return netip.Addr{}
+}
+
 func (f *FakeControl) Context() context.Context {
 	return context.Background()
 }
@@ -48,3 +65,8 @@ func (f *FakeControl) UpdateHomeRelay(int64) error {
 	// NOP
 	return nil
 }
+
+func (f *FakeControl) UpdateRoutes([]netip.Prefix) error {
+	// NOP
+	return nil
+}
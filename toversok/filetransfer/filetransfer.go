@@ -0,0 +1,539 @@
+// Package filetransfer sends files between nodes, over TCP through the overlay.
+//
+// A Sender offers a file to a peer by its hostname, and the Receiver of that peer has its AcceptFunc decide where to
+// save it, if at all. Senders are identified by their overlay address, which wireguard only accepts from the peer
+// control assigned it to. Interrupted transfers resume when the same file is offered again,
+// and files are only saved once their SHA-256 hash matches the offer.
+package filetransfer
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+)
+
+// Port is the TCP port on overlay addresses that receivers listen on.
+const Port = 4242
+
+// DecisionTimeout is the time the AcceptFunc of a receiver has to decide on an offer,
+// which may involve prompting a user.
+const DecisionTimeout = 5 * time.Minute
+
+// HandshakeTimeout is the time either side has to send its other messages.
+const HandshakeTimeout = 30 * time.Second
+
+// DefaultMaxSize is the largest file a receiver accepts offers of, unless it sets its own.
+const DefaultMaxSize = 16 << 30
+
+// maxMessageLen bounds the size of protocol messages, all of which are a single line of JSON.
+const maxMessageLen = 4096
+
+// errReceive is what the sender is told when receiving fails for a reason other than the hash,
+// which stays local, as it may contain local paths.
+var errReceive = errors.New("filetransfer: receiver could not save file")
+
+var (
+	ErrDeclined     = errors.New("filetransfer: offer declined")
+	ErrHashMismatch = errors.New("filetransfer: received file does not match its hash")
+	ErrUnknownPeer  = errors.New("filetransfer: unknown peer")
+)
+
+// Peers identifies the nodes in the overlay, such as toversok.Engine.
+type Peers interface {
+	// LookupName returns the overlay addresses of the node with the given hostname.
+	LookupName(name string) (ip4, ip6 netip.Addr, ok bool)
+	// LookupAddr returns the hostname of the node with the given overlay address.
+	LookupAddr(ip netip.Addr) (name string, ok bool)
+	// PeerByAddr returns the peer with the given overlay address.
+	PeerByAddr(ip netip.Addr) (key.NodePublic, bool)
+	// Prefixes returns the overlay prefixes, which receivers only accept connections on.
+	Prefixes() []netip.Prefix
+}
+
+// Offer is a file offered by a peer.
+type Offer struct {
+	// Peer is the sending peer, and Hostname its hostname, if it has one.
+	Peer     key.NodePublic
+	Hostname string
+
+	// Name is the base name of the file, as given by the sender; it contains no path separators.
+	Name   string
+	Size   int64
+	SHA256 [sha256.Size]byte
+}
+
+// AcceptFunc decides on an offer; it returns the path to save the file at, or an empty string to decline it.
+//
+// The file is only written there once it is complete. ctx is done when the sender gives up on a decision.
+type AcceptFunc func(ctx context.Context, offer Offer) (path string)
+
+// offerMsg, replyMsg, and resultMsg are the messages of the protocol, in order.
+//
+// After the reply, the sender sends the file from the offset in the reply, after which the receiver sends the result.
+type offerMsg struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+type replyMsg struct {
+	Accept bool
+	Offset int64 `json:",omitempty"`
+}
+
+type resultMsg struct {
+	Error string `json:",omitempty"`
+}
+
+func writeMsg(conn net.Conn, timeout time.Duration, msg any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(b, '\n'))
+
+	return err
+}
+
+func readMsg(conn net.Conn, br *bufio.Reader, timeout time.Duration, msg any) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return errors.New("message too long")
+		}
+
+		return err
+	}
+
+	return json.Unmarshal(line, msg)
+}
+
+// Receiver receives the files offered by peers.
+type Receiver struct {
+	Peers  Peers
+	Accept AcceptFunc
+
+	// MaxSize is the largest file to accept offers of, or DefaultMaxSize if 0; larger ones are declined.
+	MaxSize int64
+}
+
+func (r *Receiver) L() *slog.Logger {
+	return slog.With("from", "filetransfer")
+}
+
+// ListenAndServe listens on addr with TCP, and receives files until ctx is done.
+func (r *Receiver) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	return r.Serve(ctx, ln)
+}
+
+// Serve receives files on ln until ctx is done, after which ln is closed.
+//
+// Once it returns, all transfers have stopped, and their connections are closed.
+func (r *Receiver) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = ln.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Also stops the transfers when ln fails, before waiting on them.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			r.handle(ctx, conn)
+		}()
+	}
+}
+
+func (r *Receiver) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	offer, err := r.identify(conn)
+	if err != nil {
+		r.L().Warn("rejecting connection", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	br := bufio.NewReaderSize(conn, maxMessageLen)
+
+	var om offerMsg
+	if err := readMsg(conn, br, HandshakeTimeout, &om); err != nil {
+		r.L().Warn("could not read offer", "peer", offer.Peer.Debug(), "err", err)
+		return
+	}
+
+	if err := parseOffer(om, &offer); err != nil {
+		r.L().Warn("invalid offer", "peer", offer.Peer.Debug(), "err", err)
+		return
+	}
+
+	var path string
+
+	if maxSize := cmp.Or(r.MaxSize, DefaultMaxSize); offer.Size > maxSize {
+		r.L().Info("declining offer larger than allowed", "peer", offer.Peer.Debug(), "name", offer.Name, "size", offer.Size, "max", maxSize)
+	} else {
+		path = r.decide(ctx, offer)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if path == "" {
+		_ = writeMsg(conn, HandshakeTimeout, replyMsg{Accept: false})
+		return
+	}
+
+	err = r.receive(conn, br, offer, path)
+	if err != nil {
+		r.L().Warn("could not receive file", "peer", offer.Peer.Debug(), "name", offer.Name, "err", err)
+
+		if !errors.Is(err, ErrHashMismatch) {
+			err = errReceive
+		}
+
+		_ = writeMsg(conn, HandshakeTimeout, resultMsg{Error: err.Error()})
+		return
+	}
+
+	r.L().Info("received file", "peer", offer.Peer.Debug(), "name", offer.Name, "path", path)
+
+	_ = writeMsg(conn, HandshakeTimeout, resultMsg{})
+}
+
+// decide has the AcceptFunc decide on offer, and returns its path, or an empty string once ctx or the decision times out,
+// even if the AcceptFunc has not returned yet.
+func (r *Receiver) decide(ctx context.Context, offer Offer) string {
+	ctx, cancel := context.WithTimeout(ctx, DecisionTimeout)
+	defer cancel()
+
+	decided := make(chan string, 1)
+
+	go func() {
+		decided <- r.Accept(ctx, offer)
+	}()
+
+	select {
+	case path := <-decided:
+		return path
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+// identify returns an offer with the peer on the other side of conn, if it comes from the overlay.
+func (r *Receiver) identify(conn net.Conn) (Offer, error) {
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return Offer{}, err
+	}
+
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return Offer{}, err
+	}
+
+	if !slices.ContainsFunc(r.Peers.Prefixes(), func(p netip.Prefix) bool { return p.Contains(local.Addr().Unmap()) }) {
+		return Offer{}, errors.New("connection is not from the overlay")
+	}
+
+	peer, ok := r.Peers.PeerByAddr(remote.Addr())
+	if !ok {
+		return Offer{}, ErrUnknownPeer
+	}
+
+	hostname, _ := r.Peers.LookupAddr(remote.Addr())
+
+	return Offer{Peer: peer, Hostname: hostname}, nil
+}
+
+func parseOffer(om offerMsg, offer *Offer) error {
+	name := filepath.Base(om.Name)
+	if name != om.Name || name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name %q", om.Name)
+	}
+
+	if om.Size < 0 {
+		return fmt.Errorf("invalid size %d", om.Size)
+	}
+
+	hash, err := hex.DecodeString(om.SHA256)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid hash %q", om.SHA256)
+	}
+
+	offer.Name = name
+	offer.Size = om.Size
+	offer.SHA256 = [sha256.Size]byte(hash)
+
+	return nil
+}
+
+// partPath returns the path a file is kept at until it is complete,
+// which is keyed by its hash, so that only the same file resumes it.
+func partPath(path string, hash [sha256.Size]byte) string {
+	return path + "." + hex.EncodeToString(hash[:8]) + ".part"
+}
+
+// receive resumes receiving the file of offer into its partial file, and moves it to path once it is complete.
+func (r *Receiver) receive(conn net.Conn, br *bufio.Reader, offer Offer, path string) error {
+	part := partPath(path, offer.SHA256)
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open partial file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("could not read partial file: %w", err)
+	}
+
+	// A partial file larger than the offer cannot be resumed.
+	if offset > offer.Size {
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("could not truncate partial file: %w", err)
+		}
+
+		h.Reset()
+		offset = 0
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek partial file: %w", err)
+	}
+
+	if err := writeMsg(conn, HandshakeTimeout, replyMsg{Accept: true, Offset: offset}); err != nil {
+		return err
+	}
+
+	// Progress is saved as it arrives, so the deadline only bounds stalls.
+	remaining := offer.Size - offset
+
+	for remaining > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+			return err
+		}
+
+		n, err := io.CopyN(io.MultiWriter(f, h), br, min(remaining, 1<<20))
+		remaining -= n
+
+		if err != nil {
+			return fmt.Errorf("transfer interrupted at %d of %d bytes: %w", offer.Size-remaining, offer.Size, err)
+		}
+	}
+
+	if [sha256.Size]byte(h.Sum(nil)) != offer.SHA256 {
+		_ = f.Close()
+		_ = os.Remove(part)
+
+		return ErrHashMismatch
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close partial file: %w", err)
+	}
+
+	if err := os.Rename(part, path); err != nil {
+		return fmt.Errorf("could not move completed file: %w", err)
+	}
+
+	return nil
+}
+
+// DialFunc dials an address in the overlay, such as usrwg.NetstackWireGuardHost.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Sender offers files to peers.
+type Sender struct {
+	Peers Peers
+
+	// Dial dials peers, or a net.Dialer if nil.
+	Dial DialFunc
+
+	// Port is the port receivers listen on, or Port if 0.
+	Port uint16
+}
+
+// Send offers the file at path to the node with the given hostname, and sends it once accepted.
+//
+// Only returns once the receiver has the whole file, or errors; with ErrDeclined if it declined the offer.
+// Sending the same file again resumes the transfer where it was interrupted.
+func (s *Sender) Send(ctx context.Context, hostname, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not hash file: %w", err)
+	}
+
+	conn, err := s.dial(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if err := writeMsg(conn, HandshakeTimeout, offerMsg{
+		Name:   filepath.Base(path),
+		Size:   info.Size(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}); err != nil {
+		return fmt.Errorf("could not send offer: %w", err)
+	}
+
+	br := bufio.NewReaderSize(conn, maxMessageLen)
+
+	var reply replyMsg
+	if err := readMsg(conn, br, DecisionTimeout, &reply); err != nil {
+		return fmt.Errorf("could not read reply: %w", err)
+	}
+
+	if !reply.Accept {
+		return ErrDeclined
+	}
+
+	if reply.Offset < 0 || reply.Offset > info.Size() {
+		return fmt.Errorf("invalid offset %d in reply", reply.Offset)
+	}
+
+	if _, err := f.Seek(reply.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := s.copy(conn, f, info.Size()-reply.Offset); err != nil {
+		return fmt.Errorf("could not send file: %w", err)
+	}
+
+	var result resultMsg
+	if err := readMsg(conn, br, HandshakeTimeout, &result); err != nil {
+		return fmt.Errorf("could not read result: %w", err)
+	}
+
+	if result.Error != "" {
+		if result.Error == ErrHashMismatch.Error() {
+			return ErrHashMismatch
+		}
+
+		return fmt.Errorf("receiver failed: %s", result.Error)
+	}
+
+	return nil
+}
+
+func (s *Sender) dial(ctx context.Context, hostname string) (net.Conn, error) {
+	ip4, ip6, ok := s.Peers.LookupName(hostname)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, hostname)
+	}
+
+	ip := ip4
+	if !ip.IsValid() {
+		ip = ip6
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = Port
+	}
+
+	dial := s.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+
+	return dial(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+// copy sends n bytes from r, with the deadline only bounding stalls.
+func (s *Sender) copy(conn net.Conn, r io.Reader, n int64) error {
+	for n > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+			return err
+		}
+
+		c, err := io.CopyN(conn, r, min(n, 1<<20))
+		n -= c
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package filetransfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	loopback = netip.MustParseAddr("127.0.0.1")
+	peerKey  = key.NewNode().Public()
+)
+
+// loopbackPeers has every node live on the loopback address, as "peer".
+type loopbackPeers struct{}
+
+func (loopbackPeers) LookupName(name string) (ip4, ip6 netip.Addr, ok bool) {
+	return loopback, netip.Addr{}, name == "peer"
+}
+
+func (loopbackPeers) LookupAddr(netip.Addr) (string, bool) {
+	return "peer", true
+}
+
+func (loopbackPeers) PeerByAddr(ip netip.Addr) (key.NodePublic, bool) {
+	return peerKey, ip == loopback
+}
+
+func (loopbackPeers) Prefixes() []netip.Prefix {
+	return []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+}
+
+// serve runs a receiver with accept, and returns a sender to it.
+func serve(t *testing.T, accept AcceptFunc) *Sender {
+	return serveReceiver(t, &Receiver{Peers: loopbackPeers{}, Accept: accept})
+}
+
+// serveReceiver runs r, and returns a sender to it.
+func serveReceiver(t *testing.T, r *Receiver) *Sender {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- r.Serve(ctx, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return &Sender{Peers: loopbackPeers{}, Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+}
+
+func writeRandom(t *testing.T, path string, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	return data
+}
+
+func TestSend(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	data := writeRandom(t, filepath.Join(src, "report.pdf"), 3<<20+17)
+
+	var offer Offer
+
+	s := serve(t, func(_ context.Context, o Offer) string {
+		offer = o
+		return filepath.Join(dst, o.Name)
+	})
+
+	require.NoError(t, s.Send(context.Background(), "peer", filepath.Join(src, "report.pdf")))
+
+	assert.Equal(t, peerKey, offer.Peer)
+	assert.Equal(t, "peer", offer.Hostname)
+	assert.Equal(t, "report.pdf", offer.Name)
+	assert.Equal(t, int64(len(data)), offer.Size)
+	assert.Equal(t, sha256.Sum256(data), offer.SHA256)
+
+	got, err := os.ReadFile(filepath.Join(dst, "report.pdf"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	entries, err := os.ReadDir(dst)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "partial file should be gone")
+
+	assert.ErrorIs(t, s.Send(context.Background(), "other", filepath.Join(src, "report.pdf")), ErrUnknownPeer)
+}
+
+func TestSendDeclined(t *testing.T) {
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file"), 10)
+
+	s := serve(t, func(context.Context, Offer) string { return "" })
+
+	assert.ErrorIs(t, s.Send(context.Background(), "peer", filepath.Join(src, "file")), ErrDeclined)
+}
+
+func TestSendTooLarge(t *testing.T) {
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file"), 10)
+
+	s := serveReceiver(t, &Receiver{Peers: loopbackPeers{}, MaxSize: 9, Accept: func(context.Context, Offer) string {
+		t.Error("offer larger than MaxSize should not be asked about")
+		return ""
+	}})
+
+	assert.ErrorIs(t, s.Send(context.Background(), "peer", filepath.Join(src, "file")), ErrDeclined)
+}
+
+func TestReceiveErrorHidesPath(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "missing")
+
+	s := serve(t, func(_ context.Context, o Offer) string { return filepath.Join(dst, o.Name) })
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(loopback.String(), strconv.Itoa(int(s.Port))))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMsg(conn, HandshakeTimeout, offerMsg{Name: "file", Size: 10, SHA256: strings.Repeat("00", 32)}))
+
+	var result resultMsg
+	require.NoError(t, readMsg(conn, bufio.NewReader(conn), HandshakeTimeout, &result))
+
+	assert.Equal(t, errReceive.Error(), result.Error)
+	assert.NotContains(t, result.Error, dst)
+}
+
+func TestServeShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	asked, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+
+	// An AcceptFunc that ignores its context, like a prompt the user has not answered yet.
+	r := &Receiver{Peers: loopbackPeers{}, Accept: func(context.Context, Offer) string {
+		close(asked)
+		<-release
+		return ""
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- r.Serve(ctx, ln)
+	}()
+
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file"), 10)
+
+	s := &Sender{Peers: loopbackPeers{}, Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+	sent := make(chan error)
+
+	go func() {
+		sent <- s.Send(context.Background(), "peer", filepath.Join(src, "file"))
+	}()
+
+	<-asked
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after cancel with a pending offer")
+	}
+
+	select {
+	case err := <-sent:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of pending offer was not closed")
+	}
+}
+
+func TestSendResume(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	data := writeRandom(t, filepath.Join(src, "file"), 1<<20)
+	path := filepath.Join(dst, "file")
+
+	// An interrupted transfer left the first part behind.
+	require.NoError(t, os.WriteFile(partPath(path, sha256.Sum256(data)), data[:1000], 0o644))
+
+	s := serve(t, func(context.Context, Offer) string { return path })
+
+	require.NoError(t, s.Send(context.Background(), "peer", filepath.Join(src, "file")))
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestSendHashMismatch(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	data := writeRandom(t, filepath.Join(src, "file"), 5000)
+	path := filepath.Join(dst, "file")
+	part := partPath(path, sha256.Sum256(data))
+
+	// A corrupted partial file is caught by the hash, and removed so the next attempt starts over.
+	require.NoError(t, os.WriteFile(part, make([]byte, 1000), 0o644))
+
+	s := serve(t, func(context.Context, Offer) string { return path })
+
+	assert.ErrorIs(t, s.Send(context.Background(), "peer", filepath.Join(src, "file")), ErrHashMismatch)
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, part)
+
+	require.NoError(t, s.Send(context.Background(), "peer", filepath.Join(src, "file")))
+	assert.FileExists(t, path)
+}
+
+func TestParseOffer(t *testing.T) {
+	hash := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	for _, name := range []string{"", ".", "..", "../etc/passwd", "dir/file", "/abs"} {
+		assert.Error(t, parseOffer(offerMsg{Name: name, SHA256: hash}, &Offer{}), name)
+	}
+
+	assert.Error(t, parseOffer(offerMsg{Name: "file", Size: -1, SHA256: hash}, &Offer{}))
+	assert.Error(t, parseOffer(offerMsg{Name: "file", SHA256: "00"}, &Offer{}))
+	assert.NoError(t, parseOffer(offerMsg{Name: "file", SHA256: hash}, &Offer{}))
+}
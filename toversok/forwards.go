@@ -0,0 +1,107 @@
+package toversok
+
+import (
+	"context"
+	"net"
+	"slices"
+
+	"github.com/edup2p/common/toversok/portforward"
+)
+
+// osNet reaches the overlay through the wireguard interface of the OS.
+//
+// Its listeners are bound to the interface (if known), so that they only get the traffic which came through wireguard;
+// else hosts on the other networks of this host could reach published ports by spoofing the address of a peer.
+type osNet struct {
+	iface *net.Interface
+}
+
+func (osNet) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (n osNet) listenConfig() *net.ListenConfig {
+	lc := new(net.ListenConfig)
+
+	if n.iface != nil {
+		lc.Control = bindToInterface(n.iface)
+	}
+
+	return lc
+}
+
+func (n osNet) Listen(network, address string) (net.Listener, error) {
+	return n.listenConfig().Listen(context.Background(), network, address)
+}
+
+func (n osNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	return n.listenConfig().ListenPacket(context.Background(), network, address)
+}
+
+// overlayNet returns the network to reach the overlay through; the wireguard controller if it is an OverlayNet.
+func (s *Session) overlayNet() OverlayNet {
+	if n, ok := s.wg.(OverlayNet); ok {
+		return n
+	}
+
+	return osNet{iface: s.wg.GetInterface()}
+}
+
+// OverlayNet returns the network to reach the overlay through in the current session, see OverlayNet.
+//
+// Its listeners only get the connections and packets which came through the overlay, and stop working with the session.
+func (e *Engine) OverlayNet() (OverlayNet, error) {
+	sess := e.session()
+	if sess == nil {
+		return nil, errNoSession
+	}
+
+	return sess.overlayNet(), nil
+}
+
+// SetPortForwards forwards local ports to ports of peers, and publishes ports on the overlay addresses of this node,
+// forwarding the connections of peers to local services; see portforward for details.
+//
+// Replaces the forwards set before, and applies to the current session right away if it is running,
+// leaving the forwards that are set again running. Errors if some could not listen, the others are started regardless.
+func (e *Engine) SetPortForwards(forwards []portforward.Forward, published []portforward.Publish) error {
+	if err := portforward.Validate(forwards, published); err != nil {
+		return err
+	}
+
+	// Applied while holding forwardsMu, so that a session being installed does not apply the ones set before after.
+	e.forwardsMu.Lock()
+	defer e.forwardsMu.Unlock()
+
+	e.forwards = slices.Clone(forwards)
+	e.published = slices.Clone(published)
+
+	if sess := e.session(); sess != nil {
+		return sess.forwarder.Set(sess.ctx, forwards, published)
+	}
+
+	return nil
+}
+
+// applyPortForwards starts the port forwards on a newly installed session, see SetPortForwards.
+func (e *Engine) applyPortForwards(sess *Session) {
+	e.forwardsMu.Lock()
+	defer e.forwardsMu.Unlock()
+
+	if len(e.forwards) == 0 && len(e.published) == 0 {
+		return
+	}
+
+	if err := sess.forwarder.Set(sess.ctx, e.forwards, e.published); err != nil {
+		e.slog().Warn("could not forward all ports", "err", err)
+	}
+}
+
+// PortForwards returns the forwarded and published ports, see SetPortForwards.
+func (e *Engine) PortForwards() ([]portforward.Forward, []portforward.Publish) {
+	e.forwardsMu.Lock()
+	defer e.forwardsMu.Unlock()
+
+	return slices.Clone(e.forwards), slices.Clone(e.published)
+}
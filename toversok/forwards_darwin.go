@@ -0,0 +1,28 @@
+package toversok
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToInterface binds sockets to iface, so that they only get the packets which arrived on it.
+func bindToInterface(iface *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var err error
+
+		if cerr := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, iface.Index)
+			} else {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+
+		return err
+	}
+}
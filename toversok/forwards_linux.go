@@ -0,0 +1,23 @@
+package toversok
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToInterface binds sockets to iface, so that they only get the packets which arrived on it.
+func bindToInterface(iface *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), iface.Name)
+		}); cerr != nil {
+			return cerr
+		}
+
+		return err
+	}
+}
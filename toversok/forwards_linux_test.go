@@ -0,0 +1,53 @@
+package toversok
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSNetBindsToInterface(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	require.NoError(t, err)
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	var other *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback == 0 {
+			other = &ifaces[i]
+			break
+		}
+	}
+	if other == nil {
+		t.Skip("no interface besides the loopback interface")
+	}
+
+	dial := func(ln net.Listener) error {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err
+	}
+
+	ln, err := osNet{iface: lo}.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot bind to interface: %v", err)
+	}
+	defer ln.Close()
+
+	assert.NoError(t, dial(ln), "connection over the interface should be accepted")
+
+	// Connections over the loopback interface do not arrive on the other one.
+	ln, err = osNet{iface: other}.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	assert.Error(t, dial(ln), "connection over another interface should not be accepted")
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !windows
+
+package toversok
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errBindUnsupported = errors.New("binding sockets to the wireguard interface is not supported on this OS")
+
+// bindToInterface refuses to create sockets, as the BSDs use the weak host model, and have no way to bind them to
+// iface; a published port would then be reachable from every network of this host.
+func bindToInterface(*net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errBindUnsupported
+	}
+}
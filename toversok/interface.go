@@ -2,13 +2,16 @@ package toversok
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"net/netip"
 	"time"
 
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsconfig"
 	"github.com/edup2p/common/types/ifaces"
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
 )
 
 // PeerCfg isa a peer config update struct, all values are nullable through being pointers.
@@ -16,6 +19,10 @@ type PeerCfg struct {
 	// The IPs the node is addressable by, allowedIPs in wireguard terms.
 	VIPs VirtualIPs
 
+	// Routes are the prefixes the node routes into the network, which are allowedIPs as well,
+	// and are routed into the wireguard interface.
+	Routes []netip.Prefix
+
 	// The persistent keepalive interval, per peer.
 	KeepAliveInterval *time.Duration
 }
@@ -25,6 +32,14 @@ type VirtualIPs struct {
 	IPv6 netip.Addr
 }
 
+// AllowedIPs returns the prefixes of which the node may send, and is sent, packets; its VIPs and Routes.
+func (c PeerCfg) AllowedIPs() []netip.Prefix {
+	return append([]netip.Prefix{
+		netip.PrefixFrom(c.VIPs.IPv4, 32),
+		netip.PrefixFrom(c.VIPs.IPv6, 128),
+	}, c.Routes...)
+}
+
 type WGStats struct {
 	LastHandshake time.Time
 	TxBytes       int64
@@ -54,10 +69,19 @@ type WireGuardHost interface {
 
 	// Controller initialises the wireguard interface, and make it ready for configuration changes.
 	//
+	// mtu is the MTU given by control, or 0 if it gave none; see ChooseMTU.
+	//
 	// Only one controller is expected to exist at any time.
-	Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix) (WireGuardController, error)
+	Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix, mtu int) (WireGuardController, error)
 }
 
+// WireGuardController configures a wireguard interface.
+//
+// It can optionally implement ifaces.Injectable, to inject packets into the local network stack,
+// DNSConfigurer, to have the OS resolve the names of peers, Bypasser, to route traffic through an exit node,
+// and OverlayNet, when it has no interface in the OS.
+//
+// The routes of peers (see PeerCfg.Routes) should be routed into its interface, see PeerRoutes.
 type WireGuardController interface {
 	// UpdatePeer updates a peer with certain values, mapped by public key.
 	UpdatePeer(publicKey key.NodePublic, cfg PeerCfg) error
@@ -76,6 +100,74 @@ type WireGuardController interface {
 	ConnFor(node key.NodePublic) types.UDPConn
 
 	GetInterface() *net.Interface
+
+	// MTU returns the MTU of the wireguard interface.
+	MTU() int
+}
+
+// DNSConfigurer is optionally implemented by a WireGuardController with an interface in the OS.
+type DNSConfigurer interface {
+	// SetDNS has the OS send queries for the domains in cfg to its nameservers, through the wireguard interface.
+	//
+	// An empty cfg reverts it, as does resetting the WireGuardHost.
+	// Returns dnsconfig.ErrUnavailable when the host does not configure DNS.
+	SetDNS(cfg dnsconfig.Config) error
+}
+
+// OverlayNet is optionally implemented by a WireGuardController without an interface in the OS, such as a netstack,
+// to reach the overlay from within the program, for port forwarding (see Engine.SetPortForwards).
+//
+// Without it, connections are made through the interface of the OS.
+type OverlayNet interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+// Bypasser is optionally implemented by a WireGuardController, to route the exit routes of a peer
+// (see msgcontrol.ExitRoutes) into its interface.
+type Bypasser interface {
+	// SetBypass keeps traffic to addrs out of the wireguard interface, routed the way the host routed it before,
+	// so that routes into the interface do not capture the traffic of the overlay itself.
+	//
+	// Replaces the addresses set before, none removes the bypass.
+	SetBypass(addrs []netip.Addr) error
+}
+
+const (
+	// DefaultMTU is the MTU of the wireguard interface when neither the host nor control set one.
+	//
+	// It is the minimum MTU of IPv6, which fits through all networks.
+	DefaultMTU = 1280
+
+	MinMTU = msgcontrol.MinMTU
+	MaxMTU = msgcontrol.MaxMTU
+)
+
+// ChooseMTU picks the MTU for the wireguard interface;
+// the one configured on the host if set, else the one given by control if set, else DefaultMTU.
+//
+// Errors if the one configured on the host is out of range. The one given by control is clamped into range instead,
+// so that a misconfigured control server cannot keep clients from setting up a session.
+func ChooseMTU(hostMTU, controlMTU int) (int, error) {
+	if hostMTU != 0 {
+		if err := msgcontrol.ValidateMTU(hostMTU); err != nil {
+			return 0, err
+		}
+
+		return hostMTU, nil
+	}
+
+	if controlMTU == 0 {
+		return DefaultMTU, nil
+	}
+
+	mtu := min(max(controlMTU, MinMTU), MaxMTU)
+	if mtu != controlMTU {
+		slog.Warn("mtu given by control is out of range, clamping it", "mtu", controlMTU, "clamped", mtu)
+	}
+
+	return mtu, nil
 }
 
 type FirewallHost interface {
@@ -90,4 +182,24 @@ type FirewallController interface {
 	//
 	// Replaces an existing firewall configuration.
 	QuarantineNodes(ips []netip.Addr) error
+
+	// SetPeerRules configures the firewall to only allow the connections with peer prefixes which are allowed by their
+	// rules, see msgcontrol.FilterRule; the overlay IPs of peers, and the routes wireguard may accept from them.
+	//
+	// An IP is restricted by the rules of the most specific prefix containing it, like wireguard picks the peer
+	// it routes to. Prefixes without rules are not restricted, also when they lie within one which is.
+	//
+	// Replaces an existing rules configuration.
+	SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error
+}
+
+// Forwarder is optionally implemented by a FirewallController, to serve the routes this node advertises.
+type Forwarder interface {
+	// SetForwarding forwards traffic from the overlay prefixes into routes, with its source translated
+	// to this host, so that hosts in routes need no route back into the overlay.
+	// Traffic from the overlay prefixes to anywhere else is not forwarded.
+	//
+	// Replaces an existing forwarding configuration, no routes stop forwarding.
+	// Reverted when the FirewallHost is reset.
+	SetForwarding(overlay, routes []netip.Prefix) error
 }
@@ -0,0 +1,179 @@
+package toversok
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/edup2p/common/toversok/overlaydns"
+	"github.com/edup2p/common/types/dnsconfig"
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/stage"
+)
+
+// DNSPort is the port of the overlay resolver on the overlay address, as OS resolvers only query port 53.
+const DNSPort = 53
+
+// setupDNS has the OS resolve the overlay domain with a resolver on our overlay IPv4 address,
+// if the wireguard controller supports it.
+//
+// The OS is only pointed at the resolver once it listens, and no longer once it stops serving.
+func (s *Session) setupDNS() {
+	dc, ok := s.wg.(DNSConfigurer)
+	if !ok || s.Domain() == "" {
+		return
+	}
+
+	addr := s.cs.IPv4().Addr()
+	listenAddr := net.JoinHostPort(addr.String(), strconv.Itoa(DNSPort))
+
+	pc, ln, err := overlaydns.Listen(listenAddr)
+	if err != nil {
+		slog.Warn("could not serve overlay dns", "err", err, "addr", listenAddr)
+		return
+	}
+
+	if err := dc.SetDNS(dnsconfig.Config{
+		Nameservers:  []netip.Addr{addr},
+		Domains:      []string{s.Domain()},
+		RouteDomains: dnsconfig.ReverseZones(s.Prefixes()),
+	}); err != nil {
+		if !errors.Is(err, dnsconfig.ErrUnavailable) {
+			slog.Warn("could not configure dns", "err", err)
+		}
+
+		_ = pc.Close()
+		_ = ln.Close()
+
+		return
+	}
+
+	go func() {
+		srv := &overlaydns.Server{Source: s}
+
+		if err := srv.Serve(s.ctx, pc, ln); err != nil {
+			slog.Warn("overlay dns exited", "err", err, "addr", listenAddr)
+		}
+
+		// Once the session is done, the wireguard host reverts it, possibly after the next session configured it.
+		if s.ctx.Err() == nil {
+			if err := dc.SetDNS(dnsconfig.Config{}); err != nil {
+				slog.Warn("could not revert dns", "err", err)
+			}
+		}
+	}()
+}
+
+// LookupName returns the overlay addresses of the node with the given hostname; this node, or one of its peers.
+func (s *Session) LookupName(name string) (ip4, ip6 netip.Addr, ok bool) {
+	if self := s.cs.Hostname(); self != "" && strings.EqualFold(self, name) {
+		return s.cs.IPv4().Addr(), s.cs.IPv6().Addr(), true
+	}
+
+	s.stage.GetPeersWhere(func(_ key.NodePublic, info *stage.PeerInfo) bool {
+		if !ok && info.Hostname != "" && strings.EqualFold(info.Hostname, name) {
+			ip4, ip6, ok = info.IPv4, info.IPv6, true
+		}
+
+		return false
+	})
+
+	return ip4, ip6, ok
+}
+
+// LookupAddr returns the hostname of the node with the given overlay address; this node, or one of its peers.
+func (s *Session) LookupAddr(ip netip.Addr) (name string, ok bool) {
+	ip = ip.Unmap()
+
+	if ip == s.cs.IPv4().Addr() || ip == s.cs.IPv6().Addr() {
+		name = s.cs.Hostname()
+		return name, name != ""
+	}
+
+	s.stage.GetPeersWhere(func(_ key.NodePublic, info *stage.PeerInfo) bool {
+		if !ok && info.Hostname != "" && (info.IPv4 == ip || info.IPv6 == ip) {
+			name, ok = info.Hostname, true
+		}
+
+		return false
+	})
+
+	return name, ok
+}
+
+// PeerByAddr returns the peer with the given overlay address.
+func (s *Session) PeerByAddr(ip netip.Addr) (peer key.NodePublic, ok bool) {
+	ip = ip.Unmap()
+
+	s.stage.GetPeersWhere(func(p key.NodePublic, info *stage.PeerInfo) bool {
+		if !ok && (info.IPv4 == ip || info.IPv6 == ip) {
+			peer, ok = p, true
+		}
+
+		return false
+	})
+
+	return peer, ok
+}
+
+// Domain returns the domain of the network, see Engine.Domain.
+func (s *Session) Domain() string {
+	return s.cs.Domain()
+}
+
+// Prefixes returns the overlay prefixes of the network.
+func (s *Session) Prefixes() []netip.Prefix {
+	return []netip.Prefix{s.cs.IPv4().Masked(), s.cs.IPv6().Masked()}
+}
+
+// Domain returns the domain of the network, under which nodes are named <hostname>.<domain>.
+//
+// Returns an empty string if the engine has no session.
+func (e *Engine) Domain() string {
+	if sess := e.session(); sess != nil {
+		return sess.Domain()
+	}
+
+	return ""
+}
+
+// LookupName returns the overlay addresses of the node with the given hostname, see Session.LookupName.
+func (e *Engine) LookupName(name string) (ip4, ip6 netip.Addr, ok bool) {
+	if sess := e.session(); sess != nil {
+		return sess.LookupName(name)
+	}
+
+	return netip.Addr{}, netip.Addr{}, false
+}
+
+// LookupAddr returns the hostname of the node with the given overlay address, see Session.LookupAddr.
+func (e *Engine) LookupAddr(ip netip.Addr) (string, bool) {
+	if sess := e.session(); sess != nil {
+		return sess.LookupAddr(ip)
+	}
+
+	return "", false
+}
+
+// PeerByAddr returns the peer with the given overlay address, as identified by control, see Session.PeerByAddr.
+//
+// As wireguard only accepts traffic from a peer with its addresses, this identifies the sender of overlay traffic.
+func (e *Engine) PeerByAddr(ip netip.Addr) (key.NodePublic, bool) {
+	if sess := e.session(); sess != nil {
+		return sess.PeerByAddr(ip)
+	}
+
+	return key.NodePublic{}, false
+}
+
+// Prefixes returns the overlay prefixes of the network, or nil if the engine has no session.
+func (e *Engine) Prefixes() []netip.Prefix {
+	if sess := e.session(); sess != nil {
+		return sess.Prefixes()
+	}
+
+	return nil
+}
@@ -0,0 +1,405 @@
+// Package overlaydns contains a small DNS responder for the names of nodes in the overlay.
+//
+// It answers A and AAAA queries for <hostname>.<domain>, and PTR queries for overlay addresses,
+// from a Source such as toversok.Engine. It is authoritative for those names only, and refuses all others,
+// so it should sit behind a resolver which only forwards the overlay domain to it.
+package overlaydns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTL is the time to live of answers, kept short as peers come and go.
+const TTL = 30
+
+// TCPIdleTimeout is the time a TCP client has to send its next query.
+const TCPIdleTimeout = 10 * time.Second
+
+// Source resolves the names of nodes in the overlay, such as toversok.Engine.
+type Source interface {
+	// Domain returns the domain of the network, without trailing dot, or an empty string if it is not known (yet).
+	Domain() string
+	// LookupName returns the overlay addresses of the node with the given hostname.
+	LookupName(name string) (ip4, ip6 netip.Addr, ok bool)
+	// LookupAddr returns the hostname of the node with the given overlay address.
+	LookupAddr(ip netip.Addr) (name string, ok bool)
+	// Prefixes returns the overlay prefixes, of which this server answers reverse queries.
+	Prefixes() []netip.Prefix
+}
+
+var ErrNotFound = errors.New("overlaydns: name not found")
+
+type Server struct {
+	Source Source
+}
+
+func (s *Server) L() *slog.Logger {
+	return slog.With("from", "overlaydns")
+}
+
+// ListenAndServe listens on addr with both UDP and TCP, and serves queries until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, ln, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, pc, ln)
+}
+
+// Listen listens on addr with both UDP and TCP, for Serve.
+func Listen(addr string) (net.PacketConn, net.Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not listen on udp: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return nil, nil, fmt.Errorf("could not listen on tcp: %w", err)
+	}
+
+	return pc, ln, nil
+}
+
+// Serve serves queries on pc and ln until ctx is done, or until either fails, after which both are closed.
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var udpErr, tcpErr error
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		udpErr = s.ServeUDP(ctx, pc)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		tcpErr = s.ServeTCP(ctx, ln)
+	}()
+
+	wg.Wait()
+
+	return errors.Join(udpErr, tcpErr)
+}
+
+// ServeUDP serves queries on pc until ctx is done, after which pc is closed.
+func (s *Server) ServeUDP(ctx context.Context, pc net.PacketConn) error {
+	context.AfterFunc(ctx, func() {
+		if err := pc.Close(); err != nil {
+			s.L().Warn("failed to close packet conn", "err", err)
+		}
+	})
+
+	s.L().Info("serving", "network", "udp", "addr", pc.LocalAddr().String())
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read failed: %w", err)
+		}
+
+		resp, err := s.Respond(buf[:n])
+		if err != nil {
+			s.L().Debug("dropping query", "client", addr.String(), "err", err)
+			continue
+		}
+
+		if _, err := pc.WriteTo(resp, addr); err != nil {
+			s.L().Debug("failed to write response", "client", addr.String(), "err", err)
+		}
+	}
+}
+
+// ServeTCP serves queries on ln until ctx is done, after which ln is closed.
+func (s *Server) ServeTCP(ctx context.Context, ln net.Listener) error {
+	context.AfterFunc(ctx, func() {
+		if err := ln.Close(); err != nil {
+			s.L().Warn("failed to close listener", "err", err)
+		}
+	})
+
+	s.L().Info("serving", "network", "tcp", "addr", ln.Addr().String())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		go s.handleTCP(ctx, conn)
+	}
+}
+
+// handleTCP answers length-prefixed queries on conn, until the client goes idle or ctx is done.
+func (s *Server) handleTCP(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.L().Debug("failed to close client conn", "err", err)
+		}
+	}()
+
+	var lenBuf [2]byte
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(TCPIdleTimeout)); err != nil {
+			s.L().Warn("failed to set deadline", "err", err)
+			return
+		}
+
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		resp, err := s.Respond(query)
+		if err != nil {
+			s.L().Debug("dropping query", "client", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Respond returns the response to a query, or an error if the query cannot be parsed enough to respond to.
+func (s *Server) Respond(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse header: %w", err)
+	}
+
+	if h.Response {
+		return nil, errors.New("not a query")
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               h.ID,
+			Response:         true,
+			OpCode:           h.OpCode,
+			RecursionDesired: h.RecursionDesired,
+		},
+	}
+
+	questions, err := p.AllQuestions()
+
+	switch {
+	case h.OpCode != 0:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case err != nil || len(questions) != 1:
+		resp.RCode = dnsmessage.RCodeFormatError
+	default:
+		q := questions[0]
+
+		resp.Questions = questions
+		resp.RCode, resp.Answers = s.answer(q)
+		resp.Authoritative = resp.RCode == dnsmessage.RCodeSuccess || resp.RCode == dnsmessage.RCodeNameError
+	}
+
+	return resp.Pack()
+}
+
+// answer returns the response code and answers for a single question.
+func (s *Server) answer(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+	domain := s.Source.Domain()
+
+	if domain == "" || (q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY) {
+		return dnsmessage.RCodeRefused, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	if ip, ok := parseReverse(name); ok {
+		if !s.inOverlay(ip) {
+			return dnsmessage.RCodeRefused, nil
+		}
+
+		host, ok := s.Source.LookupAddr(ip)
+		if !ok {
+			return dnsmessage.RCodeNameError, nil
+		}
+
+		if q.Type != dnsmessage.TypePTR && q.Type != dnsmessage.TypeALL {
+			return dnsmessage.RCodeSuccess, nil
+		}
+
+		target, err := dnsmessage.NewName(host + "." + domain + ".")
+		if err != nil {
+			return dnsmessage.RCodeServerFailure, nil
+		}
+
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{
+			{Header: header(q, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: target}},
+		}
+	}
+
+	if name == domain {
+		return dnsmessage.RCodeSuccess, nil
+	}
+
+	label, ok := strings.CutSuffix(name, "."+domain)
+	if !ok {
+		return dnsmessage.RCodeRefused, nil
+	}
+
+	if strings.Contains(label, ".") {
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	ip4, ip6, ok := s.Source.LookupName(label)
+	if !ok {
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	var answers []dnsmessage.Resource
+
+	if ip4.Is4() && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL) {
+		answers = append(answers, dnsmessage.Resource{Header: header(q, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: ip4.As4()}})
+	}
+
+	if ip6.Is6() && (q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL) {
+		answers = append(answers, dnsmessage.Resource{Header: header(q, dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: ip6.As16()}})
+	}
+
+	return dnsmessage.RCodeSuccess, answers
+}
+
+func (s *Server) inOverlay(ip netip.Addr) bool {
+	for _, p := range s.Source.Prefixes() {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func header(q dnsmessage.Question, t dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  t,
+		Class: dnsmessage.ClassINET,
+		TTL:   TTL,
+	}
+}
+
+// parseReverse parses a full in-addr.arpa or ip6.arpa name (lowercase, without trailing dot) into its address.
+func parseReverse(name string) (netip.Addr, bool) {
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(rest, ".")
+		if len(parts) != 4 {
+			return netip.Addr{}, false
+		}
+
+		ip, err := netip.ParseAddr(parts[3] + "." + parts[2] + "." + parts[1] + "." + parts[0])
+
+		return ip, err == nil
+	}
+
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+
+		var b [16]byte
+
+		for i, n := range nibbles {
+			if len(n) != 1 {
+				return netip.Addr{}, false
+			}
+
+			var v byte
+
+			switch c := n[0]; {
+			case '0' <= c && c <= '9':
+				v = c - '0'
+			case 'a' <= c && c <= 'f':
+				v = c - 'a' + 10
+			default:
+				return netip.Addr{}, false
+			}
+
+			// The first nibble is the lowest of the last byte.
+			pos := 31 - i
+			if pos%2 == 0 {
+				b[pos/2] |= v << 4
+			} else {
+				b[pos/2] |= v
+			}
+		}
+
+		return netip.AddrFrom16(b), true
+	}
+
+	return netip.Addr{}, false
+}
+
+// Resolve returns a function which resolves a hostname, either bare or under the domain of src, to an overlay
+// address; the IPv4 address if the node has one. It fits overlayproxy.ResolveFunc.
+func Resolve(src Source) func(ctx context.Context, host string) (netip.Addr, error) {
+	return func(_ context.Context, host string) (netip.Addr, error) {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+		if domain := src.Domain(); domain != "" {
+			host = strings.TrimSuffix(host, "."+domain)
+		}
+
+		ip4, ip6, ok := src.LookupName(host)
+
+		switch {
+		case !ok:
+			return netip.Addr{}, ErrNotFound
+		case ip4.IsValid():
+			return ip4, nil
+		case ip6.IsValid():
+			return ip6, nil
+		default:
+			return netip.Addr{}, ErrNotFound
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package overlaydns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeSource struct {
+	domain string
+	nodes  map[string][2]netip.Addr
+}
+
+func (f *fakeSource) Domain() string {
+	return f.domain
+}
+
+func (f *fakeSource) LookupName(name string) (ip4, ip6 netip.Addr, ok bool) {
+	ips, ok := f.nodes[name]
+	return ips[0], ips[1], ok
+}
+
+func (f *fakeSource) LookupAddr(ip netip.Addr) (string, bool) {
+	for name, ips := range f.nodes {
+		if ips[0] == ip || ips[1] == ip {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+func (f *fakeSource) Prefixes() []netip.Prefix {
+	return []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10"), netip.MustParsePrefix("fd42::/64")}
+}
+
+func testServer() *Server {
+	return &Server{Source: &fakeSource{
+		domain: "edup2p",
+		nodes: map[string][2]netip.Addr{
+			"lab-pc": {netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd42::2")},
+			"v6only": {{}, netip.MustParseAddr("fd42::3")},
+		},
+	}}
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	b, err := msg.Pack()
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestRespond(t *testing.T) {
+	s := testServer()
+
+	for _, tc := range []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers []string
+	}{
+		{"a", "lab-pc.edup2p.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"100.64.0.2"}},
+		{"a mixed case", "Lab-PC.EDUP2P.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"100.64.0.2"}},
+		{"aaaa", "lab-pc.edup2p.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd42::2"}},
+		{"a without ipv4", "v6only.edup2p.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil},
+		{"other type", "lab-pc.edup2p.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil},
+		{"unknown", "nope.edup2p.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"subdomain", "www.lab-pc.edup2p.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"apex", "edup2p.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil},
+		{"outside", "example.com.", dnsmessage.TypeA, dnsmessage.RCodeRefused, nil},
+		{"ptr ipv4", "2.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"lab-pc.edup2p."}},
+		{"ptr ipv6", "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.4.d.f.ip6.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"lab-pc.edup2p."}},
+		{"ptr unknown", "9.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, nil},
+		{"ptr outside", "1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeRefused, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := s.Respond(query(t, tc.qname, tc.qtype))
+			require.NoError(t, err)
+
+			var resp dnsmessage.Message
+			require.NoError(t, resp.Unpack(b))
+
+			assert.Equal(t, uint16(42), resp.ID)
+			assert.True(t, resp.Response)
+			assert.Equal(t, tc.rcode, resp.RCode)
+
+			var answers []string
+			for _, a := range resp.Answers {
+				switch body := a.Body.(type) {
+				case *dnsmessage.AResource:
+					answers = append(answers, netip.AddrFrom4(body.A).String())
+				case *dnsmessage.AAAAResource:
+					answers = append(answers, netip.AddrFrom16(body.AAAA).String())
+				case *dnsmessage.PTRResource:
+					answers = append(answers, body.PTR.String())
+				}
+			}
+
+			assert.Equal(t, tc.answers, answers)
+		})
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	s := testServer()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = s.ServeUDP(ctx, pc)
+	}()
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+
+	lctx, lcancel := context.WithTimeout(ctx, time.Second)
+	defer lcancel()
+
+	addrs, err := r.LookupNetIP(lctx, "ip4", "lab-pc.edup2p")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("100.64.0.2")}, addrs)
+
+	names, err := r.LookupAddr(lctx, "fd42::2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lab-pc.edup2p."}, names)
+}
@@ -0,0 +1,440 @@
+// Package portforward forwards TCP and UDP ports between this host and peers, through the overlay.
+//
+// A Forward listens on a local port, and forwards its connections to a port of a peer.
+// A Publish listens on a port of the overlay addresses of this node, and forwards the connections of peers to a
+// service on the loopback address; this publishes services which only listen on localhost, without reconfiguring them.
+//
+// Connections to published ports are only accepted from peers, as identified by their overlay address,
+// which wireguard only accepts from the peer control assigned it to.
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+)
+
+// DialTimeout bounds dialing the destination of a connection.
+const DialTimeout = 10 * time.Second
+
+// Loopback is the address forwards listen on, and published ports forward to.
+var Loopback = netip.MustParseAddr("127.0.0.1")
+
+var ErrUnknownPeer = errors.New("portforward: unknown peer")
+
+// Proto is the transport protocol of a forward.
+type Proto string
+
+const (
+	TCP Proto = "tcp"
+	UDP Proto = "udp"
+)
+
+// Net opens connections through the overlay, such as usrwg.NetstackWireGuardHost.
+//
+// Its listeners should only get the traffic which came through the overlay, as peers are identified by their address.
+type Net interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+// Peers identifies the nodes in the overlay, such as toversok.Engine.
+type Peers interface {
+	// LookupName returns the overlay addresses of the node with the given hostname.
+	LookupName(name string) (ip4, ip6 netip.Addr, ok bool)
+	// PeerByAddr returns the peer with the given overlay address.
+	PeerByAddr(ip netip.Addr) (key.NodePublic, bool)
+}
+
+// Forward forwards a port on the loopback address to a port of a peer.
+type Forward struct {
+	Proto Proto
+	Port  uint16
+
+	// Peer is the hostname of the peer, which is resolved for every connection.
+	Peer     string
+	PeerPort uint16
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.Proto, netip.AddrPortFrom(Loopback, f.Port), net.JoinHostPort(f.Peer, strconv.Itoa(int(f.PeerPort))))
+}
+
+// Publish forwards a port on the overlay addresses of this node to a port on the loopback address.
+type Publish struct {
+	Proto  Proto
+	Port   uint16
+	Target uint16
+
+	// Peers are the peers allowed to connect, or all peers if empty.
+	Peers []key.NodePublic
+}
+
+func (p Publish) String() string {
+	s := fmt.Sprintf("%s :%d -> %s", p.Proto, p.Port, netip.AddrPortFrom(Loopback, p.Target))
+
+	if len(p.Peers) > 0 {
+		peers := make([]string, len(p.Peers))
+		for i, peer := range p.Peers {
+			peers[i] = peer.Debug()
+		}
+
+		s += " for " + strings.Join(peers, ",")
+	}
+
+	return s
+}
+
+func (p Publish) allows(peer key.NodePublic) bool {
+	return len(p.Peers) == 0 || slices.Contains(p.Peers, peer)
+}
+
+func validProto(p Proto) error {
+	if p != TCP && p != UDP {
+		return fmt.Errorf("invalid protocol %q", p)
+	}
+
+	return nil
+}
+
+// Validate checks that forwards and published are complete, and that no two of them listen on the same port.
+func Validate(forwards []Forward, published []Publish) error {
+	type listen struct {
+		proto Proto
+		port  uint16
+	}
+
+	seen := make(map[listen]bool)
+
+	for _, f := range forwards {
+		if err := validProto(f.Proto); err != nil {
+			return err
+		}
+
+		if f.Port == 0 || f.PeerPort == 0 || f.Peer == "" {
+			return fmt.Errorf("incomplete forward %s", f)
+		}
+
+		if seen[listen{f.Proto, f.Port}] {
+			return fmt.Errorf("duplicate forward of %s port %d", f.Proto, f.Port)
+		}
+
+		seen[listen{f.Proto, f.Port}] = true
+	}
+
+	clear(seen)
+
+	for _, p := range published {
+		if err := validProto(p.Proto); err != nil {
+			return err
+		}
+
+		if p.Port == 0 || p.Target == 0 {
+			return fmt.Errorf("incomplete publish %s", p)
+		}
+
+		if seen[listen{p.Proto, p.Port}] {
+			return fmt.Errorf("duplicate publish of %s port %d", p.Proto, p.Port)
+		}
+
+		seen[listen{p.Proto, p.Port}] = true
+	}
+
+	return nil
+}
+
+// Forwarder runs forwards and published ports.
+type Forwarder struct {
+	// Net is the overlay network, which published ports listen on, and forwards dial through.
+	Net   Net
+	Peers Peers
+
+	// Addrs are the overlay addresses of this node, which published ports listen on.
+	Addrs []netip.Addr
+
+	mu sync.Mutex
+	// running holds the running forwards and published ports, by their String.
+	running map[string]*running
+}
+
+type running struct {
+	cancel    context.CancelFunc
+	listeners []io.Closer
+}
+
+// stop closes the listeners of r right away, so that their ports can be listened on again.
+func (r *running) stop() {
+	r.cancel()
+
+	for _, l := range r.listeners {
+		_ = l.Close()
+	}
+}
+
+func (f *Forwarder) L() *slog.Logger {
+	return slog.With("from", "portforward")
+}
+
+// Set runs forwards and published until ctx is done, replacing the ones set before.
+//
+// Ones that were set before keep running, with their connections. Errors if some could not listen,
+// which are left out; the others are started regardless.
+func (f *Forwarder) Set(ctx context.Context, forwards []Forward, published []Publish) error {
+	if err := Validate(forwards, published); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.running == nil {
+		f.running = make(map[string]*running)
+	}
+
+	want := make(map[string]func(ctx context.Context) ([]io.Closer, error))
+
+	for _, fwd := range forwards {
+		want[fwd.String()] = func(ctx context.Context) ([]io.Closer, error) { return f.startForward(ctx, fwd) }
+	}
+
+	for _, pub := range published {
+		want[pub.String()] = func(ctx context.Context) ([]io.Closer, error) { return f.startPublish(ctx, pub) }
+	}
+
+	// Stop removed ones first, as their ports may be reused.
+	for name, r := range f.running {
+		if want[name] == nil {
+			r.stop()
+			delete(f.running, name)
+
+			f.L().Info("stopped", "forward", name)
+		}
+	}
+
+	var errs []error
+
+	for name, start := range want {
+		if f.running[name] != nil {
+			continue
+		}
+
+		rCtx, cancel := context.WithCancel(ctx)
+
+		listeners, err := start(rCtx)
+		if err != nil {
+			cancel()
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+
+			continue
+		}
+
+		f.running[name] = &running{cancel: cancel, listeners: listeners}
+
+		f.L().Info("started", "forward", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// startForward listens for fwd, and returns its listener.
+func (f *Forwarder) startForward(ctx context.Context, fwd Forward) ([]io.Closer, error) {
+	addr := netip.AddrPortFrom(Loopback, fwd.Port).String()
+
+	dial := func(ctx context.Context, _ net.Addr) (net.Conn, error) {
+		return f.dialPeer(ctx, fwd)
+	}
+
+	if fwd.Proto == TCP {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		go f.serveTCP(ctx, ln, dial)
+
+		return []io.Closer{ln}, nil
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go f.serveUDP(ctx, pc, dial)
+
+	return []io.Closer{pc}, nil
+}
+
+// startPublish listens for pub on the overlay addresses it can, and returns their listeners.
+func (f *Forwarder) startPublish(ctx context.Context, pub Publish) ([]io.Closer, error) {
+	dial := func(ctx context.Context, remote net.Addr) (net.Conn, error) {
+		peer, ok := f.Peers.PeerByAddr(addrOf(remote))
+		if !ok {
+			return nil, ErrUnknownPeer
+		}
+
+		if !pub.allows(peer) {
+			return nil, fmt.Errorf("peer %s is not allowed", peer.Debug())
+		}
+
+		var d net.Dialer
+
+		return d.DialContext(ctx, string(pub.Proto), netip.AddrPortFrom(Loopback, pub.Target).String())
+	}
+
+	var errs []error
+	var listeners []io.Closer
+
+	for _, ip := range f.Addrs {
+		addr := netip.AddrPortFrom(ip, pub.Port).String()
+
+		if pub.Proto == TCP {
+			ln, err := f.Net.Listen("tcp", addr)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			go f.serveTCP(ctx, ln, dial)
+			listeners = append(listeners, ln)
+		} else {
+			pc, err := f.Net.ListenPacket("udp", addr)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			go f.serveUDP(ctx, pc, dial)
+			listeners = append(listeners, pc)
+		}
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.Join(append(errs, errors.New("could not listen on any overlay address"))...)
+	}
+
+	// Published ports are still reachable on the other addresses.
+	for _, err := range errs {
+		f.L().Warn("could not listen on overlay address", "forward", pub.String(), "err", err)
+	}
+
+	return listeners, nil
+}
+
+// dialPeer dials the peer of fwd through the overlay, over IPv4 if it has it.
+func (f *Forwarder) dialPeer(ctx context.Context, fwd Forward) (net.Conn, error) {
+	ip4, ip6, ok := f.Peers.LookupName(fwd.Peer)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownPeer, fwd.Peer)
+	}
+
+	ip := ip4
+	if !ip.IsValid() {
+		ip = ip6
+	}
+
+	return f.Net.DialContext(ctx, string(fwd.Proto), netip.AddrPortFrom(ip, fwd.PeerPort).String())
+}
+
+// dialFunc dials the destination for a connection or packets from remote.
+type dialFunc func(ctx context.Context, remote net.Addr) (net.Conn, error)
+
+// serveTCP forwards the connections on ln to the ones dial makes, until ctx is done, after which ln is closed.
+func (f *Forwarder) serveTCP(ctx context.Context, ln net.Listener, dial dialFunc) {
+	context.AfterFunc(ctx, func() {
+		_ = ln.Close()
+	})
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				f.L().Warn("accept failed", "addr", ln.Addr(), "err", err)
+			}
+
+			return
+		}
+
+		go f.handleTCP(ctx, conn, dial)
+	}
+}
+
+func (f *Forwarder) handleTCP(ctx context.Context, conn net.Conn, dial dialFunc) {
+	defer conn.Close()
+
+	dCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	remote, err := dial(dCtx, conn.RemoteAddr())
+	cancel()
+
+	if err != nil {
+		f.L().Info("could not forward connection", "from", conn.RemoteAddr(), "to", conn.LocalAddr(), "err", err)
+		return
+	}
+	defer remote.Close()
+
+	// Connections end with the forward.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		_ = remote.Close()
+	})
+	defer stop()
+
+	splice(conn, remote)
+}
+
+// splice copies between a and b until both sides are done.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b)
+		closeWrite(a)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a)
+		closeWrite(b)
+	}()
+
+	wg.Wait()
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = c.Close()
+	}
+}
+
+// addrOf returns the IP address of a TCP or UDP address.
+func addrOf(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return ap.Addr().Unmap()
+}
@@ -0,0 +1,236 @@
+package portforward
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var peerKey = key.NewNode().Public()
+
+// loopbackNet is the OS network, in which the loopback address stands in for the overlay.
+type loopbackNet struct{}
+
+func (loopbackNet) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (loopbackNet) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (loopbackNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+// loopbackPeers has "peer" live on the loopback address.
+type loopbackPeers struct{}
+
+func (loopbackPeers) LookupName(name string) (ip4, ip6 netip.Addr, ok bool) {
+	return Loopback, netip.Addr{}, name == "peer"
+}
+
+func (loopbackPeers) PeerByAddr(ip netip.Addr) (key.NodePublic, bool) {
+	return peerKey, ip == Loopback
+}
+
+func newForwarder(t *testing.T) (*Forwarder, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &Forwarder{Net: loopbackNet{}, Peers: loopbackPeers{}, Addrs: []netip.Addr{Loopback}}, ctx
+}
+
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// echoTCP serves a TCP echo server on the loopback address, and returns its port.
+func echoTCP(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// echoUDP serves a UDP echo server on the loopback address, and returns its port.
+func echoUDP(t *testing.T) uint16 {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) (string, error) {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, len(msg))
+	n, err := io.ReadFull(conn, buf)
+
+	return string(buf[:n]), err
+}
+
+func TestForwardTCP(t *testing.T) {
+	f, ctx := newForwarder(t)
+	local, published := freePort(t), freePort(t)
+	pub := Publish{Proto: TCP, Port: published, Target: echoTCP(t)}
+
+	require.NoError(t, f.Set(ctx, []Forward{{Proto: TCP, Port: local, Peer: "peer", PeerPort: published}}, []Publish{pub}))
+
+	conn, err := net.Dial("tcp", netip.AddrPortFrom(Loopback, local).String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	got, err := roundTrip(t, conn, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+
+	// Removed forwards stop, while the ones set again keep running, with their connections.
+	require.NoError(t, f.Set(ctx, nil, []Publish{pub}))
+
+	_, err = net.Dial("tcp", netip.AddrPortFrom(Loopback, local).String())
+	assert.Error(t, err)
+
+	direct, err := net.Dial("tcp", netip.AddrPortFrom(Loopback, published).String())
+	require.NoError(t, err)
+	defer direct.Close()
+
+	got, err = roundTrip(t, direct, "again")
+	require.NoError(t, err)
+	assert.Equal(t, "again", got)
+
+	// Their ports can be used again right away.
+	pub.Target = echoTCP(t)
+	require.NoError(t, f.Set(ctx, nil, []Publish{pub}))
+}
+
+func TestForwardUDP(t *testing.T) {
+	f, ctx := newForwarder(t)
+	local, published := freePort(t), freePort(t)
+
+	require.NoError(t, f.Set(ctx,
+		[]Forward{{Proto: UDP, Port: local, Peer: "peer", PeerPort: published}},
+		[]Publish{{Proto: UDP, Port: published, Target: echoUDP(t)}},
+	))
+
+	conn, err := net.Dial("udp", netip.AddrPortFrom(Loopback, local).String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"one", "two"} {
+		got, err := roundTrip(t, conn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, msg, got)
+	}
+}
+
+func TestPublishPeers(t *testing.T) {
+	f, ctx := newForwarder(t)
+	published := freePort(t)
+
+	require.NoError(t, f.Set(ctx, nil, []Publish{
+		{Proto: TCP, Port: published, Target: echoTCP(t), Peers: []key.NodePublic{key.NewNode().Public()}},
+	}))
+
+	conn, err := net.Dial("tcp", netip.AddrPortFrom(Loopback, published).String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = roundTrip(t, conn, "hello")
+	assert.Error(t, err, "peer should not be allowed")
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(
+		[]Forward{{Proto: TCP, Port: 80, Peer: "peer", PeerPort: 80}, {Proto: UDP, Port: 80, Peer: "peer", PeerPort: 80}},
+		[]Publish{{Proto: TCP, Port: 80, Target: 8080}},
+	))
+
+	assert.Error(t, Validate([]Forward{{Proto: "sctp", Port: 80, Peer: "peer", PeerPort: 80}}, nil))
+	assert.Error(t, Validate([]Forward{{Proto: TCP, Port: 80, PeerPort: 80}}, nil))
+	assert.Error(t, Validate(nil, []Publish{{Proto: UDP, Port: 53}}))
+	assert.Error(t, Validate([]Forward{
+		{Proto: TCP, Port: 80, Peer: "peer", PeerPort: 80},
+		{Proto: TCP, Port: 80, Peer: "other", PeerPort: 80},
+	}, nil))
+}
+
+func TestServeUDPSlowDial(t *testing.T) {
+	f, ctx := newForwarder(t)
+	target := netip.AddrPortFrom(Loopback, echoUDP(t)).String()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer slow.Close()
+
+	// Flows from slow are never dialed.
+	go f.serveUDP(ctx, pc, func(ctx context.Context, remote net.Addr) (net.Conn, error) {
+		if remote.String() == slow.LocalAddr().String() {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		var d net.Dialer
+
+		return d.DialContext(ctx, "udp", target)
+	})
+
+	_, err = slow.Write([]byte("stuck"))
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	got, err := roundTrip(t, conn, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+}
@@ -0,0 +1,202 @@
+package portforward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPIdleTimeout is the time after which a UDP flow without packets in either direction is forgotten.
+const UDPIdleTimeout = 2 * time.Minute
+
+// MaxUDPFlows bounds the UDP flows of a forward or published port; packets from further sources are dropped.
+const MaxUDPFlows = 256
+
+// maxPendingPackets bounds the packets kept of a UDP flow while its connection is dialed; further ones are dropped.
+const maxPendingPackets = 16
+
+// maxDatagramLen is the largest UDP payload.
+const maxDatagramLen = 65535
+
+// udpFlow is the connection packets from one source are forwarded over.
+type udpFlow struct {
+	mu sync.Mutex
+	// conn is nil while it is dialed, during which packets are kept in pending.
+	conn       net.Conn
+	pending    [][]byte
+	lastActive time.Time
+}
+
+func (u *udpFlow) touch() {
+	u.mu.Lock()
+	u.lastActive = time.Now()
+	u.mu.Unlock()
+}
+
+func (u *udpFlow) idle() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return time.Since(u.lastActive) >= UDPIdleTimeout
+}
+
+// send forwards pkt over the connection, or keeps a copy of it until the connection is dialed.
+func (u *udpFlow) send(pkt []byte) error {
+	u.mu.Lock()
+
+	u.lastActive = time.Now()
+
+	if u.conn == nil {
+		if len(u.pending) < maxPendingPackets {
+			u.pending = append(u.pending, bytes.Clone(pkt))
+		}
+
+		u.mu.Unlock()
+
+		return nil
+	}
+
+	conn := u.conn
+	u.mu.Unlock()
+
+	_, err := conn.Write(pkt)
+
+	return err
+}
+
+// connected forwards the pending packets over conn, after which packets are sent over it directly.
+func (u *udpFlow) connected(conn net.Conn) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var errs []error
+
+	// Sent while holding mu, so that they stay ahead of the packets which follow them.
+	for _, pkt := range u.pending {
+		if _, err := conn.Write(pkt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	u.conn = conn
+	u.pending = nil
+
+	return errors.Join(errs...)
+}
+
+// serveUDP forwards the packets on pc over a connection dial makes per source, and the replies back to the source,
+// until ctx is done, after which pc is closed.
+//
+// Connections are dialed aside from reading pc, so that one slow destination does not hold up the other flows.
+func (f *Forwarder) serveUDP(ctx context.Context, pc net.PacketConn, dial dialFunc) {
+	// Flows end along with pc, also when it fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	context.AfterFunc(ctx, func() {
+		_ = pc.Close()
+	})
+
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	forget := func(src net.Addr) {
+		mu.Lock()
+		delete(flows, src.String())
+		mu.Unlock()
+	}
+
+	buf := make([]byte, maxDatagramLen)
+
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				f.L().Warn("read failed", "addr", pc.LocalAddr(), "err", err)
+			}
+
+			return
+		}
+
+		mu.Lock()
+		flow := flows[src.String()]
+
+		if flow == nil {
+			if len(flows) >= MaxUDPFlows {
+				mu.Unlock()
+				f.L().Debug("too many flows, dropping packet", "from", src, "to", pc.LocalAddr())
+
+				continue
+			}
+
+			flow = &udpFlow{}
+			flows[src.String()] = flow
+
+			go f.dialUDP(ctx, pc, src, flow, dial, func() { forget(src) })
+		}
+		mu.Unlock()
+
+		if err := flow.send(buf[:n]); err != nil {
+			f.L().Debug("could not forward packet", "from", src, "err", err)
+		}
+	}
+}
+
+// dialUDP dials the connection of flow, and forwards the replies on it until it is idle, closed, or ctx is done,
+// after which it calls forget.
+func (f *Forwarder) dialUDP(ctx context.Context, pc net.PacketConn, src net.Addr, flow *udpFlow, dial dialFunc, forget func()) {
+	defer forget()
+
+	dCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	conn, err := dial(dCtx, src)
+	cancel()
+
+	if err != nil {
+		f.L().Info("could not forward packets", "from", src, "to", pc.LocalAddr(), "err", err)
+		return
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if err := flow.connected(conn); err != nil {
+		f.L().Debug("could not forward packet", "from", src, "err", err)
+	}
+
+	f.replyUDP(pc, src, flow)
+}
+
+// replyUDP forwards the replies on the connection of flow back to src, until it is idle or closed.
+func (f *Forwarder) replyUDP(pc net.PacketConn, src net.Addr, flow *udpFlow) {
+	buf := make([]byte, maxDatagramLen)
+
+	for {
+		if err := flow.conn.SetReadDeadline(time.Now().Add(UDPIdleTimeout)); err != nil {
+			return
+		}
+
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && !flow.idle() {
+				// Packets were sent the other way in the meantime.
+				continue
+			}
+
+			return
+		}
+
+		flow.touch()
+
+		if _, err := pc.WriteTo(buf[:n], src); err != nil {
+			f.L().Debug("could not forward reply", "to", src, "err", err)
+			return
+		}
+	}
+}
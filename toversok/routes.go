@@ -0,0 +1,98 @@
+package toversok
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
+)
+
+// PeerRoutes keeps the routes of all peers.
+//
+// The Session keeps the routes control gave every peer, and configures the ones to route into wireguard
+// through PeerCfg.Routes (see Session.wgRoutes); a WireGuardController keeps only those, to route into its interface.
+type PeerRoutes map[key.NodePublic][]netip.Prefix
+
+// Set replaces the routes of peer, and returns whether that changed All.
+func (p PeerRoutes) Set(peer key.NodePublic, routes []netip.Prefix) bool {
+	before := p.All()
+
+	if len(routes) == 0 {
+		delete(p, peer)
+	} else {
+		p[peer] = slices.Clone(routes)
+	}
+
+	return !slices.Equal(before, p.All())
+}
+
+// All returns the routes of all peers, sorted and without duplicates.
+func (p PeerRoutes) All() []netip.Prefix {
+	var all []netip.Prefix
+
+	for _, routes := range p {
+		all = append(all, routes...)
+	}
+
+	slices.SortFunc(all, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+
+		return a.Bits() - b.Bits()
+	})
+
+	return slices.Compact(all)
+}
+
+// advertiseRoutes forwards traffic from peers into routes, and has control distribute them to peers once approved.
+func (s *Session) advertiseRoutes(routes []netip.Prefix) error {
+	if f, ok := s.fw.(Forwarder); ok {
+		overlay := []netip.Prefix{s.cs.IPv4().Masked(), s.cs.IPv6().Masked()}
+
+		if err := f.SetForwarding(overlay, routes); err != nil {
+			return fmt.Errorf("could not set up forwarding: %w", err)
+		}
+	} else if len(routes) > 0 {
+		slog.Warn("firewall cannot forward traffic into advertised routes, this has to be set up separately", "routes", routes)
+	}
+
+	if err := s.cs.UpdateRoutes(routes); err != nil {
+		return fmt.Errorf("could not inform control: %w", err)
+	}
+
+	return nil
+}
+
+// SetAdvertisedRoutes sets the prefixes this node routes into the network, for control to approve and
+// distribute to peers. Traffic from peers into these prefixes is forwarded by this node, see Forwarder.
+//
+// Include msgcontrol.ExitRoutes to offer this node as an exit node, see SetExitNode.
+//
+// Replaces the routes set before, and applies to the current session right away if it is running.
+func (e *Engine) SetAdvertisedRoutes(routes []netip.Prefix) error {
+	if err := msgcontrol.ValidateRoutes(routes); err != nil {
+		return err
+	}
+
+	e.routesMu.Lock()
+	e.routes = slices.Clone(routes)
+	e.routesMu.Unlock()
+
+	if sess := e.session(); sess != nil {
+		return sess.advertiseRoutes(routes)
+	}
+
+	return nil
+}
+
+// AdvertisedRoutes returns the prefixes this node routes into the network, see SetAdvertisedRoutes.
+func (e *Engine) AdvertisedRoutes() []netip.Prefix {
+	e.routesMu.Lock()
+	defer e.routesMu.Unlock()
+
+	return slices.Clone(e.routes)
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"slices"
 	"sync"
 
 	"github.com/edup2p/common/toversok/actors"
+	"github.com/edup2p/common/toversok/portforward"
 	"github.com/edup2p/common/types"
 	"github.com/edup2p/common/types/ifaces"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/edup2p/common/types/msgsess"
 	"github.com/edup2p/common/types/relay"
 )
 
@@ -25,12 +28,26 @@ type Session struct {
 	fw FirewallController
 	cs ifaces.ControlSession
 
+	// quarantineMu guards the firewall state; quarantinedPeers, peerRules, and peerAddrs.
 	quarantineMu     sync.Mutex
 	quarantinedPeers map[key.NodePublic]bool
+	peerRules        map[key.NodePublic][]msgcontrol.FilterRule
 	peerAddrs        map[key.NodePublic][]netip.Addr
 
+	// routesMu guards the routing state; peerRoutes, exitNode, and relays, which are kept out of the exit node.
+	routesMu   sync.Mutex
+	peerRoutes PeerRoutes
+	exitNode   key.NodePublic
+	relays     []relay.Information
+
 	stage ifaces.Stage
 
+	// forwarder runs the port forwards of the engine, see Engine.SetPortForwards.
+	forwarder *portforward.Forwarder
+
+	// onSideBand handles side-band data of application-defined types from peers, set before Start.
+	onSideBand func(peer key.NodePublic, data *msgsess.SideBandData)
+
 	sessionKey key.SessionPrivate
 }
 
@@ -51,7 +68,9 @@ func SetupSession(
 		ccc:              ccc,
 		quarantineMu:     sync.Mutex{},
 		quarantinedPeers: make(map[key.NodePublic]bool),
+		peerRules:        make(map[key.NodePublic][]msgcontrol.FilterRule),
 		peerAddrs:        make(map[key.NodePublic][]netip.Addr),
+		peerRoutes:       make(PeerRoutes),
 		sessionKey:       key.NewSession(),
 
 		stage: nil,
@@ -64,18 +83,26 @@ func SetupSession(
 		return nil, fmt.Errorf("could not create control client: %w", err)
 	}
 
-	if sess.wg, err = wg.Controller(*getNodePriv(), sess.cs.IPv4(), sess.cs.IPv6()); err != nil {
+	if sess.wg, err = wg.Controller(*getNodePriv(), sess.cs.IPv4(), sess.cs.IPv6(), sess.cs.MTU()); err != nil {
 		err = fmt.Errorf("could not init wireguard: %w", err)
 		sess.ccc(err)
 		return nil, err
 	}
 
+	sess.forwarder = &portforward.Forwarder{
+		Net:   sess.overlayNet(),
+		Peers: sess,
+		Addrs: []netip.Addr{sess.cs.IPv4().Addr(), sess.cs.IPv6().Addr()},
+	}
+
 	if sess.fw, err = fw.Controller(); err != nil {
 		err = fmt.Errorf("could not init firewall: %w", err)
 		sess.ccc(err)
 		return nil, err
 	}
 
+	injector, _ := sess.wg.(ifaces.Injectable)
+
 	sess.stage = actors.MakeStage(
 		sess.ctx,
 		getNodePriv,
@@ -85,8 +112,11 @@ func SetupSession(
 		sess.cs,
 		nil,
 		sess.wg.GetInterface(),
+		injector,
 	)
 
+	sess.stage.SetSideBandHandler(sess.receiveSideBand)
+
 	sess.cs.InstallCallbacks(sess)
 	context.AfterFunc(sess.cs.Context(), func() {
 		sess.ccc(errors.New("resumable control session exited"))
@@ -100,6 +130,7 @@ func SetupSession(
 
 func (s *Session) Start() {
 	s.stage.Start()
+	s.setupDNS()
 }
 
 func (s *Session) getPriv() *key.SessionPrivate {
@@ -113,14 +144,19 @@ func (s *Session) registerPeerAddrs(peer key.NodePublic, ip4, ip6 netip.Addr) {
 	s.peerAddrs[peer] = []netip.Addr{ip4, ip6}
 }
 
-func (s *Session) upsertQuarantine(peer key.NodePublic) {
+// upsertQuarantine quarantines peer, and returns whether it was not already.
+func (s *Session) upsertQuarantine(peer key.NodePublic) bool {
 	s.quarantineMu.Lock()
 	defer s.quarantineMu.Unlock()
 
-	if !s.quarantinedPeers[peer] {
-		s.quarantinedPeers[peer] = true
-		s.triggerQuarantineUpdate()
+	if s.quarantinedPeers[peer] {
+		return false
 	}
+
+	s.quarantinedPeers[peer] = true
+	s.triggerQuarantineUpdate()
+
+	return true
 }
 
 func (s *Session) delQuarantine(peer key.NodePublic) {
@@ -148,9 +184,96 @@ func (s *Session) triggerQuarantineUpdate() {
 	}
 }
 
+func (s *Session) setRules(peer key.NodePublic, rules []msgcontrol.FilterRule) {
+	s.quarantineMu.Lock()
+	defer s.quarantineMu.Unlock()
+
+	if len(rules) == 0 && len(s.peerRules[peer]) == 0 {
+		return
+	}
+
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			// The firewall skips invalid rules, which still restricts all other connections with the peer.
+			slog.Warn("received invalid filter rule for peer", "peer", peer.Debug(), "rule", r, "err", err)
+		}
+	}
+
+	if len(rules) == 0 {
+		delete(s.peerRules, peer)
+	} else {
+		s.peerRules[peer] = rules
+	}
+
+	s.triggerRulesUpdate()
+}
+
+// triggerRulesUpdate gives the firewall the rules of the overlay IPs and routes of all peers,
+// once any peer has rules, as a peer without rules may have IPs within the routes of one with (see SetPeerRules).
+//
+// All routes are given, also the ones which are not routed into wireguard (see wgRoutes),
+// so that the firewall already restricts them before wireguard accepts traffic from them.
+//
+// (assumes locked quarantineMu)
+func (s *Session) triggerRulesUpdate() {
+	rules := make(map[netip.Prefix][]msgcontrol.FilterRule)
+
+	if len(s.peerRules) > 0 {
+		s.routesMu.Lock()
+
+		for peer, addrs := range s.peerAddrs {
+			peerRules := s.peerRules[peer]
+
+			var prefixes []netip.Prefix
+			for _, addr := range addrs {
+				if addr.IsValid() {
+					prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				}
+			}
+
+			for _, prefix := range append(prefixes, s.peerRoutes[peer]...) {
+				// A prefix of several peers keeps the rules of the one which has them.
+				if len(peerRules) > 0 || len(rules[prefix]) == 0 {
+					rules[prefix] = peerRules
+				}
+			}
+		}
+
+		s.routesMu.Unlock()
+	}
+
+	if err := s.fw.SetPeerRules(rules); err != nil {
+		slog.Error("could not update firewall with peer rules", "err", err)
+	}
+}
+
+// forgetPeer removes all firewall and routing state of a peer.
+func (s *Session) forgetPeer(peer key.NodePublic) {
+	s.quarantineMu.Lock()
+	defer s.quarantineMu.Unlock()
+
+	_, hadRules := s.peerRules[peer]
+	wasQuarantined := s.quarantinedPeers[peer]
+
+	delete(s.peerRules, peer)
+	delete(s.quarantinedPeers, peer)
+	delete(s.peerAddrs, peer)
+
+	s.routesMu.Lock()
+	delete(s.peerRoutes, peer)
+	s.routesMu.Unlock()
+
+	if hadRules || len(s.peerRules) > 0 {
+		s.triggerRulesUpdate()
+	}
+	if wasQuarantined {
+		s.triggerQuarantineUpdate()
+	}
+}
+
 // CONTROL CALLBACKS
 
-func (s *Session) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.AddrPort, session key.SessionPublic, ip4, ip6 netip.Addr, prop msgcontrol.Properties) error {
+func (s *Session) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []netip.AddrPort, session key.SessionPublic, ip4, ip6 netip.Addr, hostname string, routes []netip.Prefix, prop msgcontrol.Properties) error {
 	s.registerPeerAddrs(peer, ip4, ip6)
 
 	if prop.Quarantine {
@@ -159,20 +282,23 @@ func (s *Session) AddPeer(peer key.NodePublic, homeRelay int64, endpoints []neti
 		s.delQuarantine(peer)
 	}
 
-	if err := s.wg.UpdatePeer(peer, PeerCfg{
-		VIPs: VirtualIPs{
-			IPv4: ip4,
-			IPv6: ip6,
-		},
-		KeepAliveInterval: nil,
-	}); err != nil {
-		return fmt.Errorf("failed to update wireguard: %w", err)
+	s.setRules(peer, prop.Rules)
+	s.setPeerRoutes(peer, routes)
+
+	if err := s.configurePeer(peer); err != nil {
+		return err
 	}
 
-	if err := s.stage.AddPeer(peer, homeRelay, endpoints, session, ip4, ip6, prop); err != nil {
+	if err := s.stage.AddPeer(peer, homeRelay, endpoints, session, ip4, ip6, hostname, routes, prop); err != nil {
 		return fmt.Errorf("failed to update stage: %w", err)
 	}
 
+	if s.isExitNode(peer) {
+		if err := s.updateBypass(); err != nil {
+			return fmt.Errorf("failed to update bypass of exit node: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -185,21 +311,115 @@ func (s *Session) RemovePeer(peer key.NodePublic) error {
 		return fmt.Errorf("failed to remove peer from wireguard: %w", err)
 	}
 
+	s.forgetPeer(peer)
+
 	return nil
 }
 
-func (s *Session) UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, prop *msgcontrol.Properties) error {
+func (s *Session) UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, hostname *string, routes *[]netip.Prefix, prop *msgcontrol.Properties) error {
 	if prop != nil {
-		if prop.Quarantine {
-			s.upsertQuarantine(peer)
+		if prop.Quarantine && s.upsertQuarantine(peer) && routes == nil && s.knowsPeer(peer) {
+			// Withholds its routes, see wgRoutes.
+			if err := s.configurePeer(peer); err != nil {
+				return err
+			}
+		}
+
+		s.setRules(peer, prop.Rules)
+	}
+
+	if routes != nil {
+		if !s.knowsPeer(peer) {
+			return fmt.Errorf("cannot update routes of unknown peer %s", peer.Debug())
+		}
+
+		s.setPeerRoutes(peer, *routes)
+
+		if err := s.configurePeer(peer); err != nil {
+			return err
+		}
+	}
+
+	if err := s.stage.UpdatePeer(peer, homeRelay, endpoints, session, hostname, routes, prop); err != nil {
+		return err
+	}
+
+	if endpoints != nil && s.isExitNode(peer) {
+		if err := s.updateBypass(); err != nil {
+			return fmt.Errorf("failed to update bypass of exit node: %w", err)
 		}
 	}
 
-	return s.stage.UpdatePeer(peer, homeRelay, endpoints, session, prop)
+	return nil
+}
+
+func (s *Session) knowsPeer(peer key.NodePublic) bool {
+	s.quarantineMu.Lock()
+	defer s.quarantineMu.Unlock()
+
+	_, ok := s.peerAddrs[peer]
+
+	return ok
+}
+
+func (s *Session) setPeerRoutes(peer key.NodePublic, routes []netip.Prefix) {
+	s.quarantineMu.Lock()
+	defer s.quarantineMu.Unlock()
+
+	s.routesMu.Lock()
+	s.peerRoutes.Set(peer, routes)
+	s.routesMu.Unlock()
+
+	if len(s.peerRules) > 0 {
+		s.triggerRulesUpdate()
+	}
+}
+
+func (s *Session) isExitNode(peer key.NodePublic) bool {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	return peer == s.exitNode
+}
+
+// configurePeer (re)configures wireguard with the addresses and routes of a peer, see wgRoutes.
+func (s *Session) configurePeer(peer key.NodePublic) error {
+	s.quarantineMu.Lock()
+	addrs, ok := s.peerAddrs[peer]
+	routes := s.wgRoutes(peer)
+	s.quarantineMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("cannot configure unknown peer %s", peer.Debug())
+	}
+
+	if err := s.wg.UpdatePeer(peer, PeerCfg{
+		VIPs: VirtualIPs{
+			IPv4: addrs[0],
+			IPv6: addrs[1],
+		},
+		Routes:            routes,
+		KeepAliveInterval: nil,
+	}); err != nil {
+		return fmt.Errorf("failed to update wireguard: %w", err)
+	}
+
+	return nil
 }
 
 // PASSTHROUGH
 
 func (s *Session) UpdateRelays(relay []relay.Information) error {
+	s.routesMu.Lock()
+	s.relays = slices.Clone(relay)
+	exit := s.exitNode
+	s.routesMu.Unlock()
+
+	if !exit.IsZero() {
+		if err := s.updateBypass(); err != nil {
+			slog.Warn("could not keep relays out of the exit node", "err", err)
+		}
+	}
+
 	return s.stage.UpdateRelays(relay)
 }
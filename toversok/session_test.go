@@ -0,0 +1,139 @@
+package toversok
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWG records the configuration of peers, in place of wireguard.
+type fakeWG struct {
+	mu    sync.Mutex
+	peers map[key.NodePublic]PeerCfg
+}
+
+func (w *fakeWG) UpdatePeer(publicKey key.NodePublic, cfg PeerCfg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.peers[publicKey] = cfg
+
+	return nil
+}
+
+func (w *fakeWG) RemovePeer(publicKey key.NodePublic) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.peers, publicKey)
+
+	return nil
+}
+
+func (w *fakeWG) GetStats(key.NodePublic) (*WGStats, error) { return nil, nil }
+func (w *fakeWG) ConnFor(key.NodePublic) types.UDPConn      { return nil }
+func (w *fakeWG) GetInterface() *net.Interface              { return nil }
+func (w *fakeWG) MTU() int                                  { return msgcontrol.MaxMTU }
+
+// accepts returns whether wireguard accepts packets from src from peer, by its allowed IPs.
+func (w *fakeWG) accepts(peer key.NodePublic, src netip.Addr) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cfg, ok := w.peers[peer]
+
+	return ok && slices.ContainsFunc(cfg.AllowedIPs(), func(p netip.Prefix) bool { return p.Contains(src) })
+}
+
+// fakeFW records the last configuration, in place of a firewall.
+type fakeFW struct {
+	quarantined []netip.Addr
+	rules       map[netip.Prefix][]msgcontrol.FilterRule
+}
+
+func (f *fakeFW) QuarantineNodes(ips []netip.Addr) error {
+	f.quarantined = ips
+	return nil
+}
+
+func (f *fakeFW) SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error {
+	f.rules = rules
+	return nil
+}
+
+func newTestSession() (*Session, *fakeWG, *fakeFW) {
+	wg := &fakeWG{peers: make(map[key.NodePublic]PeerCfg)}
+	fw := &fakeFW{}
+
+	return &Session{
+		wg:               wg,
+		fw:               fw,
+		quarantinedPeers: make(map[key.NodePublic]bool),
+		peerRules:        make(map[key.NodePublic][]msgcontrol.FilterRule),
+		peerAddrs:        make(map[key.NodePublic][]netip.Addr),
+		peerRoutes:       make(PeerRoutes),
+	}, wg, fw
+}
+
+func TestQuarantinedRoutesDropped(t *testing.T) {
+	s, wg, fw := newTestSession()
+
+	router := key.NewNode().Public()
+	ip4, ip6 := netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd00::2")
+	routed := netip.MustParseAddr("192.168.1.2")
+
+	s.registerPeerAddrs(router, ip4, ip6)
+	s.setPeerRoutes(router, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")})
+	require.NoError(t, s.configurePeer(router))
+
+	assert.True(t, wg.accepts(router, routed), "routed source is dropped")
+
+	require.True(t, s.upsertQuarantine(router))
+	require.NoError(t, s.configurePeer(router))
+
+	assert.Contains(t, fw.quarantined, ip4)
+	assert.True(t, wg.accepts(router, ip4), "overlay IP is dropped by wireguard, instead of the firewall")
+	assert.False(t, wg.accepts(router, routed), "routed source of quarantined peer is accepted")
+
+	s.delQuarantine(router)
+	require.NoError(t, s.configurePeer(router))
+
+	assert.True(t, wg.accepts(router, routed), "routed source is dropped after quarantine")
+}
+
+func TestPeerRulesCoverRoutes(t *testing.T) {
+	s, _, fw := newTestSession()
+
+	router, exit, other := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	rules := []msgcontrol.FilterRule{{Direction: msgcontrol.DirectionIn, Protocol: msgcontrol.ProtocolTCP}}
+
+	s.registerPeerAddrs(router, netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd00::2"))
+	s.registerPeerAddrs(exit, netip.MustParseAddr("100.64.0.3"), netip.MustParseAddr("fd00::3"))
+	s.registerPeerAddrs(other, netip.MustParseAddr("100.64.0.4"), netip.Addr{})
+
+	s.setRules(router, rules)
+	s.setPeerRoutes(router, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")})
+	s.setPeerRoutes(exit, msgcontrol.ExitRoutes)
+
+	assert.Equal(t, rules, fw.rules[netip.MustParsePrefix("192.168.1.0/24")], "route of peer with rules is not restricted")
+	assert.Equal(t, rules, fw.rules[netip.MustParsePrefix("100.64.0.2/32")])
+
+	// The others are given without rules, as the exit routes contain them.
+	for _, prefix := range append(slices.Clone(msgcontrol.ExitRoutes), netip.MustParsePrefix("100.64.0.4/32")) {
+		peerRules, ok := fw.rules[prefix]
+		assert.True(t, ok, "prefix %s is not given", prefix)
+		assert.Empty(t, peerRules)
+	}
+
+	s.forgetPeer(router)
+
+	assert.Empty(t, fw.rules)
+}
@@ -0,0 +1,114 @@
+package toversok
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgsess"
+)
+
+// SideBandHandler handles side-band data of an application-defined type, received from peer.
+//
+// All handlers are called one at a time, on a single goroutine shared by all types and peers, and data is only valid
+// for the duration of the call. Handlers must not block; side-band data that arrives while they are behind is dropped.
+// Longer work should be handed off to another goroutine, with a copy of data.
+type SideBandHandler func(peer key.NodePublic, data []byte)
+
+var (
+	errReservedSideBandType = fmt.Errorf("side-band data types below %#x are reserved", msgsess.FirstApplicationType)
+	errSideBandTooLarge     = fmt.Errorf("side-band data is larger than %d bytes", msgsess.MaxSideBandDataLen)
+	errNoSession            = errors.New("engine has no running session")
+	errPeerQuarantined      = errors.New("peer is quarantined")
+)
+
+// HandleSideBand registers h for side-band data of type t that peers send with SendSideBand,
+// replacing the handler registered before. A nil h removes it.
+//
+// t must be an application-defined type, see msgsess.FirstApplicationType.
+func (e *Engine) HandleSideBand(t msgsess.SideBandDataType, h SideBandHandler) error {
+	if !t.IsApplication() {
+		return errReservedSideBandType
+	}
+
+	e.sideBandMu.Lock()
+	defer e.sideBandMu.Unlock()
+
+	if h == nil {
+		delete(e.sideBandHandlers, t)
+	} else {
+		e.sideBandHandlers[t] = h
+	}
+
+	return nil
+}
+
+// SendSideBand sends data of type t to peer, in an encrypted session message, over the path currently used to reach
+// it; directly, or through its home relay. This lets applications exchange small messages with peers,
+// such as presence or signalling, without opening sockets through the tunnel.
+//
+// Like any datagram, it may be lost. t must be an application-defined type, see msgsess.FirstApplicationType,
+// and data at most msgsess.MaxSideBandDataLen bytes. It errors when the engine is not running,
+// or if peer is unknown or quarantined.
+func (e *Engine) SendSideBand(peer key.NodePublic, t msgsess.SideBandDataType, data []byte) error {
+	if !t.IsApplication() {
+		return errReservedSideBandType
+	}
+
+	if len(data) > msgsess.MaxSideBandDataLen {
+		return errSideBandTooLarge
+	}
+
+	sess := e.session()
+	if sess == nil {
+		return errNoSession
+	}
+
+	return sess.sendSideBand(peer, &msgsess.SideBandData{Type: t, Data: slices.Clone(data)})
+}
+
+func (e *Engine) handleSideBand(peer key.NodePublic, data *msgsess.SideBandData) {
+	e.sideBandMu.RLock()
+	h := e.sideBandHandlers[data.Type]
+	e.sideBandMu.RUnlock()
+
+	if h == nil {
+		e.slog().Debug("dropping side-band data without handler", "peer", peer.Debug(), "type", data.Type)
+		return
+	}
+
+	h(peer, data.Data)
+}
+
+func (s *Session) sendSideBand(peer key.NodePublic, data *msgsess.SideBandData) error {
+	if s.isQuarantined(peer) {
+		return errPeerQuarantined
+	}
+
+	return s.stage.SendSideBand(peer, data)
+}
+
+func (s *Session) receiveSideBand(peer key.NodePublic, data *msgsess.SideBandData) {
+	if s.isQuarantined(peer) {
+		slog.Debug("dropping side-band data from quarantined peer", "peer", peer.Debug(), "type", data.Type)
+		return
+	}
+
+	if len(data.Data) > msgsess.MaxSideBandDataLen {
+		slog.Debug("dropping oversized side-band data", "peer", peer.Debug(), "type", data.Type, "len", len(data.Data))
+		return
+	}
+
+	if s.onSideBand != nil {
+		s.onSideBand(peer, data)
+	}
+}
+
+func (s *Session) isQuarantined(peer key.NodePublic) bool {
+	s.quarantineMu.Lock()
+	defer s.quarantineMu.Unlock()
+
+	return s.quarantinedPeers[peer]
+}
@@ -2,14 +2,17 @@ package control
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
 	"time"
 
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsname"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgcontrol"
 )
@@ -31,6 +34,19 @@ type Client struct {
 	IPv6 netip.Prefix
 
 	Expiry time.Time
+
+	// MTU as given by control, or 0 if it gave none.
+	MTU int
+
+	// Hostname as assigned by control, or empty if it gave none.
+	Hostname string
+	// Domain as given by control, or dnsname.DefaultDomain if it gave none.
+	Domain string
+
+	// RemoteAddr is the address the connection to control goes to, or invalid if it is unknown.
+	//
+	// When connected through a proxy, this is the address of the proxy.
+	RemoteAddr netip.Addr
 }
 
 func EstablishClient(parentCtx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, timeout time.Duration, getPriv func() *key.NodePrivate, getSess func() *key.SessionPrivate, controlKey key.ControlPublic, session *string, logon types.LogonCallback) (*Client, error) {
@@ -47,6 +63,8 @@ func EstablishClient(parentCtx context.Context, mc types.MetaConn, brw *bufio.Re
 
 		ControlKey: controlKey,
 		SessionID:  session,
+
+		RemoteAddr: remoteAddr(mc),
 	}
 
 	if err := c.Handshake(timeout, logon); err != nil {
@@ -58,6 +76,21 @@ func EstablishClient(parentCtx context.Context, mc types.MetaConn, brw *bufio.Re
 	return c, nil
 }
 
+// remoteAddr returns the remote address of mc, if it is known and an IP address.
+func remoteAddr(mc types.MetaConn) netip.Addr {
+	conn, ok := mc.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return netip.Addr{}
+	}
+
+	ap, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return ap.Addr().Unmap()
+}
+
 func (c *Client) Handshake(timeout time.Duration, logon types.LogonCallback) error {
 	if timeout != 0 {
 		if err := c.cc.mc.SetDeadline(time.Now().Add(timeout)); err != nil {
@@ -100,6 +133,7 @@ func (c *Client) Handshake(timeout time.Duration, logon types.LogonCallback) err
 		NodeKeyAttestation: c.getPriv().SealToControl(c.ControlKey, clearData),
 		SessKeyAttestation: c.getSess().SealToControl(c.ControlKey, clearData),
 		ResumeSessionID:    c.SessionID,
+		Hostname:           dnsname.DeviceHostname(),
 	}); err != nil {
 		return fmt.Errorf("error when sending logon: %w", err)
 	}
@@ -134,7 +168,12 @@ func (c *Client) Handshake(timeout time.Duration, logon types.LogonCallback) err
 
 		c.Expiry = m.AuthExpiry
 
-		slog.Debug("logon accepted", "as-peer", nodePubKey.Debug(), "as-sess", sessPubKey.Debug(), "with-sess-id", types.PtrOr(c.SessionID, "<nil>"), "with-ipv4", c.IPv4.String(), "with-ipv6", c.IPv6.String())
+		c.MTU = m.MTU
+
+		c.Hostname = m.Hostname
+		c.Domain = cmp.Or(m.Domain, dnsname.DefaultDomain)
+
+		slog.Debug("logon accepted", "as-peer", nodePubKey.Debug(), "as-sess", sessPubKey.Debug(), "with-sess-id", types.PtrOr(c.SessionID, "<nil>"), "with-ipv4", c.IPv4.String(), "with-ipv6", c.IPv6.String(), "with-hostname", c.Hostname)
 
 		return nil
 	default:
@@ -115,6 +115,8 @@ func (c *Conn) Read(ttfbTimeout time.Duration) (msgcontrol.ControlMessage, error
 		to = new(msgcontrol.Logout)
 	case msgcontrol.DisconnectType:
 		to = new(msgcontrol.Disconnect)
+	case msgcontrol.RoutesUpdateType:
+		to = new(msgcontrol.RoutesUpdate)
 
 	default:
 		return nil, fmt.Errorf("unknown type %v", typ)
@@ -2,6 +2,7 @@ package control
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/edup2p/common/types/key"
@@ -27,6 +28,16 @@ func (g *EdgeGraph) UpsertEdge(from, to ClientID, pair *VisibilityPair) error {
 		return errors.New("cannot insert pair to itself")
 	}
 
+	if err := msgcontrol.ValidateServiceTypes(pair.MDNSServices); err != nil {
+		return err
+	}
+
+	for _, r := range pair.Rules {
+		if r.To != from && r.To != to {
+			return fmt.Errorf("rule towards %s is not towards either of the pair", key.NodePublic(r.To).Debug())
+		}
+	}
+
 	fromMap := g.graph[from]
 
 	if fromMap == nil {
@@ -159,16 +170,58 @@ type VisibilityPair struct {
 	Quarantine *ClientID
 
 	MDNS bool
+	// MDNSServices restricts the DNS-SD service types (e.g. "_ipp._tcp") shared between the pair, if non-empty.
+	MDNSServices []string
+
+	// Rules restrict the connections between the pair, if non-empty.
+	//
+	// Only connections matching one of the rules are then allowed, in either direction.
+	Rules []PairRule
 }
 
-func (vp *VisibilityPair) PropertiesFor(peer key.NodePublic) msgcontrol.Properties {
+// PairRule allows connections towards one of the ClientIDs of a VisibilityPair.
+type PairRule struct {
+	// To is the ClientID which may be connected to.
+	To ClientID
+
+	// Protocol is the protocol to allow, or msgcontrol.ProtocolAny for all.
+	Protocol msgcontrol.Protocol
+
+	// Ports are the destination ports to allow, or empty for all.
+	Ports []msgcontrol.PortRange
+}
+
+// PropertiesFor returns the properties peer gets of the pair, of which other is the other end.
+//
+// It errors if a rule is towards neither of them.
+func (vp *VisibilityPair) PropertiesFor(peer, other key.NodePublic) (msgcontrol.Properties, error) {
 	p := msgcontrol.Properties{
-		MDNS: vp.MDNS,
+		MDNS:         vp.MDNS,
+		MDNSServices: vp.MDNSServices,
 	}
 
 	if vp.Quarantine != nil && *vp.Quarantine != ClientID(peer) {
 		p.Quarantine = true
 	}
 
-	return p
+	for _, r := range vp.Rules {
+		var direction msgcontrol.Direction
+
+		switch r.To {
+		case ClientID(peer):
+			direction = msgcontrol.DirectionIn
+		case ClientID(other):
+			direction = msgcontrol.DirectionOut
+		default:
+			return msgcontrol.Properties{}, fmt.Errorf("rule towards %s is not towards either of the pair", key.NodePublic(r.To).Debug())
+		}
+
+		p.Rules = append(p.Rules, msgcontrol.FilterRule{
+			Direction: direction,
+			Protocol:  r.Protocol,
+			Ports:     r.Ports,
+		})
+	}
+
+	return p, nil
 }
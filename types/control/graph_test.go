@@ -0,0 +1,43 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPropertiesFor(t *testing.T) {
+	a, b := key.NewNode().Public(), key.NewNode().Public()
+
+	vp := &VisibilityPair{
+		Quarantine: ptr(ClientID(a)),
+		Rules: []PairRule{
+			{To: ClientID(b), Protocol: msgcontrol.ProtocolTCP, Ports: []msgcontrol.PortRange{{First: 22, Last: 22}}},
+		},
+	}
+
+	propA, err := vp.PropertiesFor(a, b)
+	require.NoError(t, err)
+	assert.False(t, propA.Quarantine)
+	assert.Equal(t, msgcontrol.DirectionOut, propA.Rules[0].Direction)
+
+	propB, err := vp.PropertiesFor(b, a)
+	require.NoError(t, err)
+	assert.True(t, propB.Quarantine, "b should quarantine connections from a")
+	assert.Equal(t, msgcontrol.DirectionIn, propB.Rules[0].Direction)
+
+	// Rules towards neither of the pair are invalid, instead of being taken as outgoing.
+	vp.Rules = append(vp.Rules, PairRule{To: ClientID(key.NewNode().Public())})
+
+	_, err = vp.PropertiesFor(a, b)
+	assert.Error(t, err)
+
+	assert.Error(t, NewEdgeGraph().UpsertEdge(ClientID(a), ClientID(b), vp))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
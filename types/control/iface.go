@@ -18,6 +18,8 @@ var (
 	ErrSessionIsNotAuthenticating = errors.New("session is not authenticating")
 	ErrNeedsDisconnect            = errors.New("session needs disconnect")
 	ErrClientNotConnected         = errors.New("client is not connected")
+	ErrInvalidHostname            = errors.New("hostname is not a valid DNS label")
+	ErrHostnameTaken              = errors.New("hostname is already in use by another client")
 )
 
 // ServerLogic denotes exposed functions that a control server must provide for any business logic to interface with it.
@@ -61,12 +63,39 @@ type ServerLogic interface {
 	// Will error if client ID does not have any pairs, or if client ID is unknown.
 	GetVisibilityPairs(ClientID) (map[ClientID]VisibilityPair, error)
 	// UpsertVisibilityPair will insert or update a VisibilityPair for a pair of clients.
+	// Will error if the pair has an invalid service type in MDNSServices.
 	UpsertVisibilityPair(ClientID, ClientID, VisibilityPair) error
 	// UpsertMultiVisibilityPair will insert or update multiple VisibilityPair's for pairs of clients.
+	// Will error if a pair has an invalid service type in MDNSServices.
 	UpsertMultiVisibilityPair(ClientID, map[ClientID]VisibilityPair) error
 	// RemoveVisibilityPair will delete a VisibilityPair between clients.
 	// Idempotent, will not error if no pair exists.
 	RemoveVisibilityPair(ClientID, ClientID) error
+
+	/// The following functions pertain to naming clients.
+
+	// SetHostname assigns a hostname to a client, overriding the one it requests on logon.
+	// Peers which can see the client are informed right away, the client itself learns of it on its next logon.
+	// An empty hostname removes the assignment, which takes effect on the next logon.
+	// Will error if the hostname is not a valid DNS label, or if another client already uses it.
+	SetHostname(ClientID, string) error
+
+	/// The following functions pertain to subnet routing.
+
+	// ApproveRoutes sets the prefixes a client may route into the network, replacing the ones set before.
+	// Of the routes a client advertises, those within one of these prefixes are distributed to its peers,
+	// right away if it is connected. When multiple clients route the same prefix, it is only distributed for the one
+	// which had it first, until that one no longer has it, after which one of the others takes it over.
+	// Will error if a prefix is invalid.
+	//
+	// Exit routes (see msgcontrol.ExitRoutes) are not approved by this, but by ApproveExitNode.
+	ApproveRoutes(ClientID, []netip.Prefix) error
+	// ApproveExitNode sets whether a client may be an exit node; whether the exit routes it advertises are distributed
+	// to its peers, right away if it is connected. Peers only route their traffic through it once they opt into it.
+	ApproveExitNode(ClientID, bool)
+	// GetAdvertisedRoutes gets the routes a connected client advertises, approved or not.
+	// Will error if client is not connected.
+	GetAdvertisedRoutes(ClientID) ([]netip.Prefix, error)
 }
 
 // ServerCallbacks denotes all the functions the corresponding business logic to the control server must implement,
@@ -89,8 +118,14 @@ type ServerCallbacks interface {
 	// OnSessionFinalize is called right after ServerLogic.AcceptAuthentication, but before that message is sent to the client.
 	// The client needs to known which virtual IPs it can use, and the expiry time of the authentication,
 	// and this function will provide it to the control server.
-	OnSessionFinalize(SessID, ClientID) (netip.Prefix, netip.Prefix, time.Time)
+	//
+	// If it returns an error, the logon is rejected instead.
+	OnSessionFinalize(SessID, ClientID) (netip.Prefix, netip.Prefix, time.Time, error)
 
 	// OnSessionDestroy is called after the client has been disconnected.
 	OnSessionDestroy(SessID, ClientID)
+
+	// OnRoutesAdvertised is called when a client advertises the routes it would route into the network,
+	// replacing the ones it advertised before. Call ServerLogic.ApproveRoutes to have them distributed.
+	OnRoutesAdvertised(SessID, ClientID, []netip.Prefix)
 }
@@ -2,7 +2,10 @@ package control
 
 import (
 	"errors"
+	"net/netip"
+	"slices"
 
+	"github.com/edup2p/common/types/dnsname"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgcontrol"
 )
@@ -261,3 +264,102 @@ func (s *Server) sessLockedDoVisibilityPairs(id key.NodePublic, f func(map[Clien
 
 	return f(s.vGraph.GetEdges(ClientID(id)))
 }
+
+func (s *Server) SetHostname(id ClientID, name string) error {
+	if name != "" && !dnsname.ValidLabel(name) {
+		return ErrInvalidHostname
+	}
+
+	sess, changed, err := s.setHostname(id, name)
+	if err != nil || !changed {
+		return err
+	}
+
+	s.ForVisible(sess, func(session *ServerSession) {
+		session.UpdateHostname(sess.Peer, name)
+	})
+
+	return nil
+}
+
+// setHostname stores an assigned hostname, and returns the established session of the client if its hostname changed.
+func (s *Server) setHostname(id ClientID, name string) (sess *ServerSession, changed bool, err error) {
+	s.sessLock.Lock()
+	defer s.sessLock.Unlock()
+
+	if name == "" {
+		delete(s.hostnames, id)
+		return nil, false, nil
+	}
+
+	if s.hostnameTaken(id, name) {
+		return nil, false, ErrHostnameTaken
+	}
+
+	s.hostnames[id] = name
+
+	sess, ok := s.sessByNode[key.NodePublic(id)]
+	if !ok || sess.state != Established || sess.Hostname() == name {
+		return nil, false, nil
+	}
+
+	sess.setHostname(name)
+
+	return sess, true, nil
+}
+
+func (s *Server) ApproveRoutes(id ClientID, routes []netip.Prefix) error {
+	if err := msgcontrol.ValidateRoutes(routes); err != nil {
+		return err
+	}
+
+	s.sessLock.Lock()
+
+	if len(routes) == 0 {
+		delete(s.approvedRoutes, id)
+	} else {
+		s.approvedRoutes[id] = slices.Clone(routes)
+	}
+
+	sess, ok := s.sessByNode[key.NodePublic(id)]
+	established := ok && sess.state == Established
+
+	s.sessLock.Unlock()
+
+	if established {
+		s.updateRoutes(sess)
+	}
+
+	return nil
+}
+
+func (s *Server) ApproveExitNode(id ClientID, approved bool) {
+	s.sessLock.Lock()
+
+	if approved {
+		s.exitNodes[id] = true
+	} else {
+		delete(s.exitNodes, id)
+	}
+
+	sess, ok := s.sessByNode[key.NodePublic(id)]
+	established := ok && sess.state == Established
+
+	s.sessLock.Unlock()
+
+	if established {
+		s.updateRoutes(sess)
+	}
+}
+
+func (s *Server) GetAdvertisedRoutes(id ClientID) ([]netip.Prefix, error) {
+	s.sessLock.RLock()
+	defer s.sessLock.RUnlock()
+
+	sess, ok := s.sessByNode[key.NodePublic(id)]
+	if !ok {
+		return nil, ErrClientNotConnected
+	}
+
+	return sess.AdvertisedRoutes(), nil
+}
@@ -10,10 +10,12 @@ import (
 	"net"
 	"net/netip"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsname"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/types/msgcontrol"
 	"github.com/edup2p/common/types/relay"
@@ -36,6 +38,17 @@ type Server struct {
 	// TODO a way to allow the server to dynamically update this
 	relays []relay.Information
 
+	mtu    int
+	domain string
+	// hostnames assigned by business logic, see SetHostname.
+	hostnames map[ClientID]string
+	// approvedRoutes are the prefixes business logic allows clients to route, see ApproveRoutes.
+	approvedRoutes map[ClientID][]netip.Prefix
+	// exitNodes are the clients business logic allows to be exit nodes, see ApproveExitNode.
+	exitNodes map[ClientID]bool
+	// routesLock serializes updateRoutes, so that no two sessions are given the same route at once.
+	routesLock sync.Mutex
+
 	vGraph *EdgeGraph
 	// The intention of this lock is as follows;
 	//  - it is held by any session transitioning from authenticating to established, to grab all connections
@@ -114,13 +127,21 @@ func (s *Server) handleOp(op PairOperation) {
 			return
 		}
 
+		propA, errA := op.VisibilityPair.PropertiesFor(sessA.Peer, sessB.Peer)
+		propB, errB := op.VisibilityPair.PropertiesFor(sessB.Peer, sessA.Peer)
+
+		if err := errors.Join(errA, errB); err != nil {
+			slog.Error("found invalid visibility pair, aborting", "sessA", sessA.Sess, "sessB", sessB.Sess, "err", err)
+			return
+		}
+
 		// shorthand for "already greeted both", invariant via above
 		if aGreetedB {
-			sessA.UpdateProperties(sessB.Peer, op.VisibilityPair.PropertiesFor(sessA.Peer))
-			sessB.UpdateProperties(sessA.Peer, op.VisibilityPair.PropertiesFor(sessB.Peer))
+			sessA.UpdateProperties(sessB.Peer, propA)
+			sessB.UpdateProperties(sessA.Peer, propB)
 		} else {
-			sessA.Greet(sessB, op.VisibilityPair.PropertiesFor(sessA.Peer))
-			sessB.Greet(sessA, op.VisibilityPair.PropertiesFor(sessB.Peer))
+			sessA.Greet(sessB, propA)
+			sessB.Greet(sessA, propB)
 		}
 	} else {
 		sessA, okA := s.sessByID[op.A]
@@ -157,6 +178,8 @@ func (s *Server) Accept(ctx context.Context, mc types.MetaConn, brw *bufio.ReadW
 			return s.doReject(cc, sess, err)
 		}
 
+		sess.requestedHostname = logon.Hostname
+
 		if err := sess.doAuthenticate(resumed); err != nil {
 			return fmt.Errorf("authenticate returned with error: %w", err)
 		}
@@ -301,10 +324,13 @@ func NewServer(privKey key.ControlPrivate, relays []relay.Information) *Server {
 		sessByNode: make(map[key.NodePublic]*ServerSession),
 		sessByID:   make(map[string]*ServerSession),
 		// getIPs:   getIPs,
-		relays:       relays,
-		vGraph:       NewEdgeGraph(),
-		pendingLock:  sync.Mutex{},
-		pendingPairs: make(chan []PairOperation, 128),
+		relays:         relays,
+		hostnames:      make(map[ClientID]string),
+		approvedRoutes: make(map[ClientID][]netip.Prefix),
+		exitNodes:      make(map[ClientID]bool),
+		vGraph:         NewEdgeGraph(),
+		pendingLock:    sync.Mutex{},
+		pendingPairs:   make(chan []PairOperation, 128),
 	}
 
 	go s.Run()
@@ -312,6 +338,208 @@ func NewServer(privKey key.ControlPrivate, relays []relay.Information) *Server {
 	return s
 }
 
+// SetMTU sets the network-wide MTU given to clients on logon, or 0 to leave it up to them.
+//
+// Only affects sessions which log on afterwards.
+// Will error if the MTU is out of range, see msgcontrol.ValidateMTU.
+func (s *Server) SetMTU(mtu int) error {
+	if err := msgcontrol.ValidateMTU(mtu); err != nil {
+		return err
+	}
+
+	s.sessLock.Lock()
+	defer s.sessLock.Unlock()
+
+	s.mtu = mtu
+
+	return nil
+}
+
+func (s *Server) getMTU() int {
+	s.sessLock.RLock()
+	defer s.sessLock.RUnlock()
+
+	return s.mtu
+}
+
+// SetDomain sets the domain of the network given to clients on logon, under which they resolve peers by hostname.
+// An empty domain leaves it up to the clients.
+//
+// Only affects sessions which log on afterwards.
+func (s *Server) SetDomain(domain string) error {
+	if domain != "" && !dnsname.ValidDomain(domain) {
+		return fmt.Errorf("invalid domain: %q", domain)
+	}
+
+	s.sessLock.Lock()
+	defer s.sessLock.Unlock()
+
+	s.domain = domain
+
+	return nil
+}
+
+func (s *Server) getDomain() string {
+	s.sessLock.RLock()
+	defer s.sessLock.RUnlock()
+
+	return s.domain
+}
+
+// assignHostname gives sess a hostname; the one business logic assigned it, else the one it requested.
+//
+// Requested names which are already in use by another client get a suffix from the node key, to keep them unique.
+func (s *Server) assignHostname(sess *ServerSession) {
+	s.sessLock.Lock()
+	defer s.sessLock.Unlock()
+
+	id := ClientID(sess.Peer)
+
+	if name, ok := s.hostnames[id]; ok {
+		sess.setHostname(name)
+		return
+	}
+
+	name := dnsname.SanitizeLabel(sess.requestedHostname)
+	if name == "" {
+		name = "node"
+	}
+
+	if s.hostnameTaken(id, name) {
+		suffix := "-" + sess.Peer.HexString()[:8]
+		name = strings.TrimRight(name[:min(len(name), dnsname.MaxLabelLen-len(suffix))], "-") + suffix
+	}
+
+	sess.setHostname(name)
+}
+
+// hostnameTaken returns whether any client but id has, or is assigned, name.
+//
+// Assumes sessLock is held.
+func (s *Server) hostnameTaken(id ClientID, name string) bool {
+	for other, otherName := range s.hostnames {
+		if other != id && otherName == name {
+			return true
+		}
+	}
+
+	for node, sess := range s.sessByNode {
+		if ClientID(node) != id && sess.Hostname() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateRoutes recalculates the approved routes of sess, and informs the sessions which can see it if they changed.
+//
+// Routes another session already has are left out, as peers can only route a prefix to one of them;
+// once that session no longer has them, the sessions advertising them are updated to take them over.
+func (s *Server) updateRoutes(sess *ServerSession) {
+	s.routesLock.Lock()
+
+	s.sessLock.RLock()
+	id := ClientID(sess.Peer)
+	routes := effectiveRoutes(sess.AdvertisedRoutes(), s.approvedRoutes[id], s.routesTaken(sess), s.exitNodes[id], sess.IPv4.Masked(), sess.IPv6.Masked())
+	s.sessLock.RUnlock()
+
+	prev := sess.Routes()
+	changed := sess.setRoutes(routes)
+
+	s.routesLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	sess.Slog().Info("routes changed", "routes", routes)
+
+	s.ForVisible(sess, func(session *ServerSession) {
+		session.UpdateRoutes(sess.Peer, routes)
+	})
+
+	s.releaseRoutes(sess, slices.DeleteFunc(slices.Clone(prev), func(p netip.Prefix) bool {
+		return slices.Contains(routes, p)
+	}))
+}
+
+// routesTaken returns the routes of the established sessions other than sess.
+//
+// Assumes sessLock is held.
+func (s *Server) routesTaken(sess *ServerSession) []netip.Prefix {
+	var taken []netip.Prefix
+
+	for _, other := range s.sessByNode {
+		if other != sess && other.state == Established {
+			taken = append(taken, other.Routes()...)
+		}
+	}
+
+	return taken
+}
+
+// releaseRoutes updates the routes of the established sessions other than sess which advertise one of released,
+// so that one of them takes it over.
+func (s *Server) releaseRoutes(sess *ServerSession, released []netip.Prefix) {
+	released = slices.DeleteFunc(released, msgcontrol.IsExitRoute)
+	if len(released) == 0 {
+		return
+	}
+
+	var others []*ServerSession
+
+	s.sessLock.RLock()
+	for _, other := range s.sessByNode {
+		if other != sess && other.state == Established && slices.ContainsFunc(other.AdvertisedRoutes(), func(p netip.Prefix) bool {
+			return slices.Contains(released, p)
+		}) {
+			others = append(others, other)
+		}
+	}
+	s.sessLock.RUnlock()
+
+	for _, other := range others {
+		s.updateRoutes(other)
+	}
+}
+
+// effectiveRoutes returns the advertised routes which fall within one of the approved prefixes,
+// leaving out those within the overlay prefixes, as these are already routed to their respective peers,
+// and those which are taken by another client, as peers can only route a prefix to one client.
+//
+// Exit routes are only kept when exit is set, regardless of approved and taken, see msgcontrol.ExitRoutes;
+// peers pick the exit node to route them to.
+func effectiveRoutes(advertised, approved, taken []netip.Prefix, exit bool, overlay ...netip.Prefix) []netip.Prefix {
+	var routes []netip.Prefix
+
+	within := func(p netip.Prefix) func(netip.Prefix) bool {
+		return func(outer netip.Prefix) bool {
+			return outer.Bits() <= p.Bits() && outer.Contains(p.Addr())
+		}
+	}
+
+	for _, p := range advertised {
+		if slices.Contains(routes, p) {
+			continue
+		}
+
+		if msgcontrol.IsExitRoute(p) {
+			if exit {
+				routes = append(routes, p)
+			}
+
+			continue
+		}
+
+		if slices.ContainsFunc(approved, within(p)) && !slices.ContainsFunc(overlay, within(p)) && !slices.Contains(taken, p) {
+			routes = append(routes, p)
+		}
+	}
+
+	return routes
+}
+
 func (s *Server) RunAdditionalSTUN(publicIPs []netip.Addr, listenHost string, lowPort, highPort uint16) error {
 	if s.stun.running {
 		return errors.New("already running STUN servers")
@@ -453,6 +681,16 @@ func (s *Server) ReEstablishOrMakeSession(cc *Conn, nodeKey key.NodePublic, sess
 }
 
 func (s *Server) RemoveSession(sess *ServerSession) {
+	if !s.removeSession(sess) {
+		return
+	}
+
+	// Its routes can be taken over by other sessions now.
+	s.releaseRoutes(sess, sess.Routes())
+}
+
+// removeSession removes sess, and returns whether it was still there.
+func (s *Server) removeSession(sess *ServerSession) bool {
 	s.sessLock.Lock()
 	defer s.sessLock.Unlock()
 
@@ -460,12 +698,12 @@ func (s *Server) RemoveSession(sess *ServerSession) {
 
 	if !ok {
 		// already removed?
-		return
+		return false
 	}
 
 	if sess != mappedSess {
 		// not the same session
-		return
+		return false
 	}
 
 	if sess.state != Authenticate {
@@ -501,6 +739,8 @@ func (s *Server) RemoveSession(sess *ServerSession) {
 
 	delete(s.sessByNode, sess.Peer)
 	delete(s.sessByID, sess.ID)
+
+	return true
 }
 
 // func (s *Server) RegisterSession(sess *ServerSession) {
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net/netip"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
@@ -25,6 +26,17 @@ type ServerSession struct {
 
 	HomeRelay int64
 
+	// requestedHostname is the hostname the client asked for on logon.
+	requestedHostname string
+	hostnameMu        sync.Mutex
+	hostname          string
+
+	routesMu sync.Mutex
+	// advertisedRoutes are the routes the client would route into the network,
+	// of which routes are the ones approved by business logic.
+	advertisedRoutes []netip.Prefix
+	routes           []netip.Prefix
+
 	CurrentEndpoints []netip.AddrPort
 
 	Ctx context.Context
@@ -204,6 +216,8 @@ func (s *ServerSession) Greet(otherSess *ServerSession, prop msgcontrol.Properti
 		IPv6:       otherSess.IPv6.Addr(),
 		Endpoints:  otherSess.CurrentEndpoints,
 		HomeRelay:  otherSess.HomeRelay,
+		Hostname:   otherSess.Hostname(),
+		Routes:     otherSess.Routes(),
 		Properties: prop,
 	}); err != nil {
 		slog.Error("error writing peer addition", "err", err)
@@ -261,6 +275,33 @@ func (s *ServerSession) UpdateHomeRelay(peer key.NodePublic, homeRelay int64) {
 	}
 }
 
+func (s *ServerSession) UpdateHostname(peer key.NodePublic, hostname string) {
+	s.Slog().Debug("UpdateHostname", "from", peer.Debug(), "hostname", hostname)
+
+	if err := s.conn.Write(&msgcontrol.PeerUpdate{
+		PubKey:   peer,
+		Hostname: &hostname,
+	}); err != nil {
+		slog.Error("error writing hostname peer update", "err", err)
+	}
+}
+
+func (s *ServerSession) UpdateRoutes(peer key.NodePublic, routes []netip.Prefix) {
+	s.Slog().Debug("UpdateRoutes", "from", peer.Debug(), "routes", routes)
+
+	if routes == nil {
+		// A nil slice would be sent as null, which the client can't tell apart from an absent field.
+		routes = []netip.Prefix{}
+	}
+
+	if err := s.conn.Write(&msgcontrol.PeerUpdate{
+		PubKey: peer,
+		Routes: &routes,
+	}); err != nil {
+		slog.Error("error writing routes peer update", "err", err)
+	}
+}
+
 func (s *ServerSession) UpdateProperties(peer key.NodePublic, prop msgcontrol.Properties) {
 	s.Slog().Debug("UpdateProperties", "from", peer.Debug(), "prop", prop)
 
@@ -309,6 +350,9 @@ func (s *ServerSession) AuthenticateAccept() (err error) {
 		IP6:        s.IPv6,
 		AuthExpiry: s.Expiry,
 		SessionID:  s.ID,
+		MTU:        s.server.getMTU(),
+		Hostname:   s.Hostname(),
+		Domain:     s.server.getDomain(),
 	}); err != nil {
 		err = fmt.Errorf("error when sending accept: %w", err)
 		return
@@ -318,9 +362,16 @@ func (s *ServerSession) AuthenticateAccept() (err error) {
 }
 
 func (s *ServerSession) AuthAndStart() error {
-	s.IPv4, s.IPv6, s.Expiry = s.server.callbacks.OnSessionFinalize(SessID(s.ID), ClientID(s.Peer))
+	var err error
+
+	s.IPv4, s.IPv6, s.Expiry, err = s.server.callbacks.OnSessionFinalize(SessID(s.ID), ClientID(s.Peer))
+	if err != nil {
+		return s.rejectFinalize(err)
+	}
 
-	err := s.AuthenticateAccept()
+	s.server.assignHostname(s)
+
+	err = s.AuthenticateAccept()
 	if err != nil {
 		return fmt.Errorf("error while writing logon accept: %w", err)
 	}
@@ -330,6 +381,22 @@ func (s *ServerSession) AuthAndStart() error {
 	return nil
 }
 
+// rejectFinalize rejects the logon of the session, as the business logic could not finalize it, and removes it.
+func (s *ServerSession) rejectFinalize(err error) error {
+	s.Slog().Warn("could not finalize session, rejecting logon", "err", err)
+
+	defer s.server.RemoveSession(s)
+	defer s.Ccc(ErrLogonRejected)
+
+	if werr := s.conn.Write(&msgcontrol.LogonReject{
+		Reason: "could not finalize session",
+	}); werr != nil {
+		return fmt.Errorf("error while writing logon reject: %w, %w", werr, ErrLogonRejected)
+	}
+
+	return fmt.Errorf("finalize: %w, %w", err, ErrLogonRejected)
+}
+
 func (s *ServerSession) Run() {
 	// We arrive just after having sent LogonAccept
 
@@ -447,6 +514,20 @@ func (s *ServerSession) Run() {
 			s.server.ForVisible(s, func(session *ServerSession) {
 				session.UpdateHomeRelay(s.Peer, msg.HomeRelay)
 			})
+		case *msgcontrol.RoutesUpdate:
+			if err := msgcontrol.ValidateRoutes(msg.Routes); err != nil {
+				s.Slog().Warn("received invalid routes", "err", err)
+
+				continue
+			}
+
+			s.setAdvertisedRoutes(msg.Routes)
+
+			s.Slog().Debug("received routes", "routes", msg.Routes)
+
+			s.server.callbacks.OnRoutesAdvertised(SessID(s.ID), ClientID(s.Peer), msg.Routes)
+
+			s.server.updateRoutes(s)
 		case *msgcontrol.Pong:
 			s.Slog().Debug("received pong")
 			// TODO
@@ -459,6 +540,58 @@ func (s *ServerSession) Run() {
 	}
 }
 
+// Hostname returns the hostname control assigned to this session.
+func (s *ServerSession) Hostname() string {
+	s.hostnameMu.Lock()
+	defer s.hostnameMu.Unlock()
+
+	return s.hostname
+}
+
+func (s *ServerSession) setHostname(name string) {
+	s.hostnameMu.Lock()
+	defer s.hostnameMu.Unlock()
+
+	s.hostname = name
+}
+
+// AdvertisedRoutes returns the routes the client advertised, approved or not.
+func (s *ServerSession) AdvertisedRoutes() []netip.Prefix {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	return s.advertisedRoutes
+}
+
+func (s *ServerSession) setAdvertisedRoutes(routes []netip.Prefix) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	s.advertisedRoutes = routes
+}
+
+// Routes returns the approved routes of the client, which are distributed to its peers.
+func (s *ServerSession) Routes() []netip.Prefix {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	return s.routes
+}
+
+// setRoutes sets the approved routes of the client, and returns whether they changed.
+func (s *ServerSession) setRoutes(routes []netip.Prefix) bool {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	if slices.Equal(s.routes, routes) {
+		return false
+	}
+
+	s.routes = routes
+
+	return true
+}
+
 func (s *ServerSession) Slog() *slog.Logger {
 	return slog.With("peer", s.Peer.Debug())
 }
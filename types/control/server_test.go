@@ -0,0 +1,87 @@
+package control
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	ps := make([]netip.Prefix, len(ss))
+	for i, s := range ss {
+		ps[i] = netip.MustParsePrefix(s)
+	}
+
+	return ps
+}
+
+func TestEffectiveRoutes(t *testing.T) {
+	overlay := prefixes("100.64.0.0/10", "fd00:a::/64")
+
+	tests := []struct {
+		name       string
+		advertised []netip.Prefix
+		approved   []netip.Prefix
+		taken      []netip.Prefix
+		exit       bool
+		want       []netip.Prefix
+	}{
+		{
+			name:       "approved",
+			advertised: prefixes("10.0.0.0/24", "10.1.0.0/16"),
+			approved:   prefixes("10.0.0.0/24", "10.1.0.0/16"),
+			want:       prefixes("10.0.0.0/24", "10.1.0.0/16"),
+		},
+		{
+			name:       "within approved",
+			advertised: prefixes("10.0.1.0/24", "192.168.0.0/24"),
+			approved:   prefixes("10.0.0.0/8"),
+			want:       prefixes("10.0.1.0/24"),
+		},
+		{
+			name:       "wider than approved",
+			advertised: prefixes("10.0.0.0/8"),
+			approved:   prefixes("10.0.0.0/16"),
+			want:       nil,
+		},
+		{
+			name:       "within overlay",
+			advertised: prefixes("100.64.1.0/24", "fd00:a::/80"),
+			approved:   prefixes("0.0.0.0/1", "100.0.0.0/8", "fd00::/8"),
+			want:       nil,
+		},
+		{
+			name:       "taken",
+			advertised: prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"),
+			approved:   prefixes("10.0.0.0/8"),
+			taken:      prefixes("10.0.0.0/24", "10.0.2.0/23"),
+			want:       prefixes("10.0.1.0/24", "10.0.2.0/24"),
+		},
+		{
+			name:       "duplicates",
+			advertised: prefixes("10.0.0.0/24", "10.0.0.0/24"),
+			approved:   prefixes("10.0.0.0/24"),
+			want:       prefixes("10.0.0.0/24"),
+		},
+		{
+			name:       "exit routes of an exit node",
+			advertised: prefixes("0.0.0.0/0", "::/0"),
+			taken:      prefixes("0.0.0.0/0"),
+			exit:       true,
+			want:       prefixes("0.0.0.0/0", "::/0"),
+		},
+		{
+			name:       "exit routes of other nodes",
+			advertised: prefixes("0.0.0.0/0", "::/0"),
+			approved:   prefixes("0.0.0.0/0", "::/0"),
+			want:       nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, effectiveRoutes(tt.advertised, tt.approved, tt.taken, tt.exit, overlay...))
+		})
+	}
+}
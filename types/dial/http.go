@@ -15,6 +15,10 @@ import (
 // getPriv func() *key.NodePrivate, getSess func() *key.SessionPrivate, controlKey key.NodePublic
 
 func HTTP[T any](ctx context.Context, opts Opts, url, protocol string, makeClient func(parentCtx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, opts Opts) (*T, error)) (*T, error) {
+	if opts.WebSocket {
+		return webSocket(ctx, opts, url, protocol, makeClient)
+	}
+
 	netConn, err := WithTLS(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("dial failed: %w", err)
@@ -19,8 +19,16 @@ type ProtocolServer interface {
 	Accept(ctx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, remoteAddrPort netip.AddrPort) error
 }
 
+// HTTPHandler serves proto to clients, either over a raw HTTP upgrade, or inside a WebSocket.
 func HTTPHandler(s ProtocolServer, proto string) http.Handler {
+	wsHandler := webSocketHandler(s, proto)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketRequest(r) {
+			wsHandler.ServeHTTP(w, r)
+			return
+		}
+
 		up := strings.ToLower(r.Header.Get("Upgrade"))
 
 		if up != proto {
@@ -27,6 +27,16 @@ type Opts struct {
 	// Only works if TLS is true.
 	ExpectCertCN string
 
+	// Speak the protocol inside WebSocket frames, instead of over a raw HTTP upgrade.
+	//
+	// Useful for networks with proxies or CDNs that only pass standard WebSocket upgrades.
+	WebSocket bool
+
+	// Determines the proxy to connect through, if any.
+	//
+	// If nil, uses ProxyFromEnvironment. Set to NoProxy to always connect directly.
+	Proxy ProxyFunc
+
 	// If nil, uses default of 30 seconds
 	ConnectTimeout time.Duration
 
@@ -0,0 +1,189 @@
+package dial
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc returns the proxy URL to use for a connection to target, or nil for a direct connection.
+//
+// The target URL has the scheme "https" or "http" depending on whether the connection will use TLS,
+// and the destination host:port as its host.
+//
+// Supported proxy schemes are "http", "https" (HTTP CONNECT), "socks5" and "socks5h".
+type ProxyFunc func(target *url.URL) (*url.URL, error)
+
+// ProxyFromEnvironment uses the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables (or their lowercase
+// variants) to determine the proxy, the same way net/http does.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()(target)
+}
+
+// NoProxy always connects directly.
+func NoProxy(*url.URL) (*url.URL, error) {
+	return nil, nil
+}
+
+// ProxyURL returns a ProxyFunc that always uses the proxy at u.
+func ProxyURL(u *url.URL) ProxyFunc {
+	return func(*url.URL) (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// proxyFor returns the proxy URL to use for hostPort, if any.
+func (opts *Opts) proxyFor(hostPort string) (*url.URL, error) {
+	proxyFunc := opts.Proxy
+	if proxyFunc == nil {
+		proxyFunc = ProxyFromEnvironment
+	}
+
+	scheme := "http"
+	if opts.TLS {
+		scheme = "https"
+	}
+
+	return proxyFunc(&url.URL{Scheme: scheme, Host: hostPort})
+}
+
+// viaProxy connects to hostPort through the proxy at proxyURL.
+func viaProxy(ctx context.Context, proxyURL *url.URL, hostPort string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return httpConnect(ctx, proxyURL, hostPort)
+	case "socks5", "socks5h":
+		return socks5Connect(ctx, proxyURL, hostPort)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+func proxyHostPort(proxyURL *url.URL, defaultPort string) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), defaultPort)
+}
+
+func httpConnect(ctx context.Context, proxyURL *url.URL, hostPort string) (net.Conn, error) {
+	defaultPort := "80"
+	if proxyURL.Scheme == "https" {
+		defaultPort = "443"
+	}
+
+	var d net.Dialer
+	d.KeepAlive = time.Second * 10
+
+	conn, err := d.DialContext(ctx, "tcp", proxyHostPort(proxyURL, defaultPort))
+	if err != nil {
+		return nil, fmt.Errorf("could not dial proxy: %w", err)
+	}
+
+	closeConn := func() {
+		if err := conn.Close(); err != nil {
+			slog.Error("error when closing proxy conn", "err", err)
+		}
+	}
+
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			closeConn()
+			return nil, fmt.Errorf("could not set proxy deadline: %w", err)
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: make(http.Header),
+	}
+
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		closeConn()
+		return nil, fmt.Errorf("could not write CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("could not read CONNECT response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		closeConn()
+		return nil, fmt.Errorf("proxy CONNECT failed: %d \"%s\"", resp.StatusCode, b)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		closeConn()
+		return nil, fmt.Errorf("could not reset proxy deadline: %w", err)
+	}
+
+	if br.Buffered() > 0 {
+		// The proxy already sent us bytes from the destination, keep them.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+func socks5Connect(ctx context.Context, proxyURL *url.URL, hostPort string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: pass}
+	}
+
+	d, err := proxy.SOCKS5("tcp", proxyHostPort(proxyURL, "1080"), auth, &net.Dialer{KeepAlive: time.Second * 10})
+	if err != nil {
+		return nil, fmt.Errorf("could not create socks5 dialer: %w", err)
+	}
+
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks5 dialer does not support contexts")
+	}
+
+	conn, err := cd.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 connect failed: %w", err)
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn which first drains data already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,208 @@
+package dial
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectProxy runs an HTTP CONNECT proxy which answers with status, followed by early,
+// and then echoes everything back instead of connecting to the destination.
+//
+// It returns the proxy URL, and a channel with the CONNECT request it received.
+func connectProxy(t *testing.T, status int, early string) (*url.URL, <-chan *http.Request) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	reqs := make(chan *http.Request, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		reqs <- req
+
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		if err := resp.Write(conn); err != nil || status != http.StatusOK {
+			return
+		}
+
+		if _, err := io.WriteString(conn, early); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, br)
+	}()
+
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, reqs
+}
+
+func TestTCPViaHTTPProxy(t *testing.T) {
+	proxyURL, reqs := connectProxy(t, http.StatusOK, "early ")
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	conn, err := TCP(context.Background(), Opts{Domain: "relay.example", Port: 443, Proxy: ProxyURL(proxyURL)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := <-reqs
+	assert.Equal(t, http.MethodConnect, req.Method)
+	// The domain is passed on as-is, so that the proxy resolves it.
+	assert.Equal(t, "relay.example:443", req.Host)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), req.Header.Get("Proxy-Authorization"))
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+
+	// Bytes that arrived together with the CONNECT response are not lost.
+	buf := make([]byte, len("early hello"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early hello", string(buf))
+}
+
+func TestTCPViaHTTPProxyRefused(t *testing.T) {
+	proxyURL, reqs := connectProxy(t, http.StatusForbidden, "")
+
+	_, err := TCP(context.Background(), Opts{
+		Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		Port:  80,
+		Proxy: ProxyURL(proxyURL),
+	})
+	assert.ErrorContains(t, err, "proxy CONNECT failed: 403")
+
+	assert.Equal(t, "192.0.2.1:80", (<-reqs).Host)
+}
+
+func TestTCPViaSOCKS5Proxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	dest := make(chan string, 1)
+
+	// A SOCKS5 proxy without authentication, which echoes instead of connecting to the destination.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Greeting: version, number of methods, methods.
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{5, 0}); err != nil {
+			return
+		}
+
+		// Request: version, CONNECT, reserved, domain name type, length, name, port.
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(conn, head); err != nil || head[3] != 3 {
+			return
+		}
+		name := make([]byte, int(head[4])+2)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		dest <- net.JoinHostPort(string(name[:head[4]]), strconv.Itoa(int(binary.BigEndian.Uint16(name[head[4]:]))))
+
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := TCP(context.Background(), Opts{
+		Domain: "relay.example",
+		Port:   8443,
+		Proxy:  ProxyURL(&url.URL{Scheme: "socks5h", Host: ln.Addr().String()}),
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "relay.example:8443", <-dest)
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestUnsupportedProxy(t *testing.T) {
+	_, err := TCP(context.Background(), Opts{
+		Domain: "relay.example",
+		Proxy:  ProxyURL(&url.URL{Scheme: "ftp", Host: "127.0.0.1:21"}),
+	})
+	assert.ErrorContains(t, err, `unsupported proxy scheme "ftp"`)
+}
+
+func TestUsesProxy(t *testing.T) {
+	var target *url.URL
+
+	opts := Opts{
+		Domain: "relay.example",
+		Addrs:  []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		TLS:    true,
+		Proxy: func(u *url.URL) (*url.URL, error) {
+			target = u
+			return nil, nil
+		},
+	}
+
+	proxied, err := opts.UsesProxy()
+	require.NoError(t, err)
+	assert.False(t, proxied)
+
+	// Checked by domain and default port, with the scheme telling whether it will be TLS.
+	assert.Equal(t, "https://relay.example:443", target.String())
+
+	opts.Domain = ""
+	opts.TLS = false
+
+	_, err = opts.UsesProxy()
+	require.NoError(t, err)
+	assert.Equal(t, "http://192.0.2.1:80", target.String())
+
+	opts.Proxy = ProxyURL(&url.URL{Scheme: "http", Host: "proxy.example:3128"})
+
+	proxied, err = opts.UsesProxy()
+	require.NoError(t, err)
+	assert.True(t, proxied)
+
+	opts.Proxy = NoProxy
+
+	proxied, err = opts.UsesProxy()
+	require.NoError(t, err)
+	assert.False(t, proxied)
+}
@@ -8,6 +8,7 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"strconv"
 	"time"
 )
 
@@ -44,6 +45,10 @@ func TLS(conn net.Conn, opts Opts) *tls.Conn {
 func TCP(ctx context.Context, opts Opts) (net.Conn, error) {
 	opts.SetDefaults()
 
+	if conn, proxied, err := tcpViaProxy(ctx, opts); proxied {
+		return conn, err
+	}
+
 	var err error
 
 	if len(opts.Addrs) == 0 {
@@ -113,6 +118,66 @@ func TCP(ctx context.Context, opts Opts) (net.Conn, error) {
 	}
 }
 
+// tcpViaProxy connects through a proxy if one applies to opts, and returns whether it did.
+func tcpViaProxy(ctx context.Context, opts Opts) (net.Conn, bool, error) {
+	port := strconv.Itoa(int(opts.Port))
+
+	var hostPorts []string
+	if len(opts.Addrs) > 0 {
+		for _, addr := range opts.Addrs {
+			hostPorts = append(hostPorts, netip.AddrPortFrom(addr, opts.Port).String())
+		}
+	} else {
+		hostPorts = []string{net.JoinHostPort(opts.Domain, port)}
+	}
+
+	proxyURL, err := opts.proxyFor(opts.proxyCheckHostPort())
+	if err != nil {
+		return nil, true, fmt.Errorf("could not determine proxy: %w", err)
+	} else if proxyURL == nil {
+		return nil, false, nil
+	}
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, opts.ConnectTimeout)
+	defer dialCancel()
+
+	var errs []error
+
+	for _, hostPort := range hostPorts {
+		conn, err := viaProxy(dialCtx, proxyURL, hostPort)
+		if err == nil {
+			return conn, true, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, true, fmt.Errorf("proxy dial failure via %s: %w", proxyURL.Redacted(), errors.Join(errs...))
+}
+
+// proxyCheckHostPort returns the host:port to determine the proxy for opts by;
+// the domain (if any), so that NO_PROXY entries with domain names work as expected.
+func (opts *Opts) proxyCheckHostPort() string {
+	host := opts.Domain
+	if host == "" && len(opts.Addrs) > 0 {
+		host = opts.Addrs[0].String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(opts.Port)))
+}
+
+// UsesProxy returns whether TCP connections for opts go through a proxy, see Opts.Proxy.
+//
+// Transports which cannot go through a proxy, such as QUIC, should not be tried when they do,
+// as the proxy is likely the only way out of the network.
+func (opts Opts) UsesProxy() (bool, error) {
+	opts.SetDefaults()
+
+	proxyURL, err := opts.proxyFor(opts.proxyCheckHostPort())
+
+	return proxyURL != nil, err
+}
+
 func dialOneTCP(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
 	// For some reason, DialTCP does not have a *Context variant.
 	// So for now we put the AddrPort back into a string and pass it to our dialer.
@@ -0,0 +1,121 @@
+package dial
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/edup2p/common/types"
+	"golang.org/x/net/websocket"
+)
+
+// webSocket performs the same function as HTTP, but carries the protocol inside binary WebSocket frames,
+// which passes through proxies and CDNs that refuse unknown Upgrade values.
+func webSocket[T any](ctx context.Context, opts Opts, url, protocol string, makeClient func(parentCtx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, opts Opts) (*T, error)) (*T, error) {
+	wsURL, ok := strings.CutPrefix(url, "http")
+	if !ok {
+		return nil, fmt.Errorf("url %q is not a http(s) url", url)
+	}
+	wsURL = "ws" + wsURL
+
+	cfg, err := websocket.NewConfig(wsURL, url)
+	if err != nil {
+		return nil, fmt.Errorf("could not create websocket config: %w", err)
+	}
+	cfg.Protocol = []string{protocol}
+
+	netConn, err := WithTLS(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("dial failed: %w", err)
+	}
+
+	closeNetConn := func() {
+		if err := netConn.Close(); err != nil {
+			slog.Error("error when closing netconn", "err", err)
+		}
+	}
+
+	if err := netConn.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		closeNetConn()
+		return nil, fmt.Errorf("could not set handshake deadline: %w", err)
+	}
+
+	ws, err := websocket.NewClient(cfg, netConn)
+	if err != nil {
+		closeNetConn()
+		return nil, fmt.Errorf("websocket handshake failed: %w", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		closeNetConn()
+		return nil, fmt.Errorf("could not reset handshake deadline: %w", err)
+	}
+
+	// At this point, we're speaking the protocol with the server.
+
+	brw := bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+
+	c, err := makeClient(ctx, &wsConn{Conn: ws, remoteAddr: netConn.RemoteAddr()}, brw, opts)
+	if err != nil {
+		closeNetConn()
+		return nil, fmt.Errorf("failed to establish client: %w", err)
+	}
+
+	return c, nil
+}
+
+// wsConn is a client websocket.Conn, which gives the address of the connection it was dialed over as RemoteAddr,
+// instead of the URL it connected to.
+type wsConn struct {
+	*websocket.Conn
+
+	remoteAddr net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// webSocketHandler accepts WebSocket connections which negotiated the proto subprotocol,
+// and hands them to s.
+func webSocketHandler(s ProtocolServer, proto string) http.Handler {
+	return websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			// Our clients are not browsers, and so do not always send an Origin; we do not check it.
+
+			if !slices.Contains(cfg.Protocol, proto) {
+				s.Logger().Warn("websocket without correct subprotocol", "protocols", cfg.Protocol, "peer", r.RemoteAddr)
+				return websocket.ErrBadWebSocketProtocol
+			}
+			cfg.Protocol = []string{proto}
+
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+
+			brw := bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+
+			remoteIPPort, _ := netip.ParseAddrPort(ws.Request().RemoteAddr)
+
+			// See HTTPHandler on why this isn't the request context.
+			ctx := context.TODO()
+
+			err := s.Accept(ctx, ws, brw, remoteIPPort)
+
+			s.Logger().Info("websocket client exited", "reason", err)
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package dial
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = "test-proto"
+
+// echoServer echoes lines back to its clients.
+type echoServer struct{}
+
+func (echoServer) Logger() *slog.Logger {
+	return slog.Default()
+}
+
+func (echoServer) Accept(_ context.Context, _ types.MetaConn, brw *bufio.ReadWriter, _ netip.AddrPort) error {
+	for {
+		line, err := brw.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		if _, err := brw.WriteString(line); err != nil {
+			return err
+		}
+
+		if err := brw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// testClient is what makeClient returns to the tests.
+type testClient struct {
+	mc  types.MetaConn
+	brw *bufio.ReadWriter
+}
+
+func (c *testClient) echo(t *testing.T, msg string) string {
+	require.NoError(t, c.mc.SetDeadline(time.Now().Add(2*time.Second)))
+
+	_, err := c.brw.WriteString(msg + "\n")
+	require.NoError(t, err)
+	require.NoError(t, c.brw.Flush())
+
+	line, err := c.brw.ReadString('\n')
+	require.NoError(t, err)
+
+	return line[:len(line)-1]
+}
+
+func dialTest(t *testing.T, webSocket bool) (*testClient, netip.AddrPort) {
+	srv := httptest.NewServer(HTTPHandler(echoServer{}, testProto))
+	t.Cleanup(srv.Close)
+
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	opts := Opts{
+		Domain:    "test.invalid",
+		Addrs:     []netip.Addr{ap.Addr()},
+		Port:      ap.Port(),
+		WebSocket: webSocket,
+		Proxy:     NoProxy,
+	}
+
+	c, err := HTTP(context.Background(), opts, "http://test.invalid/test", testProto,
+		func(_ context.Context, mc types.MetaConn, brw *bufio.ReadWriter, _ Opts) (*testClient, error) {
+			return &testClient{mc: mc, brw: brw}, nil
+		})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.mc.Close() })
+
+	return c, ap
+}
+
+func TestHTTP(t *testing.T) {
+	for _, webSocket := range []bool{false, true} {
+		t.Run(map[bool]string{false: "upgrade", true: "websocket"}[webSocket], func(t *testing.T) {
+			c, ap := dialTest(t, webSocket)
+
+			assert.Equal(t, "hello", c.echo(t, "hello"))
+			assert.Equal(t, "again", c.echo(t, "again"))
+
+			// The remote address is that of the server, whichever the transport, so that it can be bypassed.
+			conn, ok := c.mc.(interface{ RemoteAddr() net.Addr })
+			require.True(t, ok)
+			assert.Equal(t, ap.String(), conn.RemoteAddr().String())
+		})
+	}
+}
+
+func TestWebSocketWrongProtocol(t *testing.T) {
+	srv := httptest.NewServer(HTTPHandler(echoServer{}, "other-proto"))
+	defer srv.Close()
+
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	_, err := HTTP(context.Background(), Opts{Addrs: []netip.Addr{ap.Addr()}, Port: ap.Port(), WebSocket: true, Proxy: NoProxy},
+		"http://test.invalid/test", testProto,
+		func(context.Context, types.MetaConn, *bufio.ReadWriter, Opts) (*io.Reader, error) {
+			t.Fatal("should not establish a client")
+			return nil, nil
+		})
+	assert.Error(t, err)
+}
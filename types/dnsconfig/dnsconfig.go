@@ -0,0 +1,78 @@
+// Package dnsconfig configures the resolver of the OS, to send queries for the overlay domain to the overlay resolver,
+// while leaving all other queries to the normal DNS configuration.
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ErrUnavailable is returned when the resolver of the OS cannot be configured.
+var ErrUnavailable = errors.New("dnsconfig: unavailable")
+
+// Config is the DNS configuration of an interface.
+type Config struct {
+	// Nameservers receive the queries for Domains and RouteDomains, on port 53.
+	Nameservers []netip.Addr
+
+	// Domains are routed to Nameservers, and added as search domains.
+	Domains []string
+	// RouteDomains are only routed to Nameservers, such as the reverse zones of the overlay.
+	//
+	// Not every configurator can route domains, see NewConfigurator.
+	RouteDomains []string
+}
+
+// IsZero reports whether c configures nothing.
+func (c Config) IsZero() bool {
+	return len(c.Nameservers) == 0 && len(c.Domains) == 0 && len(c.RouteDomains) == 0
+}
+
+// Configurator configures the resolver of the OS for one interface.
+type Configurator interface {
+	// Set replaces the configuration of the interface. An empty Config reverts it, like Close.
+	Set(Config) error
+
+	// Close reverts the resolver of the OS to how it was before the first Set.
+	Close() error
+}
+
+// ReverseZones returns the in-addr.arpa and ip6.arpa zones which cover prefixes exactly,
+// skipping those which do not end on a label boundary (8 bits for IPv4, 4 bits for IPv6).
+func ReverseZones(prefixes []netip.Prefix) []string {
+	var zones []string
+
+	for _, p := range prefixes {
+		p = p.Masked()
+
+		switch {
+		case p.Addr().Is4() && p.Bits()%8 == 0:
+			b := p.Addr().As4()
+
+			labels := []string{"in-addr", "arpa"}
+			for i := range p.Bits() / 8 {
+				labels = append([]string{fmt.Sprint(b[i])}, labels...)
+			}
+
+			zones = append(zones, strings.Join(labels, "."))
+		case p.Addr().Is6() && p.Bits()%4 == 0:
+			b := p.Addr().As16()
+
+			labels := []string{"ip6", "arpa"}
+			for i := range p.Bits() / 4 {
+				nibble := b[i/2] >> 4
+				if i%2 == 1 {
+					nibble = b[i/2] & 0xf
+				}
+
+				labels = append([]string{fmt.Sprintf("%x", nibble)}, labels...)
+			}
+
+			zones = append(zones, strings.Join(labels, "."))
+		}
+	}
+
+	return zones
+}
@@ -0,0 +1,29 @@
+package dnsconfig
+
+import (
+	"log/slog"
+)
+
+// NewConfigurator returns a Configurator for iface.
+//
+// It prefers systemd-resolved, which routes only the configured domains to the interface.
+// Without it, it rewrites ResolvConfPath, which puts the nameservers in front of the existing ones for all queries,
+// and ignores Config.RouteDomains. The overlay resolver refuses names outside the overlay, after which the
+// system resolver moves on to the next nameserver.
+func NewConfigurator(iface string) (Configurator, error) {
+	r, err := newResolved(iface)
+	if err == nil {
+		slog.Info("dnsconfig: using systemd-resolved", "iface", iface)
+
+		return r, nil
+	}
+
+	slog.Info("dnsconfig: systemd-resolved unavailable, falling back to rewriting resolv.conf", "err", err, "path", ResolvConfPath)
+
+	rc, err := newResolvConf(ResolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
@@ -0,0 +1,95 @@
+package dnsconfig
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = Config{
+	Nameservers:  []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+	Domains:      []string{"edup2p"},
+	RouteDomains: []string{"64.100.in-addr.arpa"},
+}
+
+func TestResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+
+	orig := "# comment\nnameserver 192.168.1.1\nsearch lan\noptions edns0\n"
+	require.NoError(t, os.WriteFile(path, []byte(orig), 0o644))
+
+	r, err := newResolvConf(path)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Set(testConfig))
+	// Setting twice keeps the first original.
+	require.NoError(t, r.Set(testConfig))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"# Generated by edup2p, the original is at "+path+backupSuffix+" and will be restored.\n"+
+			"nameserver 100.64.0.1\n"+
+			"search edup2p lan\n"+
+			"# comment\nnameserver 192.168.1.1\noptions edns0\n",
+		string(b),
+	)
+
+	require.NoError(t, r.Close())
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, orig, string(b))
+
+	_, err = os.Lstat(path + backupSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// An empty config reverts as well.
+	require.NoError(t, r.Set(testConfig))
+	require.NoError(t, r.Set(Config{}))
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, orig, string(b))
+}
+
+func TestResolvConfSymlinkAndCrash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+	target := filepath.Join(dir, "stub-resolv.conf")
+
+	require.NoError(t, os.WriteFile(target, []byte("nameserver 127.0.0.53\n"), 0o644))
+	require.NoError(t, os.Symlink("stub-resolv.conf", path))
+
+	r, err := newResolvConf(path)
+	require.NoError(t, err)
+	require.NoError(t, r.Set(testConfig))
+
+	b, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 127.0.0.53\n", string(b), "symlink target was written through")
+
+	// A new configurator, as after a crash, restores the symlink.
+	_, err = newResolvConf(path)
+	require.NoError(t, err)
+
+	link, err := os.Readlink(path)
+	require.NoError(t, err)
+	assert.Equal(t, "stub-resolv.conf", link)
+}
+
+func TestReverseZones(t *testing.T) {
+	assert.Equal(t,
+		[]string{"64.100.in-addr.arpa", "0.0.0.0.0.0.0.0.0.0.0.0.2.4.d.f.ip6.arpa"},
+		ReverseZones([]netip.Prefix{
+			netip.MustParsePrefix("100.64.0.0/16"),
+			netip.MustParsePrefix("100.64.0.0/10"),
+			netip.MustParsePrefix("fd42::1/64"),
+		}),
+	)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package dnsconfig
+
+// NewConfigurator returns ErrUnavailable, as configuring the resolver is only done automatically on linux.
+func NewConfigurator(_ string) (Configurator, error) {
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,132 @@
+package dnsconfig
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ResolvConfPath is the path of the resolv.conf which is rewritten without systemd-resolved.
+var ResolvConfPath = "/etc/resolv.conf"
+
+// backupSuffix is appended to the path of the original resolv.conf, which is moved aside while rewritten.
+const backupSuffix = ".edup2p-orig"
+
+// resolvConf rewrites a resolv.conf, keeping the original (file or symlink) next to it to restore.
+//
+// As the original is moved rather than copied, it is also restored by the next configurator after a crash.
+type resolvConf struct {
+	mu sync.Mutex
+
+	path, backup string
+}
+
+func newResolvConf(path string) (*resolvConf, error) {
+	r := &resolvConf{path: path, backup: path + backupSuffix}
+
+	if _, err := os.Lstat(r.backup); err == nil {
+		slog.Warn("dnsconfig: restoring resolv.conf left behind by a previous run", "path", path)
+
+		if err := r.restore(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *resolvConf) Set(cfg Config) error {
+	if cfg.IsZero() {
+		return r.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := os.Lstat(r.backup); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(r.path, r.backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not move aside %s: %w", r.path, err)
+		}
+	}
+
+	// Follows the backup if it is a symlink.
+	orig, err := os.ReadFile(r.backup)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not read original resolv.conf: %w", err)
+	}
+
+	tmp := filepath.Join(filepath.Dir(r.path), "."+filepath.Base(r.path)+".edup2p-tmp")
+
+	if err := os.WriteFile(tmp, renderResolvConf(orig, cfg, r.backup), 0o644); err != nil {
+		return fmt.Errorf("could not write resolv.conf: %w", err)
+	}
+
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("could not replace resolv.conf: %w", err)
+	}
+
+	return nil
+}
+
+func (r *resolvConf) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := os.Lstat(r.backup); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return r.restore()
+}
+
+func (r *resolvConf) restore() error {
+	if err := os.Rename(r.backup, r.path); err != nil {
+		return fmt.Errorf("could not restore %s: %w", r.path, err)
+	}
+
+	return nil
+}
+
+// renderResolvConf returns orig with the nameservers of cfg in front, and the domains of cfg in front of its search
+// domains.
+func renderResolvConf(orig []byte, cfg Config, backup string) []byte {
+	var out, rest bytes.Buffer
+
+	search := slices.Clone(cfg.Domains)
+
+	sc := bufio.NewScanner(bytes.NewReader(orig))
+	for sc.Scan() {
+		line := sc.Text()
+
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			// The last search or domain line wins, so we merge them into one.
+			search = append(search[:len(cfg.Domains)], fields[1:]...)
+			continue
+		}
+
+		rest.WriteString(line)
+		rest.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&out, "# Generated by edup2p, the original is at %s and will be restored.\n", backup)
+
+	for _, ns := range cfg.Nameservers {
+		fmt.Fprintf(&out, "nameserver %s\n", ns)
+	}
+
+	if len(search) > 0 {
+		fmt.Fprintf(&out, "search %s\n", strings.Join(search, " "))
+	}
+
+	out.Write(rest.Bytes())
+
+	return out.Bytes()
+}
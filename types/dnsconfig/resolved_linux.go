@@ -0,0 +1,140 @@
+package dnsconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedDest = "org.freedesktop.resolve1"
+	resolvedPath = dbus.ObjectPath("/org/freedesktop/resolve1")
+
+	resolvedManager = "org.freedesktop.resolve1.Manager"
+)
+
+// Address families, as expected by resolved.
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// resolved configures the per-link DNS of systemd-resolved over D-Bus.
+type resolved struct {
+	mu sync.Mutex
+
+	obj     dbus.BusObject
+	ifindex int32
+
+	set bool
+}
+
+type resolvedDNS struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain    string
+	RouteOnly bool
+}
+
+func newResolved(iface string) (*resolved, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("could not find interface %q: %w", iface, err)
+	}
+
+	// The shared system bus connection, which must not be closed.
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to system bus: %w", err)
+	}
+
+	obj := conn.Object(resolvedDest, resolvedPath)
+
+	if err := obj.Call("org.freedesktop.DBus.Peer.Ping", 0).Err; err != nil {
+		return nil, fmt.Errorf("could not reach systemd-resolved: %w", err)
+	}
+
+	return &resolved{
+		obj:     obj,
+		ifindex: int32(ifi.Index),
+	}, nil
+}
+
+func (r *resolved) call(method string, args ...any) error {
+	if err := r.obj.Call(resolvedManager+"."+method, 0, append([]any{r.ifindex}, args...)...).Err; err != nil {
+		return fmt.Errorf("resolved %s: %w", method, err)
+	}
+
+	return nil
+}
+
+func (r *resolved) Set(cfg Config) error {
+	if cfg.IsZero() {
+		return r.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dns := make([]resolvedDNS, 0, len(cfg.Nameservers))
+	for _, ns := range cfg.Nameservers {
+		if ns.Is4() {
+			b := ns.As4()
+			dns = append(dns, resolvedDNS{Family: afInet, Address: b[:]})
+		} else {
+			b := ns.As16()
+			dns = append(dns, resolvedDNS{Family: afInet6, Address: b[:]})
+		}
+	}
+
+	domains := make([]resolvedDomain, 0, len(cfg.Domains)+len(cfg.RouteDomains))
+	for _, d := range cfg.Domains {
+		domains = append(domains, resolvedDomain{Domain: d})
+	}
+	for _, d := range cfg.RouteDomains {
+		domains = append(domains, resolvedDomain{Domain: d, RouteOnly: true})
+	}
+
+	r.set = true
+
+	if err := r.call("SetLinkDNS", dns); err != nil {
+		return err
+	}
+
+	if err := r.call("SetLinkDomains", domains); err != nil {
+		return err
+	}
+
+	// Never send queries outside of the domains to the overlay; not supported on resolved before v240,
+	// which only sends them to links with search domains anyway.
+	if err := r.call("SetLinkDefaultRoute", false); err != nil && !isUnknownMethod(err) {
+		return err
+	}
+
+	return nil
+}
+
+func isUnknownMethod(err error) bool {
+	var dbusErr dbus.Error
+
+	return errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.UnknownMethod"
+}
+
+func (r *resolved) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.set {
+		return nil
+	}
+
+	r.set = false
+
+	return r.call("RevertLink")
+}
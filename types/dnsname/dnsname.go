@@ -0,0 +1,71 @@
+// Package dnsname contains helpers for the hostnames of nodes, and the domain of their network.
+//
+// Nodes are named <hostname>.<domain>, where the hostname is a single DNS label.
+package dnsname
+
+import (
+	"os"
+	"strings"
+)
+
+// DefaultDomain is the domain of the network, when control does not give one.
+const DefaultDomain = "edup2p"
+
+// MaxLabelLen is the maximum length of a single DNS label.
+const MaxLabelLen = 63
+
+// SanitizeLabel turns s into a valid DNS label;
+// lowercased, with only the first label of a dotted name, and other invalid characters replaced by hyphens.
+//
+// Returns an empty string if nothing usable remains.
+func SanitizeLabel(s string) string {
+	s, _, _ = strings.Cut(s, ".")
+
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('-')
+		}
+	}
+
+	label := b.String()
+	if len(label) > MaxLabelLen {
+		label = label[:MaxLabelLen]
+	}
+
+	return strings.Trim(label, "-")
+}
+
+// ValidLabel returns whether s is a valid, lowercase DNS label.
+func ValidLabel(s string) bool {
+	return s != "" && SanitizeLabel(s) == s
+}
+
+// ValidDomain returns whether s is a valid, lowercase domain name without trailing dot.
+func ValidDomain(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if !ValidLabel(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DeviceHostname returns the hostname of this device as a valid label, or an empty string if it has none.
+func DeviceHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	return SanitizeLabel(name)
+}
@@ -0,0 +1,54 @@
+package dnsname
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"laptop":                       "laptop",
+		"My Laptop":                    "my-laptop",
+		"host.example.com":             "host",
+		"--edge--":                     "edge",
+		"Über":                         "ber",
+		"printer_2":                    "printer-2",
+		"":                             "",
+		"...":                          "",
+		"___":                          "",
+		strings.Repeat("a", 70):        strings.Repeat("a", MaxLabelLen),
+		strings.Repeat("a", 62) + "-b": strings.Repeat("a", 62),
+	} {
+		assert.Equal(t, want, SanitizeLabel(in), "%q", in)
+	}
+}
+
+func TestValidLabel(t *testing.T) {
+	for in, want := range map[string]bool{
+		"host":                  true,
+		"host-2":                true,
+		"Host":                  false,
+		"-host":                 false,
+		"a.b":                   false,
+		"":                      false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	} {
+		assert.Equal(t, want, ValidLabel(in), "%q", in)
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	for in, want := range map[string]bool{
+		DefaultDomain:   true,
+		"corp.example":  true,
+		"corp..example": false,
+		"corp.example.": false,
+		"Corp.example":  false,
+		"":              false,
+	} {
+		assert.Equal(t, want, ValidDomain(in), "%q", in)
+	}
+}
@@ -17,11 +17,13 @@ type ControlCallbacks interface {
 		peer key.NodePublic,
 		homeRelay int64, endpoints []netip.AddrPort, session key.SessionPublic,
 		ip4, ip6 netip.Addr,
+		hostname string,
+		routes []netip.Prefix,
 		prop msgcontrol.Properties,
 	) error
 
 	// UpdatePeer has the server inform of one of more updates to the client. All parameters other than peer are nullable.
-	UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, prop *msgcontrol.Properties) error
+	UpdatePeer(peer key.NodePublic, homeRelay *int64, endpoints []netip.AddrPort, session *key.SessionPublic, hostname *string, routes *[]netip.Prefix, prop *msgcontrol.Properties) error
 
 	// RemovePeer has the server inform the client to stop observing another peer.
 	RemovePeer(peer key.NodePublic) error
@@ -49,11 +51,23 @@ type ControlInterface interface {
 	// Expiry of the current control session, defaults to zero-value if there is no expiry,
 	// or session is not connected.
 	Expiry() time.Time
+	// MTU gets the network-wide MTU for the WireGuard interface as given by the control server,
+	// or 0 if it gave none.
+	MTU() int
+	// Hostname gets the node's hostname as assigned by the control server, or an empty string if it gave none.
+	Hostname() string
+	// Domain gets the domain of the network, under which peers are named <hostname>.<domain>.
+	Domain() string
+	// ControlAddr gets the address that the connection to the control server currently goes to,
+	// or an invalid address if it is unknown.
+	ControlAddr() netip.Addr
 
 	// UpdateEndpoints informs the server of any changes in STUN-resolved endpoints. This is a set-replace operation.
 	UpdateEndpoints([]netip.AddrPort) error
 	// UpdateHomeRelay informs the server of the current client preferred home relay.
 	UpdateHomeRelay(int64) error
+	// UpdateRoutes informs the server of the prefixes the client would route into the network. This is a set-replace operation.
+	UpdateRoutes([]netip.Prefix) error
 }
 
 // ControlSession is an interface representing an active control session.
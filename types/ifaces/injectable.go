@@ -2,8 +2,18 @@ package ifaces
 
 import "net/netip"
 
+// Injectable can inject packets into the local network stack, as if they came from the overlay.
+//
+// It is optionally implemented by a toversok.WireGuardController.
 type Injectable interface {
 	Available() bool
 
+	// InjectPacket injects a UDP packet with pkt as payload, over IPv4 or IPv6.
+	//
+	// from has to be an address within the overlay, and to one of the overlay addresses of this node or a
+	// multicast group, both of the same family.
 	InjectPacket(from, to netip.AddrPort, pkt []byte) error
+
+	// InjectICMPv6 injects an ICMPv6 message of type typ and code, with body after its checksum.
+	InjectICMPv6(from, to netip.Addr, typ, code uint8, body []byte) error
 }
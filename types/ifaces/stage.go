@@ -5,6 +5,7 @@ import (
 	"net/netip"
 
 	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/msgsess"
 	"github.com/edup2p/common/types/stage"
 )
 
@@ -19,7 +20,14 @@ type Stage interface {
 	SetEndpoints(peer key.NodePublic, endpoints []netip.AddrPort) error
 
 	GetPeerInfo(peer key.NodePublic) *stage.PeerInfo
+	GetPeersWhere(f func(key.NodePublic, *stage.PeerInfo) bool) []key.NodePublic
 	GetEndpoints() []netip.AddrPort
 
+	// SendSideBand sends side-band data to peer, over the path currently used to reach it.
+	SendSideBand(peer key.NodePublic, data *msgsess.SideBandData) error
+	// SetSideBandHandler sets the handler of side-band data of application-defined types received from peers,
+	// see msgsess.FirstApplicationType. Must be called before Start.
+	SetSideBandHandler(h func(peer key.NodePublic, data *msgsess.SideBandData))
+
 	Context() context.Context
 }
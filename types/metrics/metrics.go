@@ -0,0 +1,196 @@
+// Package metrics contains a minimal set of counters and gauges,
+// which can be exposed in the Prometheus text exposition format.
+//
+// This deliberately does not pull in the full prometheus client library;
+// the servers in this repository only need a handful of monotonic counters and gauges.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/maps"
+)
+
+// Counter is a monotonically increasing value. The zero value is ready for use.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec is a set of counters, partitioned by the value of a single label.
+// The zero value is ready for use.
+type CounterVec struct {
+	mu sync.RWMutex
+	m  map[string]*Counter
+}
+
+// With returns the counter for the given label value, creating it if needed.
+func (cv *CounterVec) With(value string) *Counter {
+	cv.mu.RLock()
+	c, ok := cv.m[value]
+	cv.mu.RUnlock()
+
+	if ok {
+		return c
+	}
+
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	if c, ok = cv.m[value]; ok {
+		return c
+	}
+
+	if cv.m == nil {
+		cv.m = make(map[string]*Counter)
+	}
+
+	c = new(Counter)
+	cv.m[value] = c
+
+	return c
+}
+
+// snapshot returns the label values (sorted) and their current counts.
+func (cv *CounterVec) snapshot() ([]string, []uint64) {
+	cv.mu.RLock()
+	defer cv.mu.RUnlock()
+
+	keys := maps.Keys(cv.m)
+	slices.Sort(keys)
+
+	values := make([]uint64, len(keys))
+	for i, k := range keys {
+		values[i] = cv.m[k].Value()
+	}
+
+	return keys, values
+}
+
+type metricType string
+
+const (
+	typeCounter metricType = "counter"
+	typeGauge   metricType = "gauge"
+)
+
+type entry struct {
+	name  string
+	help  string
+	typ   metricType
+	write func(w io.Writer, name string) error
+}
+
+// Registry holds a set of named metrics, and writes them out in the order they were added.
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(e entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, o := range r.entries {
+		if o.name == e.name {
+			panic(fmt.Sprintf("metrics: duplicate metric name %q", e.name))
+		}
+	}
+
+	r.entries = append(r.entries, e)
+}
+
+// AddCounter registers an existing counter under name.
+func (r *Registry) AddCounter(name, help string, c *Counter) {
+	r.add(entry{name, help, typeCounter, func(w io.Writer, name string) error {
+		_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+		return err
+	}})
+}
+
+// AddCounterVec registers an existing counter vector under name, with its values exported under label.
+func (r *Registry) AddCounterVec(name, help, label string, cv *CounterVec) {
+	r.add(entry{name, help, typeCounter, func(w io.Writer, name string) error {
+		keys, values := cv.snapshot()
+		for i, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, quoteLabel(k), values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}})
+}
+
+// AddGaugeFunc registers a gauge, whose value is retrieved with f on every scrape.
+func (r *Registry) AddGaugeFunc(name, help string, f func() float64) {
+	r.add(entry{name, help, typeGauge, func(w io.Writer, name string) error {
+		_, err := fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(f(), 'g', -1, 64))
+		return err
+	}})
+}
+
+// WriteText writes all registered metrics to w in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	entries := slices.Clone(r.entries)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", e.name, escapeHelp(e.help), e.name, e.typ); err != nil {
+			return err
+		}
+		if err := e.write(bw, e.name); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP implements http.Handler, so a Registry can be mounted directly on a /metrics path.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if err := r.WriteText(w); err != nil {
+		slog.Error("failed to write metrics", "err", err)
+	}
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func quoteLabel(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterVec(t *testing.T) {
+	var cv CounterVec
+
+	cv.With("b").Inc()
+	cv.With("a").Add(3)
+	cv.With("b").Inc()
+
+	assert.Same(t, cv.With("a"), cv.With("a"))
+
+	keys, values := cv.snapshot()
+	assert.Equal(t, []string{"a", "b"}, keys)
+	assert.Equal(t, []uint64{3, 2}, values)
+}
+
+func TestWriteText(t *testing.T) {
+	var (
+		c  Counter
+		cv CounterVec
+	)
+
+	c.Add(42)
+	cv.With(`odd "value"` + "\n").Inc()
+	cv.With("plain").Add(2)
+
+	reg := NewRegistry()
+	reg.AddCounter("test_total", "A counter.", &c)
+	reg.AddGaugeFunc("test_gauge", `A gauge, with \ and`+"\nnewline.", func() float64 { return 1.5 })
+	reg.AddCounterVec("test_vec_total", "A vector.", "reason", &cv)
+
+	var sb strings.Builder
+	require.NoError(t, reg.WriteText(&sb))
+
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 42
+# HELP test_gauge A gauge, with \\ and\nnewline.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_vec_total A vector.
+# TYPE test_vec_total counter
+test_vec_total{reason="odd \"value\"\n"} 1
+test_vec_total{reason="plain"} 2
+`, sb.String())
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	reg.AddCounter("test_total", "", new(Counter))
+
+	assert.Panics(t, func() {
+		reg.AddGaugeFunc("test_total", "", func() float64 { return 0 })
+	})
+}
+
+func TestServeHTTP(t *testing.T) {
+	var c Counter
+	c.Inc()
+
+	reg := NewRegistry()
+	reg.AddCounter("test_total", "A counter.", &c)
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_total 1\n")
+}
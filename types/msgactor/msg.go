@@ -45,11 +45,19 @@ type TManSessionMessageFromDirect struct {
 	Msg *msgsess.ClearMessage
 }
 
-type TManSpreadMDNSPacket struct {
+type TManSendMDNSPacket struct {
+	To key.NodePublic
+
 	Pkt []byte
 	IP6 bool
 }
 
+type TManSendSideBandData struct {
+	To key.NodePublic
+
+	Data *msgsess.SideBandData
+}
+
 // ======================================================================================================
 // SessionManager msgs
 
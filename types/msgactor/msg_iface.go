@@ -10,7 +10,8 @@ func (o *TManConnActivity) amsg()             {}
 func (o *TManConnGoodBye) amsg()              {}
 func (o *TManSessionMessageFromRelay) amsg()  {}
 func (o *TManSessionMessageFromDirect) amsg() {}
-func (o *TManSpreadMDNSPacket) amsg()         {}
+func (o *TManSendMDNSPacket) amsg()           {}
+func (o *TManSendSideBandData) amsg()         {}
 
 func (o *SManSessionFrameFromRelay) amsg()      {}
 func (o *SManSessionFrameFromAddrPort) amsg()   {}
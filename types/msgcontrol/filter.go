@@ -0,0 +1,124 @@
+package msgcontrol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type Direction string
+
+const (
+	// DirectionIn is traffic from the peer, to this node.
+	DirectionIn Direction = "in"
+	// DirectionOut is traffic from this node, to the peer.
+	DirectionOut Direction = "out"
+)
+
+type Protocol string
+
+const (
+	ProtocolAny  Protocol = ""
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	ProtocolICMP Protocol = "icmp"
+)
+
+// FilterRule allows connections with a peer in one direction, with a protocol, and to a set of destination ports.
+//
+// If a peer has no rules, all connections with it are allowed.
+// Otherwise, only the connections matching one of its rules are, in either direction;
+// return traffic of allowed connections is always allowed.
+//
+// Quarantine takes precedence over any rules.
+type FilterRule struct {
+	Direction Direction
+
+	// Protocol is the protocol to allow, or ProtocolAny for all.
+	Protocol Protocol `json:",omitempty"`
+
+	// Ports are the destination ports to allow, or empty for all.
+	//
+	// Only applies to TCP and UDP; with ProtocolAny, the ports are allowed for both.
+	Ports []PortRange `json:",omitempty"`
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func SinglePort(port uint16) PortRange {
+	return PortRange{First: port, Last: port}
+}
+
+func (p PortRange) Contains(port uint16) bool {
+	return p.First <= port && port <= p.Last
+}
+
+func (p PortRange) String() string {
+	if p.First == p.Last {
+		return fmt.Sprintf("%d", p.First)
+	}
+
+	return fmt.Sprintf("%d-%d", p.First, p.Last)
+}
+
+func (r FilterRule) Validate() error {
+	switch r.Direction {
+	case DirectionIn, DirectionOut:
+	default:
+		return fmt.Errorf("invalid direction %q", r.Direction)
+	}
+
+	switch r.Protocol {
+	case ProtocolAny, ProtocolTCP, ProtocolUDP:
+	case ProtocolICMP:
+		if len(r.Ports) > 0 {
+			return errors.New("icmp rule cannot have ports")
+		}
+	default:
+		return fmt.Errorf("invalid protocol %q", r.Protocol)
+	}
+
+	for _, p := range r.Ports {
+		if p.First > p.Last {
+			return fmt.Errorf("invalid port range %d-%d", p.First, p.Last)
+		}
+	}
+
+	return nil
+}
+
+// Matches returns whether a new connection in direction, with protocol and destination port, is allowed by r.
+//
+// port is ignored for protocols other than TCP and UDP.
+func (r FilterRule) Matches(direction Direction, protocol Protocol, port uint16) bool {
+	if r.Direction != direction {
+		return false
+	}
+
+	if r.Protocol != ProtocolAny && r.Protocol != protocol {
+		return false
+	}
+
+	if len(r.Ports) == 0 || (protocol != ProtocolTCP && protocol != ProtocolUDP) {
+		return len(r.Ports) == 0
+	}
+
+	return slices.ContainsFunc(r.Ports, func(p PortRange) bool {
+		return p.Contains(port)
+	})
+}
+
+// Allows returns whether a new connection in direction, with protocol and destination port, is allowed by rules.
+func Allows(rules []FilterRule, direction Direction, protocol Protocol, port uint16) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(rules, func(r FilterRule) bool {
+		return r.Matches(direction, protocol, port)
+	})
+}
@@ -0,0 +1,26 @@
+package msgcontrol
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// serviceTypeRe matches DNS-SD service types, a service name (RFC 6335) and its protocol.
+var serviceTypeRe = regexp.MustCompile(`(?i)^_[a-z0-9]([a-z0-9-]{0,13}[a-z0-9])?\._(tcp|udp)$`)
+
+// IsServiceType returns whether t is a DNS-SD service type, like "_ipp._tcp", without the domain.
+func IsServiceType(t string) bool {
+	return serviceTypeRe.MatchString(t)
+}
+
+// ValidateServiceTypes checks that all service types are DNS-SD service types, like "_ipp._tcp",
+// without the domain.
+func ValidateServiceTypes(types []string) error {
+	for _, t := range types {
+		if !IsServiceType(t) {
+			return fmt.Errorf("invalid service type %q, expected one like \"_ipp._tcp\"", t)
+		}
+	}
+
+	return nil
+}
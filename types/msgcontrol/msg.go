@@ -32,6 +32,7 @@ const (
 	RelayUpdateType
 	LogoutType
 	DisconnectType
+	RoutesUpdateType
 )
 
 // === handshake phase
@@ -57,6 +58,9 @@ type Logon struct {
 	SessKeyAttestation []byte
 
 	ResumeSessionID *string `json:",omitempty"`
+
+	// Hostname is the name this device would like to have in the network, control may assign another.
+	Hostname string `json:",omitempty"`
 }
 
 type LogonAuthenticate struct {
@@ -78,6 +82,40 @@ type LogonAccept struct {
 	AuthExpiry time.Time
 
 	SessionID string
+
+	// MTU is the network-wide MTU for the WireGuard interface, or 0 to leave it up to the client.
+	//
+	// There is no MTU per peer, as the interface has a single MTU for all of them;
+	// it has to fit through the paths to every peer.
+	MTU int `json:",omitempty"`
+
+	// Hostname is the name control assigned to this device, empty if it has none.
+	Hostname string `json:",omitempty"`
+	// Domain is the domain of the network, under which peers resolve as <hostname>.<domain>.
+	Domain string `json:",omitempty"`
+}
+
+const (
+	// MinMTU is the smallest MTU of the WireGuard interface, the minimum MTU of IPv6.
+	MinMTU = 1280
+	// MaxMTU is the largest MTU of the WireGuard interface; that of ethernet (1500), minus the overhead of WireGuard.
+	//
+	// WireGuard wraps every packet in at most 80 bytes; an outer IPv6 (40) and UDP (8) header,
+	// and its own header and authentication tag (32). Larger MTUs would have outer packets exceed 1500 bytes,
+	// which only fit through paths with jumbo frames.
+	MaxMTU = 1500 - WireGuardOverhead
+
+	// WireGuardOverhead is the largest number of bytes WireGuard adds to a packet, see MaxMTU.
+	WireGuardOverhead = 80
+)
+
+// ValidateMTU checks that mtu is either 0, or within [MinMTU, MaxMTU].
+func ValidateMTU(mtu int) error {
+	if mtu != 0 && (mtu < MinMTU || mtu > MaxMTU) {
+		return fmt.Errorf("mtu %d is out of range [%d, %d]", mtu, MinMTU, MaxMTU)
+	}
+
+	return nil
 }
 
 type RetryStrategyType byte
@@ -150,6 +188,36 @@ type HomeRelayUpdate struct {
 	HomeRelay int64
 }
 
+// -> control
+type RoutesUpdate struct {
+	// Routes are the prefixes this client would route into the network, pending approval by control.
+	Routes []netip.Prefix
+}
+
+// ValidateRoutes checks that all routes are valid, and have no address bits set past their prefix length.
+func ValidateRoutes(routes []netip.Prefix) error {
+	for _, r := range routes {
+		if !r.IsValid() {
+			return fmt.Errorf("invalid route %s", r)
+		}
+
+		if r != r.Masked() {
+			return fmt.Errorf("route %s has bits set past its prefix length, expected %s", r, r.Masked())
+		}
+	}
+
+	return nil
+}
+
+// ExitRoutes are the default routes a client advertises to offer itself as an exit node,
+// which peers can opt into routing all their traffic through.
+var ExitRoutes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// IsExitRoute returns whether route is one of ExitRoutes.
+func IsExitRoute(route netip.Prefix) bool {
+	return route.Bits() == 0
+}
+
 // -> client
 type PeerAddition struct {
 	PubKey  key.NodePublic
@@ -161,12 +229,25 @@ type PeerAddition struct {
 	Endpoints []netip.AddrPort
 	HomeRelay int64
 
+	// Hostname is the name of the peer in the network, empty if it has none.
+	Hostname string `json:",omitempty"`
+
+	// Routes are the prefixes the peer routes into the network, on top of its IPs, as approved by control.
+	Routes []netip.Prefix `json:",omitempty"`
+
 	Properties Properties
 }
 
 type Properties struct {
 	Quarantine bool
 	MDNS       bool
+
+	// MDNSServices are the DNS-SD service types (e.g. "_ipp._tcp") shared with this peer over mDNS, if MDNS is set.
+	// All service types are shared when empty.
+	MDNSServices []string `json:",omitempty"`
+
+	// Rules restrict the traffic with this peer, see FilterRule.
+	Rules []FilterRule `json:",omitempty"`
 }
 
 // -> client
@@ -176,6 +257,9 @@ type PeerUpdate struct {
 	SessKey   *key.SessionPublic `json:",omitempty"`
 	Endpoints []netip.AddrPort   `json:",omitempty"`
 	HomeRelay *int64             `json:",omitempty"`
+	Hostname  *string            `json:",omitempty"`
+	// Routes replaces the routes of the peer, see PeerAddition.Routes. Non-nil and empty when it has none left.
+	Routes *[]netip.Prefix `json:",omitempty"`
 
 	Properties *Properties `json:",omitempty"`
 }
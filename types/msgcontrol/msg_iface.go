@@ -71,3 +71,7 @@ func (c *Logout) CMsgType() ControlMessageType {
 func (c *Disconnect) CMsgType() ControlMessageType {
 	return DisconnectType
 }
+
+func (c *RoutesUpdate) CMsgType() ControlMessageType {
+	return RoutesUpdateType
+}
@@ -0,0 +1,42 @@
+package msgcontrol
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	assert.NoError(t, ValidateRoutes(nil))
+	assert.NoError(t, ValidateRoutes([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("fd00::/64"),
+		netip.MustParsePrefix("192.168.1.1/32"),
+	}))
+	assert.NoError(t, ValidateRoutes(ExitRoutes))
+
+	assert.Error(t, ValidateRoutes([]netip.Prefix{{}}), "invalid prefix")
+	assert.Error(t, ValidateRoutes([]netip.Prefix{netip.MustParsePrefix("192.168.1.1/24")}), "bits past prefix length")
+	assert.Error(t, ValidateRoutes([]netip.Prefix{netip.MustParsePrefix("fd00::1/64")}), "bits past prefix length")
+}
+
+func TestIsExitRoute(t *testing.T) {
+	for _, r := range ExitRoutes {
+		assert.True(t, IsExitRoute(r))
+	}
+
+	assert.False(t, IsExitRoute(netip.MustParsePrefix("0.0.0.0/1")))
+	assert.False(t, IsExitRoute(netip.MustParsePrefix("10.0.0.0/8")))
+}
+
+func TestValidateMTU(t *testing.T) {
+	for _, mtu := range []int{0, MinMTU, 1392, MaxMTU} {
+		assert.NoError(t, ValidateMTU(mtu), mtu)
+	}
+
+	for _, mtu := range []int{-1, 576, MinMTU - 1, MaxMTU + 1, 1500, 65535} {
+		assert.Error(t, ValidateMTU(mtu), mtu)
+	}
+}
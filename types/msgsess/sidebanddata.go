@@ -10,8 +10,21 @@ type SideBandDataType byte
 const (
 	MDNSv4Type SideBandDataType = iota
 	MDNSv6Type SideBandDataType = iota
+
+	// FirstApplicationType is the first type of side-band data defined by applications embedding toversok,
+	// the types below it are reserved for toversok itself.
+	FirstApplicationType SideBandDataType = 0x80
 )
 
+// MaxSideBandDataLen is the largest side-band data, that keeps its session message within the minimum IPv6 MTU,
+// once encrypted and sent through a relay.
+const MaxSideBandDataLen = 1024
+
+// IsApplication returns whether t is a type of side-band data defined by applications, see FirstApplicationType.
+func (t SideBandDataType) IsApplication() bool {
+	return t >= FirstApplicationType
+}
+
 type SideBandData struct {
 	Type SideBandDataType
 	Data []byte
@@ -62,6 +62,9 @@ type HTTPClient struct {
 	sendCh chan SendPacket
 	recvCh chan RecvPacket
 
+	// Optional, packets are preferably sent and received over this if set.
+	dg DatagramConn
+
 	closed bool
 }
 
@@ -100,6 +103,11 @@ type RecvPacket struct {
 // It logs in and authenticates the server before returning a HTTPClient object.
 // If any error occurs, or no client can be established before timeout, it returns.
 func EstablishClient(parentCtx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, timeout time.Duration, getPriv func() *key.NodePrivate) (*HTTPClient, error) {
+	return EstablishClientWithDatagrams(parentCtx, mc, brw, nil, timeout, getPriv)
+}
+
+// EstablishClientWithDatagrams is EstablishClient, with an additional DatagramConn to send and receive packets on.
+func EstablishClientWithDatagrams(parentCtx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, dg DatagramConn, timeout time.Duration, getPriv func() *key.NodePrivate) (*HTTPClient, error) {
 	ctx, ccc := context.WithCancelCause(parentCtx)
 
 	c := &HTTPClient{
@@ -118,6 +126,8 @@ func EstablishClient(parentCtx context.Context, mc types.MetaConn, brw *bufio.Re
 
 		sendCh: make(chan SendPacket, PacketChanLen),
 		recvCh: make(chan RecvPacket, PacketChanLen),
+
+		dg: dg,
 	}
 
 	// Make sure any reads that don't complete before the deadline return with an error.
@@ -297,6 +307,10 @@ func (c *HTTPClient) Closed() bool {
 func (c *HTTPClient) Run() {
 	go c.RunReceive()
 	go c.RunSend()
+
+	if c.dg != nil {
+		go c.RunReceiveDatagrams()
+	}
 }
 
 func (c *HTTPClient) RunReceive() {
@@ -349,8 +363,11 @@ func (c *HTTPClient) RunReceive() {
 				break
 			}
 
-			// TODO this could block, should we do this in a goroutine?
-			c.recvCh <- pkt
+			select {
+			case c.recvCh <- pkt:
+			case <-c.ctx.Done():
+				return
+			}
 		case framePong:
 			// Ignore for now
 			// FIXME do checking that we sent the ping?
@@ -402,6 +419,11 @@ func (c *HTTPClient) RunSend() {
 			_, err = c.writer.Write([]byte("toversok"))
 
 		case pkt := <-c.sendCh:
+			if c.dg != nil && c.dg.SendDatagram(makeDatagram(pkt.Dst, pkt.Data)) == nil {
+				// Sent as datagram, else fall back to the stream
+				break
+			}
+
 			if err = writeFrameHeader(c.writer, frameSendPacket, uint32(len(pkt.Data)+key.Len)); err != nil {
 				break
 			}
@@ -424,3 +446,36 @@ func (c *HTTPClient) RunSend() {
 		}
 	}
 }
+
+func (c *HTTPClient) RunReceiveDatagrams() {
+	defer func() {
+		if v := recover(); v != nil {
+			c.Cancel(fmt.Errorf("datagram reader panicked: %s", v))
+		}
+	}()
+
+	for {
+		b, err := c.dg.ReceiveDatagram(c.ctx)
+
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			c.Cancel(fmt.Errorf("error receiving datagram: %w", err))
+			return
+		}
+
+		src, data, err := parseDatagram(b)
+		if err != nil {
+			slog.Warn("dropping malformed datagram", "err", err)
+			continue
+		}
+
+		select {
+		case c.recvCh <- RecvPacket{Src: src, Data: data}:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"context"
+	"errors"
+
+	"github.com/edup2p/common/types/key"
+)
+
+// DatagramConn is an unreliable, message-oriented channel running alongside the framed relay stream,
+// such as QUIC datagrams.
+//
+// When a client or server has one, packets are preferably sent over it,
+// so that loss of one packet does not hold up the others.
+// Packets which do not fit in a datagram are sent over the framed stream instead.
+//
+// Datagrams have the same layout as the body of frameSendPacket (from the client),
+// and frameRecvPacket (from the server); a 32B public key, followed by the packet bytes.
+type DatagramConn interface {
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+var errShortDatagram = errors.New("datagram too short for key")
+
+func makeDatagram(k key.NodePublic, data []byte) []byte {
+	b := make([]byte, key.Len+len(data))
+
+	copy(b, k[:])
+	copy(b[key.Len:], data)
+
+	return b
+}
+
+func parseDatagram(b []byte) (k key.NodePublic, data []byte, err error) {
+	if len(b) < key.Len {
+		err = errShortDatagram
+		return
+	}
+
+	copy(k[:], b[:key.Len])
+
+	return k, b[key.Len:], nil
+}
@@ -29,6 +29,11 @@ type Information struct {
 	// Optional HTTPS/TLS port override. (Default 443)
 	HTTPSPort *uint16 `json:",omitempty"`
 
+	// Optional UDP port on which the relay serves the relay protocol over QUIC.
+	//
+	// If set, clients try to connect over QUIC first, falling back to HTTP(S) if that fails.
+	QUICPort *uint16 `json:",omitempty"`
+
 	// Optional HTTP port override. (Default 80)
 	//
 	// Also used for captive portal checks.
@@ -39,6 +44,11 @@ type Information struct {
 	// Used for tests and development environments.
 	IsInsecure bool `json:",omitempty"`
 
+	// Whether to connect to this relay over WebSockets, instead of a raw HTTP upgrade.
+	//
+	// Used for relays behind proxies or CDNs which only pass standard WebSocket traffic.
+	UseWebSocket bool `json:",omitempty"`
+
 	// Whether to use this relay to detect captive portals.
 	IsCaptiveBuster *bool `json:",omitempty"`
 
@@ -0,0 +1,68 @@
+package relay
+
+import "github.com/edup2p/common/types/metrics"
+
+// DropReason denotes why the relay server could not forward a packet.
+type DropReason string
+
+const (
+	// DropNoDestination is when the destination client is not (or no longer) connected.
+	DropNoDestination DropReason = "no_destination"
+	// DropQueueFull is when the destination client did not empty its send queue in time.
+	DropQueueFull DropReason = "queue_full"
+	// DropOversize is when a client tried to send a packet larger than MaxPacketSize.
+	DropOversize DropReason = "oversize"
+)
+
+// ServerMetrics contains the counters a Server keeps over its lifetime.
+type ServerMetrics struct {
+	// Packets and bytes received from clients, to be forwarded.
+	PacketsReceived metrics.Counter
+	BytesReceived   metrics.Counter
+
+	// Packets and bytes written to clients.
+	PacketsSent metrics.Counter
+	BytesSent   metrics.Counter
+
+	// Packets enqueued on sendSessionCh and sendCh, respectively.
+	SessionPackets metrics.Counter
+	DataPackets    metrics.Counter
+
+	// Drops, by DropReason.
+	Drops metrics.CounterVec
+
+	// Clients that failed to complete the handshake in receiveClientKeyAndInfo.
+	HandshakeFailures metrics.Counter
+}
+
+func (m *ServerMetrics) drop(reason DropReason) {
+	m.Drops.With(string(reason)).Inc()
+}
+
+// Metrics returns the live metrics of this server.
+func (s *Server) Metrics() *ServerMetrics {
+	return &s.metrics
+}
+
+// RegisterMetrics adds all server metrics to reg.
+func (s *Server) RegisterMetrics(reg *metrics.Registry) {
+	m := &s.metrics
+
+	// Pre-create all reasons, so that their series exist from the start.
+	for _, r := range []DropReason{DropNoDestination, DropQueueFull, DropOversize} {
+		m.Drops.With(string(r))
+	}
+
+	reg.AddGaugeFunc("toversok_relay_clients_connected", "Number of clients currently connected.", func() float64 {
+		return float64(s.clientCount())
+	})
+
+	reg.AddCounter("toversok_relay_received_packets_total", "Packets received from clients for forwarding.", &m.PacketsReceived)
+	reg.AddCounter("toversok_relay_received_bytes_total", "Packet bytes received from clients for forwarding.", &m.BytesReceived)
+	reg.AddCounter("toversok_relay_sent_packets_total", "Packets sent to clients.", &m.PacketsSent)
+	reg.AddCounter("toversok_relay_sent_bytes_total", "Packet bytes sent to clients.", &m.BytesSent)
+	reg.AddCounter("toversok_relay_session_packets_total", "Session message packets queued for sending.", &m.SessionPackets)
+	reg.AddCounter("toversok_relay_data_packets_total", "Data packets queued for sending.", &m.DataPackets)
+	reg.AddCounterVec("toversok_relay_dropped_packets_total", "Packets dropped, by reason.", "reason", &m.Drops)
+	reg.AddCounter("toversok_relay_handshake_failures_total", "Client connections that failed the relay handshake.", &m.HandshakeFailures)
+}
@@ -0,0 +1,33 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	s := NewServer(key.NewNode())
+
+	reg := metrics.NewRegistry()
+	s.RegisterMetrics(reg)
+
+	s.Metrics().PacketsReceived.Inc()
+	s.Metrics().drop(DropQueueFull)
+
+	var sb strings.Builder
+	require.NoError(t, reg.WriteText(&sb))
+
+	out := sb.String()
+	assert.Contains(t, out, "toversok_relay_clients_connected 0\n")
+	assert.Contains(t, out, "toversok_relay_received_packets_total 1\n")
+	assert.Contains(t, out, `toversok_relay_dropped_packets_total{reason="queue_full"} 1`+"\n")
+
+	// Reasons that never happened are still exported.
+	assert.Contains(t, out, `toversok_relay_dropped_packets_total{reason="no_destination"} 0`+"\n")
+	assert.Contains(t, out, `toversok_relay_dropped_packets_total{reason="oversize"} 0`+"\n")
+}
@@ -0,0 +1,287 @@
+package relayquic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/edup2p/common/types/dial"
+	"github.com/edup2p/common/types/key"
+	"github.com/edup2p/common/types/relay"
+	"github.com/quic-go/quic-go"
+)
+
+// RouteCheckInterval is how often the client checks if the local address towards the relay has changed.
+const RouteCheckInterval = 5 * time.Second
+
+// ConnectTimeout bounds dialing a relay over QUIC, on top of dial.Opts.ConnectTimeout;
+// it is shorter, as clients fall back to HTTP(S) on networks which drop UDP.
+const ConnectTimeout = 10 * time.Second
+
+// ErrProxied is returned by Dial when connections to the relay go through a proxy, which QUIC cannot.
+var ErrProxied = errors.New("connections to relay go through a proxy, not dialing quic")
+
+// Client is a relay client over QUIC, which migrates its connection to a new socket when the local address
+// towards the relay changes, such as when roaming between networks.
+type Client struct {
+	*relay.HTTPClient
+
+	conn   quic.Connection
+	remote *net.UDPAddr
+
+	mu sync.Mutex
+	// dialed is the transport the connection was dialed on, which has to stay open for the connection's lifetime.
+	dialed *quic.Transport
+	// migrated and path are the currently active migrated transport and path, nil if still on the original path.
+	migrated *quic.Transport
+	path     *quic.Path
+}
+
+// Dial connects to a relay over QUIC, conforming to relayhttp.RelayDialFunc.
+//
+// opts.Port should be the QUIC port of the relay.
+// Returns ErrProxied right away if opts would connect through a proxy, see dial.Opts.UsesProxy.
+// If opts.TLS is false, the certificate of the relay is not verified, which is only meant for development relays;
+// the relay is always authenticated by its key when expectKey is set.
+func Dial(ctx context.Context, opts dial.Opts, getPriv func() *key.NodePrivate, expectKey key.NodePublic) (relay.Client, error) {
+	opts.SetDefaults()
+
+	if proxied, err := opts.UsesProxy(); err != nil {
+		return nil, fmt.Errorf("could not determine proxy: %w", err)
+	} else if proxied {
+		return nil, ErrProxied
+	}
+
+	addrs := opts.Addrs
+	if len(addrs) == 0 {
+		var err error
+		if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", opts.Domain); err != nil {
+			return nil, fmt.Errorf("failed to lookup %s: %w", opts.Domain, err)
+		}
+	}
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, min(opts.ConnectTimeout, ConnectTimeout))
+	defer dialCancel()
+
+	var errs []error
+
+	for _, addr := range addrs {
+		c, err := dialOne(dialCtx, ctx, opts, netip.AddrPortFrom(addr, opts.Port), getPriv)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if !expectKey.IsZero() && c.RelayKey() != expectKey {
+			err = fmt.Errorf("relay key did not match expected key")
+			c.Cancel(err)
+
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("quic dial failure: %w", errors.Join(errs...))
+}
+
+func tlsConfig(opts dial.Opts) *tls.Config {
+	cfg := &tls.Config{
+		NextProtos: []string{ALPN},
+		MinVersion: tls.VersionTLS13,
+	}
+
+	if opts.ExpectCertCN != "" {
+		cfg.ServerName = opts.ExpectCertCN
+	} else {
+		cfg.ServerName = opts.Domain
+	}
+
+	if !opts.TLS {
+		cfg.InsecureSkipVerify = true //nolint:gosec // Development relays, authenticated by their key instead.
+	}
+
+	return cfg
+}
+
+func newTransport() (*quic.Transport, error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create udp socket: %w", err)
+	}
+
+	return &quic.Transport{Conn: udpConn}, nil
+}
+
+func dialOne(dialCtx, parentCtx context.Context, opts dial.Opts, ap netip.AddrPort, getPriv func() *key.NodePrivate) (*Client, error) {
+	tr, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	remote := net.UDPAddrFromAddrPort(ap)
+
+	conn, err := tr.Dial(dialCtx, remote, tlsConfig(opts), quicConfig())
+	if err != nil {
+		if err := tr.Close(); err != nil {
+			slog.Error("failed to close quic transport", "err", err)
+		}
+		return nil, fmt.Errorf("quic dial to %s failed: %w", ap, err)
+	}
+
+	c := &Client{
+		conn:   conn,
+		remote: remote,
+		dialed: tr,
+	}
+
+	stream, err := conn.OpenStreamSync(dialCtx)
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("could not open relay stream: %w", err)
+	}
+
+	mc := &streamConn{Stream: stream, conn: conn}
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+
+	if err := brw.WriteByte(streamHello); err != nil {
+		c.close()
+		return nil, fmt.Errorf("could not write stream hello: %w", err)
+	}
+	if err := brw.Flush(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("could not flush stream hello: %w", err)
+	}
+
+	c.HTTPClient, err = relay.EstablishClientWithDatagrams(parentCtx, mc, brw, conn, opts.EstablishTimeout, getPriv)
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("failed to establish client: %w", err)
+	}
+
+	// The relay client closes the connection when it exits, and vice versa.
+	context.AfterFunc(conn.Context(), func() {
+		c.Cancel(fmt.Errorf("quic connection closed: %w", context.Cause(conn.Context())))
+		c.close()
+	})
+
+	return c, nil
+}
+
+func (c *Client) Run() {
+	c.HTTPClient.Run()
+
+	go c.watchRoute()
+}
+
+func (c *Client) close() {
+	if err := c.conn.CloseWithError(0, "closed"); err != nil {
+		slog.Debug("failed to close quic connection", "err", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tr := range []*quic.Transport{c.migrated, c.dialed} {
+		if tr == nil {
+			continue
+		}
+		if err := tr.Close(); err != nil {
+			slog.Debug("failed to close quic transport", "err", err)
+		}
+	}
+	c.migrated, c.dialed = nil, nil
+}
+
+// watchRoute migrates the connection when the local address used to reach the relay changes.
+func (c *Client) watchRoute() {
+	ticker := time.NewTicker(RouteCheckInterval)
+	defer ticker.Stop()
+
+	last := localAddrTowards(c.remote)
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := localAddrTowards(c.remote)
+		if !cur.IsValid() || cur == last {
+			continue
+		}
+
+		slog.Info("relay: local address changed, migrating quic connection", "from", last, "to", cur)
+
+		if err := c.Migrate(c.conn.Context()); err != nil {
+			slog.Warn("relay: quic migration failed", "err", err)
+			continue
+		}
+
+		last = cur
+	}
+}
+
+// Migrate moves the connection onto a fresh socket, after validating the new path.
+func (c *Client) Migrate(ctx context.Context) error {
+	tr, err := newTransport()
+	if err != nil {
+		return err
+	}
+
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		return errors.Join(fmt.Errorf("could not add path: %w", err), tr.Close())
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := path.Probe(probeCtx); err != nil {
+		return errors.Join(fmt.Errorf("could not probe path: %w", err), path.Close(), tr.Close())
+	}
+
+	if err := path.Switch(); err != nil {
+		return errors.Join(fmt.Errorf("could not switch path: %w", err), path.Close(), tr.Close())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path != nil {
+		// The previously migrated path and its transport are no longer used.
+		// (The dialed transport cannot be closed, as that would close the connection.)
+		if err := c.path.Close(); err != nil {
+			slog.Debug("failed to close previous quic path", "err", err)
+		}
+		if err := c.migrated.Close(); err != nil {
+			slog.Debug("failed to close previous quic transport", "err", err)
+		}
+	}
+
+	c.path, c.migrated = path, tr
+
+	return nil
+}
+
+// localAddrTowards returns the local address the OS would currently use to reach remote.
+func localAddrTowards(remote *net.UDPAddr) netip.Addr {
+	// A connected UDP socket does not send anything, but does make the OS pick a route and source address.
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return netip.Addr{}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+}
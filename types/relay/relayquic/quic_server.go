@@ -0,0 +1,132 @@
+package relayquic
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/relay"
+	"github.com/quic-go/quic-go"
+)
+
+// ListenAndServe serves the relay protocol for s over QUIC on addr, until ctx is done.
+//
+// tlsConf is cloned, and its NextProtos is replaced with ALPN.
+func ListenAndServe(ctx context.Context, s *relay.Server, addr string, tlsConf *tls.Config) error {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+
+	ln, err := quic.ListenAddr(addr, tlsConf, quicConfig())
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	context.AfterFunc(ctx, func() {
+		if err := ln.Close(); err != nil {
+			s.L().Error("failed to close quic listener", "err", err)
+		}
+	})
+
+	s.L().Info("relay: serving quic", "addr", ln.Addr().String())
+
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		go serveConn(ctx, s, conn)
+	}
+}
+
+func serveConn(ctx context.Context, s *relay.Server, conn quic.Connection) {
+	remote := conn.RemoteAddr().(*net.UDPAddr).AddrPort()
+
+	mc, brw, err := acceptStream(ctx, conn)
+	if err != nil {
+		s.L().Warn("quic client did not open relay stream", "peer", remote.String(), "err", err)
+		if err := conn.CloseWithError(1, "no stream"); err != nil {
+			s.L().Warn("failed to close quic conn", "err", err)
+		}
+		return
+	}
+
+	err = s.AcceptWithDatagrams(conn.Context(), mc, brw, conn, types.NormaliseAddrPort(remote))
+
+	s.L().Info("quic client exited", "reason", err)
+
+	if err := mc.Close(); err != nil {
+		s.L().Debug("failed to close quic conn", "err", err)
+	}
+}
+
+func acceptStream(ctx context.Context, conn quic.Connection) (*streamConn, *bufio.ReadWriter, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mc := &streamConn{Stream: stream, conn: conn}
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+
+	if err := stream.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return nil, nil, err
+	}
+
+	if b, err := brw.ReadByte(); err != nil {
+		return nil, nil, err
+	} else if b != streamHello {
+		return nil, nil, fmt.Errorf("unexpected stream hello: %d", b)
+	}
+
+	return mc, brw, nil
+}
+
+// SelfSignedTLSConfig creates a TLS config with an ephemeral self-signed certificate for hostname,
+// for serving QUIC (which always requires TLS) to insecure (development) clients.
+func SelfSignedTLSConfig(hostname string) (*tls.Config, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if hostname != "" {
+		tmpl.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
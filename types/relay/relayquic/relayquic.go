@@ -0,0 +1,44 @@
+// Package relayquic contains an implementation of the relay protocol over QUIC.
+//
+// The framed relay protocol runs over a single bidirectional stream, opened by the client,
+// while packets are carried in QUIC datagrams wherever they fit.
+// This gives relayed traffic UDP-like loss semantics, and lets connections survive client address changes.
+package relayquic
+
+import (
+	"time"
+
+	"github.com/edup2p/common/types/relay"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol negotiated during the QUIC handshake.
+const ALPN = relay.UpgradeProtocol
+
+// streamHello is sent by the client as the first byte on the stream, as QUIC only announces a stream to the peer
+// once data has been sent on it, while the relay protocol has the server speak first.
+const streamHello byte = 0
+
+const (
+	KeepAlivePeriod = 10 * time.Second
+	MaxIdleTimeout  = 30 * time.Second
+)
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: KeepAlivePeriod,
+		MaxIdleTimeout:  MaxIdleTimeout,
+	}
+}
+
+// streamConn is a MetaConn over a QUIC stream, which closes the entire connection when closed.
+type streamConn struct {
+	quic.Stream
+
+	conn quic.Connection
+}
+
+func (s *streamConn) Close() error {
+	return s.conn.CloseWithError(0, "closed")
+}
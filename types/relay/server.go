@@ -23,6 +23,8 @@ type Server struct {
 
 	mu      sync.RWMutex
 	clients map[key.NodePublic]*ServerClient
+
+	metrics ServerMetrics
 }
 
 func NewServer(privKey key.NodePrivate) *Server {
@@ -135,6 +137,11 @@ func (s *Server) sendServerInfo(client *ServerClient) error {
 }
 
 func (s *Server) Accept(ctx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, remoteAddrPort netip.AddrPort) error {
+	return s.AcceptWithDatagrams(ctx, mc, brw, nil, remoteAddrPort)
+}
+
+// AcceptWithDatagrams is Accept, with an additional DatagramConn to send and receive packets on.
+func (s *Server) AcceptWithDatagrams(ctx context.Context, mc types.MetaConn, brw *bufio.ReadWriter, dg DatagramConn, remoteAddrPort netip.AddrPort) error {
 	reader := brw.Reader
 	// TODO: Tailscale mentions that bufio writer buffers take up a large portion of their memory,
 	//  and so they've made an implementation that lazily grabs memory from a pool,
@@ -159,6 +166,7 @@ func (s *Server) Accept(ctx context.Context, mc types.MetaConn, brw *bufio.ReadW
 	}
 	clientKey, clientInfo, err := s.receiveClientKeyAndInfo(reader)
 	if err != nil {
+		s.metrics.HandshakeFailures.Inc()
 		return err
 	}
 
@@ -191,6 +199,8 @@ func (s *Server) Accept(ctx context.Context, mc types.MetaConn, brw *bufio.ReadW
 		sendSessionCh: make(chan ServerPacket, ServerClientSendQueueDepth),
 		sendPongCh:    make(chan PingData, 1),
 
+		datagrams: dg,
+
 		info: clientInfo,
 	}
 
@@ -211,6 +221,13 @@ func (s *Server) getClient(peer key.NodePublic) *ServerClient {
 	return s.clients[peer]
 }
 
+func (s *Server) clientCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.clients)
+}
+
 func (s *Server) registerClient(client *ServerClient) {
 	// Check if there's a client active on this key already.
 	if sc := s.getClient(client.nodeKey); sc != nil {
@@ -53,6 +53,9 @@ type ServerClient struct {
 	// Not thread-safe; owned by RunSender
 	buffWriter *bufio.Writer
 
+	// Optional, packets are preferably sent and received over this if set.
+	datagrams DatagramConn
+
 	info *ClientInfo
 }
 
@@ -61,6 +64,9 @@ func (sc *ServerClient) SendPacket(pkt ServerPacket) {
 	queue := sc.sendCh
 	if msgsess.LooksLikeSessionWireMessage(pkt.bytes) {
 		queue = sc.sendSessionCh
+		sc.server.metrics.SessionPackets.Inc()
+	} else {
+		sc.server.metrics.DataPackets.Inc()
 	}
 
 	// First pass trying to queue directly
@@ -68,6 +74,7 @@ func (sc *ServerClient) SendPacket(pkt ServerPacket) {
 	case <-sc.ctx.Done():
 		// return, dst is gone
 		sc.L().Warn("could not send packet; sc context done", "src", pkt.src.Debug())
+		sc.server.metrics.drop(DropNoDestination)
 		return
 	case queue <- pkt:
 		return
@@ -82,12 +89,14 @@ func (sc *ServerClient) SendPacket(pkt ServerPacket) {
 		select {
 		case <-sc.ctx.Done():
 			sc.L().Warn("could not send packet after delay; sc context done", "src", pkt.src.Debug())
+			sc.server.metrics.drop(DropNoDestination)
 			// return, dst is gone
 			return
 		case queue <- pkt:
 			return
 		case <-time.NewTimer(time.Second * 5).C:
 			// Timed out, return
+			sc.server.metrics.drop(DropQueueFull)
 			return
 		}
 	}()
@@ -98,6 +107,10 @@ func (sc *ServerClient) Run() (err error) {
 	go sc.RunReceiver()
 	go sc.RunSender()
 
+	if sc.datagrams != nil {
+		go sc.RunDatagramReceiver()
+	}
+
 	sc.L().Info("new client", "peer", sc.nodeKey.Debug())
 
 	<-sc.ctx.Done()
@@ -152,6 +165,40 @@ func (sc *ServerClient) handleSend(frLen uint32) error {
 		return err
 	}
 
+	sc.forward(dstKey, contents)
+
+	return nil
+}
+
+func (sc *ServerClient) RunDatagramReceiver() {
+	defer func() {
+		if v := recover(); v != nil {
+			sc.ccc(fmt.Errorf("datagram receiver panicked: %s", v))
+		}
+	}()
+
+	for {
+		b, err := sc.datagrams.ReceiveDatagram(sc.ctx)
+		if err != nil {
+			sc.ccc(fmt.Errorf("datagram receiver: %w", err))
+			return
+		}
+
+		dstKey, contents, err := parseDatagram(b)
+		if err != nil {
+			sc.L().Warn("dropping malformed datagram", "err", err)
+			continue
+		}
+
+		sc.forward(dstKey, contents)
+	}
+}
+
+// forward sends a packet received from this client onwards to dstKey.
+func (sc *ServerClient) forward(dstKey key.NodePublic, contents []byte) {
+	sc.server.metrics.PacketsReceived.Inc()
+	sc.server.metrics.BytesReceived.Add(uint64(len(contents)))
+
 	dstClient := sc.server.getClient(dstKey)
 
 	if dstClient == nil {
@@ -159,8 +206,9 @@ func (sc *ServerClient) handleSend(frLen uint32) error {
 		// TODO tailscale sends back that the peer is gone,
 		//   we currently dont take into account if peers are connected when sending over relay,
 		//   we assume the home relay always is able to send packets.
-		sc.L().Warn("handleSend dropping packet", "to-peer", dstKey.Debug(), "reason", "client-not-connected")
-		return nil
+		sc.L().Warn("forward dropping packet", "to-peer", dstKey.Debug(), "reason", "client-not-connected")
+		sc.server.metrics.drop(DropNoDestination)
+		return
 	}
 
 	slog.Debug("sending packet", "src", sc.nodeKey.Debug(), "dst", dstClient.nodeKey.Debug())
@@ -169,8 +217,6 @@ func (sc *ServerClient) handleSend(frLen uint32) error {
 		bytes: contents,
 		src:   sc.nodeKey,
 	})
-
-	return nil
 }
 
 func (sc *ServerClient) readSend(frLen uint32) (dstKey key.NodePublic, contents []byte, err error) {
@@ -186,6 +232,7 @@ func (sc *ServerClient) readSend(frLen uint32) (dstKey key.NodePublic, contents
 	packetLen := frLen - key.Len
 
 	if packetLen > MaxPacketSize {
+		sc.server.metrics.drop(DropOversize)
 		err = fmt.Errorf("data packet longer (%d) than max of %v", packetLen, MaxPacketSize)
 		return
 	}
@@ -304,6 +351,14 @@ func (sc *ServerClient) sendKeepAlive() error {
 }
 
 func (sc *ServerClient) sendPacket(src key.NodePublic, data []byte) (err error) {
+	if sc.datagrams != nil && sc.datagrams.SendDatagram(makeDatagram(src, data)) == nil {
+		sc.server.metrics.PacketsSent.Inc()
+		sc.server.metrics.BytesSent.Add(uint64(len(data)))
+
+		return nil
+	}
+	// Else, fall back to the stream
+
 	sc.setWriteDeadline()
 
 	pktLen := len(data) + key.Len
@@ -315,9 +370,14 @@ func (sc *ServerClient) sendPacket(src key.NodePublic, data []byte) (err error)
 	if _, err := sc.buffWriter.Write(src[:]); err != nil {
 		return err
 	}
-	_, err = sc.buffWriter.Write(data)
+	if _, err = sc.buffWriter.Write(data); err != nil {
+		return err
+	}
 
-	return err
+	sc.server.metrics.PacketsSent.Inc()
+	sc.server.metrics.BytesSent.Add(uint64(len(data)))
+
+	return nil
 }
 
 func (sc *ServerClient) sendPong(data [8]byte) error {
@@ -0,0 +1,255 @@
+// Package servertls contains the TLS setup shared between the relay and control server binaries,
+// either with certificates automatically obtained via ACME (autocert), or with manually provided ones.
+package servertls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type CertMode string
+
+const (
+	// CertModeLetsEncrypt obtains and renews certificates via ACME, by default from Let's Encrypt.
+	CertModeLetsEncrypt CertMode = "letsencrypt"
+	// CertModeManual reads <hostname>.crt and <hostname>.key from the certificate directory.
+	CertModeManual CertMode = "manual"
+)
+
+type Config struct {
+	Mode CertMode
+
+	// Hostname is the hostname to obtain or check certificates for.
+	Hostname string
+
+	// CertDir is the ACME cache directory in CertModeLetsEncrypt,
+	// and the directory to read certificates from in CertModeManual.
+	CertDir string
+
+	// HTTPAddr is the address to serve plain HTTP on while serving TLS,
+	// which answers ACME HTTP-01 challenges, and redirects everything else to HTTPS.
+	//
+	// Empty disables the HTTP listener.
+	HTTPAddr string
+
+	// ACMEDirectory overrides the ACME directory URL, if non-empty. Defaults to Let's Encrypt.
+	ACMEDirectory string
+
+	// ACMERootCA is a path to a PEM bundle to trust for the ACME directory, if non-empty.
+	//
+	// Useful for testing against a local ACME server such as pebble.
+	ACMERootCA string
+
+	// ACMEEmail is the contact address registered with the ACME account, if non-empty.
+	ACMEEmail string
+
+	setupOnce   sync.Once
+	setupErr    error
+	tlsConfig   *tls.Config
+	httpHandler http.Handler
+}
+
+// RegisterFlags registers the common certificate flags on fs, and returns the Config they'll be parsed into.
+func RegisterFlags(fs *flag.FlagSet, defaultCertDir string) *Config {
+	cfg := new(Config)
+
+	fs.Func("certmode", "mode for getting a cert. possible options: letsencrypt, manual (default letsencrypt)", func(s string) error {
+		switch m := CertMode(s); m {
+		case CertModeLetsEncrypt, CertModeManual:
+			cfg.Mode = m
+			return nil
+		default:
+			return fmt.Errorf("unknown certmode %q", s)
+		}
+	})
+	cfg.Mode = CertModeLetsEncrypt
+
+	fs.StringVar(&cfg.Hostname, "hostname", "", "hostname to serve TLS for; required when serving HTTPS")
+	fs.StringVar(&cfg.CertDir, "certdir", defaultCertDir, "directory to store LetsEncrypt certs in, or to read <hostname>.crt and <hostname>.key from with -certmode manual")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", ":80", "plain HTTP listen address while serving HTTPS, for ACME HTTP-01 challenges and redirects; empty to disable")
+	fs.StringVar(&cfg.ACMEDirectory, "acme-directory", "", "ACME directory URL to use instead of LetsEncrypt's")
+	fs.StringVar(&cfg.ACMERootCA, "acme-ca", "", "PEM file with extra root CAs to trust when talking to the ACME directory")
+	fs.StringVar(&cfg.ACMEEmail, "acme-email", "", "contact email to register with the ACME account")
+
+	return cfg
+}
+
+// ShouldServeTLS returns whether TLS should be served on addr;
+// when its port is 443, and/or when certificates are manually provided.
+func (c *Config) ShouldServeTLS(addr string) bool {
+	if c.Mode == CertModeManual {
+		return true
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+
+	return err == nil && port == "443"
+}
+
+// ListenAndServe serves srv on srv.Addr, with TLS if ShouldServeTLS says so, until srv is shut down.
+//
+// While serving TLS, this also runs the plain HTTP listener on HTTPAddr until ctx is done.
+func (c *Config) ListenAndServe(ctx context.Context, srv *http.Server) error {
+	if !c.ShouldServeTLS(srv.Addr) {
+		return srv.ListenAndServe()
+	}
+
+	tlsCfg, err := c.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	srv.TLSConfig = tlsCfg
+
+	if c.HTTPAddr != "" {
+		go c.serveHTTP(ctx, c.httpHandler)
+	}
+
+	return srv.ListenAndServeTLS("", "")
+}
+
+// TLSConfig returns the TLS configuration for the certificate mode,
+// which can be shared between multiple listeners (such as HTTPS and QUIC).
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	c.setupOnce.Do(func() {
+		c.tlsConfig, c.httpHandler, c.setupErr = c.setup()
+	})
+
+	return c.tlsConfig, c.setupErr
+}
+
+func (c *Config) setup() (*tls.Config, http.Handler, error) {
+	if c.Hostname == "" {
+		return nil, nil, errors.New("serving TLS requires a hostname")
+	}
+
+	switch c.Mode {
+	case CertModeLetsEncrypt:
+		m, err := c.autocertManager()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return m.TLSConfig(), m.HTTPHandler(nil), nil
+	case CertModeManual:
+		tlsCfg, err := c.manualTLSConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return tlsCfg, http.HandlerFunc(redirectToHTTPS), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown certmode %q", c.Mode)
+	}
+}
+
+func (c *Config) autocertManager() (*autocert.Manager, error) {
+	if err := os.MkdirAll(c.CertDir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create cert dir: %w", err)
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Hostname),
+		Cache:      autocert.DirCache(c.CertDir),
+		Email:      c.ACMEEmail,
+	}
+
+	if c.ACMEDirectory != "" || c.ACMERootCA != "" {
+		client := &acme.Client{DirectoryURL: c.ACMEDirectory}
+
+		if c.ACMERootCA != "" {
+			pem, err := os.ReadFile(c.ACMERootCA)
+			if err != nil {
+				return nil, fmt.Errorf("could not read ACME root CA: %w", err)
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", c.ACMERootCA)
+			}
+
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+
+		m.Client = client
+	}
+
+	return m, nil
+}
+
+func (c *Config) manualTLSConfig() (*tls.Config, error) {
+	crtPath := filepath.Join(c.CertDir, c.Hostname+".crt")
+	keyPath := filepath.Join(c.CertDir, c.Hostname+".key")
+
+	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load manual certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manual certificate: %w", err)
+	}
+
+	if err := leaf.VerifyHostname(c.Hostname); err != nil {
+		return nil, fmt.Errorf("manual certificate does not match hostname: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (c *Config) serveHTTP(ctx context.Context, h http.Handler) {
+	srv := &http.Server{
+		Addr:    c.HTTPAddr,
+		Handler: h,
+
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			slog.Error("failed to shutdown http server", "err", err)
+		}
+	}()
+
+	slog.Info("serving http", "addr", c.HTTPAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("http listen error", "addr", c.HTTPAddr, "err", err)
+	}
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
@@ -0,0 +1,181 @@
+package servertls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate for hostname to dir, as <name>.crt and <name>.key,
+// and returns the certificate.
+func writeCert(t *testing.T, dir, name, hostname string) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := RegisterFlags(fs, "/certs")
+
+	assert.Equal(t, CertModeLetsEncrypt, cfg.Mode)
+	assert.Equal(t, "/certs", cfg.CertDir)
+	assert.Equal(t, ":80", cfg.HTTPAddr)
+
+	require.NoError(t, fs.Parse([]string{"-certmode", "manual", "-hostname", "relay.example", "-http-addr", ""}))
+
+	assert.Equal(t, CertModeManual, cfg.Mode)
+	assert.Equal(t, "relay.example", cfg.Hostname)
+	assert.Empty(t, cfg.HTTPAddr)
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs, "")
+
+	assert.Error(t, fs.Parse([]string{"-certmode", "selfsigned"}))
+}
+
+func TestShouldServeTLS(t *testing.T) {
+	cfg := &Config{Mode: CertModeLetsEncrypt}
+
+	assert.True(t, cfg.ShouldServeTLS(":443"))
+	assert.True(t, cfg.ShouldServeTLS("0.0.0.0:443"))
+	assert.False(t, cfg.ShouldServeTLS(":80"))
+	assert.False(t, cfg.ShouldServeTLS("invalid"))
+
+	cfg.Mode = CertModeManual
+
+	assert.True(t, cfg.ShouldServeTLS(":8080"))
+}
+
+func TestManualTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir, "relay.example", "relay.example")
+
+	cfg := &Config{Mode: CertModeManual, Hostname: "relay.example", CertDir: dir}
+
+	tlsCfg, err := cfg.TLSConfig()
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    pool,
+		ServerName: "relay.example",
+		MinVersion: tls.VersionTLS12,
+	}}}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestManualTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	// A certificate for another name, under the hostname's file names.
+	writeCert(t, dir, "relay.example", "other.example")
+
+	_, err := (&Config{Mode: CertModeManual, Hostname: "relay.example", CertDir: dir}).TLSConfig()
+	assert.ErrorContains(t, err, "does not match hostname")
+
+	_, err = (&Config{Mode: CertModeManual, Hostname: "missing.example", CertDir: dir}).TLSConfig()
+	assert.ErrorContains(t, err, "could not load manual certificate")
+
+	_, err = (&Config{Mode: CertModeManual, CertDir: dir}).TLSConfig()
+	assert.ErrorContains(t, err, "requires a hostname")
+}
+
+func TestAutocertManager(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "ca", "ca.example")
+
+	cfg := &Config{
+		Mode:          CertModeLetsEncrypt,
+		Hostname:      "relay.example",
+		CertDir:       filepath.Join(dir, "cache"),
+		ACMEDirectory: "https://localhost:14000/dir",
+		ACMERootCA:    filepath.Join(dir, "ca.crt"),
+		ACMEEmail:     "admin@relay.example",
+	}
+
+	m, err := cfg.autocertManager()
+	require.NoError(t, err)
+
+	assert.DirExists(t, cfg.CertDir)
+	assert.Equal(t, "admin@relay.example", m.Email)
+	require.NotNil(t, m.Client)
+	assert.Equal(t, "https://localhost:14000/dir", m.Client.DirectoryURL)
+	assert.NotNil(t, m.Client.HTTPClient, "the ACME root CA should be trusted by the client")
+
+	assert.Error(t, m.HostPolicy(context.Background(), "other.example"))
+	assert.NoError(t, m.HostPolicy(context.Background(), "relay.example"))
+
+	cfg.ACMERootCA = filepath.Join(dir, "ca.key")
+
+	_, err = cfg.autocertManager()
+	assert.ErrorContains(t, err, "no certificates found")
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	rec := httptest.NewRecorder()
+	redirectToHTTPS(rec, httptest.NewRequest(http.MethodGet, "http://relay.example:80/relay?x=1", nil))
+
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://relay.example/relay?x=1", rec.Header().Get("Location"))
+
+	rec = httptest.NewRecorder()
+	redirectToHTTPS(rec, httptest.NewRequest(http.MethodPost, "http://relay.example/relay", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -22,5 +22,9 @@ type PeerInfo struct {
 	RendezvousEndpoints []netip.AddrPort
 	Session             key.SessionPublic
 	IPv4, IPv6          netip.Addr
+	Hostname            string
+	Routes              []netip.Prefix
 	MDNS                bool
+	// MDNSServices are the service types shared with the peer, all when empty, see msgcontrol.Properties.
+	MDNSServices []string
 }
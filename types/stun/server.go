@@ -9,11 +9,15 @@ import (
 	"net"
 	"net/netip"
 	"time"
+
+	"github.com/edup2p/common/types/metrics"
 )
 
 type Server struct {
 	ctx  context.Context // ctx signals service shutdown
 	bind *net.UDPConn    // bind is the UDP listener
+
+	served metrics.Counter // served counts the binding requests answered
 }
 
 func NewServer(ctx context.Context) *Server {
@@ -79,10 +83,17 @@ func (s *Server) Serve() error {
 
 		if _, err = s.bind.WriteTo(res, ua); err != nil {
 			slog.Info("writing back STUN response failed", "error", err)
+		} else {
+			s.served.Inc()
 		}
 	}
 }
 
+// RegisterMetrics adds the STUN server's metrics to reg.
+func (s *Server) RegisterMetrics(reg *metrics.Registry) {
+	reg.AddCounter("toversok_stun_requests_served_total", "STUN binding requests answered.", &s.served)
+}
+
 // ListenAndServe starts the STUN server on listenAddr.
 func (s *Server) ListenAndServe(listenAddr netip.AddrPort) error {
 	if err := s.Listen(listenAddr); err != nil {
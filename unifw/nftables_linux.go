@@ -0,0 +1,706 @@
+package unifw
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/edup2p/common/toversok"
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// TableName is the name of the nftables table (in the inet family) managed by NFTablesHost.
+const TableName = "toversok"
+
+const (
+	setQuarantine4 = "quarantine4"
+	setQuarantine6 = "quarantine6"
+
+	chainPeersIn  = "peers_in"
+	chainPeersOut = "peers_out"
+	chainNAT      = "nat"
+	chainRoutes   = "routes"
+)
+
+func NewFirewallHost(iface string) (toversok.FirewallHost, error) {
+	return NewNFTablesHost(iface)
+}
+
+// NFTablesHost is a toversok.FirewallHost which installs a dedicated nftables table.
+//
+// Its input chain drops new connections from quarantined overlay IPs arriving on the overlay interface,
+// while still accepting return traffic of connections made from this host.
+//
+// Peer rules are enforced in the peers_in and peers_out chains, jumped to from the input and output chains.
+//
+// Traffic forwarded from the overlay, see toversok.Forwarder, is filtered by its forward chain like incoming traffic,
+// and masqueraded by its nat chain. Its routes chain, jumped to from the forward chain, drops the traffic from the
+// overlay to anywhere but the advertised routes.
+type NFTablesHost struct {
+	// iface is the name of the overlay interface, or empty to match quarantined IPs on any interface.
+	iface string
+
+	conn *nftables.Conn
+
+	mu      sync.Mutex
+	running *NFTablesController
+
+	// sysctls are the original values of the forwarding sysctls which were changed, by path.
+	sysctls map[string]string
+}
+
+func NewNFTablesHost(iface string) (*NFTablesHost, error) {
+	if len(iface) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %q too long", iface)
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create nftables connection: %w", err)
+	}
+
+	return &NFTablesHost{
+		iface:   iface,
+		conn:    conn,
+		sysctls: make(map[string]string),
+	}, nil
+}
+
+// Reset removes the table, if it exists, and turns forwarding back off if it was turned on.
+func (h *NFTablesHost) Reset() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.running = nil
+
+	return errors.Join(h.restoreSysctls(func(string) bool { return true }), h.deleteTable())
+}
+
+func (h *NFTablesHost) deleteTable() error {
+	tables, err := h.conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("could not list tables: %w", err)
+	}
+
+	for _, t := range tables {
+		if t.Name == TableName {
+			h.conn.DelTable(t)
+
+			if err := h.conn.Flush(); err != nil {
+				return fmt.Errorf("could not delete table: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Controller (re)creates the table, without any quarantined IPs.
+func (h *NFTablesHost) Controller() (toversok.FirewallController, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.deleteTable(); err != nil {
+		return nil, err
+	}
+
+	table := h.conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   TableName,
+	})
+
+	policy := nftables.ChainPolicyAccept
+	input := h.conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	output := h.conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	forward := h.conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	nat := h.conn.AddChain(&nftables.Chain{
+		Name:     chainNAT,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	peersIn := h.conn.AddChain(&nftables.Chain{Name: chainPeersIn, Table: table})
+	peersOut := h.conn.AddChain(&nftables.Chain{Name: chainPeersOut, Table: table})
+	routes := h.conn.AddChain(&nftables.Chain{Name: chainRoutes, Table: table})
+
+	set4 := &nftables.Set{Table: table, Name: setQuarantine4, KeyType: nftables.TypeIPAddr}
+	set6 := &nftables.Set{Table: table, Name: setQuarantine6, KeyType: nftables.TypeIP6Addr}
+
+	for _, set := range []*nftables.Set{set4, set6} {
+		if err := h.conn.AddSet(set, nil); err != nil {
+			return nil, fmt.Errorf("could not add set %s: %w", set.Name, err)
+		}
+	}
+
+	for _, chain := range []*nftables.Chain{input, forward} {
+		rules := [][]expr.Any{
+			h.matchEstablished(expr.MetaKeyIIFNAME),
+			h.matchQuarantined(unix.NFPROTO_IPV4, 12, 4, set4),
+			h.matchQuarantined(unix.NFPROTO_IPV6, 8, 16, set6),
+		}
+
+		// Forwarded traffic is restricted to the routes before the peer rules, which accept it.
+		if chain == forward {
+			rules = append(rules, h.jump(expr.MetaKeyIIFNAME, chainRoutes))
+		}
+
+		for _, exprs := range append(rules, h.jump(expr.MetaKeyIIFNAME, chainPeersIn)) {
+			h.conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+		}
+	}
+
+	for _, exprs := range [][]expr.Any{
+		h.matchEstablished(expr.MetaKeyOIFNAME),
+		h.jump(expr.MetaKeyOIFNAME, chainPeersOut),
+	} {
+		h.conn.AddRule(&nftables.Rule{Table: table, Chain: output, Exprs: exprs})
+	}
+
+	if err := h.conn.Flush(); err != nil {
+		return nil, fmt.Errorf("could not create table: %w", err)
+	}
+
+	h.running = &NFTablesController{host: h, set4: set4, set6: set6, peersIn: peersIn, peersOut: peersOut, nat: nat, routes: routes}
+
+	return h.running, nil
+}
+
+// matchIface matches packets coming in on (with expr.MetaKeyIIFNAME), or going out of (with expr.MetaKeyOIFNAME)
+// the overlay interface, or all packets if it is not set.
+func (h *NFTablesHost) matchIface(key expr.MetaKey) []expr.Any {
+	if h.iface == "" {
+		return nil
+	}
+
+	name := make([]byte, unix.IFNAMSIZ)
+	copy(name, h.iface)
+
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: name},
+	}
+}
+
+// matchEstablished accepts packets belonging to established connections.
+//
+// ct state established,related accept
+func (h *NFTablesHost) matchEstablished(ifaceKey expr.MetaKey) []expr.Any {
+	return append(h.matchIface(ifaceKey),
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+}
+
+// matchQuarantined drops packets of a protocol family, of which the source address (at offset in the network
+// header, with length) is in set.
+//
+// ip saddr @set drop / ip6 saddr @set drop
+func (h *NFTablesHost) matchQuarantined(nfproto byte, offset, length uint32, set *nftables.Set) []expr.Any {
+	return append(h.matchIface(expr.MetaKeyIIFNAME),
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// jump jumps to chain for packets on the overlay interface.
+func (h *NFTablesHost) jump(ifaceKey expr.MetaKey, chain string) []expr.Any {
+	return append(h.matchIface(ifaceKey), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain})
+}
+
+type NFTablesController struct {
+	host *NFTablesHost
+
+	set4, set6 *nftables.Set
+
+	peersIn, peersOut *nftables.Chain
+
+	nat, routes *nftables.Chain
+}
+
+var errResetController = errors.New("firewall controller has been reset")
+
+// QuarantineNodes replaces the contents of the quarantine sets with ips, in a single transaction.
+func (c *NFTablesController) QuarantineNodes(ips []netip.Addr) error {
+	h := c.host
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running != c {
+		return errResetController
+	}
+
+	var elems4, elems6 []nftables.SetElement
+
+	for _, ip := range ips {
+		ip = ip.Unmap()
+
+		if ip.Is4() {
+			elems4 = append(elems4, nftables.SetElement{Key: ip.AsSlice()})
+		} else {
+			elems6 = append(elems6, nftables.SetElement{Key: ip.AsSlice()})
+		}
+	}
+
+	h.conn.FlushSet(c.set4)
+	h.conn.FlushSet(c.set6)
+
+	for _, sa := range []struct {
+		set   *nftables.Set
+		elems []nftables.SetElement
+	}{{c.set4, elems4}, {c.set6, elems6}} {
+		if len(sa.elems) == 0 {
+			continue
+		}
+
+		if err := h.conn.SetAddElements(sa.set, sa.elems); err != nil {
+			return fmt.Errorf("could not add elements to %s: %w", sa.set.Name, err)
+		}
+	}
+
+	if err := h.conn.Flush(); err != nil {
+		return fmt.Errorf("could not update quarantine sets: %w", err)
+	}
+
+	return nil
+}
+
+// SetPeerRules replaces the contents of the peer rule chains, in a single transaction.
+//
+// The most specific prefixes are matched first. Prefixes without rules return from the chains,
+// so that the rules of less specific prefixes which contain them do not apply.
+//
+// Invalid rules are skipped; the other connections with their peer are then still dropped.
+func (c *NFTablesController) SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error {
+	h := c.host
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running != c {
+		return errResetController
+	}
+
+	h.conn.FlushChain(c.peersIn)
+	h.conn.FlushChain(c.peersOut)
+
+	prefixes := slices.SortedFunc(maps.Keys(rules), func(a, b netip.Prefix) int {
+		if a.Bits() != b.Bits() {
+			return b.Bits() - a.Bits()
+		}
+
+		return a.Addr().Compare(b.Addr())
+	})
+
+	for _, prefix := range prefixes {
+		peerRules := rules[prefix]
+		if len(peerRules) == 0 && !restrictedWithin(rules, prefix) {
+			continue
+		}
+
+		prefix = unmapPrefix(prefix)
+
+		for _, chain := range []*nftables.Chain{c.peersIn, c.peersOut} {
+			direction := msgcontrol.DirectionIn
+			if chain == c.peersOut {
+				direction = msgcontrol.DirectionOut
+			}
+
+			if len(peerRules) == 0 {
+				h.conn.AddRule(&nftables.Rule{
+					Table: chain.Table,
+					Chain: chain,
+					Exprs: append(matchPeerPrefix(prefix, direction), &expr.Verdict{Kind: expr.VerdictReturn}),
+				})
+
+				continue
+			}
+
+			for _, r := range peerRules {
+				if r.Direction != direction || r.Validate() != nil {
+					continue
+				}
+
+				for _, exprs := range ruleExprs(prefix, r) {
+					h.conn.AddRule(&nftables.Rule{
+						Table: chain.Table,
+						Chain: chain,
+						Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
+					})
+				}
+			}
+
+			h.conn.AddRule(&nftables.Rule{
+				Table: chain.Table,
+				Chain: chain,
+				Exprs: append(matchPeerPrefix(prefix, direction), &expr.Verdict{Kind: expr.VerdictDrop}),
+			})
+		}
+	}
+
+	if err := h.conn.Flush(); err != nil {
+		return fmt.Errorf("could not update peer rules: %w", err)
+	}
+
+	return nil
+}
+
+// restrictedWithin returns whether prefix lies within a less specific prefix with rules.
+func restrictedWithin(rules map[netip.Prefix][]msgcontrol.FilterRule, prefix netip.Prefix) bool {
+	for other, otherRules := range rules {
+		if len(otherRules) > 0 && other.Bits() < prefix.Bits() && other.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unmapPrefix returns prefix with an IPv4-mapped IPv6 address as an IPv4 prefix.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if !addr.Is4In6() || prefix.Bits() < 96 {
+		return prefix.Masked()
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked()
+}
+
+// matchPeerPrefix matches packets from or to prefix, like matchPeer for a single address.
+func matchPeerPrefix(prefix netip.Prefix, direction msgcontrol.Direction) []expr.Any {
+	if prefix.IsSingleIP() {
+		return matchPeer(prefix.Addr(), direction)
+	}
+
+	return matchPrefix(prefix, direction)
+}
+
+// matchPeer matches packets from (with msgcontrol.DirectionIn) or to (with msgcontrol.DirectionOut) addr.
+//
+// ip saddr addr / ip daddr addr / ip6 saddr addr / ip6 daddr addr
+func matchPeer(addr netip.Addr, direction msgcontrol.Direction) []expr.Any {
+	nfproto, offset := byte(unix.NFPROTO_IPV4), uint32(12)
+	if addr.Is6() {
+		nfproto, offset = unix.NFPROTO_IPV6, 8
+	}
+
+	if direction == msgcontrol.DirectionOut {
+		// The destination address follows the source address.
+		offset += uint32(addr.BitLen() / 8)
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(addr.BitLen() / 8)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr.AsSlice()},
+	}
+}
+
+// ruleExprs returns the matches for a rule with the peer prefix, of which each should be accepted.
+func ruleExprs(prefix netip.Prefix, r msgcontrol.FilterRule) [][]expr.Any {
+	var protos []byte
+
+	switch r.Protocol {
+	case msgcontrol.ProtocolTCP:
+		protos = []byte{unix.IPPROTO_TCP}
+	case msgcontrol.ProtocolUDP:
+		protos = []byte{unix.IPPROTO_UDP}
+	case msgcontrol.ProtocolICMP:
+		if prefix.Addr().Is6() {
+			protos = []byte{unix.IPPROTO_ICMPV6}
+		} else {
+			protos = []byte{unix.IPPROTO_ICMP}
+		}
+	case msgcontrol.ProtocolAny:
+		if len(r.Ports) == 0 {
+			return [][]expr.Any{matchPeerPrefix(prefix, r.Direction)}
+		}
+
+		protos = []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP}
+	}
+
+	var matches [][]expr.Any
+
+	for _, proto := range protos {
+		base := append(matchPeerPrefix(prefix, r.Direction),
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+
+		if len(r.Ports) == 0 || (proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP) {
+			matches = append(matches, base)
+			continue
+		}
+
+		for _, p := range r.Ports {
+			matches = append(matches, append(slices.Clip(base),
+				// th dport first-last
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Range{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					FromData: binaryutil.BigEndian.PutUint16(p.First),
+					ToData:   binaryutil.BigEndian.PutUint16(p.Last),
+				},
+			))
+		}
+	}
+
+	return matches
+}
+
+var _ toversok.Forwarder = (*NFTablesController)(nil)
+
+// SetForwarding replaces the contents of the nat and routes chains, in a single transaction,
+// and turns on forwarding for the address families of routes.
+func (c *NFTablesController) SetForwarding(overlay, routes []netip.Prefix) error {
+	h := c.host
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running != c {
+		return errResetController
+	}
+
+	h.conn.FlushChain(c.nat)
+	h.conn.FlushChain(c.routes)
+
+	for _, route := range routes {
+		// ip daddr route return
+		h.conn.AddRule(&nftables.Rule{
+			Table: c.routes.Table,
+			Chain: c.routes,
+			Exprs: append(matchPrefix(route, msgcontrol.DirectionOut), &expr.Verdict{Kind: expr.VerdictReturn}),
+		})
+	}
+
+	for _, prefix := range overlay {
+		// ip saddr prefix drop
+		h.conn.AddRule(&nftables.Rule{
+			Table: c.routes.Table,
+			Chain: c.routes,
+			Exprs: append(matchPrefix(prefix, msgcontrol.DirectionIn), &expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+
+	// Traffic within the overlay is left as-is, as exit routes (see msgcontrol.ExitRoutes) also cover it.
+	for _, prefix := range overlay {
+		// ip daddr prefix return
+		h.conn.AddRule(&nftables.Rule{
+			Table: c.nat.Table,
+			Chain: c.nat,
+			Exprs: append(matchPrefix(prefix, msgcontrol.DirectionOut), &expr.Verdict{Kind: expr.VerdictReturn}),
+		})
+	}
+
+	for _, route := range routes {
+		for _, from := range overlay {
+			if from.Addr().Is4() != route.Addr().Is4() {
+				continue
+			}
+
+			// ip saddr from ip daddr route masquerade
+			h.conn.AddRule(&nftables.Rule{
+				Table: c.nat.Table,
+				Chain: c.nat,
+				Exprs: slices.Concat(
+					matchPrefix(from, msgcontrol.DirectionIn),
+					matchPrefix(route, msgcontrol.DirectionOut),
+					[]expr.Any{&expr.Masq{}},
+				),
+			})
+		}
+	}
+
+	if err := h.conn.Flush(); err != nil {
+		return fmt.Errorf("could not update forwarding chains: %w", err)
+	}
+
+	if slices.ContainsFunc(routes, func(p netip.Prefix) bool { return p.Addr().Is4() }) {
+		if err := h.setSysctl(sysctlForward4, "1"); err != nil {
+			return err
+		}
+	} else if err := h.restoreSysctl(sysctlForward4); err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(routes, func(p netip.Prefix) bool { return p.Addr().Is6() }) {
+		return h.enableForward6()
+	}
+
+	return h.restoreSysctls(func(path string) bool { return strings.HasPrefix(path, sysctlConf6) })
+}
+
+// matchPrefix matches packets from (with msgcontrol.DirectionIn) or to (with msgcontrol.DirectionOut) prefix.
+//
+// ip saddr prefix / ip daddr prefix / ip6 saddr prefix / ip6 daddr prefix
+func matchPrefix(prefix netip.Prefix, direction msgcontrol.Direction) []expr.Any {
+	exprs := matchPeer(prefix.Masked().Addr(), direction)
+
+	length := prefix.Addr().BitLen() / 8
+	mask := make([]byte, length)
+	for i := range prefix.Bits() {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+
+	// Mask the loaded address before the comparison with the address, which is the last expression.
+	return slices.Insert(exprs, len(exprs)-1, expr.Any(&expr.Bitwise{
+		SourceRegister: 1,
+		DestRegister:   1,
+		Len:            uint32(length),
+		Mask:           mask,
+		Xor:            make([]byte, length),
+	}))
+}
+
+const (
+	sysctlForward4 = "/proc/sys/net/ipv4/ip_forward"
+	sysctlConf6    = "/proc/sys/net/ipv6/conf/"
+	sysctlForward6 = sysctlConf6 + "all/forwarding"
+)
+
+// enableForward6 turns on IPv6 forwarding.
+//
+// Unlike the one for IPv4, this turns every interface into a router, which then ignore router advertisements,
+// and so would lose the addresses and default route they got by SLAAC. Interfaces which accept router advertisements
+// (including the ones added later, by default) are set to keep doing so while forwarding.
+//
+// Forwarding cannot be turned on for the overlay interface only, as forwarded packets are checked against the
+// interface they arrive on, which is another one for replies.
+//
+// Assumes mu is held.
+func (h *NFTablesHost) enableForward6() error {
+	paths, err := filepath.Glob(sysctlConf6 + "*/accept_ra")
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if strings.HasPrefix(path, sysctlConf6+"all/") {
+			continue
+		}
+
+		// Only 1 accepts router advertisements when not forwarding; 0 never does, and 2 already does when forwarding.
+		if _, changed := h.sysctls[path]; !changed && sysctlValue(path) != "1" {
+			continue
+		}
+
+		if err := h.setSysctl(path, "2"); err != nil {
+			return err
+		}
+	}
+
+	return h.setSysctl(sysctlForward6, "1")
+}
+
+// sysctlValue returns the value of the sysctl at path, or empty if it cannot be read.
+func sysctlValue(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// setSysctl sets the sysctl at path to value, remembering its original value.
+//
+// Assumes mu is held.
+func (h *NFTablesHost) setSysctl(path, value string) error {
+	if _, ok := h.sysctls[path]; !ok {
+		orig, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+
+		h.sysctls[path] = strings.TrimSpace(string(orig))
+	}
+
+	if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+		return fmt.Errorf("could not set %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// restoreSysctls sets the changed sysctls which match back to their original values.
+//
+// Assumes mu is held.
+func (h *NFTablesHost) restoreSysctls(match func(path string) bool) error {
+	var errs []error
+
+	for path := range h.sysctls {
+		if !match(path) {
+			continue
+		}
+
+		if err := h.restoreSysctl(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// restoreSysctl sets the sysctl at path back to its original value, if it was changed, and is still there.
+//
+// Assumes mu is held.
+func (h *NFTablesHost) restoreSysctl(path string) error {
+	orig, ok := h.sysctls[path]
+	if !ok {
+		return nil
+	}
+
+	delete(h.sysctls, path)
+
+	if err := os.WriteFile(path, []byte(orig), 0o644); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not restore %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,408 @@
+package unifw
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/internal/netnstest"
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
+)
+
+func canConnect(t *testing.T, ln net.Listener, from netip.Addr) bool {
+	d := net.Dialer{
+		Timeout:   200 * time.Millisecond,
+		LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(from, 0)),
+	}
+
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return false
+	}
+
+	assert.NoError(t, conn.Close())
+
+	return true
+}
+
+func TestNFTablesQuarantine(t *testing.T) {
+	netnstest.Run(t, func() {
+		h, err := NewNFTablesHost("lo")
+		require.NoError(t, err)
+
+		c, err := h.Controller()
+		if err != nil {
+			t.Skipf("cannot use nftables: %v", err)
+		}
+
+		ln4, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln4.Close()
+
+		ln6, err := net.Listen("tcp", "[::1]:0")
+		require.NoError(t, err)
+		defer ln6.Close()
+
+		for _, ln := range []net.Listener{ln4, ln6} {
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					_ = conn.Close()
+				}
+			}()
+		}
+
+		loop4 := netip.MustParseAddr("127.0.0.1")
+		other4 := netip.MustParseAddr("127.0.0.2")
+		loop6 := netip.IPv6Loopback()
+
+		assert.True(t, canConnect(t, ln4, loop4))
+		assert.True(t, canConnect(t, ln6, loop6))
+
+		// An established connection from before the quarantine should keep working.
+		established, err := net.Dial("tcp", ln4.Addr().String())
+		require.NoError(t, err)
+		defer established.Close()
+
+		require.NoError(t, c.QuarantineNodes([]netip.Addr{loop4, loop6, loop4}))
+
+		assert.False(t, canConnect(t, ln4, loop4), "quarantined ipv4 address can connect")
+		assert.False(t, canConnect(t, ln6, loop6), "quarantined ipv6 address can connect")
+		assert.True(t, canConnect(t, ln4, other4), "non-quarantined address cannot connect")
+
+		_, err = established.Write([]byte("still here"))
+		assert.NoError(t, err)
+
+		require.NoError(t, c.QuarantineNodes([]netip.Addr{loop6}))
+
+		assert.True(t, canConnect(t, ln4, loop4), "unquarantined ipv4 address cannot connect")
+		assert.False(t, canConnect(t, ln6, loop6), "quarantined ipv6 address can connect")
+
+		require.NoError(t, h.Reset())
+
+		assert.True(t, canConnect(t, ln6, loop6), "ipv6 address cannot connect after reset")
+		assert.ErrorIs(t, c.QuarantineNodes(nil), errResetController)
+
+		conn, err := nftables.New()
+		require.NoError(t, err)
+		tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+		require.NoError(t, err)
+		for _, table := range tables {
+			assert.NotEqual(t, TableName, table.Name, "table still exists after reset")
+		}
+	})
+}
+
+func TestNFTablesPeerRules(t *testing.T) {
+	netnstest.Run(t, func() {
+		h, err := NewNFTablesHost("lo")
+		require.NoError(t, err)
+
+		c, err := h.Controller()
+		if err != nil {
+			t.Skipf("cannot use nftables: %v", err)
+		}
+		defer h.Reset()
+
+		var lns []net.Listener
+		for range 2 {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					_ = conn.Close()
+				}
+			}()
+
+			lns = append(lns, ln)
+		}
+
+		allowed, denied := lns[0], lns[1]
+		allowedPort := uint16(allowed.Addr().(*net.TCPAddr).Port)
+
+		peer := netip.MustParseAddr("127.0.0.2")
+		other := netip.MustParseAddr("127.0.0.3")
+
+		rules := []msgcontrol.FilterRule{{
+			Direction: msgcontrol.DirectionIn,
+			Protocol:  msgcontrol.ProtocolTCP,
+			Ports:     []msgcontrol.PortRange{msgcontrol.SinglePort(allowedPort)},
+		}}
+
+		require.NoError(t, c.SetPeerRules(map[netip.Prefix][]msgcontrol.FilterRule{
+			netip.PrefixFrom(peer, 32): rules,
+		}))
+
+		assert.True(t, canConnect(t, allowed, peer), "peer cannot connect to allowed port")
+		assert.False(t, canConnect(t, denied, peer), "peer can connect to other port")
+		assert.True(t, canConnect(t, denied, other), "peer without rules cannot connect")
+
+		// The peer routes a prefix, within which another peer without rules has its address.
+		routed := netip.MustParseAddr("127.0.1.2")
+		unrestricted := netip.MustParseAddr("127.0.1.3")
+
+		require.NoError(t, c.SetPeerRules(map[netip.Prefix][]msgcontrol.FilterRule{
+			netip.PrefixFrom(peer, 32):            rules,
+			netip.MustParsePrefix("127.0.1.0/24"): rules,
+			netip.PrefixFrom(unrestricted, 32):    nil,
+			netip.PrefixFrom(other, 32):           nil,
+		}))
+
+		assert.True(t, canConnect(t, allowed, routed), "routed source cannot connect to allowed port")
+		assert.False(t, canConnect(t, denied, routed), "routed source can connect to other port")
+		assert.True(t, canConnect(t, denied, unrestricted), "peer without rules within route cannot connect")
+		assert.True(t, canConnect(t, denied, other), "peer without rules cannot connect")
+
+		require.NoError(t, c.SetPeerRules(nil))
+
+		assert.True(t, canConnect(t, denied, peer), "peer cannot connect after clearing rules")
+	})
+}
+
+// newNetNS creates a network namespace with the loopback interface up, without entering it.
+func newNetNS(t *testing.T) netns.NsHandle {
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+
+	ns, err := netns.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { ns.Close() })
+
+	require.NoError(t, netns.Set(orig))
+
+	h, err := netlink.NewHandleAt(ns)
+	require.NoError(t, err)
+	defer h.Close()
+
+	lo, err := h.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, h.LinkSetUp(lo))
+
+	return ns
+}
+
+// withNetNS runs f within ns, on the locked thread of netnstest.Run.
+func withNetNS(t *testing.T, ns netns.NsHandle, f func()) {
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+
+	require.NoError(t, netns.Set(ns))
+	defer func() {
+		require.NoError(t, netns.Set(orig))
+	}()
+
+	f()
+}
+
+// addVeth creates a veth pair with one end in the current namespace, and the other in ns,
+// each with their prefixes assigned, and routes over the other end in ns.
+func addVeth(t *testing.T, name, peerName string, ns netns.NsHandle, local, remote []netip.Prefix, routes []netip.Prefix) {
+	require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: peerName}))
+
+	link, err := netlink.LinkByName(name)
+	require.NoError(t, err)
+	peer, err := netlink.LinkByName(peerName)
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetNsFd(peer, int(ns)))
+
+	h, err := netlink.NewHandleAt(ns)
+	require.NoError(t, err)
+	defer h.Close()
+
+	peer, err = h.LinkByName(peerName)
+	require.NoError(t, err)
+
+	for _, la := range []struct {
+		h     *netlink.Handle
+		link  netlink.Link
+		addrs []netip.Prefix
+	}{{nil, link, local}, {h, peer, remote}} {
+		lh := la.h
+		if lh == nil {
+			lh = &netlink.Handle{}
+		}
+
+		for _, p := range la.addrs {
+			require.NoError(t, lh.AddrAdd(la.link, &netlink.Addr{IPNet: netipx.PrefixIPNet(p), Flags: unix.IFA_F_NODAD}))
+		}
+
+		require.NoError(t, lh.LinkSetUp(la.link))
+	}
+
+	for _, route := range routes {
+		gw := local[0].Addr()
+		if route.Addr().Is6() {
+			gw = local[1].Addr()
+		}
+
+		require.NoError(t, h.RouteAdd(&netlink.Route{
+			LinkIndex: peer.Attrs().Index,
+			Dst:       netipx.PrefixIPNet(route),
+			Gw:        gw.AsSlice(),
+		}))
+	}
+}
+
+func readSysctl(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	return strings.TrimSpace(string(b))
+}
+
+// TestNFTablesForwarding routes a "client" namespace over the overlay interface of this namespace, into a "lan"
+// namespace which has no route back into the overlay.
+func TestNFTablesForwarding(t *testing.T) {
+	netnstest.Run(t, func() {
+		h, err := NewNFTablesHost("ov0")
+		require.NoError(t, err)
+
+		fc, err := h.Controller()
+		if err != nil {
+			t.Skipf("cannot use nftables: %v", err)
+		}
+		defer h.Reset()
+
+		c := fc.(*NFTablesController)
+
+		clientNS, lanNS := newNetNS(t), newNetNS(t)
+
+		overlay := []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10"), netip.MustParsePrefix("fd00:a::/64")}
+		routes := []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16"), netip.MustParsePrefix("fd00:b::/64")}
+
+		addVeth(t, "ov0", "ov1", clientNS,
+			[]netip.Prefix{netip.MustParsePrefix("100.64.0.1/10"), netip.MustParsePrefix("fd00:a::1/64")},
+			[]netip.Prefix{netip.MustParsePrefix("100.64.0.2/10"), netip.MustParsePrefix("fd00:a::2/64")},
+			routes,
+		)
+		addVeth(t, "lan0", "lan1", lanNS,
+			[]netip.Prefix{netip.MustParsePrefix("10.20.0.1/16"), netip.MustParsePrefix("fd00:b::1/64")},
+			[]netip.Prefix{netip.MustParsePrefix("10.20.0.2/16"), netip.MustParsePrefix("fd00:b::2/64")},
+			nil,
+		)
+
+		type listener struct {
+			net.Listener
+			remotes chan netip.Addr
+			// masqueraded is the address of this namespace on the lan, which connections should come from.
+			masqueraded netip.Addr
+		}
+
+		var lns []listener
+
+		withNetNS(t, lanNS, func() {
+			for _, addrs := range [][2]string{{"10.20.0.2", "10.20.0.1"}, {"fd00:b::2", "fd00:b::1"}} {
+				ln, err := net.Listen("tcp", net.JoinHostPort(addrs[0], "0"))
+				require.NoError(t, err)
+
+				l := listener{ln, make(chan netip.Addr, 8), netip.MustParseAddr(addrs[1])}
+
+				go func() {
+					for {
+						conn, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						l.remotes <- conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+						_ = conn.Close()
+					}
+				}()
+
+				lns = append(lns, l)
+			}
+		})
+		defer func() {
+			for _, l := range lns {
+				l.Close()
+			}
+		}()
+
+		dial := func(l listener) bool {
+			var ok bool
+
+			withNetNS(t, clientNS, func() {
+				conn, err := net.DialTimeout("tcp", l.Addr().String(), 500*time.Millisecond)
+				if err == nil {
+					ok = true
+					assert.NoError(t, conn.Close())
+				}
+			})
+
+			return ok
+		}
+
+		for _, l := range lns {
+			assert.False(t, dial(l), "client can reach %s without forwarding", l.Addr())
+		}
+
+		acceptRA := sysctlConf6 + "lan0/accept_ra"
+		require.Equal(t, "1", readSysctl(t, acceptRA))
+
+		require.NoError(t, c.SetForwarding(overlay, routes))
+
+		assert.Equal(t, "1", readSysctl(t, sysctlForward4))
+		assert.Equal(t, "1", readSysctl(t, sysctlForward6))
+		assert.Equal(t, "2", readSysctl(t, acceptRA), "interfaces should keep accepting router advertisements")
+
+		for _, l := range lns {
+			if assert.True(t, dial(l), "client cannot reach %s with forwarding", l.Addr()) {
+				assert.Equal(t, l.masqueraded, <-l.remotes, "connection is not masqueraded")
+			}
+		}
+
+		// Quarantined peers should not be forwarded either.
+		require.NoError(t, c.QuarantineNodes([]netip.Addr{netip.MustParseAddr("100.64.0.2")}))
+		assert.False(t, dial(lns[0]), "quarantined client can reach %s", lns[0].Addr())
+		require.NoError(t, c.QuarantineNodes(nil))
+
+		// As an exit node, all traffic is forwarded.
+		require.NoError(t, c.SetForwarding(overlay, msgcontrol.ExitRoutes))
+
+		for _, l := range lns {
+			if assert.True(t, dial(l), "client cannot reach %s through exit node", l.Addr()) {
+				assert.Equal(t, l.masqueraded, <-l.remotes, "connection is not masqueraded")
+			}
+		}
+
+		// Only traffic into the routes is forwarded.
+		require.NoError(t, c.SetForwarding(overlay, []netip.Prefix{netip.MustParsePrefix("10.20.1.0/24"), routes[1]}))
+
+		assert.Equal(t, "1", readSysctl(t, sysctlForward4))
+		assert.False(t, dial(lns[0]), "client can reach %s outside of the routes", lns[0].Addr())
+		assert.True(t, dial(lns[1]), "client cannot reach %s with forwarding", lns[1].Addr())
+
+		// Only forward ipv6 from now on.
+		require.NoError(t, c.SetForwarding(overlay, routes[1:]))
+
+		assert.Equal(t, "0", readSysctl(t, sysctlForward4))
+		assert.False(t, dial(lns[0]), "client can reach %s after removing its route", lns[0].Addr())
+		assert.True(t, dial(lns[1]), "client cannot reach %s with forwarding", lns[1].Addr())
+
+		require.NoError(t, h.Reset())
+
+		assert.Equal(t, "0", readSysctl(t, sysctlForward6))
+		assert.Equal(t, "1", readSysctl(t, acceptRA))
+		assert.ErrorIs(t, c.SetForwarding(overlay, routes), errResetController)
+	})
+}
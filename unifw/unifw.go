@@ -0,0 +1,6 @@
+// Package unifw contains toversok.FirewallHost implementations for major platforms.
+package unifw
+
+import "errors"
+
+var ErrUnsupported = errors.New("unifw: no firewall implementation for this platform")
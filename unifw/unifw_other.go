@@ -0,0 +1,9 @@
+//go:build !linux
+
+package unifw
+
+import "github.com/edup2p/common/toversok"
+
+func NewFirewallHost(_ string) (toversok.FirewallHost, error) {
+	return nil, ErrUnsupported
+}
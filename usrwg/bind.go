@@ -1,49 +1,83 @@
 package usrwg
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
-	"reflect"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/edup2p/common/types"
 	"github.com/edup2p/common/types/key"
 	"golang.org/x/exp/maps"
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+// ToverSokBind is a conn.Bind which passes packets between wireguard-go and the stage,
+// through a ChannelConn per peer.
+//
+// Packets for wireguard-go are fanned in from all conns into a single queue,
+// from which its ReceiveFunc takes them in batches.
 type ToverSokBind struct {
-	connMu     sync.RWMutex
-	conns      map[key.NodePublic]*ChannelConn
-	connChange chan bool
+	connMu sync.RWMutex
+	conns  map[key.NodePublic]*ChannelConn
 
-	permClosed bool
+	// queue holds the packets written by all ChannelConns, for wireguard-go.
+	queue chan *packetBuf
+
+	openMu sync.Mutex
+	// closing is closed on Close, to stop the ReceiveFunc given out on the last Open.
+	closing chan struct{}
+
+	permClosed atomic.Bool
 
 	endpointMu sync.RWMutex
 	endpoints  map[key.NodePublic]*endpoint
 }
 
+// BindQueueSize is the amount of packets for wireguard-go that can be queued, after which ChannelConn.Write blocks.
+const BindQueueSize = 1024
+
 func createBind() *ToverSokBind {
 	return &ToverSokBind{
-		conns:      make(map[key.NodePublic]*ChannelConn),
-		connChange: make(chan bool),
-		endpoints:  make(map[key.NodePublic]*endpoint),
+		conns:     make(map[key.NodePublic]*ChannelConn),
+		queue:     make(chan *packetBuf, BindQueueSize),
+		endpoints: make(map[key.NodePublic]*endpoint),
 	}
 }
 
 func (b *ToverSokBind) Open(uint16) (fns []conn.ReceiveFunc, fakePort uint16, err error) {
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
+
+	if b.isPermanentlyClosed() {
+		return nil, 0, net.ErrClosed
+	}
+
+	if b.closing != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	closing := make(chan struct{})
+	b.closing = closing
+
 	fakePort = 12345
-	fns = []conn.ReceiveFunc{b.ReadFromConns}
+	fns = []conn.ReceiveFunc{func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		return b.receive(closing, packets, sizes, eps)
+	}}
 
 	return
 }
 
 func (b *ToverSokBind) Close() error {
+	b.openMu.Lock()
+	if b.closing != nil {
+		close(b.closing)
+		b.closing = nil
+	}
+	b.openMu.Unlock()
+
 	b.endpointMu.Lock()
 	b.connMu.Lock()
 	defer b.connMu.Unlock()
@@ -61,161 +95,66 @@ func (b *ToverSokBind) Close() error {
 
 	maps.Clear(b.conns)
 
+	// Drop packets of the closed conns.
+drain:
+	for {
+		select {
+		case pb := <-b.queue:
+			putPacketBuf(pb)
+		default:
+			break drain
+		}
+	}
+
 	if len(errs) > 0 {
 		return fmt.Errorf("errors when closing connections: %w", errors.Join(errs...))
 	}
 
-	b.notifyConnChange()
-
 	return nil
 }
 
 func (b *ToverSokBind) Cancel() error {
-	b.permClosed = true
+	b.permClosed.Store(true)
 	return b.Close()
 }
 
-// ReadFromConns implements conn.ReceiveFunc
-func (b *ToverSokBind) ReadFromConns(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+// receive implements conn.ReceiveFunc, until closing is closed.
+//
+// It waits for a first packet, and then takes as many more as are queued and fit in the batch.
+func (b *ToverSokBind) receive(closing <-chan struct{}, packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
 	if b.isPermanentlyClosed() {
 		return 0, net.ErrClosed
 	}
 
-	// We get a keys slice that could potentially get immediately outdated,
-	// but we use it to fill buffers from existing conns first.
-	b.connMu.RLock()
-	keys := maps.Keys(b.conns)
-	b.connMu.RUnlock()
-
-fill:
-	for i := 0; i < len(eps); i++ {
-		var peer key.NodePublic
-		var cc *ChannelConn
-		var p []byte
+	var pb *packetBuf
 
-		for {
-			if len(keys) == 0 {
-				break fill
-			}
-
-			peer, keys = keys[0], keys[1:]
-
-			cc = b.fetchConn(peer)
-
-			if cc == nil {
-				continue
-			}
-
-			p = cc.tryGetOut()
-
-			if p == nil {
-				continue
-			}
-
-			break
-		}
-
-		eps[i] = b.endpointFor(peer)
-		sizes[i] = len(p)
-		copy(packets[i], p)
-
-		n++
-	}
-
-	if n != 0 {
-		// Buffer filled, return early
-		return
+	select {
+	case pb = <-b.queue:
+	case <-closing:
+		return 0, net.ErrClosed
 	}
 
-	// FIXME: Here we use reflect.Select, which may not be very good in the long run.
-	// 	The above part handles the hot case, but this cold case can possibly have performance issues,
-	//  as noted by several stackoverflow answers.
-	//  The most important part is that it does not spinloop, and that it waits appropriately for any change.
+	for {
+		sizes[n] = copy(packets[n], pb.data)
+		eps[n] = pb.ep
+		putPacketBuf(pb)
 
-	// Buffer wasn't filled, we wait for an incoming packet.
-	p, ep := b.waitForValueFromConns()
+		n++
 
-	if p == nil {
-		// Woken up by conn change, just return
+		if n == len(packets) {
+			return n, nil
+		}
 
-		return
+		select {
+		case pb = <-b.queue:
+		default:
+			return n, nil
+		}
 	}
-
-	sizes[0] = len(p)
-	copy(packets[0], p)
-	eps[0] = ep
-
-	n = 1
-
-	return
 }
 
 func (b *ToverSokBind) isPermanentlyClosed() bool {
-	return b.permClosed
-}
-
-func (b *ToverSokBind) waitForValueFromConns() ([]byte, *endpoint) {
-	caseMap := b.buildConnsSelectCaseMap()
-	connChangeCase := b.createConnChangeSelectCase()
-
-	keys := maps.Keys(caseMap)
-
-	cases := make([]reflect.SelectCase, len(caseMap))
-	for i, k := range keys {
-		cases[i] = caseMap[k]
-	}
-
-	cases = append(cases, connChangeCase)
-
-	choice, recv, recvOk := reflect.Select(cases)
-
-	slog.Log(
-		context.Background(),
-		types.LevelTrace,
-		"waitForValueFromConns reflect.Select",
-		"choice", choice,
-		"len", len(cases),
-		"recv", recv,
-		"recvOk", recvOk,
-		"cases", cases,
-	)
-
-	// choice == last index
-	if choice == len(cases)-1 {
-		return nil, nil
-	}
-
-	// We expect any other recv to be from slices
-	return recv.Bytes(), b.endpointFor(keys[choice])
-}
-
-func (b *ToverSokBind) buildConnsSelectCaseMap() map[key.NodePublic]reflect.SelectCase {
-	cases := make(map[key.NodePublic]reflect.SelectCase)
-
-	b.connMu.RLock()
-	defer b.connMu.RUnlock()
-
-	for k, v := range b.conns {
-		cases[k] = createChannelConnSelectCase(v)
-	}
-
-	return cases
-}
-
-func createChannelConnSelectCase(cc *ChannelConn) reflect.SelectCase {
-	return reflect.SelectCase{
-		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(cc.outgoing),
-		Send: reflect.Value{},
-	}
-}
-
-func (b *ToverSokBind) createConnChangeSelectCase() reflect.SelectCase {
-	return reflect.SelectCase{
-		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(b.connChange),
-		Send: reflect.Value{},
-	}
+	return b.permClosed.Load()
 }
 
 // SetMark is used by wireguard-go to avoid routing loops.
@@ -254,7 +193,7 @@ func (b *ToverSokBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 }
 
 func (b *ToverSokBind) BatchSize() int {
-	return runtime.NumCPU()
+	return conn.IdealBatchSize
 }
 
 func (b *ToverSokBind) GetConn(peer key.NodePublic) *ChannelConn {
@@ -276,16 +215,17 @@ func (b *ToverSokBind) fetchConn(peer key.NodePublic) *ChannelConn {
 }
 
 func (b *ToverSokBind) createOrGetConn(peer key.NodePublic) *ChannelConn {
+	// Get the endpoint first, as Close locks endpointMu before connMu.
+	ep := b.endpointFor(peer)
+
 	b.connMu.Lock()
 	defer b.connMu.Unlock()
 
 	cc, ok := b.conns[peer]
 
 	if !ok {
-		cc = makeChannelConn()
+		cc = makeChannelConn(b.queue, ep)
 		b.conns[peer] = cc
-
-		b.notifyConnChange()
 	}
 
 	return cc
@@ -303,15 +243,6 @@ func (b *ToverSokBind) CloseConn(peer key.NodePublic) {
 	}
 
 	delete(b.conns, peer)
-
-	b.notifyConnChange()
-}
-
-func (b *ToverSokBind) notifyConnChange() {
-	select {
-	case b.connChange <- true:
-	default:
-	}
 }
 
 func (b *ToverSokBind) endpointFor(peer key.NodePublic) *endpoint {
@@ -325,9 +256,11 @@ func (b *ToverSokBind) endpointFor(peer key.NodePublic) *endpoint {
 		b.endpointMu.Lock()
 		defer b.endpointMu.Unlock()
 
-		e = &endpoint{k: peer}
+		if e = b.endpoints[peer]; e == nil {
+			e = &endpoint{k: peer}
 
-		b.endpoints[peer] = e
+			b.endpoints[peer] = e
+		}
 	}
 
 	return e
@@ -0,0 +1,215 @@
+package usrwg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const benchPacketSize = 1280
+
+func benchPeers(n int) []key.NodePublic {
+	peers := make([]key.NodePublic, n)
+	for i := range peers {
+		peers[i] = key.NewNode().Public()
+	}
+
+	return peers
+}
+
+func makeBufs(n, size int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+
+	return bufs
+}
+
+func TestBindRoundTrip(t *testing.T) {
+	b := createBind()
+
+	fns, _, err := b.Open(0)
+	require.NoError(t, err)
+	require.Len(t, fns, 1)
+
+	peers := benchPeers(3)
+
+	// From the stage to wireguard-go.
+	for i, peer := range peers {
+		_, err := b.GetConn(peer).Write([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+
+	bufs := makeBufs(b.BatchSize(), 16)
+	sizes := make([]int, len(bufs))
+	eps := make([]conn.Endpoint, len(bufs))
+
+	got := make(map[key.NodePublic][]byte)
+	for len(got) < len(peers) {
+		n, err := fns[0](bufs, sizes, eps)
+		require.NoError(t, err)
+
+		for i := range n {
+			got[eps[i].(*endpoint).k] = append([]byte(nil), bufs[i][:sizes[i]]...)
+		}
+	}
+
+	for i, peer := range peers {
+		assert.Equal(t, []byte{byte(i)}, got[peer])
+	}
+
+	// From wireguard-go to the stage; the buffer is reused by wireguard-go after Send.
+	buf := []byte("hello")
+	require.NoError(t, b.Send([][]byte{buf}, b.endpointFor(peers[0])))
+	copy(buf, "xxxxx")
+
+	cc := b.GetConn(peers[0])
+	require.NoError(t, cc.SetReadDeadline(time.Now().Add(time.Second)))
+
+	rb := make([]byte, 16)
+	n, _, err := cc.ReadFromUDPAddrPort(rb)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(rb[:n]))
+
+	// Closing wakes up a blocked receive.
+	done := make(chan error)
+	go func() {
+		_, err := fns[0](bufs, sizes, eps)
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, b.Close())
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("receive did not return after close")
+	}
+
+	_, err = cc.Write([]byte{1})
+	assert.Error(t, err, "write to closed conn succeeded")
+}
+
+// BenchmarkBindReceive measures packets going from the stage (ChannelConn.Write) to wireguard-go (ReceiveFunc).
+func BenchmarkBindReceive(b *testing.B) {
+	for _, numPeers := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("peers=%d", numPeers), func(b *testing.B) {
+			bind := createBind()
+
+			fns, _, err := bind.Open(0)
+			require.NoError(b, err)
+
+			peers := benchPeers(numPeers)
+			conns := make([]interface{ Write([]byte) (int, error) }, numPeers)
+			for i, peer := range peers {
+				conns[i] = bind.GetConn(peer)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			var wg sync.WaitGroup
+			for i, cc := range conns {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					pkt := make([]byte, benchPacketSize)
+					for j := i; j < b.N; j += numPeers {
+						if ctx.Err() != nil {
+							return
+						}
+						if _, err := cc.Write(pkt); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			bufs := makeBufs(bind.BatchSize(), benchPacketSize)
+			sizes := make([]int, len(bufs))
+			eps := make([]conn.Endpoint, len(bufs))
+
+			b.SetBytes(benchPacketSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for received := 0; received < b.N; {
+				n, err := fns[0](bufs, sizes, eps)
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += n
+			}
+
+			b.StopTimer()
+			cancel()
+			_ = bind.Close()
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkBindSend measures packets going from wireguard-go (Send) to the stage (ChannelConn.ReadFromUDPAddrPort).
+func BenchmarkBindSend(b *testing.B) {
+	for _, numPeers := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("peers=%d", numPeers), func(b *testing.B) {
+			bind := createBind()
+
+			_, _, err := bind.Open(0)
+			require.NoError(b, err)
+
+			peers := benchPeers(numPeers)
+			eps := make([]conn.Endpoint, numPeers)
+			for i, peer := range peers {
+				eps[i] = bind.endpointFor(peer)
+			}
+
+			var wg sync.WaitGroup
+			for i, peer := range peers {
+				cc := bind.GetConn(peer)
+				count := b.N / numPeers
+				if i < b.N%numPeers {
+					count++
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					buf := make([]byte, benchPacketSize)
+					for range count {
+						if _, _, err := cc.ReadFromUDPAddrPort(buf); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			bufs := [][]byte{make([]byte, benchPacketSize)}
+
+			b.SetBytes(benchPacketSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := range b.N {
+				if err := bind.Send(bufs, eps[i%numPeers]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			wg.Wait()
+			b.StopTimer()
+			_ = bind.Close()
+		})
+	}
+}
@@ -11,24 +11,33 @@ import (
 // ChannelConn is a types.UDPConn based on two internal channels.
 //
 // On the "frontend" (types.UDPConn) it supports SetReadDeadLine, as normal.
+//
+// Packets written by the frontend go into the fan-in queue of the ToverSokBind it belongs to,
+// tagged with the endpoint of its peer.
 type ChannelConn struct {
 	// Packets to be read by the frontend
-	incoming chan []byte
+	incoming chan *packetBuf
 
-	// Packets written by the frontend
-	outgoing chan []byte
+	// Packets written by the frontend, shared between all conns of a bind
+	outgoing chan<- *packetBuf
+	ep       *endpoint
 
+	closed  chan struct{}
 	doClose sync.Once
 
 	currentReadDeadline time.Time
+	// readTimer is reused between reads with a deadline, as there is only one reader.
+	readTimer *time.Timer
 }
 
 const ChannelConnBufferSize = 16
 
-func makeChannelConn() *ChannelConn {
+func makeChannelConn(outgoing chan<- *packetBuf, ep *endpoint) *ChannelConn {
 	return &ChannelConn{
-		incoming: make(chan []byte, ChannelConnBufferSize),
-		outgoing: make(chan []byte, ChannelConnBufferSize),
+		incoming: make(chan *packetBuf, ChannelConnBufferSize),
+		outgoing: outgoing,
+		ep:       ep,
+		closed:   make(chan struct{}),
 	}
 }
 
@@ -41,39 +50,76 @@ func (cc *ChannelConn) SetReadDeadline(t time.Time) error {
 }
 
 func (cc *ChannelConn) ReadFromUDPAddrPort(b []byte) (n int, addr netip.AddrPort, err error) {
-	var val []byte
+	var pb *packetBuf
 
-	if cc.currentReadDeadline == (time.Time{}) {
-		// Block until value received.
-		val = <-cc.incoming
-	} else {
-		// Block until value or timeout.
-		select {
-		case val = <-cc.incoming:
-		case <-time.After(time.Until(cc.currentReadDeadline)):
-			return 0, netip.AddrPort{}, context.DeadlineExceeded
+	select {
+	case pb = <-cc.incoming:
+	case <-cc.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	default:
+		if cc.currentReadDeadline == (time.Time{}) {
+			// Block until value received.
+			select {
+			case pb = <-cc.incoming:
+			case <-cc.closed:
+				return 0, netip.AddrPort{}, net.ErrClosed
+			}
+		} else {
+			// Block until value or timeout.
+			if cc.readTimer == nil {
+				cc.readTimer = time.NewTimer(time.Until(cc.currentReadDeadline))
+			} else {
+				cc.readTimer.Reset(time.Until(cc.currentReadDeadline))
+			}
+
+			select {
+			case pb = <-cc.incoming:
+				cc.readTimer.Stop()
+			case <-cc.closed:
+				cc.readTimer.Stop()
+				return 0, netip.AddrPort{}, net.ErrClosed
+			case <-cc.readTimer.C:
+				return 0, netip.AddrPort{}, context.DeadlineExceeded
+			}
 		}
 	}
 
-	return copy(b, val), netip.AddrPort{}, nil
+	n = copy(b, pb.data)
+	putPacketBuf(pb)
+
+	return n, netip.AddrPort{}, nil
 }
 
 func (cc *ChannelConn) Write(b []byte) (int, error) {
 	// We don't have SetWriteDeadline, so we just block.
 
-	cc.outgoing <- b
+	// The caller may reuse b after we return, so we copy it.
+	pb := getPacketBuf(b)
+	pb.ep = cc.ep
 
-	return len(b), nil
+	select {
+	case <-cc.closed:
+	default:
+		select {
+		case cc.outgoing <- pb:
+			return len(b), nil
+		case <-cc.closed:
+		}
+	}
+
+	putPacketBuf(pb)
+
+	return 0, net.ErrClosed
 }
 
 func (cc *ChannelConn) WriteToUDPAddrPort(_ []byte, _ netip.AddrPort) (int, error) {
 	return 0, net.ErrWriteToConnected
 }
 
+// Close closes the conn, pending and later reads and writes return net.ErrClosed.
 func (cc *ChannelConn) Close() error {
 	cc.doClose.Do(func() {
-		close(cc.outgoing)
-		close(cc.incoming)
+		close(cc.closed)
 	})
 
 	return nil
@@ -81,38 +127,74 @@ func (cc *ChannelConn) Close() error {
 
 /// The "Backend"
 
-// Tries to read a packet from the outgoing channel, returns nil if there's none waiting.
-func (cc *ChannelConn) tryGetOut() (pkt []byte) {
+// Puts a copy of a packet in the incoming channel, and waits.
+//
+// Will return false on timeout, or when the conn is closed.
+func (cc *ChannelConn) putIn(pkt []byte, d time.Duration) (ok bool) {
+	pb := getPacketBuf(pkt)
+
 	select {
-	case pkt = <-cc.outgoing:
+	case cc.incoming <- pb:
+		return true
+	case <-cc.closed:
+		putPacketBuf(pb)
+		return false
 	default:
 	}
 
-	return
-}
+	// Only allocate a timer when we have to wait.
+	t := time.NewTimer(d)
+	defer t.Stop()
 
-// Reads a packet from the outgoing channel, and waits.
-//
-// Returns nil on timeout.
-func (cc *ChannelConn) getOut(d time.Duration) (pkt []byte) { // nolint:unused
 	select {
-	case pkt = <-cc.outgoing:
-	case <-time.After(d):
+	case cc.incoming <- pb:
+		return true
+	case <-cc.closed:
+	case <-t.C:
 	}
 
-	return
+	putPacketBuf(pb)
+
+	return false
 }
 
-// Puts a packet in the incoming channel, and waits.
+// packetBufSize is the capacity of pooled packet buffers, enough for a WireGuard packet with toversok.MaxMTU.
 //
-// Will return false on timeout.
-func (cc *ChannelConn) putIn(pkt []byte, d time.Duration) (ok bool) {
-	select {
-	case cc.incoming <- pkt:
-		ok = true
-	case <-time.After(d):
-		ok = false
+// Larger packets get their own buffer.
+const packetBufSize = 2048
+
+// packetBuf is a pooled copy of a packet, on its way through a ChannelConn.
+type packetBuf struct {
+	data []byte
+	// ep is the endpoint of the peer which sent the packet, set on packets for wireguard-go.
+	ep *endpoint
+}
+
+var packetBufPool = sync.Pool{
+	New: func() any {
+		return &packetBuf{data: make([]byte, 0, packetBufSize)}
+	},
+}
+
+// getPacketBuf returns a buffer from the pool with a copy of pkt.
+func getPacketBuf(pkt []byte) *packetBuf {
+	pb := packetBufPool.Get().(*packetBuf)
+
+	if cap(pb.data) < len(pkt) {
+		pb.data = make([]byte, 0, len(pkt))
+	}
+
+	pb.data = append(pb.data[:0], pkt...)
+
+	return pb
+}
+
+func putPacketBuf(pb *packetBuf) {
+	if cap(pb.data) != packetBufSize {
+		// Let oversized buffers be collected, instead of growing the pool.
+		return
 	}
 
-	return
+	pb.ep = nil
+	packetBufPool.Put(pb)
 }
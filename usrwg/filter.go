@@ -0,0 +1,438 @@
+package usrwg
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/edup2p/common/toversok"
+	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/msgcontrol"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Idle timeouts of tracked connections, after which they have to be allowed again as new connections.
+const (
+	FilterTCPTimeout   = 2 * time.Hour
+	FilterUDPTimeout   = 2 * time.Minute
+	FilterOtherTimeout = 30 * time.Second
+)
+
+// FilterFragmentTimeout is how long the fragments of a packet are let through after its first fragment was,
+// like the time the OS takes to reassemble them.
+const FilterFragmentTimeout = 30 * time.Second
+
+// filterSweepInterval is the minimum interval between sweeps of expired connections.
+const filterSweepInterval = time.Minute
+
+var errResetFilter = errors.New("packet filter has been reset, controller is stale")
+
+// PacketFilter is a toversok.FirewallHost which filters packets in-process,
+// between the TUN device (or netstack) and wireguard-go, for when the OS firewall cannot be configured.
+//
+// It is stateful; connections it allowed are tracked, and their return traffic is allowed,
+// also when a peer gets quarantined or restricted afterwards.
+//
+// Non-first fragments carry no ports to match rules against, so from peers with rules, they are only let through
+// after the first fragment of their packet was. Fragments that arrive before their first fragment are dropped.
+//
+// Use it by passing it to SetPacketFilter on a UserSpaceWireGuardHost or NetstackWireGuardHost,
+// and to toversok.NewEngine as its FirewallHost.
+type PacketFilter struct {
+	mu      sync.RWMutex
+	running *PacketFilterController
+
+	quarantined map[netip.Addr]bool
+	// addrRules are the rules of single addresses, and routeRules those of larger prefixes, most specific first.
+	addrRules  map[netip.Addr][]msgcontrol.FilterRule
+	routeRules []prefixRules
+
+	connMu    sync.Mutex
+	conns     map[flowKey]time.Time
+	frags     map[fragmentKey]time.Time
+	lastSweep time.Time
+}
+
+type prefixRules struct {
+	prefix netip.Prefix
+	rules  []msgcontrol.FilterRule
+}
+
+// flowKey identifies a connection, from the perspective of this node.
+type flowKey struct {
+	proto         uint8
+	local, remote netip.AddrPort
+}
+
+// fragmentKey identifies a fragmented packet.
+//
+// The protocol is left out, as the fragments of an IPv6 packet only have it when there are no extension headers
+// after the fragment header.
+type fragmentKey struct {
+	src, dst netip.Addr
+	id       uint32
+}
+
+func NewPacketFilter() *PacketFilter {
+	return &PacketFilter{
+		conns: make(map[flowKey]time.Time),
+		frags: make(map[fragmentKey]time.Time),
+	}
+}
+
+func (f *PacketFilter) Reset() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.running = nil
+	f.quarantined = nil
+	f.addrRules = nil
+	f.routeRules = nil
+
+	f.connMu.Lock()
+	clear(f.conns)
+	clear(f.frags)
+	f.connMu.Unlock()
+
+	return nil
+}
+
+func (f *PacketFilter) Controller() (toversok.FirewallController, error) {
+	if err := f.Reset(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.running = &PacketFilterController{filter: f}
+
+	return f.running, nil
+}
+
+type PacketFilterController struct {
+	filter *PacketFilter
+}
+
+func (c *PacketFilterController) QuarantineNodes(ips []netip.Addr) error {
+	f := c.filter
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.running != c {
+		return errResetFilter
+	}
+
+	f.quarantined = make(map[netip.Addr]bool, len(ips))
+	for _, ip := range ips {
+		f.quarantined[ip.Unmap()] = true
+	}
+
+	return nil
+}
+
+func (c *PacketFilterController) SetPeerRules(rules map[netip.Prefix][]msgcontrol.FilterRule) error {
+	f := c.filter
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.running != c {
+		return errResetFilter
+	}
+
+	// Prefixes without rules are kept, as they lift the rules of less specific prefixes.
+	// Invalid rules never match, as their direction or protocol is unknown.
+	f.addrRules = make(map[netip.Addr][]msgcontrol.FilterRule)
+	f.routeRules = nil
+
+	for prefix, peerRules := range rules {
+		prefix = unmapPrefix(prefix)
+
+		if prefix.IsSingleIP() {
+			f.addrRules[prefix.Addr()] = peerRules
+		} else {
+			f.routeRules = append(f.routeRules, prefixRules{prefix, peerRules})
+		}
+	}
+
+	slices.SortFunc(f.routeRules, func(a, b prefixRules) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+
+	return nil
+}
+
+// unmapPrefix returns prefix with an IPv4-mapped IPv6 address as an IPv4 prefix, like packets are parsed.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if !addr.Is4In6() || prefix.Bits() < 96 {
+		return prefix.Masked()
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked()
+}
+
+// rulesFor returns the rules of the most specific prefix containing addr, nil if there is none.
+// Assumes mu is held.
+func (f *PacketFilter) rulesFor(addr netip.Addr) []msgcontrol.FilterRule {
+	if rules, ok := f.addrRules[addr]; ok {
+		return rules
+	}
+
+	for _, pr := range f.routeRules {
+		if pr.prefix.Contains(addr) {
+			return pr.rules
+		}
+	}
+
+	return nil
+}
+
+// allowOutbound returns whether a packet from this node to a peer may pass.
+func (f *PacketFilter) allowOutbound(pkt []byte) bool {
+	info, ok := parsePacket(pkt)
+	if !ok {
+		return false
+	}
+
+	key := flowKey{
+		proto:  info.proto,
+		local:  netip.AddrPortFrom(info.src, info.sport),
+		remote: netip.AddrPortFrom(info.dst, info.dport),
+	}
+
+	if f.seen(key, info.tcpFlags) {
+		return true
+	}
+
+	if info.fragment || info.icmpError {
+		// Errors about received packets, and fragments of packets which have been let through already.
+		return true
+	}
+
+	f.mu.RLock()
+	rules := f.rulesFor(info.dst)
+	f.mu.RUnlock()
+
+	if !msgcontrol.Allows(rules, msgcontrol.DirectionOut, info.protocol(), info.dport) {
+		return false
+	}
+
+	f.track(key, info.tcpFlags)
+
+	return true
+}
+
+// allowInbound returns whether a packet from a peer to this node may pass.
+func (f *PacketFilter) allowInbound(pkt []byte) bool {
+	info, ok := parsePacket(pkt)
+	if !ok {
+		return false
+	}
+
+	key := flowKey{
+		proto:  info.proto,
+		local:  netip.AddrPortFrom(info.dst, info.dport),
+		remote: netip.AddrPortFrom(info.src, info.sport),
+	}
+
+	if f.seen(key, info.tcpFlags) {
+		f.trackFragments(&info)
+		return true
+	}
+
+	if info.fragment && f.seenFragment(&info) {
+		// Follows a first fragment which was let through.
+		return true
+	}
+
+	f.mu.RLock()
+	quarantined := f.quarantined[info.src]
+	rules := f.rulesFor(info.src)
+	f.mu.RUnlock()
+
+	if info.icmpError {
+		// Errors are only allowed about packets of known connections, which the inner packet was sent on.
+		if inner, ok := parsePacket(info.inner); ok {
+			return f.seen(flowKey{
+				proto:  inner.proto,
+				local:  netip.AddrPortFrom(inner.src, inner.sport),
+				remote: netip.AddrPortFrom(inner.dst, inner.dport),
+			}, 0)
+		}
+
+		return false
+	}
+
+	switch {
+	case quarantined:
+		return false
+	case info.fragment:
+		// Without ports, fragments cannot be matched against rules.
+		return len(rules) == 0
+	case !msgcontrol.Allows(rules, msgcontrol.DirectionIn, info.protocol(), info.dport):
+		return false
+	}
+
+	f.track(key, info.tcpFlags)
+	f.trackFragments(&info)
+
+	return true
+}
+
+func flowTimeout(proto uint8) time.Duration {
+	switch proto {
+	case protoTCP:
+		return FilterTCPTimeout
+	case protoUDP:
+		return FilterUDPTimeout
+	default:
+		return FilterOtherTimeout
+	}
+}
+
+// seen returns whether key is a tracked connection, and refreshes it if so.
+func (f *PacketFilter) seen(key flowKey, tcpFlags uint8) bool {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	now := time.Now()
+
+	expiry, ok := f.conns[key]
+	if !ok || now.After(expiry) {
+		return false
+	}
+
+	if tcpFlags&tcpFlagRST != 0 {
+		// The reset itself still passes, after which the connection is gone.
+		delete(f.conns, key)
+	} else {
+		f.conns[key] = now.Add(flowTimeout(key.proto))
+	}
+
+	return true
+}
+
+// seenFragment returns whether the first fragment of the packet of the (non-first) fragment info was let through.
+func (f *PacketFilter) seenFragment(info *packetInfo) bool {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	expiry, ok := f.frags[fragmentKey{info.src, info.dst, info.fragmentID}]
+
+	return ok && !time.Now().After(expiry)
+}
+
+// trackFragments lets the other fragments of the packet through, if info is the first fragment that was.
+func (f *PacketFilter) trackFragments(info *packetInfo) {
+	if !info.firstFragment {
+		return
+	}
+
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	now := time.Now()
+	f.sweep(now)
+
+	f.frags[fragmentKey{info.src, info.dst, info.fragmentID}] = now.Add(FilterFragmentTimeout)
+}
+
+// track starts tracking a new connection.
+func (f *PacketFilter) track(key flowKey, tcpFlags uint8) {
+	if tcpFlags&tcpFlagRST != 0 {
+		return
+	}
+
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	now := time.Now()
+	f.sweep(now)
+
+	f.conns[key] = now.Add(flowTimeout(key.proto))
+}
+
+// sweep forgets expired connections and fragmented packets, at most once per filterSweepInterval.
+// Assumes connMu is held.
+func (f *PacketFilter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) <= filterSweepInterval {
+		return
+	}
+
+	maps.DeleteFunc(f.conns, func(_ flowKey, expiry time.Time) bool {
+		return now.After(expiry)
+	})
+	maps.DeleteFunc(f.frags, func(_ fragmentKey, expiry time.Time) bool {
+		return now.After(expiry)
+	})
+	f.lastSweep = now
+}
+
+// wrap returns a tun.Device which passes packets through the filter.
+func (f *PacketFilter) wrap(dev tun.Device) tun.Device {
+	return &filteredTUN{Device: dev, filter: f}
+}
+
+// filteredTUN filters the packets wireguard-go reads from (outbound) and writes to (inbound) the device.
+type filteredTUN struct {
+	tun.Device
+
+	filter *PacketFilter
+}
+
+func (t *filteredTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Device.Read(bufs, sizes, offset)
+
+	for i := range n {
+		if sizes[i] > 0 && !t.filter.allowOutbound(bufs[i][offset:offset+sizes[i]]) {
+			slog.Log(context.Background(), types.LevelTrace, "filter: dropped outbound packet", "from", "usrwg")
+
+			// wireguard-go skips empty packets.
+			sizes[i] = 0
+		}
+	}
+
+	return n, err
+}
+
+func (t *filteredTUN) Write(bufs [][]byte, offset int) (int, error) {
+	var allowed [][]byte
+
+	for i, buf := range bufs {
+		if t.filter.allowInbound(buf[offset:]) {
+			if allowed != nil {
+				allowed = append(allowed, buf)
+			}
+
+			continue
+		}
+
+		slog.Log(context.Background(), types.LevelTrace, "filter: dropped inbound packet", "from", "usrwg")
+
+		if allowed == nil {
+			// Only copy the batch once a packet has to be left out.
+			allowed = make([][]byte, i, len(bufs))
+			copy(allowed, bufs[:i])
+		}
+	}
+
+	if allowed == nil {
+		return t.Device.Write(bufs, offset)
+	}
+
+	if len(allowed) > 0 {
+		if _, err := t.Device.Write(allowed, offset); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(bufs), nil
+}
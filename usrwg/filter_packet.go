@@ -0,0 +1,190 @@
+package usrwg
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/edup2p/common/types/msgcontrol"
+)
+
+// packetInfo is what the packet filter needs to know about an IP packet.
+type packetInfo struct {
+	src, dst     netip.Addr
+	proto        uint8
+	sport, dport uint16
+
+	// tcpFlags are the flags of a TCP packet.
+	tcpFlags uint8
+
+	// fragment is set for non-first fragments, which carry no transport header.
+	fragment bool
+	// firstFragment is set for the first fragment of a fragmented packet, which does.
+	firstFragment bool
+	// fragmentID is the identification of the packet the fragment belongs to, set for both.
+	fragmentID uint32
+
+	// icmpError is set for ICMP(v6) error messages, inner then contains the offending packet.
+	icmpError bool
+	inner     []byte
+}
+
+// IP protocol numbers, as not all platforms define them.
+const (
+	protoHopOpts  = 0
+	protoICMP     = 1
+	protoTCP      = 6
+	protoUDP      = 17
+	protoRouting  = 43
+	protoFragment = 44
+	protoICMPv6   = 58
+	protoDstOpts  = 60
+)
+
+const tcpFlagRST = 0x04
+
+const (
+	icmpv4EchoReply   = 0
+	icmpv4Unreachable = 3
+	icmpv4EchoRequest = 8
+	icmpv4TimeExceed  = 11
+	icmpv4ParamProb   = 12
+
+	icmpv6Unreachable = 1
+	icmpv6TooBig      = 2
+	icmpv6TimeExceed  = 3
+	icmpv6ParamProb   = 4
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// parsePacket parses the IP and transport headers of pkt.
+//
+// The transport payload may be truncated, as is the case for packets inside ICMP errors.
+func parsePacket(pkt []byte) (info packetInfo, ok bool) {
+	if len(pkt) < 1 {
+		return
+	}
+
+	var l4 []byte
+
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return
+		}
+
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return
+		}
+
+		info.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		info.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		info.proto = pkt[9]
+
+		flags := binary.BigEndian.Uint16(pkt[6:8])
+		info.fragment = flags&0x1fff != 0
+		info.firstFragment = flags&0x1fff == 0 && flags&0x2000 != 0
+		info.fragmentID = uint32(binary.BigEndian.Uint16(pkt[4:6]))
+
+		l4 = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 {
+			return
+		}
+
+		info.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		info.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+
+		next, rest := pkt[6], pkt[40:]
+
+		// Skip extension headers, to get to the transport header.
+	headers:
+		for {
+			switch next {
+			case protoHopOpts, protoRouting, protoDstOpts:
+				if len(rest) < 8 {
+					return
+				}
+
+				hdrLen := (int(rest[1]) + 1) * 8
+				if len(rest) < hdrLen {
+					return
+				}
+
+				next, rest = rest[0], rest[hdrLen:]
+			case protoFragment:
+				if len(rest) < 8 {
+					return
+				}
+
+				offset, more := binary.BigEndian.Uint16(rest[2:4])&0xfff8, rest[3]&0x1 != 0
+				info.fragment = offset != 0
+				info.firstFragment = offset == 0 && more
+				info.fragmentID = binary.BigEndian.Uint32(rest[4:8])
+
+				next, rest = rest[0], rest[8:]
+			default:
+				break headers
+			}
+		}
+
+		info.proto = next
+		l4 = rest
+	default:
+		return
+	}
+
+	if info.fragment {
+		return info, true
+	}
+
+	switch info.proto {
+	case protoTCP, protoUDP:
+		if len(l4) < 4 {
+			return
+		}
+
+		info.sport = binary.BigEndian.Uint16(l4[0:2])
+		info.dport = binary.BigEndian.Uint16(l4[2:4])
+
+		if info.proto == protoTCP && len(l4) >= 14 {
+			info.tcpFlags = l4[13]
+		}
+	case protoICMP, protoICMPv6:
+		if len(l4) < 8 {
+			return
+		}
+
+		isV6 := info.proto == protoICMPv6
+
+		switch typ := l4[0]; {
+		case !isV6 && (typ == icmpv4EchoRequest || typ == icmpv4EchoReply),
+			isV6 && (typ == icmpv6EchoRequest || typ == icmpv6EchoReply):
+			// Echo messages are tracked by their identifier, on both sides.
+			id := binary.BigEndian.Uint16(l4[4:6])
+			info.sport, info.dport = id, id
+		case !isV6 && (typ == icmpv4Unreachable || typ == icmpv4TimeExceed || typ == icmpv4ParamProb),
+			isV6 && (typ == icmpv6Unreachable || typ == icmpv6TooBig || typ == icmpv6TimeExceed || typ == icmpv6ParamProb):
+			info.icmpError = true
+			info.inner = l4[8:]
+		}
+	}
+
+	return info, true
+}
+
+// protocol returns the msgcontrol.Protocol of the packet, or msgcontrol.ProtocolAny when no specific one applies,
+// which then only matches rules for any protocol.
+func (p *packetInfo) protocol() msgcontrol.Protocol {
+	switch p.proto {
+	case protoTCP:
+		return msgcontrol.ProtocolTCP
+	case protoUDP:
+		return msgcontrol.ProtocolUDP
+	case protoICMP, protoICMPv6:
+		return msgcontrol.ProtocolICMP
+	default:
+		return msgcontrol.ProtocolAny
+	}
+}
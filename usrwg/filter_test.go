@@ -0,0 +1,258 @@
+package usrwg
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/edup2p/common/types/msgcontrol"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ipLayer(src, dst netip.Addr, proto layers.IPProtocol) gopacket.NetworkLayer {
+	if src.Is4() {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: src.AsSlice(), DstIP: dst.AsSlice()}
+	}
+
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: src.AsSlice(), DstIP: dst.AsSlice()}
+}
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...))
+
+	return buf.Bytes()
+}
+
+func tcpPacket(t *testing.T, src, dst netip.AddrPort, syn, rst bool) []byte {
+	ip := ipLayer(src.Addr(), dst.Addr(), layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(src.Port()), DstPort: layers.TCPPort(dst.Port()), SYN: syn, RST: rst, ACK: !syn}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	return serialize(t, ip.(gopacket.SerializableLayer), tcp)
+}
+
+func udpPacket(t *testing.T, src, dst netip.AddrPort) []byte {
+	ip := ipLayer(src.Addr(), dst.Addr(), layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+
+	return serialize(t, ip.(gopacket.SerializableLayer), udp, gopacket.Payload("hi"))
+}
+
+func pingPacket(t *testing.T, src, dst netip.Addr, reply bool) []byte {
+	typ := uint8(layers.ICMPv4TypeEchoRequest)
+	if reply {
+		typ = layers.ICMPv4TypeEchoReply
+	}
+
+	return serialize(t,
+		ipLayer(src, dst, layers.IPProtocolICMPv4).(gopacket.SerializableLayer),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Id: 42, Seq: 1},
+	)
+}
+
+func TestPacketFilter(t *testing.T) {
+	f := NewPacketFilter()
+
+	fc, err := f.Controller()
+	require.NoError(t, err)
+
+	self4 := netip.MustParseAddr("100.64.0.1")
+	self6 := netip.MustParseAddr("fd00::1")
+	peer4 := netip.MustParseAddr("100.64.0.2")
+	peer6 := netip.MustParseAddr("fd00::2")
+	other4 := netip.MustParseAddr("100.64.0.3")
+
+	selfSSH := netip.AddrPortFrom(self4, 22)
+	selfHTTP := netip.AddrPortFrom(self4, 80)
+	peerClient := netip.AddrPortFrom(peer4, 40000)
+	otherClient := netip.AddrPortFrom(other4, 40000)
+
+	// Without quarantine or rules, everything passes.
+	assert.True(t, f.allowInbound(tcpPacket(t, peerClient, selfHTTP, true, false)))
+	assert.True(t, f.allowInbound(pingPacket(t, peer4, self4, false)))
+
+	require.NoError(t, fc.SetPeerRules(map[netip.Prefix][]msgcontrol.FilterRule{
+		netip.PrefixFrom(peer4, 32):  {{Direction: msgcontrol.DirectionIn, Protocol: msgcontrol.ProtocolTCP, Ports: []msgcontrol.PortRange{msgcontrol.SinglePort(22)}}},
+		netip.PrefixFrom(peer6, 128): {{Direction: msgcontrol.DirectionOut, Protocol: msgcontrol.ProtocolUDP}},
+	}))
+
+	t.Run("rules", func(t *testing.T) {
+		assert.True(t, f.allowInbound(tcpPacket(t, peerClient, selfSSH, true, false)), "allowed port is dropped")
+		assert.True(t, f.allowOutbound(tcpPacket(t, selfSSH, peerClient, false, false)), "return traffic is dropped")
+
+		assert.False(t, f.allowInbound(tcpPacket(t, netip.AddrPortFrom(peer4, 40001), selfHTTP, true, false)), "other port is allowed")
+		assert.False(t, f.allowInbound(udpPacket(t, peerClient, netip.AddrPortFrom(self4, 22))), "other protocol is allowed")
+		assert.False(t, f.allowOutbound(tcpPacket(t, netip.AddrPortFrom(self4, 50000), netip.AddrPortFrom(peer4, 22), true, false)), "outbound without rule is allowed")
+		assert.True(t, f.allowInbound(tcpPacket(t, otherClient, selfHTTP, true, false)), "peer without rules is dropped")
+
+		// The earlier connection from before the rules is still tracked.
+		assert.True(t, f.allowInbound(tcpPacket(t, peerClient, selfHTTP, false, false)), "tracked connection is dropped")
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		selfUDP := netip.AddrPortFrom(self6, 50000)
+		peerDNS := netip.AddrPortFrom(peer6, 53)
+
+		assert.False(t, f.allowInbound(udpPacket(t, peerDNS, selfUDP)), "unsolicited udp is allowed")
+		assert.True(t, f.allowOutbound(udpPacket(t, selfUDP, peerDNS)), "allowed outbound udp is dropped")
+		assert.True(t, f.allowInbound(udpPacket(t, peerDNS, selfUDP)), "udp reply is dropped")
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		conn := netip.AddrPortFrom(peer4, 40002)
+
+		assert.True(t, f.allowInbound(tcpPacket(t, conn, selfSSH, true, false)))
+		assert.True(t, f.allowOutbound(tcpPacket(t, selfSSH, conn, false, true)), "reset is dropped")
+		assert.False(t, f.allowInbound(tcpPacket(t, conn, selfHTTP, false, false)), "connection is tracked after reset")
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		require.NoError(t, fc.QuarantineNodes([]netip.Addr{other4}))
+
+		assert.False(t, f.allowInbound(pingPacket(t, other4, self4, false)), "quarantined ping is allowed")
+		assert.True(t, f.allowInbound(tcpPacket(t, otherClient, selfHTTP, false, false)), "tracked connection of quarantined peer is dropped")
+
+		assert.True(t, f.allowOutbound(pingPacket(t, self4, other4, false)), "outbound ping to quarantined peer is dropped")
+		assert.True(t, f.allowInbound(pingPacket(t, other4, self4, true)), "ping reply from quarantined peer is dropped")
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		assert.False(t, f.allowInbound(nil))
+		assert.False(t, f.allowInbound([]byte{0x45, 0, 0}))
+	})
+
+	require.NoError(t, f.Reset())
+
+	assert.ErrorIs(t, fc.QuarantineNodes(nil), errResetFilter)
+	assert.True(t, f.allowInbound(pingPacket(t, other4, self4, false)), "quarantine remains after reset")
+}
+
+func TestPacketFilterRoutes(t *testing.T) {
+	f := NewPacketFilter()
+
+	fc, err := f.Controller()
+	require.NoError(t, err)
+
+	self := netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), 80)
+	sshRule := []msgcontrol.FilterRule{{Direction: msgcontrol.DirectionIn, Protocol: msgcontrol.ProtocolTCP, Ports: []msgcontrol.PortRange{msgcontrol.SinglePort(22)}}}
+
+	// A subnet router with rules, an exit node with rules, and a peer without rules within the routes of both.
+	require.NoError(t, fc.SetPeerRules(map[netip.Prefix][]msgcontrol.FilterRule{
+		netip.MustParsePrefix("100.64.0.2/32"):       sshRule,
+		netip.MustParsePrefix("192.168.1.0/24"):      sshRule,
+		netip.MustParsePrefix("0.0.0.0/0"):           sshRule,
+		netip.MustParsePrefix("192.168.1.7/32"):      nil,
+		netip.MustParsePrefix("::ffff:10.0.0.0/104"): nil,
+	}))
+
+	routed := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.2"), 40000)
+	assert.False(t, f.allowInbound(tcpPacket(t, routed, self, true, false)), "routed source is not restricted")
+	assert.True(t, f.allowInbound(tcpPacket(t, routed, netip.AddrPortFrom(self.Addr(), 22), true, false)), "allowed port from routed source is dropped")
+
+	exit := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), 40000)
+	assert.False(t, f.allowInbound(tcpPacket(t, exit, self, true, false)), "source routed through exit node is not restricted")
+
+	unrestricted := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.7"), 40000)
+	assert.True(t, f.allowInbound(tcpPacket(t, unrestricted, self, true, false)), "more specific prefix without rules is restricted")
+
+	mapped := netip.AddrPortFrom(netip.MustParseAddr("10.1.2.3"), 40000)
+	assert.True(t, f.allowInbound(tcpPacket(t, mapped, self, true, false)), "IPv4-mapped prefix without rules is restricted")
+}
+
+// fragment4 returns an IPv4 fragment of a UDP packet from src to dst, which has the UDP header if offset is 0.
+func fragment4(t *testing.T, src, dst netip.AddrPort, id uint16, offset uint16, more bool) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src.Addr().AsSlice(), DstIP: dst.Addr().AsSlice(), Id: id, FragOffset: offset}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+
+	if offset != 0 {
+		return serialize(t, ip, gopacket.Payload("rest of the payload"))
+	}
+
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+
+	return serialize(t, ip, udp, gopacket.Payload("hi"))
+}
+
+// fragment6 returns an IPv6 fragment of a UDP packet from src to dst, which has the UDP header if offset is 0.
+func fragment6(t *testing.T, src, dst netip.AddrPort, id uint32, offset uint16, more bool) []byte {
+	// The fragment header: next header, reserved, offset (in 8 byte units) and M flag, identification.
+	hdr := make([]byte, 8, 24)
+	hdr[0] = byte(layers.IPProtocolUDP)
+	binary.BigEndian.PutUint16(hdr[2:4], offset<<3)
+	if more {
+		hdr[3] |= 1
+	}
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+
+	if offset == 0 {
+		hdr = binary.BigEndian.AppendUint16(hdr, src.Port())
+		hdr = binary.BigEndian.AppendUint16(hdr, dst.Port())
+		hdr = append(hdr, 0, 16, 0, 0)
+	}
+
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment, SrcIP: src.Addr().AsSlice(), DstIP: dst.Addr().AsSlice()}
+
+	return serialize(t, ip, gopacket.Payload(append(hdr, "payload!"...)))
+}
+
+func TestPacketFilterFragments(t *testing.T) {
+	f := NewPacketFilter()
+
+	fc, err := f.Controller()
+	require.NoError(t, err)
+
+	self4, peer4, other4 := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("100.64.0.3")
+	self6, peer6 := netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")
+
+	dnsRule := []msgcontrol.FilterRule{{Direction: msgcontrol.DirectionIn, Protocol: msgcontrol.ProtocolUDP, Ports: []msgcontrol.PortRange{msgcontrol.SinglePort(53)}}}
+
+	require.NoError(t, fc.SetPeerRules(map[netip.Prefix][]msgcontrol.FilterRule{
+		netip.PrefixFrom(peer4, 32):  dnsRule,
+		netip.PrefixFrom(peer6, 128): dnsRule,
+	}))
+
+	peerClient4, peerClient6 := netip.AddrPortFrom(peer4, 40000), netip.AddrPortFrom(peer6, 40000)
+	selfDNS4, selfDNS6 := netip.AddrPortFrom(self4, 53), netip.AddrPortFrom(self6, 53)
+	selfOther4, selfOther6 := netip.AddrPortFrom(self4, 54), netip.AddrPortFrom(self6, 54)
+
+	t.Run("ipv4", func(t *testing.T) {
+		assert.True(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 1, 0, true)), "allowed first fragment is dropped")
+		assert.True(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 1, 3, true)), "fragment of allowed packet is dropped")
+		assert.True(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 1, 6, false)), "last fragment of allowed packet is dropped")
+
+		assert.False(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 2, 3, false)), "fragment without first fragment is allowed")
+
+		assert.False(t, f.allowInbound(fragment4(t, peerClient4, selfOther4, 3, 0, true)), "disallowed first fragment is allowed")
+		assert.False(t, f.allowInbound(fragment4(t, peerClient4, selfOther4, 3, 3, false)), "fragment of disallowed packet is allowed")
+
+		// Peers without rules have no need for their fragments to be tracked.
+		assert.True(t, f.allowInbound(fragment4(t, netip.AddrPortFrom(other4, 40000), selfOther4, 4, 3, false)), "fragment from peer without rules is dropped")
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		assert.True(t, f.allowInbound(fragment6(t, peerClient6, selfDNS6, 1, 0, true)), "allowed first fragment is dropped")
+		assert.True(t, f.allowInbound(fragment6(t, peerClient6, selfDNS6, 1, 2, false)), "fragment of allowed packet is dropped")
+
+		assert.False(t, f.allowInbound(fragment6(t, peerClient6, selfOther6, 2, 0, true)), "disallowed first fragment is allowed")
+		assert.False(t, f.allowInbound(fragment6(t, peerClient6, selfOther6, 2, 2, false)), "fragment of disallowed packet is allowed")
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		require.NoError(t, fc.QuarantineNodes([]netip.Addr{peer4}))
+
+		// The first fragment of a tracked connection is let through after quarantine, and so are the others.
+		assert.True(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 5, 0, true)), "first fragment of tracked connection is dropped")
+		assert.True(t, f.allowInbound(fragment4(t, peerClient4, selfDNS4, 5, 3, false)), "fragment of tracked connection is dropped")
+
+		assert.False(t, f.allowInbound(fragment4(t, netip.AddrPortFrom(peer4, 40001), selfDNS4, 6, 0, true)), "new first fragment is allowed")
+		assert.False(t, f.allowInbound(fragment4(t, netip.AddrPortFrom(peer4, 40001), selfDNS4, 6, 3, false)), "new fragment is allowed")
+	})
+}
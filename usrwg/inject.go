@@ -0,0 +1,126 @@
+package usrwg
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/edup2p/common/types/ifaces"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var _ ifaces.Injectable = (*UserSpaceWireGuardController)(nil)
+
+// injectOffset is the headroom given to the TUN device when writing injected packets,
+// which it may need for its own headers.
+const injectOffset = 16
+
+var (
+	ErrInjectFamilyMismatch = errors.New("usrwg: source and destination of injected packet are not of the same family")
+	ErrInjectNotOverlay     = errors.New("usrwg: injected packet is not from the overlay to this node or a multicast group")
+)
+
+func (u *UserSpaceWireGuardController) Available() bool {
+	return true
+}
+
+// InjectPacket injects a UDP packet with pkt as payload into the local network stack,
+// as if it came from the overlay.
+//
+// from has to be an address within the overlay, and to one of the overlay addresses of this node or a multicast group,
+// both of the same family.
+func (u *UserSpaceWireGuardController) InjectPacket(from, to netip.AddrPort, pkt []byte) error {
+	ip, err := u.injectIPLayer(from.Addr(), to.Addr(), layers.IPProtocolUDP)
+	if err != nil {
+		return err
+	}
+
+	udp := &layers.UDP{
+		DstPort: layers.UDPPort(to.Port()),
+		SrcPort: layers.UDPPort(from.Port()),
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return fmt.Errorf("failed to set udp checksum: %w", err)
+	}
+
+	return u.inject(ip.(gopacket.SerializableLayer), udp, gopacket.Payload(pkt))
+}
+
+// InjectICMPv6 injects an ICMPv6 message of type typ and code, with body after its checksum,
+// into the local network stack as if it came from the overlay.
+//
+// from has to be an IPv6 address within the overlay, and to the IPv6 overlay address of this node or a multicast group.
+func (u *UserSpaceWireGuardController) InjectICMPv6(from, to netip.Addr, typ, code uint8, body []byte) error {
+	if !from.Is6() || !to.Is6() {
+		return fmt.Errorf("usrwg: icmpv6 needs ipv6 addresses, got %s and %s", from, to)
+	}
+
+	ip, err := u.injectIPLayer(from, to, layers.IPProtocolICMPv6)
+	if err != nil {
+		return err
+	}
+
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, code)}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		return fmt.Errorf("failed to set icmpv6 checksum: %w", err)
+	}
+
+	return u.inject(ip.(gopacket.SerializableLayer), icmp, gopacket.Payload(body))
+}
+
+// injectIPLayer validates from and to, and returns the IP layer for them, with proto as protocol.
+func (u *UserSpaceWireGuardController) injectIPLayer(from, to netip.Addr, proto layers.IPProtocol) (gopacket.NetworkLayer, error) {
+	from, to = from.Unmap(), to.Unmap()
+
+	switch {
+	case from.Is4() && to.Is4():
+		if !u.addr4.Contains(from) || (to != u.addr4.Addr() && !to.IsMulticast()) {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrInjectNotOverlay, from, to)
+		}
+
+		return &layers.IPv4{
+			Version:  4,
+			TTL:      255,
+			Protocol: proto,
+			SrcIP:    from.AsSlice(),
+			DstIP:    to.AsSlice(),
+		}, nil
+	case from.Is6() && to.Is6():
+		if !u.addr6.Contains(from) || (to != u.addr6.Addr() && !to.IsMulticast()) {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrInjectNotOverlay, from, to)
+		}
+
+		return &layers.IPv6{
+			Version:    6,
+			HopLimit:   255,
+			NextHeader: proto,
+			SrcIP:      from.AsSlice(),
+			DstIP:      to.AsSlice(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInjectFamilyMismatch, from, to)
+	}
+}
+
+// inject serializes the layers into a packet, and writes it to the TUN device.
+func (u *UserSpaceWireGuardController) inject(ls ...gopacket.SerializableLayer) error {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return fmt.Errorf("failed to serialize packet: %w", err)
+	}
+
+	packetData := slices.Concat(make([]byte, injectOffset), buf.Bytes())
+
+	if _, err := u.tunDev.Write([][]byte{packetData}, injectOffset); err != nil {
+		return fmt.Errorf("failed to inject packet: %w", err)
+	}
+
+	return nil
+}
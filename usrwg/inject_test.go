@@ -0,0 +1,77 @@
+package usrwg
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/edup2p/common/types/ifaces"
+	"github.com/edup2p/common/types/key"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectPacket(t *testing.T) {
+	addr4 := netip.MustParsePrefix("10.42.0.1/16")
+	addr6 := netip.MustParsePrefix("fd42::1/64")
+
+	h := NewNetstackWGHost()
+
+	wgc, err := h.Controller(key.NewNode(), addr4, addr6, 0)
+	require.NoError(t, err)
+	defer h.Reset()
+
+	inj, ok := wgc.(ifaces.Injectable)
+	require.True(t, ok, "netstack controller is not injectable")
+
+	for _, tc := range []struct {
+		name     string
+		self     netip.Addr
+		peer     netip.Addr
+		listenOn string
+	}{
+		{"ipv4", addr4.Addr(), netip.MustParseAddr("10.42.0.2"), "0.0.0.0:5353"},
+		{"ipv6", addr6.Addr(), netip.MustParseAddr("fd42::2"), "[::]:5354"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc, err := h.ListenPacket("udp", tc.listenOn)
+			require.NoError(t, err)
+			defer pc.Close()
+
+			_, port, err := net.SplitHostPort(tc.listenOn)
+			require.NoError(t, err)
+
+			to := netip.MustParseAddrPort(net.JoinHostPort(tc.self.String(), port))
+			from := netip.AddrPortFrom(tc.peer, 1234)
+
+			require.NoError(t, inj.InjectPacket(from, to, []byte("injected")))
+
+			require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+
+			buf := make([]byte, 64)
+			n, src, err := pc.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, "injected", string(buf[:n]))
+			assert.Equal(t, from.String(), src.String())
+		})
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		self4 := netip.AddrPortFrom(addr4.Addr(), 53)
+		self6 := netip.AddrPortFrom(addr6.Addr(), 53)
+
+		assert.ErrorIs(t, inj.InjectPacket(netip.MustParseAddrPort("[fd42::2]:53"), self4, nil), ErrInjectFamilyMismatch)
+		assert.ErrorIs(t, inj.InjectPacket(netip.MustParseAddrPort("192.168.0.1:53"), self4, nil), ErrInjectNotOverlay)
+		assert.ErrorIs(t, inj.InjectPacket(netip.MustParseAddrPort("[fd00::2]:53"), self6, nil), ErrInjectNotOverlay)
+		assert.ErrorIs(t, inj.InjectPacket(netip.MustParseAddrPort("10.42.0.2:53"), netip.MustParseAddrPort("10.42.0.3:53"), nil), ErrInjectNotOverlay)
+		assert.ErrorIs(t, inj.InjectPacket(netip.MustParseAddrPort("192.168.0.1:5353"), netip.MustParseAddrPort("224.0.0.251:5353"), nil), ErrInjectNotOverlay)
+
+		// Multicast groups are allowed, for mDNS.
+		assert.NoError(t, inj.InjectPacket(netip.MustParseAddrPort("10.42.0.2:5353"), netip.MustParseAddrPort("224.0.0.251:5353"), nil))
+		assert.NoError(t, inj.InjectPacket(netip.MustParseAddrPort("[fd42::2]:5353"), netip.MustParseAddrPort("[ff02::fb]:5353"), nil))
+
+		assert.Error(t, inj.InjectICMPv6(netip.MustParseAddr("10.42.0.2"), addr4.Addr(), 128, 0, nil))
+		assert.NoError(t, inj.InjectICMPv6(netip.MustParseAddr("fd42::2"), addr6.Addr(), 128, 0, []byte{0, 1, 0, 1}))
+	})
+}
@@ -0,0 +1,237 @@
+package usrwg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/edup2p/common/toversok"
+	"github.com/edup2p/common/types/key"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// ErrNotRunning is returned by the NetstackWireGuardHost networking methods while there is no active controller.
+var ErrNotRunning = errors.New("usrwg: netstack is not running")
+
+// NetstackWireGuardHost is a toversok.WireGuardHost which runs wireguard-go on top of a userspace (gVisor)
+// network stack, instead of a TUN device.
+//
+// As it touches no OS network configuration, it needs no root privileges;
+// the overlay is only reachable from within the program, through Dial, Listen, and ListenPacket.
+type NetstackWireGuardHost struct {
+	mu      sync.RWMutex
+	running *NetstackWireGuardController
+
+	filter *PacketFilter
+
+	// mtu is the MTU configured on the host, or 0 to use the one given by control.
+	mtu int
+}
+
+// SetPacketFilter makes the next controllers pass all packets through filter, or none if nil.
+func (n *NetstackWireGuardHost) SetPacketFilter(filter *PacketFilter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.filter = filter
+}
+
+func NewNetstackWGHost() *NetstackWireGuardHost {
+	return &NetstackWireGuardHost{}
+}
+
+// NewNetstackWGHostWithMTU creates a host which uses mtu for the netstack, instead of the one given by control.
+func NewNetstackWGHostWithMTU(mtu int) *NetstackWireGuardHost {
+	return &NetstackWireGuardHost{mtu: mtu}
+}
+
+func (n *NetstackWireGuardHost) Reset() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.running != nil {
+		n.running.Close()
+		n.running = nil
+	}
+
+	return nil
+}
+
+func (n *NetstackWireGuardHost) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix, controlMTU int) (toversok.WireGuardController, error) {
+	if err := n.Reset(); err != nil {
+		return nil, fmt.Errorf("usrwg: failed to reset running netstack controller: %v", err)
+	}
+
+	mtu, err := toversok.ChooseMTU(n.mtu, controlMTU)
+	if err != nil {
+		return nil, fmt.Errorf("usrwg: %w", err)
+	}
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{addr4.Addr(), addr6.Addr()}, nil, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netstack: %w", err)
+	}
+
+	n.mu.RLock()
+	filter := n.filter
+	n.mu.RUnlock()
+
+	usrwgc, err := newController(tunDev, privateKey, mtu, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	usrwgc.addr4, usrwgc.addr6 = addr4, addr6
+
+	nsc := &NetstackWireGuardController{
+		UserSpaceWireGuardController: usrwgc,
+		net:                          tnet,
+	}
+
+	n.mu.Lock()
+	n.running = nsc
+	n.mu.Unlock()
+
+	return nsc, nil
+}
+
+func (n *NetstackWireGuardHost) current() (*NetstackWireGuardController, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.running == nil {
+		return nil, ErrNotRunning
+	}
+
+	return n.running, nil
+}
+
+// DialContext connects to address in the overlay, see NetstackWireGuardController.DialContext.
+func (n *NetstackWireGuardHost) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := n.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.DialContext(ctx, network, address)
+}
+
+// Dial is DialContext with a background context.
+func (n *NetstackWireGuardHost) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// Listen listens for TCP connections from the overlay, see NetstackWireGuardController.Listen.
+func (n *NetstackWireGuardHost) Listen(network, address string) (net.Listener, error) {
+	c, err := n.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Listen(network, address)
+}
+
+// ListenPacket listens for UDP packets from the overlay, see NetstackWireGuardController.ListenPacket.
+func (n *NetstackWireGuardHost) ListenPacket(network, address string) (net.PacketConn, error) {
+	c, err := n.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ListenPacket(network, address)
+}
+
+func parseListenAddr(address string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	var addr netip.Addr
+	if host != "" {
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return netip.AddrPort{}, err
+		}
+
+		if addr.IsUnspecified() {
+			// The netstack only listens on all addresses when given none at all.
+			addr = netip.Addr{}
+		}
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// NetstackWireGuardController is a UserSpaceWireGuardController running on a netstack, instead of a TUN device.
+type NetstackWireGuardController struct {
+	*UserSpaceWireGuardController
+
+	net *netstack.Net
+}
+
+var _ toversok.OverlayNet = (*NetstackWireGuardController)(nil)
+
+// GetInterface returns nil, as a netstack has no OS network interface.
+func (n *NetstackWireGuardController) GetInterface() *net.Interface {
+	return nil
+}
+
+// DialContext connects to address in the overlay, over "tcp", "tcp4", "tcp6", "udp", "udp4", or "udp6".
+//
+// address has to be an IP address with a port, as there is no resolver within the overlay.
+func (n *NetstackWireGuardController) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return n.net.DialContext(ctx, network, address)
+}
+
+// Listen listens for TCP connections from the overlay on address,
+// which can omit the IP (or leave it unspecified) to listen on all overlay IPs.
+func (n *NetstackWireGuardController) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("usrwg: unsupported network for listen: %q", network)
+	}
+
+	ap, err := parseListenAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := n.net.ListenTCPAddrPort(ap)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// ListenPacket listens for UDP packets from the overlay on address,
+// which can omit the IP (or leave it unspecified) to listen on all overlay IPs.
+func (n *NetstackWireGuardController) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("usrwg: unsupported network for listen: %q", network)
+	}
+
+	ap, err := parseListenAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := n.net.ListenUDPAddrPort(ap)
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
@@ -0,0 +1,45 @@
+package overlayproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+func (s *Server) handshakeHTTP(ctx context.Context, br *bufio.Reader, conn net.Conn) (net.Conn, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("could not read http request: %w", err)
+	}
+
+	if req.Method != http.MethodConnect {
+		_ = writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("unsupported http method %q", req.Method)
+	}
+
+	host, port, err := splitHostPort(req.Host)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid connect target %q: %w", req.Host, err)
+	}
+
+	remote, err := s.dial(ctx, host, port)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadGateway)
+		return nil, err
+	}
+
+	if err := writeHTTPStatus(conn, http.StatusOK); err != nil {
+		_ = remote.Close()
+		return nil, fmt.Errorf("could not write response: %w", err)
+	}
+
+	return remote, nil
+}
+
+func writeHTTPStatus(conn net.Conn, code int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+	return err
+}
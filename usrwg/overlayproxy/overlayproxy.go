@@ -0,0 +1,188 @@
+// Package overlayproxy contains a local SOCKS5 and HTTP CONNECT proxy, which dials its destinations through the
+// overlay.
+//
+// This lets applications on machines without a TUN interface reach peers,
+// when toversok runs on a netstack (see usrwg.NetstackWireGuardHost).
+//
+// Both protocols are served on the same listener, distinguished by the first byte of the connection.
+package overlayproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HandshakeTimeout is the time a client has to send its proxy request.
+const HandshakeTimeout = 10 * time.Second
+
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ResolveFunc resolves a (peer) hostname to an overlay IP.
+type ResolveFunc func(ctx context.Context, host string) (netip.Addr, error)
+
+var ErrNoResolver = errors.New("overlayproxy: no resolver for hostnames")
+
+type Server struct {
+	// Dial dials through the overlay, such as (*usrwg.NetstackWireGuardHost).DialContext.
+	Dial DialFunc
+
+	// Resolve resolves destination hostnames, when they are not IP addresses.
+	//
+	// If nil, only IP addresses are accepted as destination.
+	Resolve ResolveFunc
+}
+
+func (s *Server) L() *slog.Logger {
+	return slog.With("from", "overlayproxy")
+}
+
+// ListenAndServe listens on addr, and serves proxy connections until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves proxy connections on ln until ctx is done, after which ln is closed.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	context.AfterFunc(ctx, func() {
+		if err := ln.Close(); err != nil {
+			s.L().Warn("failed to close listener", "err", err)
+		}
+	})
+
+	s.L().Info("serving", "addr", ln.Addr().String())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.L().Debug("failed to close client conn", "err", err)
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		s.L().Warn("failed to set handshake deadline", "err", err)
+		return
+	}
+
+	br := bufio.NewReader(conn)
+
+	first, err := br.Peek(1)
+	if err != nil {
+		s.L().Debug("failed to read from client", "err", err)
+		return
+	}
+
+	var remote net.Conn
+	if first[0] == socks5Version {
+		remote, err = s.handshakeSOCKS5(ctx, br, conn)
+	} else {
+		remote, err = s.handshakeHTTP(ctx, br, conn)
+	}
+
+	if err != nil {
+		s.L().Info("proxy request failed", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer func() {
+		if err := remote.Close(); err != nil {
+			s.L().Debug("failed to close overlay conn", "err", err)
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.L().Warn("failed to clear handshake deadline", "err", err)
+		return
+	}
+
+	s.L().Debug("proxying", "client", conn.RemoteAddr().String(), "to", remote.RemoteAddr().String())
+
+	// The client may already have sent data after its request, which is still buffered.
+	splice(remote, conn, br)
+}
+
+// dial resolves host (if needed) and dials it through the overlay.
+func (s *Server) dial(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		if s.Resolve == nil {
+			return nil, ErrNoResolver
+		}
+
+		if addr, err = s.Resolve(ctx, host); err != nil {
+			return nil, fmt.Errorf("could not resolve %q: %w", host, err)
+		}
+	}
+
+	return s.Dial(ctx, "tcp", netip.AddrPortFrom(addr.Unmap(), port).String())
+}
+
+// splice copies between remote and client until either side is done, reading from the client through br.
+func splice(remote, client net.Conn, br *bufio.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(remote, br)
+		closeWrite(remote)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, remote)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = c.Close()
+	}
+}
+
+func splitHostPort(hostport string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	return host, uint16(port), nil
+}
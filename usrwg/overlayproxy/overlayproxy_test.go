@@ -0,0 +1,184 @@
+package overlayproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// echoListener echoes everything back on its connections, in place of a peer.
+func echoListener(t *testing.T) netip.AddrPort {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return netip.MustParseAddrPort(ln.Addr().String())
+}
+
+// serve runs s, with the overlay being the local network, and returns its address.
+func serve(t *testing.T, s *Server) string {
+	var d net.Dialer
+	s.Dial = d.DialContext
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- s.Serve(ctx, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return ln.Addr().String()
+}
+
+// resolvePeer resolves "peer" to the loopback address.
+func resolvePeer(_ context.Context, host string) (netip.Addr, error) {
+	if host != "peer" {
+		return netip.Addr{}, errors.New("unknown peer")
+	}
+
+	return netip.MustParseAddr("127.0.0.1"), nil
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) string {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	_, err := io.WriteString(conn, msg)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	return string(buf)
+}
+
+// connect sends an HTTP CONNECT request for target over a new connection to addr, and returns its status code.
+func connect(t *testing.T, addr, target string) (net.Conn, int) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	require.NoError(t, err)
+
+	// The peer only echoes, so the reader cannot hold on to tunneled data past the response.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+
+	return conn, resp.StatusCode
+}
+
+func TestHTTPConnect(t *testing.T) {
+	peer := echoListener(t)
+	addr := serve(t, &Server{Resolve: resolvePeer})
+
+	conn, code := connect(t, addr, peer.String())
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", echo(t, conn, "hello"))
+
+	conn, code = connect(t, addr, fmt.Sprintf("peer:%d", peer.Port()))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "by name", echo(t, conn, "by name"))
+
+	_, code = connect(t, addr, fmt.Sprintf("other:%d", peer.Port()))
+	assert.Equal(t, http.StatusBadGateway, code)
+
+	_, code = connect(t, addr, "peer")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHTTPNotConnect(t *testing.T) {
+	addr := serve(t, &Server{})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET http://peer/ HTTP/1.1\r\nHost: peer\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestSOCKS5(t *testing.T) {
+	peer := echoListener(t)
+	addr := serve(t, &Server{Resolve: resolvePeer})
+
+	d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	require.NoError(t, err)
+
+	conn, err := d.Dial("tcp", peer.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "hello", echo(t, conn, "hello"))
+
+	named, err := d.Dial("tcp", fmt.Sprintf("peer:%d", peer.Port()))
+	require.NoError(t, err)
+	defer named.Close()
+	assert.Equal(t, "by name", echo(t, named, "by name"))
+
+	_, err = d.Dial("tcp", fmt.Sprintf("other:%d", peer.Port()))
+	assert.ErrorContains(t, err, "host unreachable")
+}
+
+func TestSOCKS5NoResolver(t *testing.T) {
+	addr := serve(t, &Server{})
+
+	d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	require.NoError(t, err)
+
+	_, err = d.Dial("tcp", "peer:80")
+	assert.ErrorContains(t, err, "host unreachable")
+}
+
+func TestSOCKS5AuthRequired(t *testing.T) {
+	addr := serve(t, &Server{})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Only offers username/password authentication.
+	_, err = conn.Write([]byte{socks5Version, 1, 2})
+	require.NoError(t, err)
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, socks5AuthNoAcceptable}, reply)
+}
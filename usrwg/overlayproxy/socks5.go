@@ -0,0 +1,133 @@
+package overlayproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// SOCKS5, as per RFC 1928; only the CONNECT command without authentication is supported.
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5ReplySuccess             = 0
+	socks5ReplyHostUnreachable     = 4
+	socks5ReplyCommandNotSupported = 7
+	socks5ReplyAddrNotSupported    = 8
+)
+
+func (s *Server) handshakeSOCKS5(ctx context.Context, br *bufio.Reader, conn net.Conn) (net.Conn, error) {
+	// Greeting: version, number of methods, methods.
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("could not read greeting: %w", err)
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, fmt.Errorf("could not read methods: %w", err)
+	}
+
+	if !slices.Contains(methods, socks5AuthNone) {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return nil, errors.New("client does not support unauthenticated socks5")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return nil, fmt.Errorf("could not write method selection: %w", err)
+	}
+
+	// Request: version, command, reserved, address type, address, port.
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return nil, fmt.Errorf("could not read request: %w", err)
+	}
+
+	if req[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected socks version %d", req[0])
+	}
+
+	host, err := readSOCKS5Addr(br, req[3])
+	if err != nil {
+		if errors.Is(err, errUnsupportedAddrType) {
+			_ = writeSOCKS5Reply(conn, socks5ReplyAddrNotSupported)
+		}
+		return nil, err
+	}
+
+	var portBytes [2]byte
+	if _, err := io.ReadFull(br, portBytes[:]); err != nil {
+		return nil, fmt.Errorf("could not read port: %w", err)
+	}
+	port := binary.BigEndian.Uint16(portBytes[:])
+
+	if req[1] != socks5CmdConnect {
+		_ = writeSOCKS5Reply(conn, socks5ReplyCommandNotSupported)
+		return nil, fmt.Errorf("unsupported socks5 command %d", req[1])
+	}
+
+	remote, err := s.dial(ctx, host, port)
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5ReplyHostUnreachable)
+		return nil, err
+	}
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySuccess); err != nil {
+		_ = remote.Close()
+		return nil, fmt.Errorf("could not write reply: %w", err)
+	}
+
+	return remote, nil
+}
+
+var errUnsupportedAddrType = errors.New("unsupported socks5 address type")
+
+func readSOCKS5Addr(br *bufio.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AddrIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return "", err
+		}
+		return netip.AddrFrom4(b).String(), nil
+	case socks5AddrIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return "", err
+		}
+		return netip.AddrFrom16(b).String(), nil
+	case socks5AddrDomain:
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("%w: %d", errUnsupportedAddrType, atyp)
+	}
+}
+
+// writeSOCKS5Reply writes a reply with an unspecified bound address, as that is of no use to clients.
+func writeSOCKS5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
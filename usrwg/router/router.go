@@ -1,6 +1,9 @@
 package router
 
-import "net/netip"
+import (
+	"errors"
+	"net/netip"
+)
 
 // TODO: we could probably refactor this package out of usrwg into something more universal
 //  currently it'll be coupled with the data that tun_* gives, so that's a consideration
@@ -15,4 +18,21 @@ type Router interface {
 type Config struct {
 	LocalAddrs      []netip.Addr
 	RoutingPrefixes []netip.Prefix
+
+	// Routes are extra prefixes to route into the device, on top of RoutingPrefixes.
+	//
+	// On linux and BSD, default routes are installed as their two halves,
+	// which take precedence over the default route of the host without replacing it.
+	Routes []netip.Prefix
+
+	// Bypass are addresses to keep routing the way the host routed them, outside the device,
+	// so that Routes do not capture the traffic the device itself is carried by.
+	//
+	// Only supported on linux, ErrBypassUnsupported is returned elsewhere.
+	Bypass []netip.Addr
+
+	// MTU is the MTU to set on the device, or 0 to leave it as-is.
+	MTU int
 }
+
+var ErrBypassUnsupported = errors.New("bypass routes are not supported on this platform")
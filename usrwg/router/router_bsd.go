@@ -21,12 +21,14 @@ func NewRouter(device tun.Device) (Router, error) {
 	return &bsdRouter{
 		tunName:      name,
 		currPrefixes: make([]netip.Prefix, 0),
+		currRoutes:   make([]netip.Prefix, 0),
 	}, nil
 }
 
 type bsdRouter struct {
 	tunName      string
 	currPrefixes []netip.Prefix
+	currRoutes   []netip.Prefix
 }
 
 func (r *bsdRouter) Up() error {
@@ -42,6 +44,12 @@ func (r *bsdRouter) Close() error {
 }
 
 func (r *bsdRouter) Set(c *Config) (retErr error) {
+	if len(c.Bypass) > 0 {
+		return ErrBypassUnsupported
+	}
+
+	routes := splitDefaultRoutes(c.Routes)
+
 	setErr := func(err error) {
 		if retErr == nil {
 			retErr = err
@@ -72,8 +80,23 @@ func (r *bsdRouter) Set(c *Config) (retErr error) {
 		}
 	}
 
+	for _, prefix := range prefixesToRemove(routes, r.currRoutes) {
+		if err := r.removeRoute(prefix); err != nil {
+			setErr(err)
+			slog.Warn("removeRoute failed", "for", prefix.String(), "err", err)
+		}
+	}
+
+	for _, prefix := range prefixesToAdd(routes, r.currRoutes) {
+		if err := r.addRoute(prefix); err != nil {
+			setErr(err)
+			slog.Warn("addRoute failed", "for", prefix.String(), "err", err)
+		}
+	}
+
 	if retErr == nil {
 		r.currPrefixes = c.RoutingPrefixes
+		r.currRoutes = routes
 	}
 
 	return
@@ -1,10 +1,16 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/netip"
+	"slices"
 
+	"github.com/vishvananda/netlink"
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
@@ -14,70 +20,570 @@ func NewRouter(device tun.Device) (Router, error) {
 		return nil, err
 	}
 
+	return newLinuxRouter(name)
+}
+
+// NewLinkRouter returns a Router for an existing link by name, such as a kernel WireGuard device.
+func NewLinkRouter(name string) (Router, error) {
+	r, err := newLinuxRouter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func newLinuxRouter(name string) (*linuxRouter, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find link %q: %w", name, err)
+	}
+
+	attrs := link.Attrs()
+
+	origAddrs, err := linkAddrs(link)
+	if err != nil {
+		return nil, err
+	}
+
 	return &linuxRouter{
-		iface:        name,
+		iface: name,
+		link:  link,
+
+		origMTU:   attrs.MTU,
+		origUp:    attrs.Flags&unix.IFF_UP != 0,
+		origAddrs: origAddrs,
+
+		mtu:          attrs.MTU,
 		currPrefixes: make([]netip.Prefix, 0),
+		currRoutes:   make([]netip.Prefix, 0),
+		currBypass:   make(map[netip.Addr]*netlink.Route),
 	}, nil
 }
 
+// linuxRouter configures a link through netlink.
+//
+// Every change is applied transactionally; if one step fails, the steps before it are rolled back,
+// leaving the link in the state of the last successful call.
+//
+// The state of the link from before the router was created is restored on Close.
 type linuxRouter struct {
-	iface        string
+	iface string
+	link  netlink.Link
+
+	origMTU   int
+	origUp    bool
+	origAddrs []netip.Prefix
+
+	up           bool
+	mtu          int
 	currPrefixes []netip.Prefix
+	// currRoutes is only filled while up, as the kernel refuses routes over a link which is down.
+	currRoutes []netip.Prefix
+	// wantRoutes are the routes to install when up.
+	wantRoutes []netip.Prefix
+	// currBypass are the routes installed for Config.Bypass, over other links than this one.
+	currBypass map[netip.Addr]*netlink.Route
 }
 
-func (r *linuxRouter) Up() error {
-	if out, err := cmd("ip", "link", "set", "dev", r.iface, "up").CombinedOutput(); err != nil {
-		return fmt.Errorf("failed bringing up device: %w\n%s", err, out)
+// step is one reversible change to the link.
+type step struct {
+	desc string
+	do   func() error
+	undo func() error
+}
+
+// apply runs all steps, and rolls back the applied ones in reverse when one fails.
+func apply(steps []step) error {
+	for i, s := range steps {
+		if err := s.do(); err != nil {
+			for _, prev := range slices.Backward(steps[:i]) {
+				if uerr := prev.undo(); uerr != nil {
+					slog.Warn("failed to roll back router change", "change", prev.desc, "err", uerr)
+				}
+			}
+
+			return fmt.Errorf("%s: %w", s.desc, err)
+		}
 	}
 
 	return nil
 }
 
-func (r *linuxRouter) Close() error {
-	// TODO implement me
+func (r *linuxRouter) Up() error {
+	if r.up {
+		return nil
+	}
+
+	steps := []step{{
+		desc: "bringing up device",
+		do:   func() error { return netlink.LinkSetUp(r.link) },
+		undo: func() error { return netlink.LinkSetDown(r.link) },
+	}}
+
+	for _, route := range r.wantRoutes {
+		steps = append(steps, r.addRouteStep(route))
+	}
+
+	if err := apply(steps); err != nil {
+		return err
+	}
+
+	r.up = true
+	r.currRoutes = r.wantRoutes
+
 	return nil
 }
 
-func (r *linuxRouter) Set(c *Config) (retErr error) {
-	setErr := func(err error) {
-		if retErr == nil {
-			retErr = err
+func (r *linuxRouter) Set(c *Config) error {
+	wantRoutes := routesFor(c)
+
+	newBypass, staleBypass, err := r.bypassToSet(c.Bypass)
+	if err != nil {
+		return err
+	}
+
+	// Bypass routes are added first, so that no traffic to them enters the device in between.
+	var steps []step
+
+	for addr, route := range newBypass {
+		if stale, ok := staleBypass[addr]; ok {
+			steps = append(steps, replaceBypassStep(addr, stale, route))
+		} else {
+			steps = append(steps, addBypassStep(addr, route))
+		}
+	}
+
+	for addr, stale := range staleBypass {
+		if _, ok := newBypass[addr]; !ok {
+			steps = append(steps, removeBypassStep(addr, stale))
+		}
+	}
+
+	if r.up {
+		for _, route := range prefixesToRemove(wantRoutes, r.currRoutes) {
+			steps = append(steps, r.removeRouteStep(route))
 		}
 	}
 
+	if c.MTU != 0 && c.MTU != r.mtu {
+		steps = append(steps, r.setMTUStep(r.mtu, c.MTU))
+	}
+
+	// Old addresses are removed before new ones are added,
+	// as removing a primary address also removes all (new) secondary addresses in the same subnet.
 	for _, prefix := range prefixesToRemove(c.RoutingPrefixes, r.currPrefixes) {
+		steps = append(steps, r.removeAddrStep(prefix))
+	}
+
+	for _, prefix := range prefixesToAdd(c.RoutingPrefixes, r.currPrefixes) {
+		steps = append(steps, r.addAddrStep(prefix))
+	}
+
+	if r.up {
+		// Existing routes are (idempotently) installed again,
+		// as the kernel flushes all routes over a link once its last address of a family is removed.
+		for _, route := range wantRoutes {
+			if slices.Contains(r.currRoutes, route) {
+				steps = append(steps, r.ensureRouteStep(route))
+			} else {
+				steps = append(steps, r.addRouteStep(route))
+			}
+		}
+	}
+
+	for addr, route := range r.currBypass {
+		if !slices.Contains(c.Bypass, addr) {
+			steps = append(steps, removeBypassStep(addr, route))
+		}
+	}
+
+	if err := apply(steps); err != nil {
+		if r.up {
+			r.reinstallRoutes()
+		}
+		return err
+	}
+
+	maps.DeleteFunc(r.currBypass, func(addr netip.Addr, _ *netlink.Route) bool {
+		_, stale := staleBypass[addr]
+		return stale || !slices.Contains(c.Bypass, addr)
+	})
+	maps.Copy(r.currBypass, newBypass)
+
+	r.currPrefixes = slices.Clone(c.RoutingPrefixes)
+	r.wantRoutes = wantRoutes
+	if r.up {
+		r.currRoutes = wantRoutes
+	}
+	if c.MTU != 0 {
+		r.mtu = c.MTU
+	}
+
+	return nil
+}
+
+// Close removes all routes and addresses added by the router,
+// and restores the addresses, MTU, and up/down state the link had before.
+func (r *linuxRouter) Close() error {
+	if _, err := netlink.LinkByIndex(r.link.Attrs().Index); err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			// The link is already gone, and with it all of its state.
+			return nil
+		}
+
+		return fmt.Errorf("could not find link %q: %w", r.iface, err)
+	}
+
+	var errs []error
+
+	for _, route := range r.currRoutes {
+		if err := r.removeRoute(route); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for addr, route := range r.currBypass {
+		if err := removeBypass(addr, route); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, prefix := range r.currPrefixes {
+		if slices.Contains(r.origAddrs, prefix) {
+			continue
+		}
+
 		if err := r.removeAddr(prefix); err != nil {
-			setErr(err)
-			slog.Warn("removeAddr failed", "for", prefix.String(), "err", err)
+			errs = append(errs, err)
 		}
 	}
 
-	for _, prefix := range prefixesToAdd(c.RoutingPrefixes, r.currPrefixes) {
-		if err := r.addAddr(prefix); err != nil {
-			setErr(err)
-			slog.Warn("addAddr failed", "for", prefix.String(), "err", err)
+	// Addresses which were already on the link, but which were removed by a Set since.
+	if addrs, err := linkAddrs(r.link); err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, prefix := range prefixesToAdd(r.origAddrs, addrs) {
+			if err := r.restoreAddr(prefix); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if r.mtu != r.origMTU {
+		if err := netlink.LinkSetMTU(r.link, r.origMTU); err != nil {
+			errs = append(errs, fmt.Errorf("restoring mtu of tunnel interface: %w", err))
 		}
 	}
 
-	if retErr == nil {
-		r.currPrefixes = c.RoutingPrefixes
+	if r.up && !r.origUp {
+		if err := netlink.LinkSetDown(r.link); err != nil {
+			errs = append(errs, fmt.Errorf("bringing down tunnel interface: %w", err))
+		}
 	}
 
-	return
+	r.up = false
+	r.mtu = r.origMTU
+	r.currPrefixes = r.currPrefixes[:0]
+	r.currRoutes = r.currRoutes[:0]
+	r.wantRoutes = nil
+	clear(r.currBypass)
+
+	return errors.Join(errs...)
+}
+
+// reinstallRoutes makes a best effort to install currRoutes again, after a rollback may have flushed them.
+func (r *linuxRouter) reinstallRoutes() {
+	for _, route := range r.currRoutes {
+		if err := r.addRoute(route); err != nil {
+			slog.Warn("failed to reinstall route", "route", route.String(), "err", err)
+		}
+	}
+}
+
+// routesFor returns the (deduplicated) routes to install for c.
+func routesFor(c *Config) []netip.Prefix {
+	routes := make([]netip.Prefix, 0, len(c.RoutingPrefixes)+len(c.Routes))
+
+	for _, p := range slices.Concat(c.RoutingPrefixes, splitDefaultRoutes(c.Routes)) {
+		p = p.Masked()
+		if !slices.Contains(routes, p) {
+			routes = append(routes, p)
+		}
+	}
+
+	return routes
+}
+
+// bypassToSet resolves the routes for the addresses in bypass, and returns the ones to add, and the installed ones
+// which no longer route the way the host does, and which are replaced by them (if any).
+//
+// The routes of the host are only followed on Set, not when they change in between;
+// toversok sets the bypass again whenever the endpoints of the exit node change, which they do along with the network.
+func (r *linuxRouter) bypassToSet(bypass []netip.Addr) (add, stale map[netip.Addr]*netlink.Route, err error) {
+	add = make(map[netip.Addr]*netlink.Route)
+	stale = make(map[netip.Addr]*netlink.Route)
+
+	for _, addr := range bypass {
+		route, err := r.hostRouteFor(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		curr, installed := r.currBypass[addr]
+		if installed && route != nil && curr.Equal(*route) {
+			continue
+		}
+
+		if installed {
+			stale[addr] = curr
+		}
+
+		if route == nil {
+			slog.Warn("no route to bypass address, leaving it be", "addr", addr.String())
+			continue
+		}
+
+		add[addr] = route
+	}
+
+	return add, stale, nil
+}
+
+// hostRouteFor returns a route for only addr, which routes it the way the most specific route of the host
+// (apart from the ones over this link, and its own bypass route) does, or nil if there is none.
+func (r *linuxRouter) hostRouteFor(addr netip.Addr) (*netlink.Route, error) {
+	family := netlink.FAMILY_V4
+	if addr.Is6() {
+		family = netlink.FAMILY_V6
+	}
+
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("could not list routes: %w", err)
+	}
+
+	var (
+		best     *netlink.Route
+		bestBits int
+	)
+
+	for i := range routes {
+		route := &routes[i]
+
+		if route.LinkIndex == r.link.Attrs().Index || route.Type != unix.RTN_UNICAST {
+			continue
+		}
+
+		bits := 0
+		if route.Dst != nil {
+			dst, ok := netipx.FromStdIPNet(route.Dst)
+			if !ok || !dst.Contains(addr) {
+				continue
+			}
+
+			bits = dst.Bits()
+
+			if curr, ok := r.currBypass[addr]; ok && route.Protocol == curr.Protocol && bits == addr.BitLen() {
+				continue
+			}
+		}
+
+		if best == nil || bits > bestBits || (bits == bestBits && route.Priority < best.Priority) {
+			best, bestBits = route, bits
+		}
+	}
+
+	if best == nil {
+		return nil, nil
+	}
+
+	return &netlink.Route{
+		LinkIndex: best.LinkIndex,
+		Dst:       netipx.PrefixIPNet(netip.PrefixFrom(addr, addr.BitLen())),
+		Gw:        best.Gw,
+		MultiPath: best.MultiPath,
+		Src:       best.Src,
+		Scope:     best.Scope,
+		Priority:  best.Priority,
+		Protocol:  unix.RTPROT_STATIC,
+	}, nil
+}
+
+func linkAddrs(link netlink.Link) ([]netip.Prefix, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("could not list addresses of link %q: %w", link.Attrs().Name, err)
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(addrs))
+	for _, a := range addrs {
+		if p, ok := netipx.FromStdIPNet(a.IPNet); ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return prefixes, nil
+}
+
+func (r *linuxRouter) addrFor(prefix netip.Prefix) *netlink.Addr {
+	return &netlink.Addr{
+		IPNet: netipx.PrefixIPNet(prefix),
+		// The router installs the routes for the prefix itself,
+		// so that they can be tracked and removed alongside any extra routes.
+		// There are no other hosts on the link, so duplicate address detection is pointless.
+		Flags: unix.IFA_F_NOPREFIXROUTE | unix.IFA_F_NODAD,
+	}
+}
+
+func (r *linuxRouter) addAddr(prefix netip.Prefix) error {
+	if err := netlink.AddrReplace(r.link, r.addrFor(prefix)); err != nil {
+		return fmt.Errorf("adding address %q to tunnel interface: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// restoreAddr re-adds an address from before the router was created, which is left to install its own prefix route.
+func (r *linuxRouter) restoreAddr(prefix netip.Prefix) error {
+	if err := netlink.AddrReplace(r.link, &netlink.Addr{IPNet: netipx.PrefixIPNet(prefix)}); err != nil {
+		return fmt.Errorf("restoring address %q on tunnel interface: %w", prefix, err)
+	}
+
+	return nil
 }
 
 func (r *linuxRouter) removeAddr(prefix netip.Prefix) error {
-	if out, err := cmd("ip", "addr", "del", prefix.String(), "dev", r.iface).CombinedOutput(); err != nil {
-		return fmt.Errorf("deleting address %q from tunnel interface: %w\n%s", prefix, err, out)
+	if err := netlink.AddrDel(r.link, r.addrFor(prefix)); err != nil {
+		return fmt.Errorf("deleting address %q from tunnel interface: %w", prefix, err)
 	}
 
 	return nil
 }
 
-func (r *linuxRouter) addAddr(prefix netip.Prefix) error {
-	if out, err := cmd("ip", "addr", "add", prefix.String(), "dev", r.iface).CombinedOutput(); err != nil {
-		return fmt.Errorf("adding address %q to tunnel interface: %w\n%s", prefix, err, out)
+func (r *linuxRouter) routeFor(prefix netip.Prefix) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: r.link.Attrs().Index,
+		Dst:       netipx.PrefixIPNet(prefix),
+		Scope:     netlink.SCOPE_LINK,
+		Protocol:  unix.RTPROT_STATIC,
+	}
+}
+
+func (r *linuxRouter) addRoute(prefix netip.Prefix) error {
+	if err := netlink.RouteReplace(r.routeFor(prefix)); err != nil {
+		return fmt.Errorf("adding route %q to tunnel interface: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// removeRoute removes a route, if it is still there.
+func (r *linuxRouter) removeRoute(prefix netip.Prefix) error {
+	if err := netlink.RouteDel(r.routeFor(prefix)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("deleting route %q from tunnel interface: %w", prefix, err)
+	}
+
+	return nil
+}
+
+func (r *linuxRouter) addAddrStep(prefix netip.Prefix) step {
+	return step{
+		desc: "adding address " + prefix.String(),
+		do:   func() error { return r.addAddr(prefix) },
+		undo: func() error { return r.removeAddr(prefix) },
+	}
+}
+
+func (r *linuxRouter) removeAddrStep(prefix netip.Prefix) step {
+	return step{
+		desc: "removing address " + prefix.String(),
+		do:   func() error { return r.removeAddr(prefix) },
+		undo: func() error { return r.addAddr(prefix) },
+	}
+}
+
+func (r *linuxRouter) addRouteStep(prefix netip.Prefix) step {
+	return step{
+		desc: "adding route " + prefix.String(),
+		do:   func() error { return r.addRoute(prefix) },
+		undo: func() error { return r.removeRoute(prefix) },
+	}
+}
+
+// ensureRouteStep installs a route which should already be there, and so is left alone on rollback.
+func (r *linuxRouter) ensureRouteStep(prefix netip.Prefix) step {
+	return step{
+		desc: "adding route " + prefix.String(),
+		do:   func() error { return r.addRoute(prefix) },
+		undo: func() error { return nil },
+	}
+}
+
+func (r *linuxRouter) removeRouteStep(prefix netip.Prefix) step {
+	return step{
+		desc: "removing route " + prefix.String(),
+		do:   func() error { return r.removeRoute(prefix) },
+		undo: func() error { return r.addRoute(prefix) },
+	}
+}
+
+func addBypass(addr netip.Addr, route *netlink.Route) error {
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("adding bypass route for %q: %w", addr, err)
+	}
+
+	return nil
+}
+
+// removeBypass removes a bypass route, if it is still there.
+func removeBypass(addr netip.Addr, route *netlink.Route) error {
+	if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("deleting bypass route for %q: %w", addr, err)
 	}
 
 	return nil
 }
+
+func addBypassStep(addr netip.Addr, route *netlink.Route) step {
+	return step{
+		desc: "adding bypass route for " + addr.String(),
+		do:   func() error { return addBypass(addr, route) },
+		undo: func() error { return removeBypass(addr, route) },
+	}
+}
+
+func replaceBypassStep(addr netip.Addr, from, to *netlink.Route) step {
+	return step{
+		desc: "replacing bypass route for " + addr.String(),
+		do: func() error {
+			if err := removeBypass(addr, from); err != nil {
+				return err
+			}
+			return addBypass(addr, to)
+		},
+		undo: func() error {
+			if err := removeBypass(addr, to); err != nil {
+				return err
+			}
+			return addBypass(addr, from)
+		},
+	}
+}
+
+func removeBypassStep(addr netip.Addr, route *netlink.Route) step {
+	return step{
+		desc: "removing bypass route for " + addr.String(),
+		do:   func() error { return removeBypass(addr, route) },
+		undo: func() error { return addBypass(addr, route) },
+	}
+}
+
+func (r *linuxRouter) setMTUStep(from, to int) step {
+	return step{
+		desc: fmt.Sprintf("setting mtu to %d", to),
+		do:   func() error { return netlink.LinkSetMTU(r.link, to) },
+		undo: func() error { return netlink.LinkSetMTU(r.link, from) },
+	}
+}
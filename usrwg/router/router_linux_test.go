@@ -0,0 +1,100 @@
+package router
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/edup2p/common/internal/netnstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
+)
+
+// addLink adds an up veth link with prefixes assigned, and returns its index.
+func addLink(t *testing.T, name string, prefixes ...netip.Prefix) int {
+	require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}))
+
+	link, err := netlink.LinkByName(name)
+	require.NoError(t, err)
+	peer, err := netlink.LinkByName(name + "p")
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(peer))
+
+	for _, p := range prefixes {
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: netipx.PrefixIPNet(p), Flags: unix.IFA_F_NODAD}))
+	}
+
+	require.NoError(t, netlink.LinkSetUp(link))
+
+	return link.Attrs().Index
+}
+
+// routeVia returns the index of the link that the kernel routes dst over.
+func routeVia(t *testing.T, dst string) int {
+	routes, err := netlink.RouteGet(netip.MustParseAddr(dst).AsSlice())
+	require.NoError(t, err)
+	require.NotEmpty(t, routes)
+
+	return routes[0].LinkIndex
+}
+
+func TestLinuxRouterExitRoutes(t *testing.T) {
+	netnstest.Run(t, func() {
+		eth := addLink(t, "eth0", netip.MustParsePrefix("192.0.2.2/24"), netip.MustParsePrefix("fd00:2::2/64"))
+		tun := addLink(t, "tun0")
+
+		for _, gw := range []string{"192.0.2.1", "fd00:2::1"} {
+			require.NoError(t, netlink.RouteAdd(&netlink.Route{
+				LinkIndex: eth,
+				Gw:        netip.MustParseAddr(gw).AsSlice(),
+			}))
+		}
+
+		r, err := newLinuxRouter("tun0")
+		require.NoError(t, err)
+
+		cfg := &Config{
+			RoutingPrefixes: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/10"), netip.MustParsePrefix("fd00:a::1/64")},
+			Routes:          []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			Bypass:          []netip.Addr{netip.MustParseAddr("198.51.100.7"), netip.MustParseAddr("2001:db8::7")},
+		}
+		require.NoError(t, r.Set(cfg))
+		require.NoError(t, r.Up())
+
+		assert.Equal(t, tun, routeVia(t, "198.51.100.8"))
+		assert.Equal(t, tun, routeVia(t, "2001:db8::8"))
+		assert.Equal(t, eth, routeVia(t, "198.51.100.7"), "bypassed address should be routed as before")
+		assert.Equal(t, eth, routeVia(t, "2001:db8::7"), "bypassed address should be routed as before")
+
+		// The default routes of the host are left in place.
+		assert.Equal(t, eth, routeVia(t, "192.0.2.50"))
+
+		// Bypass routes follow the host when it routes differently, once set again.
+		eth1 := addLink(t, "eth1", netip.MustParsePrefix("192.0.3.2/24"))
+		require.NoError(t, netlink.RouteDel(&netlink.Route{LinkIndex: eth, Gw: netip.MustParseAddr("192.0.2.1").AsSlice()}))
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{LinkIndex: eth1, Gw: netip.MustParseAddr("192.0.3.1").AsSlice()}))
+
+		require.NoError(t, r.Set(cfg))
+
+		assert.Equal(t, eth1, routeVia(t, "198.51.100.7"), "bypass route should follow the host")
+		assert.Equal(t, eth, routeVia(t, "2001:db8::7"))
+
+		cfg.Bypass = cfg.Bypass[1:]
+		require.NoError(t, r.Set(cfg))
+
+		assert.Equal(t, tun, routeVia(t, "198.51.100.7"), "removed bypass address should enter the device")
+		assert.Equal(t, eth, routeVia(t, "2001:db8::7"))
+
+		require.NoError(t, r.Close())
+
+		assert.Equal(t, eth1, routeVia(t, "198.51.100.8"))
+		assert.Equal(t, eth, routeVia(t, "2001:db8::8"))
+		assert.Equal(t, eth, routeVia(t, "2001:db8::7"))
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: unix.RTPROT_STATIC}, netlink.RT_FILTER_PROTOCOL)
+		require.NoError(t, err)
+		assert.Empty(t, routes, "all routes of the router should be removed")
+	})
+}
@@ -105,6 +105,10 @@ func (r *windowsRouter) setFirewall() {
 }
 
 func (r *windowsRouter) Set(cfg *Config) (retErr error) {
+	if len(cfg.Bypass) > 0 {
+		return ErrBypassUnsupported
+	}
+
 	iface, err := interfaceFromLUID(r.luid,
 		// Issue tailscale/tailscale#474: on early boot, when the network is still
 		// coming up, if the Tailscale service comes up first,
@@ -204,7 +208,7 @@ func (r *windowsRouter) Set(cfg *Config) (retErr error) {
 	var routes []*routeData
 	foundDefault4 := false
 	foundDefault6 := false
-	for _, route := range cfg.RoutingPrefixes {
+	for _, route := range slices.Concat(cfg.RoutingPrefixes, cfg.Routes) {
 		route = route.Masked()
 
 		if (route.Addr().Is4() && ipif4 == nil) || (route.Addr().Is6() && ipif6 == nil) {
@@ -47,6 +47,29 @@ func inet(p netip.Prefix) string {
 	return "inet"
 }
 
+var (
+	defaultHalves4 = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1")}
+	defaultHalves6 = []netip.Prefix{netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1")}
+)
+
+// splitDefaultRoutes replaces the default routes in routes by their two halves, see Config.Routes.
+func splitDefaultRoutes(routes []netip.Prefix) []netip.Prefix {
+	split := make([]netip.Prefix, 0, len(routes))
+
+	for _, p := range routes {
+		switch {
+		case p.Bits() != 0:
+			split = append(split, p)
+		case p.Addr().Is4():
+			split = append(split, defaultHalves4...)
+		default:
+			split = append(split, defaultHalves6...)
+		}
+	}
+
+	return split
+}
+
 func cmd(args ...string) *exec.Cmd {
 	if len(args) == 0 {
 		// We control this input, and without argv[0] we can't do anything anyways.
@@ -6,14 +6,14 @@ import (
 	"net"
 	"net/netip"
 	"slices"
-	"syscall"
+	"strings"
+	"sync"
 
 	"github.com/edup2p/common/toversok"
 	"github.com/edup2p/common/types"
+	"github.com/edup2p/common/types/dnsconfig"
 	"github.com/edup2p/common/types/key"
 	"github.com/edup2p/common/usrwg/router"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -25,8 +25,41 @@ func NewUsrWGHost() *UserSpaceWireGuardHost {
 	return &UserSpaceWireGuardHost{}
 }
 
+// NewUsrWGHostWithMTU creates a host which sets mtu on the TUN device, instead of the one given by control.
+func NewUsrWGHostWithMTU(mtu int) *UserSpaceWireGuardHost {
+	return &UserSpaceWireGuardHost{mtu: mtu}
+}
+
 type UserSpaceWireGuardHost struct {
 	running *UserSpaceWireGuardController
+
+	// mu guards the settings for the next controllers; filter and configureDNS.
+	mu sync.Mutex
+
+	// mtu is the MTU configured on the host, or 0 to use the one given by control.
+	mtu int
+
+	filter *PacketFilter
+
+	// configureDNS makes controllers configure the resolver of the OS for the TUN device.
+	configureDNS bool
+}
+
+// SetConfigureDNS makes the next controllers configure the resolver of the OS for the TUN device,
+// see toversok.DNSConfigurer.
+func (u *UserSpaceWireGuardHost) SetConfigureDNS(enabled bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.configureDNS = enabled
+}
+
+// SetPacketFilter makes the next controllers pass all packets through filter, or none if nil.
+func (u *UserSpaceWireGuardHost) SetPacketFilter(filter *PacketFilter) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.filter = filter
 }
 
 func (u *UserSpaceWireGuardHost) Reset() error {
@@ -40,16 +73,19 @@ func (u *UserSpaceWireGuardHost) Reset() error {
 
 const WGGOIPCDevSetup = "private_key=%s\n"
 
-func (u *UserSpaceWireGuardHost) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix) (toversok.WireGuardController, error) {
+func (u *UserSpaceWireGuardHost) Controller(privateKey key.NodePrivate, addr4, addr6 netip.Prefix, controlMTU int) (toversok.WireGuardController, error) {
 	if u.running != nil {
 		if err := u.Reset(); err != nil {
 			return nil, fmt.Errorf("usrwg: failed to reset running usrwg controller: %v", err)
 		}
 	}
 
-	// TODO set this to 1392 per https://docs.eduvpn.org/server/v3/wireguard.html
-	//  and make adjustable by environment variable
-	tunDev, err := createTUN(1280)
+	mtu, err := toversok.ChooseMTU(u.mtu, controlMTU)
+	if err != nil {
+		return nil, fmt.Errorf("usrwg: %w", err)
+	}
+
+	tunDev, err := createTUN(mtu)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TUN device: %w", err)
 	}
@@ -67,9 +103,56 @@ func (u *UserSpaceWireGuardHost) Controller(privateKey key.NodePrivate, addr4, a
 		slog.Warn("got error trying to get TUN device name", "err", err)
 	}
 
+	u.mu.Lock()
+	filter := u.filter
+	u.mu.Unlock()
+
+	usrwgc, err := newController(tunDev, privateKey, mtu, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.Set(&router.Config{
+		LocalAddrs:      []netip.Addr{addr4.Addr(), addr6.Addr()},
+		RoutingPrefixes: []netip.Prefix{addr4, addr6},
+		MTU:             mtu,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to set routing config: %w", err)
+	}
+
+	if err = r.Up(); err != nil {
+		return nil, fmt.Errorf("failed to bring up device through router: %w", err)
+	}
+
+	usrwgc.router = r
+	usrwgc.addr4, usrwgc.addr6 = addr4, addr6
+
+	u.mu.Lock()
+	configureDNS := u.configureDNS
+	u.mu.Unlock()
+
+	if configureDNS {
+		if usrwgc.dns, err = dnsconfig.NewConfigurator(interfaceName); err != nil {
+			slog.Warn("usrwg: cannot configure dns", "err", err)
+		}
+	}
+
+	u.running = usrwgc
+
+	return usrwgc, nil
+}
+
+// newController runs a wireguard-go device with privateKey on top of tunDev with mtu, with packets passing through
+// filter if non-nil.
+func newController(tunDev tun.Device, privateKey key.NodePrivate, mtu int, filter *PacketFilter) (*UserSpaceWireGuardController, error) {
 	bind := createBind()
 
-	wgDev := device.NewDevice(tunDev, bind, &device.Logger{
+	wgTun := tunDev
+	if filter != nil {
+		wgTun = filter.wrap(tunDev)
+	}
+
+	wgDev := device.NewDevice(wgTun, bind, &device.Logger{
 		Verbosef: func(format string, args ...any) {
 			slog.Debug(fmt.Sprintf(format, args...), "from", "wireguard-go")
 		},
@@ -81,105 +164,70 @@ func (u *UserSpaceWireGuardHost) Controller(privateKey key.NodePrivate, addr4, a
 	nKey := key.UnveilPrivate(privateKey)
 
 	if err := wgDev.IpcSet(fmt.Sprintf(WGGOIPCDevSetup, nKey.HexString())); err != nil {
+		wgDev.Close()
 		return nil, fmt.Errorf("failed to set private key on wireguard device: %w", err)
 	}
 
 	if err := wgDev.Up(); err != nil {
+		wgDev.Close()
 		return nil, fmt.Errorf("failed to bring up wireguard device: %w", err)
 	}
 
-	if err = r.Set(&router.Config{
-		LocalAddrs:      []netip.Addr{addr4.Addr(), addr6.Addr()},
-		RoutingPrefixes: []netip.Prefix{addr4, addr6},
-	}); err != nil {
-		return nil, fmt.Errorf("failed to set routing config: %w", err)
-	}
-
-	if err = r.Up(); err != nil {
-		return nil, fmt.Errorf("failed to bring up device through router: %w", err)
-	}
-
-	usrwgc := &UserSpaceWireGuardController{
+	return &UserSpaceWireGuardController{
 		wgDev:  wgDev,
 		bind:   bind,
 		tunDev: tunDev,
-		router: r,
-	}
-
-	u.running = usrwgc
-
-	return usrwgc, nil
+		mtu:    mtu,
+		routes: make(toversok.PeerRoutes),
+	}, nil
 }
 
 type UserSpaceWireGuardController struct {
-	wgDev  *device.Device
-	bind   *ToverSokBind
+	wgDev *device.Device
+	bind  *ToverSokBind
+	// tunDev is the device without packet filter, so that injected packets always pass.
 	tunDev tun.Device
+	// router is nil when not running on a TUN device.
 	router router.Router
-}
-
-func (u *UserSpaceWireGuardController) Available() bool {
-	return true
-}
+	// dns is nil when not configuring the resolver of the OS.
+	dns dnsconfig.Configurator
 
-func (u *UserSpaceWireGuardController) InjectPacket(from, to netip.AddrPort, pkt []byte) error {
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
-	}
-	ipv4 := &layers.IPv4{
-		Version:  0x4,
-		TTL:      255,
-		Protocol: syscall.IPPROTO_UDP,
-		DstIP:    to.Addr().AsSlice(),
-		SrcIP:    from.Addr().AsSlice(),
-	}
-	udp := &layers.UDP{
-		DstPort: layers.UDPPort(to.Port()),
-		SrcPort: layers.UDPPort(from.Port()),
-	}
-	if err := udp.SetNetworkLayerForChecksum(ipv4); err != nil {
-		return fmt.Errorf("failed to set udp checksum: %w", err)
-	}
+	mtu int
 
-	err := gopacket.SerializeLayers(buf, opts,
-		ipv4,
-		udp,
-		gopacket.Payload(pkt),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to serialize packet: %w", err)
-	}
+	// addr4 and addr6 are the overlay addresses of this node, with the prefixes of the overlay.
+	addr4, addr6 netip.Prefix
 
-	packetData := slices.Concat(make([]byte, 16), buf.Bytes())
-
-	if _, err = u.tunDev.Write([][]byte{packetData}, 16); err != nil {
-		return fmt.Errorf("failed to inject packet: %w", err)
-	}
-
-	return nil
+	// routesMu guards routes, the routes of peers which are routed into the TUN device,
+	// and bypass, the addresses which are kept out of it.
+	routesMu sync.Mutex
+	routes   toversok.PeerRoutes
+	bypass   []netip.Addr
 }
 
 const WGGOIPCAddPeer = `public_key=%s
 replace_allowed_ips=true
-allowed_ip=%s/32
-allowed_ip=%s/128
-endpoint=%s
+%sendpoint=%s
 `
 
+const WGGOIPCAllowedIP = "allowed_ip=%s\n"
+
 func (u *UserSpaceWireGuardController) UpdatePeer(publicKey key.NodePublic, cfg toversok.PeerCfg) error {
+	var allowedIPs strings.Builder
+	for _, p := range cfg.AllowedIPs() {
+		fmt.Fprintf(&allowedIPs, WGGOIPCAllowedIP, p)
+	}
+
 	err := u.wgDev.IpcSet(
 		fmt.Sprintf(
 			WGGOIPCAddPeer,
-			publicKey.HexString(), cfg.VIPs.IPv4.String(), cfg.VIPs.IPv6.String(), publicKey.Marshal(),
+			publicKey.HexString(), allowedIPs.String(), publicKey.Marshal(),
 		),
 	)
 	if err != nil {
-		err = fmt.Errorf("failed to do IPC set: %w", err)
+		return fmt.Errorf("failed to do IPC set: %w", err)
 	}
 
-	return err
+	return u.setRoutes(publicKey, cfg.Routes)
 }
 
 func (u *UserSpaceWireGuardController) RemovePeer(publicKey key.NodePublic) error {
@@ -187,6 +235,53 @@ func (u *UserSpaceWireGuardController) RemovePeer(publicKey key.NodePublic) erro
 
 	u.bind.CloseConn(publicKey)
 
+	return u.setRoutes(publicKey, nil)
+}
+
+// setRoutes replaces the routes of a peer, and routes the routes of all peers into the TUN device if they changed.
+func (u *UserSpaceWireGuardController) setRoutes(peer key.NodePublic, routes []netip.Prefix) error {
+	u.routesMu.Lock()
+	defer u.routesMu.Unlock()
+
+	if !u.routes.Set(peer, routes) {
+		return nil
+	}
+
+	return u.configureRouter()
+}
+
+// SetBypass implements toversok.Bypasser.
+func (u *UserSpaceWireGuardController) SetBypass(addrs []netip.Addr) error {
+	u.routesMu.Lock()
+	defer u.routesMu.Unlock()
+
+	if slices.Equal(u.bypass, addrs) {
+		return nil
+	}
+
+	u.bypass = slices.Clone(addrs)
+
+	return u.configureRouter()
+}
+
+// configureRouter sets the routes and bypass on the router, if there is one.
+//
+// Assumes routesMu is held.
+func (u *UserSpaceWireGuardController) configureRouter() error {
+	if u.router == nil {
+		return nil
+	}
+
+	if err := u.router.Set(&router.Config{
+		LocalAddrs:      []netip.Addr{u.addr4.Addr(), u.addr6.Addr()},
+		RoutingPrefixes: []netip.Prefix{u.addr4, u.addr6},
+		Routes:          u.routes.All(),
+		Bypass:          u.bypass,
+		MTU:             u.mtu,
+	}); err != nil {
+		return fmt.Errorf("failed to set routes: %w", err)
+	}
+
 	return nil
 }
 
@@ -200,6 +295,11 @@ func (u *UserSpaceWireGuardController) ConnFor(node key.NodePublic) types.UDPCon
 	return u.bind.GetConn(node)
 }
 
+var (
+	_ toversok.DNSConfigurer = (*UserSpaceWireGuardController)(nil)
+	_ toversok.Bypasser      = (*UserSpaceWireGuardController)(nil)
+)
+
 func (u *UserSpaceWireGuardController) GetInterface() *net.Interface {
 	name, err := u.tunDev.Name()
 	if err != nil {
@@ -214,12 +314,31 @@ func (u *UserSpaceWireGuardController) GetInterface() *net.Interface {
 	return i
 }
 
+func (u *UserSpaceWireGuardController) MTU() int {
+	return u.mtu
+}
+
+func (u *UserSpaceWireGuardController) SetDNS(cfg dnsconfig.Config) error {
+	if u.dns == nil {
+		return dnsconfig.ErrUnavailable
+	}
+
+	return u.dns.Set(cfg)
+}
+
 func (u *UserSpaceWireGuardController) Close() {
 	if err := u.bind.Cancel(); err != nil {
 		slog.Error("Failed to close wireguard bind", "err", err)
 	}
-	if err := u.router.Close(); err != nil {
-		slog.Error("Failed to close router", "err", err)
+	if u.dns != nil {
+		if err := u.dns.Close(); err != nil {
+			slog.Error("Failed to revert dns", "err", err)
+		}
+	}
+	if u.router != nil {
+		if err := u.router.Close(); err != nil {
+			slog.Error("Failed to close router", "err", err)
+		}
 	}
 	u.wgDev.Close()
 }